@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batcher concatenates up to size lines into one message, sending what it
+// has once window has passed since the first line of the batch.
+type batcher struct {
+	mu        sync.Mutex
+	size      int
+	window    time.Duration
+	separator string
+	send      func(string, checkpoint) error
+
+	lines []string
+	at    checkpoint
+	timer *time.Timer
+}
+
+// newBatcher sends each batch with the checkpoint of its last line, so
+// that the lines batched are not checkpointed before they are sent.
+func newBatcher(size int, window time.Duration, separator string, send func(string, checkpoint) error) *batcher {
+	return &batcher{
+		size:      size,
+		window:    window,
+		separator: separator,
+		send:      send,
+	}
+}
+
+func (b *batcher) Add(line string, at checkpoint) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.at = at
+	if len(line) == 0 {
+		if len(b.lines) == 0 {
+			return b.send("", at)
+		}
+		return nil
+	}
+
+	b.lines = append(b.lines, line)
+	if len(b.lines) >= b.size {
+		return b.flush()
+	}
+
+	if len(b.lines) == 1 && b.window > 0 {
+		b.timer = time.AfterFunc(b.window, b.expire)
+	}
+	return nil
+}
+
+func (b *batcher) expire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.flush(); err != nil {
+		log.Print(err)
+	}
+}
+
+func (b *batcher) flush() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.lines) == 0 {
+		return nil
+	}
+
+	message := strings.Join(b.lines, b.separator)
+	b.lines = b.lines[:0]
+
+	return b.send(message, b.at)
+}
+
+func (b *batcher) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flush()
+}
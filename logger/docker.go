@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	syslog "github.com/racksec/srslog"
+)
+
+const (
+	dockerDefaultHost = "unix:///var/run/docker.sock"
+	dockerAPIVersion  = "v1.41"
+)
+
+// dockerClient talks to the Docker Engine API over its unix socket or TCP.
+type dockerClient struct {
+	base   string
+	client *http.Client
+}
+
+func newDockerClient() (*dockerClient, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = dockerDefaultHost
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{}
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		u = &url.URL{Scheme: "http", Host: "docker"}
+	case "tcp":
+		u.Scheme = "http"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported DOCKER_HOST: %s", host)
+	}
+
+	return &dockerClient{
+		base:   strings.TrimSuffix(u.String(), "/") + "/" + dockerAPIVersion,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (c *dockerClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("docker: %s: %s", resp.Status, e.Message)
+	}
+	return resp, nil
+}
+
+type dockerContainer struct {
+	ID   string
+	Name string
+	TTY  bool
+}
+
+func (c *dockerClient) inspect(ctx context.Context, name string) (dockerContainer, error) {
+	resp, err := c.get(ctx, "/containers/"+url.PathEscape(name)+"/json", nil)
+	if err != nil {
+		return dockerContainer{}, err
+	}
+	defer resp.Body.Close()
+
+	var info struct {
+		ID     string `json:"Id"`
+		Name   string `json:"Name"`
+		Config struct {
+			Tty bool `json:"Tty"`
+		} `json:"Config"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return dockerContainer{}, err
+	}
+
+	return dockerContainer{
+		ID:   info.ID,
+		Name: strings.TrimPrefix(info.Name, "/"),
+		TTY:  info.Config.Tty,
+	}, nil
+}
+
+func (c *dockerClient) running(ctx context.Context) ([]string, error) {
+	resp, err := c.get(ctx, "/containers/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list []struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, c := range list {
+		ids = append(ids, c.ID)
+	}
+	return ids, nil
+}
+
+// starts streams the IDs of containers as they are started.
+func (c *dockerClient) starts(ctx context.Context, since time.Time, ids chan<- string) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start"},
+	})
+	query := url.Values{
+		"since":   {fmt.Sprint(since.Unix())},
+		"filters": {string(filters)},
+	}
+
+	resp, err := c.get(ctx, "/events", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev struct {
+			ID string `json:"id"`
+		}
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		select {
+		case ids <- ev.ID:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// logs follows the output of a container from now on and calls send for
+// every complete line, telling whether it came from stderr.
+func (c *dockerClient) logs(ctx context.Context, ct dockerContainer, send func(line string, stderr bool) error) error {
+	query := url.Values{
+		"follow": {"1"},
+		"stdout": {"1"},
+		"stderr": {"1"},
+		"since":  {fmt.Sprint(time.Now().Unix())},
+	}
+
+	resp, err := c.get(ctx, "/containers/"+ct.ID+"/logs", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if ct.TTY {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if err := send(strings.TrimRight(scanner.Text(), "\r"), false); err != nil {
+				return err
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		return scanner.Err()
+	}
+
+	// Without a TTY the stream is multiplexed: every frame starts with an
+	// 8 byte header holding the stream type and the payload length.
+	var partial [3]string
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(resp.Body, header); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		stream := header[0]
+		if stream > 2 {
+			return fmt.Errorf("docker: invalid stream type %d", stream)
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(resp.Body, payload); err != nil {
+			return err
+		}
+
+		data := partial[stream] + string(payload)
+		lines := strings.Split(data, "\n")
+		partial[stream] = lines[len(lines)-1]
+		for _, line := range lines[:len(lines)-1] {
+			if err := send(strings.TrimRight(line, "\r"), stream == 2); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// followDocker forwards the logs of the named containers, or of every
+// running and newly started container when all is set, until ctx is done.
+func followDocker(ctx context.Context, w *pool, priority syslog.Priority, names []string, all bool) error {
+	c, err := newDockerClient()
+	if err != nil {
+		return err
+	}
+
+	stderrPriority := priority&^0x07 | syslog.LOG_ERR
+	if priority&0x07 < syslog.LOG_ERR {
+		stderrPriority = priority
+	}
+
+	var mu sync.Mutex
+	following := make(map[string]bool)
+	var wg sync.WaitGroup
+
+	follow := func(id string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if following[id] {
+			return
+		}
+
+		ct, err := c.inspect(ctx, id)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		following[ct.ID] = true
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				mu.Lock()
+				delete(following, ct.ID)
+				mu.Unlock()
+			}()
+
+			err := c.logs(ctx, ct, func(line string, stderr bool) error {
+				if len(line) == 0 {
+					return nil
+				}
+				p := priority
+				if stderr {
+					p = stderrPriority
+				}
+				if _, err := w.WriteWithTag(p, ct.Name, []byte(line)); err != nil {
+					log.Print(err)
+				}
+				return nil
+			})
+			if err != nil {
+				log.Printf("%s: %v", ct.Name, err)
+			}
+		}()
+	}
+
+	if all {
+		started := make(chan string)
+		since := time.Now()
+		go func() {
+			if err := c.starts(ctx, since, started); err != nil {
+				log.Print(err)
+			}
+		}()
+
+		ids, err := c.running(ctx)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			follow(id)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				wg.Wait()
+				return nil
+			case id := <-started:
+				follow(id)
+			}
+		}
+	}
+
+	for _, name := range names {
+		follow(name)
+	}
+	wg.Wait()
+	return nil
+}
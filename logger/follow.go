@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	followInterval     = 250 * time.Millisecond
+	checkpointInterval = time.Second
+)
+
+type checkpoint struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+func loadCheckpoint(path string) (checkpoint, error) {
+	var c checkpoint
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+func (c checkpoint) save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+type follower struct {
+	path       string
+	follow     bool
+	checkpoint string
+
+	file    *os.File
+	reader  *bufio.Reader
+	inode   uint64
+	offset  int64
+	partial string
+
+	mu        sync.Mutex
+	delivered checkpoint
+	saved     checkpoint
+	savedAt   time.Time
+}
+
+func newFollower(path string, follow bool, checkpointPath string) (*follower, error) {
+	f := &follower{path: path, follow: follow, checkpoint: checkpointPath}
+
+	var resume checkpoint
+	if checkpointPath != "" {
+		c, err := loadCheckpoint(checkpointPath)
+		if err != nil {
+			return nil, err
+		}
+		resume = c
+		f.saved = c
+	}
+
+	if err := f.open(resume); err != nil {
+		return nil, err
+	}
+	f.delivered = checkpoint{Inode: f.inode, Offset: f.offset}
+
+	return f, nil
+}
+
+func (f *follower) open(resume checkpoint) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.inode = fileInode(fi)
+	f.offset = 0
+	f.partial = ""
+
+	if resume.Inode == f.inode && resume.Offset <= fi.Size() {
+		if _, err := file.Seek(resume.Offset, io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+		f.offset = resume.Offset
+	}
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	f.reader = bufio.NewReader(file)
+
+	return nil
+}
+
+// rotated reports whether the path now points to a different file or the
+// current file has been truncated below the position already read.
+func (f *follower) rotated() (bool, error) {
+	fi, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if fileInode(fi) != f.inode {
+		return true, nil
+	}
+	if fi.Size() < f.offset {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Run sends the lines of the file, each with the checkpoint just past it.
+// The checkpoint saved is the last one passed to Delivered, so that the
+// lines still held by the joiner or the batcher are read again after a
+// restart.
+func (f *follower) Run(send func(string, checkpoint) error, stop <-chan struct{}) error {
+	for {
+		line, err := f.reader.ReadString('\n')
+		if err == nil {
+			line = f.partial + line
+			f.partial = ""
+
+			if err := f.emit(send, line); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		f.partial += line
+
+		if !f.follow {
+			if f.partial != "" {
+				if err := f.emit(send, f.partial); err != nil {
+					return err
+				}
+				f.partial = ""
+			}
+			return nil
+		}
+
+		f.mark(true)
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(followInterval):
+		}
+
+		rotated, err := f.rotated()
+		if err != nil {
+			return err
+		}
+		if rotated {
+			if err := f.drain(send); err != nil {
+				return err
+			}
+			if f.partial != "" {
+				if err := f.emit(send, f.partial); err != nil {
+					return err
+				}
+				f.partial = ""
+			}
+			if err := f.open(checkpoint{}); err != nil {
+				return err
+			}
+			f.mark(true)
+		}
+	}
+}
+
+// drain sends the lines appended to a file renamed away before it was
+// replaced, up to its end. A truncated file has nothing left to read.
+func (f *follower) drain(send func(string, checkpoint) error) error {
+	fi, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < f.offset {
+		return nil
+	}
+
+	for {
+		line, err := f.reader.ReadString('\n')
+		if err == io.EOF {
+			f.partial += line
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = f.partial + line
+		f.partial = ""
+
+		if err := f.emit(send, line); err != nil {
+			return err
+		}
+	}
+}
+
+// emit sends line, moving the offset past it.
+func (f *follower) emit(send func(string, checkpoint) error, line string) error {
+	f.offset += int64(len(line))
+	return send(strings.TrimRight(line, "\r\n"), checkpoint{Inode: f.inode, Offset: f.offset})
+}
+
+// Delivered records that the lines up to c have been written, which may be
+// called from the timers of the joiner and the batcher.
+func (f *follower) Delivered(c checkpoint) {
+	f.mu.Lock()
+	f.delivered = c
+	f.mu.Unlock()
+
+	f.mark(false)
+}
+
+func (f *follower) mark(force bool) {
+	if f.checkpoint == "" {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !force && time.Since(f.savedAt) < checkpointInterval {
+		return
+	}
+
+	c := f.delivered
+	if c == f.saved {
+		return
+	}
+	if err := c.save(f.checkpoint); err != nil {
+		log.Print(err)
+		return
+	}
+	f.saved = c
+	f.savedAt = time.Now()
+}
+
+func (f *follower) Close() error {
+	f.mark(true)
+	return f.file.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileInode has no inode to return, so rotation is only noticed when the
+// file is truncated below the position already read.
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	syslog "github.com/racksec/srslog"
+)
+
+const forwardTimeout = 10 * time.Second
+
+var severityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+var facilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+func priorityNames(p syslog.Priority) (string, string) {
+	facility := int(p) >> 3
+	if facility >= len(facilityNames) {
+		return fmt.Sprint(facility), severityNames[p&0x07]
+	}
+	return facilityNames[facility], severityNames[p&0x07]
+}
+
+// forwarder speaks the Fluentd forward protocol in Message Mode, one event
+// per message, optionally waiting for the server to acknowledge each chunk.
+type forwarder struct {
+	mu        sync.Mutex
+	addr      string
+	tlsConfig *tls.Config
+	conn      net.Conn
+
+	tag      string
+	ident    string
+	hostname string
+	priority syslog.Priority
+	ack      bool
+}
+
+func dialForwarder(addr string, tlsConfig *tls.Config, tag, ident, hostname string, priority syslog.Priority, ack bool) (*forwarder, error) {
+	f := &forwarder{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		tag:       tag,
+		ident:     ident,
+		hostname:  hostname,
+		priority:  priority,
+		ack:       ack,
+	}
+	if err := f.connect(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *forwarder) connect() error {
+	d := &net.Dialer{Timeout: forwardTimeout}
+
+	var conn net.Conn
+	var err error
+	if f.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(d, "tcp", f.addr, f.tlsConfig)
+	} else {
+		conn, err = d.Dial("tcp", f.addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	f.conn = conn
+	return nil
+}
+
+func (f *forwarder) Write(b []byte) (int, error) {
+	return f.WriteWithPriority(f.priority, b)
+}
+
+func (f *forwarder) WriteWithPriority(p syslog.Priority, b []byte) (int, error) {
+	return f.WriteWithTag(p, f.ident, b)
+}
+
+func (f *forwarder) WriteWithTag(p syslog.Priority, tag string, b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	facility, severity := priorityNames(p)
+	record := map[string]interface{}{
+		"host":     f.hostname,
+		"ident":    tag,
+		"pid":      os.Getpid(),
+		"facility": facility,
+		"severity": severity,
+		"message":  string(b),
+	}
+	event := []interface{}{f.tag, eventTime(time.Now()), record}
+
+	var chunk string
+	if f.ack {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return 0, err
+		}
+		chunk = base64.StdEncoding.EncodeToString(id)
+		event = append(event, map[string]interface{}{"chunk": chunk})
+	}
+
+	data, err := appendMsgpack(nil, event)
+	if err != nil {
+		return 0, err
+	}
+
+	// Retry once on a fresh connection, the server may have closed an
+	// idle one.
+	for attempt := 0; ; attempt++ {
+		err = f.send(data, chunk)
+		if err == nil || attempt > 0 {
+			break
+		}
+		f.closeConn()
+	}
+	if err != nil {
+		f.closeConn()
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (f *forwarder) send(data []byte, chunk string) error {
+	if f.conn == nil {
+		if err := f.connect(); err != nil {
+			return err
+		}
+	}
+
+	f.conn.SetDeadline(time.Now().Add(forwardTimeout))
+	if _, err := f.conn.Write(data); err != nil {
+		return err
+	}
+	if chunk == "" {
+		return nil
+	}
+
+	resp, err := readStringMap(f.conn)
+	if err != nil {
+		return err
+	}
+	if resp["ack"] != chunk {
+		return fmt.Errorf("forward: unexpected ack %q", resp["ack"])
+	}
+	return nil
+}
+
+func (f *forwarder) closeConn() {
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+func (f *forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closeConn()
+	return nil
+}
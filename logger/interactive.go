@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	syslog "github.com/racksec/srslog"
+	"golang.org/x/term"
+)
+
+const interactivePrompt = "logger> "
+
+const interactiveHelp = `Enter one message per line, optionally prefixed with a priority:
+  err: disk failure on sda
+  local3.warning: link flapping on ge-0/0/1
+  plain text uses the --priority default
+Type "help" for this text and "quit" or Ctrl-D to leave.`
+
+// linePriority splits an interactive line into its priority and message.
+// The prefix may be a level ("err") or facility.level ("auth.info"); a
+// line without a recognizable prefix is sent with the default priority.
+func linePriority(line string, def syslog.Priority) (syslog.Priority, string) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return def, line
+	}
+
+	prefix := strings.TrimSpace(line[:i])
+	message := strings.TrimSpace(line[i+1:])
+	if prefix == "" || strings.ContainsAny(prefix, " \t") {
+		return def, line
+	}
+
+	if strings.Contains(prefix, ".") {
+		if p, err := parsePriority(prefix); err == nil {
+			return p, message
+		}
+		return def, line
+	}
+
+	if level, err := levelPriority(prefix); err == nil {
+		return def&^0x07 | level, message
+	}
+	return def, line
+}
+
+func runInteractive(w *pool, def syslog.Priority) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return runLines(w, def, os.Stdin, os.Stderr)
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, interactivePrompt)
+	fmt.Fprintln(t, interactiveHelp)
+
+	for {
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if done := handleLine(w, def, line, t); done {
+			return nil
+		}
+	}
+}
+
+func runLines(w *pool, def syslog.Priority, r io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if done := handleLine(w, def, scanner.Text(), out); done {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func handleLine(w *pool, def syslog.Priority, line string, out io.Writer) bool {
+	line = strings.TrimSpace(line)
+	switch line {
+	case "":
+		return false
+	case "quit", "exit":
+		return true
+	case "help", "?":
+		fmt.Fprintln(out, interactiveHelp)
+		return false
+	}
+
+	priority, message := linePriority(line, def)
+	if _, err := w.WriteWithPriority(priority, []byte(message)); err != nil {
+		fmt.Fprintf(out, "error: %v\n", err)
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	syslog "github.com/racksec/srslog"
+)
+
+const markMessage = "-- MARK --"
+
+// keepaliveDialer dials network with TCP keepalives every period, with TLS
+// if tlsConfig is not nil. It is to be given to srslog for its "custom"
+// network, the only one it dials with a DialFunc.
+func keepaliveDialer(network string, period time.Duration, tlsConfig *tls.Config) syslog.DialFunc {
+	d := &net.Dialer{KeepAlive: period}
+	return func(_, addr string) (net.Conn, error) {
+		if tlsConfig != nil {
+			return tls.DialWithDialer(d, "tcp", addr, tlsConfig)
+		}
+		return d.Dial(network, addr)
+	}
+}
+
+// markWriter remembers when the last message went out so that an idle
+// connection can be kept warm with MARK messages.
+type markWriter struct {
+	mu   sync.Mutex
+	w    output
+	last time.Time
+}
+
+func newMarkWriter(w output) *markWriter {
+	return &markWriter{w: w, last: time.Now()}
+}
+
+func (m *markWriter) Write(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.last = time.Now()
+	return m.w.Write(b)
+}
+
+func (m *markWriter) idle() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return time.Since(m.last)
+}
+
+func (m *markWriter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if m.idle() >= interval {
+				m.Write([]byte(markMessage))
+			}
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
 	flags "github.com/jessevdk/go-flags"
 	syslog "github.com/racksec/srslog"
@@ -100,11 +106,36 @@ func parsePriority(priority string) (syslog.Priority, error) {
 
 func main() {
 	var opts struct {
-		Connection string `short:"c" long:"network" description:"Connect to this network" choice:"tcp" choice:"udp" default:"udp"`
-		Address    string `short:"n" long:"address" description:"Write to this remote syslog server" default:":514"`
-		Priority   string `short:"p" long:"priority" description:"Mark given message with this priority" default:"user.notice"`
-		Tag        string `short:"t" long:"tag" description:"Mark every line with this tag (default: $0)"`
-		Hostname   string `short:"l" long:"hostname" description:"Override syslog sender with this name (default: hostname)"`
+		Output             string        `short:"o" long:"output" description:"Protocol to send messages with" choice:"syslog" choice:"forward" choice:"otlp" default:"syslog"`
+		Connection         string        `short:"c" long:"network" description:"Connect to this network" choice:"tcp" choice:"udp" default:"udp"`
+		Address            []string      `short:"n" long:"address" description:"Write to this remote syslog server (repeatable)" default:":514"`
+		Srv                string        `long:"srv" description:"Discover the servers from these DNS SRV records (e.g. _syslog._tcp.example.com)"`
+		Balance            string        `long:"balance" description:"How to spread messages over several servers" choice:"roundrobin" choice:"failover" default:"failover"`
+		Priority           string        `short:"p" long:"priority" description:"Mark given message with this priority" default:"user.notice"`
+		Tag                string        `short:"t" long:"tag" description:"Mark every line with this tag (default: $0)"`
+		Hostname           string        `short:"l" long:"hostname" description:"Override syslog sender with this name (default: hostname)"`
+		File               string        `short:"f" long:"file" description:"Log the contents of this file, one message per line"`
+		Follow             bool          `short:"F" long:"follow" description:"Keep reading the file as it grows and across rotation"`
+		Checkpoint         string        `long:"checkpoint" description:"Persist the read position of the file here and resume from it"`
+		TLS                bool          `long:"tls" description:"Encrypt the connection with TLS"`
+		TLSCA              string        `long:"tls-ca" description:"Verify the server certificate against this CA bundle"`
+		TLSSkipVerify      bool          `long:"tls-skip-verify" description:"Do not verify the server certificate"`
+		ForwardTag         string        `long:"forward-tag" description:"Fluentd tag for the forward output" default:"syslog"`
+		ForwardAck         bool          `long:"forward-ack" description:"Wait for the Fluentd server to acknowledge every message"`
+		OTLPEndpoint       string        `long:"otlp-endpoint" description:"Export messages as OpenTelemetry logs to this OTLP/gRPC endpoint"`
+		OTLPInsecure       bool          `long:"otlp-insecure" description:"Use plaintext HTTP/2 for a host:port OTLP endpoint"`
+		Docker             []string      `long:"docker" description:"Forward the stdout/stderr of this container (repeatable)"`
+		DockerAll          bool          `long:"docker-all" description:"Forward the stdout/stderr of every running container"`
+		Interactive        bool          `short:"i" long:"interactive" description:"Read priority-prefixed messages from the terminal over one connection"`
+		MultilinePattern   string        `long:"multiline-pattern" description:"Join lines matching this regexp onto the previous line (e.g. '^\\s')"`
+		MultilineSeparator string        `long:"multiline-separator" description:"Separator between joined lines" default:"\n"`
+		MultilineTimeout   time.Duration `long:"multiline-timeout" description:"Send a pending multiline message after this much quiet" default:"1s"`
+		MultilineMaxSize   int           `long:"multiline-max-size" description:"Send a pending multiline message before it exceeds this many bytes" default:"8192"`
+		BatchLines         int           `long:"batch-lines" description:"Concatenate up to this many lines into one message"`
+		BatchWindow        time.Duration `long:"batch-window" description:"Send a partial batch after this long" default:"500ms"`
+		BatchSeparator     string        `long:"batch-separator" description:"Separator between batched lines" default:"\n"`
+		Keepalive          time.Duration `long:"keepalive" description:"Enable TCP keepalive probes with this period"`
+		Mark               time.Duration `long:"mark" description:"Send a MARK message when the connection has been idle this long (follow mode)"`
 	}
 
 	args, err := flags.Parse(&opts)
@@ -130,16 +161,157 @@ func main() {
 		log.Fatal(err)
 	}
 
-	w, err := syslog.Dial(opts.Connection, opts.Address, priority, opts.Tag)
+	var tlsConfig *tls.Config
+	if opts.TLS {
+		tlsConfig, err = loadTLSConfig(opts.TLSCA, opts.TLSSkipVerify)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	addrs := opts.Address
+	if opts.OTLPEndpoint != "" {
+		opts.Output = "otlp"
+		addrs = []string{opts.OTLPEndpoint}
+	}
+
+	dial := func(addr string) (output, error) {
+		switch opts.Output {
+		case "forward":
+			return dialForwarder(addr, tlsConfig, opts.ForwardTag, opts.Tag, opts.Hostname, priority, opts.ForwardAck)
+		case "otlp":
+			return dialOTLP(addr, tlsConfig, opts.OTLPInsecure, opts.Tag, opts.Hostname, priority)
+		}
+
+		var w *syslog.Writer
+		var err error
+		if opts.Keepalive > 0 {
+			w, err = syslog.DialWithCustomDialer("custom", addr, priority, opts.Tag, keepaliveDialer(opts.Connection, opts.Keepalive, tlsConfig))
+		} else if tlsConfig != nil {
+			w, err = syslog.DialWithTLSConfig("tcp+tls", addr, priority, opts.Tag, tlsConfig)
+		} else {
+			w, err = syslog.Dial(opts.Connection, addr, priority, opts.Tag)
+		}
+		if err != nil {
+			return nil, err
+		}
+		w.SetHostname(opts.Hostname)
+		return newSyslogOutput(w), nil
+	}
+
+	var ttl time.Duration
+	if opts.Srv != "" {
+		addrs, ttl, err = resolveSRV(opts.Srv)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	w, err := newPool(addrs, opts.Balance, dial)
 	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.Srv != "" {
+		go watchSRV(opts.Srv, w, ttl, nil)
+	}
+	if err := w.Connect(); err != nil {
 		log.Print(err)
 		os.Exit(1)
 	}
-	w.SetHostname(opts.Hostname)
 	defer w.Close()
 
+	if opts.Interactive {
+		if err := runInteractive(w, priority); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(opts.Docker) > 0 || opts.DockerAll {
+		ctx, cancel := context.WithCancel(context.Background())
+		sig := make(chan os.Signal, 2)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			<-sig
+			cancel()
+		}()
+
+		if err := followDocker(ctx, w, priority, opts.Docker, opts.DockerAll); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if opts.File != "" {
+		f, err := newFollower(opts.File, opts.Follow, opts.Checkpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		stop := make(chan struct{})
+		sig := make(chan os.Signal, 2)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			<-sig
+			close(stop)
+		}()
+
+		mw := newMarkWriter(w)
+		if opts.Mark > 0 {
+			go mw.Run(opts.Mark, stop)
+		}
+
+		send := func(message string, at checkpoint) error {
+			if len(message) > 0 {
+				if _, err := mw.Write([]byte(message)); err != nil {
+					return err
+				}
+			}
+			f.Delivered(at)
+			return nil
+		}
+
+		var b *batcher
+		if opts.BatchLines > 1 {
+			b = newBatcher(opts.BatchLines, opts.BatchWindow, opts.BatchSeparator, send)
+			send = b.Add
+		}
+
+		var j *joiner
+		if opts.MultilinePattern != "" {
+			pattern, err := regexp.Compile(opts.MultilinePattern)
+			if err != nil {
+				log.Fatal(err)
+			}
+			j = newJoiner(pattern, opts.MultilineSeparator, opts.MultilineTimeout, opts.MultilineMaxSize, send)
+			send = j.Add
+		}
+
+		err = f.Run(send, stop)
+		if j != nil {
+			if ferr := j.Flush(); err == nil {
+				err = ferr
+			}
+		}
+		if b != nil {
+			if ferr := b.Flush(); err == nil {
+				err = ferr
+			}
+		}
+		if ferr := f.Close(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	message := strings.Join(args, " ")
 	if len(message) > 0 {
-		w.Write([]byte(message))
+		if _, err := w.Write([]byte(message)); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
 	}
 }
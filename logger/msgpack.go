@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// A minimal MessagePack codec covering what the Fluentd forward protocol
+// needs: nil, booleans, integers, strings, arrays, string-keyed maps and
+// the EventTime extension.
+
+type eventTime time.Time
+
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case int:
+		return appendInt(b, int64(v)), nil
+	case int64:
+		return appendInt(b, v), nil
+	case uint64:
+		return appendUint(b, v), nil
+	case float64:
+		b = append(b, 0xcb)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v)), nil
+	case string:
+		return appendString(b, v), nil
+	case []byte:
+		return appendBinary(b, v), nil
+	case eventTime:
+		t := time.Time(v)
+		b = append(b, 0xd7, 0x00)
+		b = binary.BigEndian.AppendUint32(b, uint32(t.Unix()))
+		return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond())), nil
+	case []interface{}:
+		b = appendArrayHeader(b, len(v))
+		for _, e := range v {
+			var err error
+			if b, err = appendMsgpack(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b = appendMapHeader(b, len(v))
+		for _, k := range keys {
+			b = appendString(b, k)
+			var err error
+			if b, err = appendMsgpack(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for k, s := range v {
+			m[k] = s
+		}
+		return appendMsgpack(b, m)
+	default:
+		return nil, fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+}
+
+func appendInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return appendUint(b, uint64(n))
+	case n >= -32:
+		return append(b, byte(n))
+	case n >= math.MinInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+	}
+}
+
+func appendUint(b []byte, n uint64) []byte {
+	switch {
+	case n <= 0x7f:
+		return append(b, byte(n))
+	case n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), n)
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendBinary(b []byte, p []byte) []byte {
+	n := len(p)
+	switch {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+	return append(b, p...)
+}
+
+func appendArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+func appendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+// The bounds of an ack, {"ack": chunk ID}, against a broken or hostile
+// server.
+const (
+	maxAckEntries = 16
+	maxAckString  = 1024
+)
+
+// readStringMap reads from r a map whose keys and values are strings,
+// which is the shape of a forward protocol ack response. It reads no more
+// than the map, which may arrive in pieces.
+func readStringMap(r io.Reader) (map[string]string, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:1]); err != nil {
+		return nil, err
+	}
+
+	var n int
+	switch {
+	case hdr[0]&0xf0 == 0x80:
+		n = int(hdr[0] & 0x0f)
+	case hdr[0] == 0xde:
+		if _, err := io.ReadFull(r, hdr[1:3]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint16(hdr[1:]))
+	case hdr[0] == 0xdf:
+		if _, err := io.ReadFull(r, hdr[1:5]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint32(hdr[1:]))
+	default:
+		return nil, fmt.Errorf("msgpack: expected map, got 0x%02x", hdr[0])
+	}
+	if n > maxAckEntries {
+		return nil, fmt.Errorf("msgpack: map of %d entries", n)
+	}
+
+	m := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		k, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+func readString(r io.Reader) (string, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:1]); err != nil {
+		return "", err
+	}
+
+	var size int
+	switch {
+	case hdr[0]&0xe0 == 0xa0:
+		return readN(r, int(hdr[0]&0x1f))
+	case hdr[0] == 0xd9 || hdr[0] == 0xc4:
+		size = 1
+	case hdr[0] == 0xda || hdr[0] == 0xc5:
+		size = 2
+	case hdr[0] == 0xdb || hdr[0] == 0xc6:
+		size = 4
+	default:
+		return "", fmt.Errorf("msgpack: expected string, got 0x%02x", hdr[0])
+	}
+	if _, err := io.ReadFull(r, hdr[1:1+size]); err != nil {
+		return "", err
+	}
+	var n uint32
+	for _, c := range hdr[1 : 1+size] {
+		n = n<<8 | uint32(c)
+	}
+	if n > maxAckString {
+		return "", fmt.Errorf("msgpack: string of %d bytes", n)
+	}
+	return readN(r, int(n))
+}
+
+func readN(r io.Reader, n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// joiner glues continuation lines (those matching pattern) onto the line
+// before them. The pending message is sent when a non-continuation line
+// arrives, when nothing arrived for timeout, or before it would grow past
+// maxSize bytes.
+type joiner struct {
+	mu        sync.Mutex
+	pattern   *regexp.Regexp
+	separator string
+	timeout   time.Duration
+	maxSize   int
+	send      func(string, checkpoint) error
+
+	lines []string
+	size  int
+	at    checkpoint
+	timer *time.Timer
+}
+
+// newJoiner sends each message with the checkpoint of its last line, so
+// that the lines pending are not checkpointed before they are sent.
+func newJoiner(pattern *regexp.Regexp, separator string, timeout time.Duration, maxSize int, send func(string, checkpoint) error) *joiner {
+	return &joiner{
+		pattern:   pattern,
+		separator: separator,
+		timeout:   timeout,
+		maxSize:   maxSize,
+		send:      send,
+	}
+}
+
+func (j *joiner) Add(line string, at checkpoint) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.lines) > 0 {
+		continuation := j.pattern.MatchString(line)
+		tooBig := j.maxSize > 0 && j.size+len(j.separator)+len(line) > j.maxSize
+		if !continuation || tooBig {
+			if err := j.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(j.lines) > 0 {
+		j.size += len(j.separator)
+	}
+	j.lines = append(j.lines, line)
+	j.size += len(line)
+	j.at = at
+
+	if j.timer == nil {
+		j.timer = time.AfterFunc(j.timeout, j.expire)
+	} else {
+		j.timer.Reset(j.timeout)
+	}
+	return nil
+}
+
+func (j *joiner) expire() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.flush(); err != nil {
+		log.Print(err)
+	}
+}
+
+func (j *joiner) flush() error {
+	if len(j.lines) == 0 {
+		return nil
+	}
+
+	message := strings.Join(j.lines, j.separator)
+	j.lines = j.lines[:0]
+	j.size = 0
+
+	return j.send(message, j.at)
+}
+
+func (j *joiner) Flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+	return j.flush()
+}
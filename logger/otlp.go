@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"time"
+
+	"github.com/haccht/syslog_tools/otlp"
+	syslog "github.com/racksec/srslog"
+)
+
+type otlpOutput struct {
+	e        *otlp.Exporter
+	tag      string
+	priority syslog.Priority
+}
+
+func dialOTLP(endpoint string, tlsConfig *tls.Config, insecure bool, tag, hostname string, priority syslog.Priority) (*otlpOutput, error) {
+	resource := map[string]interface{}{
+		"host.name":    hostname,
+		"service.name": tag,
+		"process.pid":  os.Getpid(),
+	}
+
+	e, err := otlp.NewExporter(endpoint, resource, tlsConfig, insecure)
+	if err != nil {
+		return nil, err
+	}
+	return &otlpOutput{e: e, tag: tag, priority: priority}, nil
+}
+
+func (o *otlpOutput) Write(b []byte) (int, error) {
+	return o.WriteWithPriority(o.priority, b)
+}
+
+func (o *otlpOutput) WriteWithPriority(p syslog.Priority, b []byte) (int, error) {
+	return o.WriteWithTag(p, o.tag, b)
+}
+
+func (o *otlpOutput) WriteWithTag(p syslog.Priority, tag string, b []byte) (int, error) {
+	facility, _ := priorityNames(p)
+	now := time.Now()
+
+	record := otlp.Record{
+		Time:         now,
+		ObservedTime: now,
+		Severity:     int(p & 0x07),
+		Body:         string(b),
+		Attributes: map[string]interface{}{
+			"syslog.facility": facility,
+			"syslog.tag":      tag,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+
+	if err := o.e.Export(ctx, []otlp.Record{record}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (o *otlpOutput) Close() error {
+	return o.e.Close()
+}
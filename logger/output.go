@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+
+	syslog "github.com/racksec/srslog"
+)
+
+// output is a connection to a single server.
+type output interface {
+	Write(b []byte) (int, error)
+	WriteWithPriority(p syslog.Priority, b []byte) (int, error)
+	WriteWithTag(p syslog.Priority, tag string, b []byte) (int, error)
+	Close() error
+}
+
+// syslogOutput wraps a srslog writer, whose tag is fixed at dial time, so
+// that individual messages can carry a different tag.
+type syslogOutput struct {
+	mu  sync.Mutex
+	w   *syslog.Writer
+	tag string
+}
+
+func newSyslogOutput(w *syslog.Writer) *syslogOutput {
+	o := &syslogOutput{w: w}
+	w.SetFormatter(o.format)
+	return o
+}
+
+func (o *syslogOutput) format(p syslog.Priority, hostname, tag, content string) string {
+	if o.tag != "" {
+		tag = o.tag
+	}
+	return syslog.DefaultFormatter(p, hostname, tag, content)
+}
+
+func (o *syslogOutput) Write(b []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.w.Write(b)
+}
+
+func (o *syslogOutput) WriteWithPriority(p syslog.Priority, b []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.w.WriteWithPriority(p, b)
+}
+
+func (o *syslogOutput) WriteWithTag(p syslog.Priority, tag string, b []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.tag = tag
+	defer func() { o.tag = "" }()
+	return o.w.WriteWithPriority(p, b)
+}
+
+func (o *syslogOutput) Close() error {
+	return o.w.Close()
+}
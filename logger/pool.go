@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	syslog "github.com/racksec/srslog"
+)
+
+const (
+	balanceRoundRobin = "roundrobin"
+	balanceFailover   = "failover"
+
+	retryInterval = 30 * time.Second
+)
+
+type dialFunc func(addr string) (output, error)
+
+type member struct {
+	addr      string
+	w         output
+	downUntil time.Time
+}
+
+// pool spreads messages over several servers. A server that fails is
+// skipped for retryInterval and then tried again.
+type pool struct {
+	mu      sync.Mutex
+	members []*member
+	balance string
+	next    int
+	dial    dialFunc
+}
+
+func newPool(addrs []string, balance string, dial dialFunc) (*pool, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no syslog server address")
+	}
+
+	p := &pool{balance: balance, dial: dial}
+	for _, addr := range addrs {
+		p.members = append(p.members, &member{addr: addr})
+	}
+
+	return p, nil
+}
+
+// Connect dials every server up front and fails only if none is reachable.
+func (p *pool) Connect() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var lastErr error
+	for _, m := range p.members {
+		if err := p.connect(m); err != nil {
+			log.Print(err)
+			lastErr = err
+		}
+	}
+
+	for _, m := range p.members {
+		if m.w != nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+// SetAddrs replaces the server list, keeping the connections to servers
+// that remain in it.
+func (p *pool) SetAddrs(addrs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := make(map[string]*member)
+	for _, m := range p.members {
+		current[m.addr] = m
+	}
+
+	var members []*member
+	for _, addr := range addrs {
+		if m, ok := current[addr]; ok {
+			members = append(members, m)
+			delete(current, addr)
+		} else {
+			members = append(members, &member{addr: addr})
+		}
+	}
+	for _, m := range current {
+		if m.w != nil {
+			m.w.Close()
+		}
+	}
+
+	p.members = members
+	p.next = 0
+}
+
+func (p *pool) connect(m *member) error {
+	if m.w != nil {
+		return nil
+	}
+
+	w, err := p.dial(m.addr)
+	if err != nil {
+		m.downUntil = time.Now().Add(retryInterval)
+		return fmt.Errorf("%s: %v", m.addr, err)
+	}
+	m.w = w
+	m.downUntil = time.Time{}
+
+	return nil
+}
+
+func (p *pool) fail(m *member) {
+	if m.w != nil {
+		m.w.Close()
+		m.w = nil
+	}
+	m.downUntil = time.Now().Add(retryInterval)
+}
+
+// order returns the members to try for the next message: healthy ones in
+// balancing order first, followed by those still marked down.
+func (p *pool) order() []*member {
+	if len(p.members) == 0 {
+		return nil
+	}
+
+	start := 0
+	if p.balance == balanceRoundRobin {
+		start = p.next
+		p.next = (p.next + 1) % len(p.members)
+	}
+
+	now := time.Now()
+	var up, down []*member
+	for i := range p.members {
+		m := p.members[(start+i)%len(p.members)]
+		if now.Before(m.downUntil) {
+			down = append(down, m)
+		} else {
+			up = append(up, m)
+		}
+	}
+
+	return append(up, down...)
+}
+
+func (p *pool) Write(b []byte) (int, error) {
+	return p.send(func(w output) (int, error) {
+		return w.Write(b)
+	})
+}
+
+func (p *pool) WriteWithPriority(priority syslog.Priority, b []byte) (int, error) {
+	return p.send(func(w output) (int, error) {
+		return w.WriteWithPriority(priority, b)
+	})
+}
+
+func (p *pool) WriteWithTag(priority syslog.Priority, tag string, b []byte) (int, error) {
+	return p.send(func(w output) (int, error) {
+		return w.WriteWithTag(priority, tag, b)
+	})
+}
+
+func (p *pool) send(write func(output) (int, error)) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lastErr := errors.New("no syslog server available")
+	for _, m := range p.order() {
+		if err := p.connect(m); err != nil {
+			lastErr = err
+			continue
+		}
+
+		n, err := write(m.w)
+		if err != nil {
+			p.fail(m)
+			lastErr = fmt.Errorf("%s: %v", m.addr, err)
+			continue
+		}
+		return n, nil
+	}
+
+	return 0, lastErr
+}
+
+func (p *pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, m := range p.members {
+		if m.w != nil {
+			m.w.Close()
+			m.w = nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeSRV   = 33
+	dnsClassINET = 1
+
+	srvMinTTL     = 5 * time.Second
+	srvDefaultTTL = 60 * time.Second
+	srvTimeout    = 5 * time.Second
+)
+
+type srvRecord struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+	TTL      time.Duration
+}
+
+// resolveSRV looks up name and returns the collector addresses in the order
+// RFC 2782 prescribes, together with how long the answer may be cached.
+func resolveSRV(name string) ([]string, time.Duration, error) {
+	records, err := querySRV(name)
+	if err != nil {
+		records, err = lookupSRV(name)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(records) == 0 {
+		return nil, 0, fmt.Errorf("no SRV records for %s", name)
+	}
+
+	ttl := records[0].TTL
+	for _, r := range records {
+		if r.TTL < ttl {
+			ttl = r.TTL
+		}
+	}
+	if ttl < srvMinTTL {
+		ttl = srvMinTTL
+	}
+
+	var addrs []string
+	for _, r := range orderSRV(records) {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), fmt.Sprint(r.Port)))
+	}
+	return addrs, ttl, nil
+}
+
+// orderSRV sorts by ascending priority and, within a priority, picks the
+// records in weighted random order.
+func orderSRV(records []srvRecord) []srvRecord {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+
+	var ordered []srvRecord
+	for i := 0; i < len(records); {
+		j := i
+		for j < len(records) && records[j].Priority == records[i].Priority {
+			j++
+		}
+		ordered = append(ordered, shuffleByWeight(records[i:j])...)
+		i = j
+	}
+	return ordered
+}
+
+func shuffleByWeight(records []srvRecord) []srvRecord {
+	rest := append([]srvRecord(nil), records...)
+
+	var out []srvRecord
+	for len(rest) > 0 {
+		total := 0
+		for _, r := range rest {
+			total += int(r.Weight)
+		}
+
+		pick := 0
+		if total > 0 {
+			n := rand.Intn(total + 1)
+			for i, r := range rest {
+				n -= int(r.Weight)
+				if n <= 0 {
+					pick = i
+					break
+				}
+			}
+		}
+
+		out = append(out, rest[pick])
+		rest = append(rest[:pick], rest[pick+1:]...)
+	}
+	return out
+}
+
+func lookupSRV(name string) ([]srvRecord, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []srvRecord
+	for _, a := range addrs {
+		records = append(records, srvRecord{
+			Target:   a.Target,
+			Port:     a.Port,
+			Priority: a.Priority,
+			Weight:   a.Weight,
+			TTL:      srvDefaultTTL,
+		})
+	}
+	return records, nil
+}
+
+func nameservers() []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return []string{"127.0.0.1:53"}
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+// querySRV asks the system nameservers directly, since the resolver in the
+// standard library does not expose record TTLs.
+func querySRV(name string) ([]srvRecord, error) {
+	query, id, err := buildSRVQuery(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, server := range nameservers() {
+		records, err := exchangeSRV(server, query, id)
+		if err == nil {
+			return records, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func exchangeSRV(server string, query []byte, id uint16) ([]srvRecord, error) {
+	conn, err := net.DialTimeout("udp", server, srvTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(srvTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return parseSRVResponse(buf[:n], id)
+}
+
+func buildSRVQuery(name string) ([]byte, uint16, error) {
+	id := uint16(rand.Intn(1 << 16))
+
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid SRV name: %s", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, dnsTypeSRV, 0, dnsClassINET)
+
+	return msg, id, nil
+}
+
+var errDNSFormat = errors.New("malformed DNS response")
+
+func parseSRVResponse(msg []byte, id uint16) ([]srvRecord, error) {
+	if len(msg) < 12 {
+		return nil, errDNSFormat
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, errors.New("DNS response id mismatch")
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x0200 != 0 {
+		return nil, errors.New("truncated DNS response")
+	}
+	if rcode := flags & 0x000f; rcode != 0 {
+		return nil, fmt.Errorf("DNS query failed with rcode %d", rcode)
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		var err error
+		if _, off, err = readName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+
+	var records []srvRecord
+	for i := 0; i < ancount; i++ {
+		var err error
+		if _, off, err = readName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errDNSFormat
+		}
+
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, errDNSFormat
+		}
+
+		if rtype == dnsTypeSRV && rdlen >= 7 {
+			target, _, err := readName(msg, off+6)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, srvRecord{
+				Priority: binary.BigEndian.Uint16(msg[off:]),
+				Weight:   binary.BigEndian.Uint16(msg[off+2:]),
+				Port:     binary.BigEndian.Uint16(msg[off+4:]),
+				Target:   target,
+				TTL:      time.Duration(ttl) * time.Second,
+			})
+		}
+		off += rdlen
+	}
+
+	return records, nil
+}
+
+// readName decodes a possibly compressed domain name starting at off and
+// returns it along with the offset just past it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+
+	for hops := 0; hops < 64; hops++ {
+		if off >= len(msg) {
+			return "", 0, errDNSFormat
+		}
+
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSFormat
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSFormat
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+
+	return "", 0, errDNSFormat
+}
+
+// watchSRV keeps the pool membership in sync with the SRV records,
+// re-resolving whenever the previous answer expires.
+func watchSRV(name string, p *pool, ttl time.Duration, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(ttl):
+		}
+
+		addrs, next, err := resolveSRV(name)
+		if err != nil {
+			log.Print(err)
+			ttl = srvDefaultTTL
+			continue
+		}
+		p.SetAddrs(addrs)
+		ttl = next
+	}
+}
@@ -0,0 +1,145 @@
+// Package otlp converts syslog messages into OpenTelemetry LogRecords and
+// exports them to an OTLP endpoint without pulling in the gRPC and protobuf
+// runtimes.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	scopeName  = "github.com/haccht/syslog_tools"
+	exportPath = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+)
+
+var severityTexts = []string{"EMERG", "ALERT", "CRIT", "ERR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+
+// severityNumbers maps syslog severities to OpenTelemetry SeverityNumber,
+// keeping the relative order of the three most severe syslog levels.
+var severityNumbers = []int{23, 22, 21, 17, 13, 10, 9, 5}
+
+// Record is a single log entry. Severity is a syslog severity (0-7).
+type Record struct {
+	Time         time.Time
+	ObservedTime time.Time
+	Severity     int
+	Body         string
+	Attributes   map[string]interface{}
+}
+
+func (r *Record) severityNumber() int {
+	if r.Severity < 0 || r.Severity >= len(severityNumbers) {
+		return 0
+	}
+	return severityNumbers[r.Severity]
+}
+
+func (r *Record) severityText() string {
+	if r.Severity < 0 || r.Severity >= len(severityTexts) {
+		return ""
+	}
+	return severityTexts[r.Severity]
+}
+
+// Exporter sends records to an OTLP/gRPC endpoint.
+type Exporter struct {
+	url      string
+	resource map[string]interface{}
+	client   *http.Client
+}
+
+// NewExporter returns an exporter for endpoint, which is either host:port or
+// an http(s) URL. A bare host:port uses TLS unless insecure is set.
+func NewExporter(endpoint string, resource map[string]interface{}, tlsConfig *tls.Config, insecure bool) (*Exporter, error) {
+	if !strings.Contains(endpoint, "://") {
+		if insecure {
+			endpoint = "http://" + endpoint
+		} else {
+			endpoint = "https://" + endpoint
+		}
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("otlp: unsupported endpoint scheme %q", u.Scheme)
+	}
+
+	// gRPC needs HTTP/2, over TLS or with prior knowledge on cleartext.
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	transport := &http.Transport{
+		Protocols:       &protocols,
+		TLSClientConfig: tlsConfig,
+	}
+
+	return &Exporter{
+		url:      strings.TrimSuffix(u.String(), "/") + exportPath,
+		resource: resource,
+		client:   &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Export sends the records in a single ExportLogsServiceRequest.
+func (e *Exporter) Export(ctx context.Context, records []Record) error {
+	msg := encodeRequest(e.resource, scopeName, records)
+
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("otlp: unexpected HTTP status %s", resp.Status)
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// Trailers-only responses carry the status in the headers.
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	if status != "" && status != "0" {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		return fmt.Errorf("otlp: export failed with grpc-status %s: %s", status, message)
+	}
+
+	return nil
+}
+
+// Close releases idle connections.
+func (e *Exporter) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
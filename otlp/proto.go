@@ -0,0 +1,154 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// Protobuf wire encoding of the subset of the OTLP logs schema we emit.
+// Field numbers follow opentelemetry/proto/{collector/logs,logs,common,resource}/v1.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func appendTag(b []byte, field, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wire))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendFixed64Field(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendStringField(b []byte, field int, v string) []byte {
+	return appendBytesField(b, field, []byte(v))
+}
+
+// appendMessageField writes an embedded message even when it is empty, as
+// presence matters for oneof members and repeated entries.
+func appendMessageField(b []byte, field int, msg []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// AnyValue
+func encodeAnyValue(v interface{}) []byte {
+	var b []byte
+	switch v := v.(type) {
+	case string:
+		b = appendMessageField(b, 1, []byte(v))
+	case bool:
+		b = appendTag(b, 2, wireVarint)
+		if v {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	case int:
+		b = appendTag(b, 3, wireVarint)
+		b = binary.AppendUvarint(b, uint64(int64(v)))
+	case int64:
+		b = appendTag(b, 3, wireVarint)
+		b = binary.AppendUvarint(b, uint64(v))
+	case float64:
+		b = appendTag(b, 4, wireFixed64)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	case map[string]interface{}:
+		b = appendMessageField(b, 6, encodeKeyValueList(v))
+	case []byte:
+		b = appendMessageField(b, 7, v)
+	}
+	return b
+}
+
+// KeyValueList
+func encodeKeyValueList(m map[string]interface{}) []byte {
+	var b []byte
+	for _, kv := range encodeAttributes(m) {
+		b = appendMessageField(b, 1, kv)
+	}
+	return b
+}
+
+// encodeAttributes returns one encoded KeyValue per map entry, sorted by key
+// so the output is deterministic.
+func encodeAttributes(m map[string]interface{}) [][]byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var kvs [][]byte
+	for _, k := range keys {
+		var kv []byte
+		kv = appendStringField(kv, 1, k)
+		kv = appendMessageField(kv, 2, encodeAnyValue(m[k]))
+		kvs = append(kvs, kv)
+	}
+	return kvs
+}
+
+// LogRecord
+func encodeLogRecord(r *Record) []byte {
+	var b []byte
+	b = appendFixed64Field(b, 1, uint64(r.Time.UnixNano()))
+	b = appendVarintField(b, 2, uint64(r.severityNumber()))
+	b = appendStringField(b, 3, r.severityText())
+	b = appendMessageField(b, 5, encodeAnyValue(r.Body))
+	for _, kv := range encodeAttributes(r.Attributes) {
+		b = appendMessageField(b, 6, kv)
+	}
+	if !r.ObservedTime.IsZero() {
+		b = appendFixed64Field(b, 11, uint64(r.ObservedTime.UnixNano()))
+	}
+	return b
+}
+
+// ExportLogsServiceRequest with a single ResourceLogs and ScopeLogs.
+func encodeRequest(resource map[string]interface{}, scope string, records []Record) []byte {
+	var res []byte
+	for _, kv := range encodeAttributes(resource) {
+		res = appendMessageField(res, 1, kv)
+	}
+
+	var sc []byte
+	sc = appendStringField(sc, 1, scope)
+
+	var scopeLogs []byte
+	scopeLogs = appendMessageField(scopeLogs, 1, sc)
+	for i := range records {
+		scopeLogs = appendMessageField(scopeLogs, 2, encodeLogRecord(&records[i]))
+	}
+
+	var resourceLogs []byte
+	resourceLogs = appendMessageField(resourceLogs, 1, res)
+	resourceLogs = appendMessageField(resourceLogs, 2, scopeLogs)
+
+	return appendMessageField(nil, 1, resourceLogs)
+}
@@ -0,0 +1,130 @@
+// Package plugin lets other packages add inputs, outputs and transforms to
+// syslogd. A plugin registers its types from an init function, and is
+// compiled in by a blank import in syslogd/plugins.go:
+//
+//	import _ "example.com/siem/syslogd-output"
+//
+// The types are then used in the syslogd configuration like the built-in
+// ones, with the options of the plugin under options.
+//
+// Plugins see the messages as Message, which does not follow the
+// server.Message of syslogd as it grows with its features.
+package plugin
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MessageVersion is the version of Message. Within a version fields are
+// only added; removing or changing one makes a new version, with new
+// interfaces for plugins built against the old ones to keep working.
+const MessageVersion = 1
+
+// Message is a syslog message as plugins see it. It is also the JSON
+// object of a message that sidecar plugins exchange with syslogd.
+type Message struct {
+	Time           time.Time                    `json:"time"`                  // of reception
+	Source         string                       `json:"source,omitempty"`      // address of the sender, not set by inputs
+	SourceHost     string                       `json:"source_host,omitempty"` // name of the sender by reverse DNS
+	Facility       string                       `json:"facility"`              // kern to local7, user by default
+	Severity       string                       `json:"severity"`              // emerg to debug, notice by default
+	Timestamp      time.Time                    `json:"timestamp,omitzero"`    // as reported by the sender
+	Hostname       string                       `json:"hostname,omitempty"`
+	Tag            string                       `json:"tag,omitempty"` // RFC 3164
+	Content        string                       `json:"content"`
+	Version        int                          `json:"version,omitempty"` // 1 for RFC 5424
+	AppName        string                       `json:"app_name,omitempty"`
+	ProcID         string                       `json:"proc_id,omitempty"`
+	MsgID          string                       `json:"msg_id,omitempty"`
+	TraceID        string                       `json:"trace_id,omitempty"`
+	SpanID         string                       `json:"span_id,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Raw            string                       `json:"raw"` // as received, the content by default
+}
+
+// Options are the options of a plugin in the configuration.
+type Options map[string]string
+
+// Output is a destination that routing rules send messages to. Write is
+// not called concurrently.
+type Output interface {
+	Write(*Message) error
+	Close() error
+}
+
+// Input produces messages besides the listeners of syslogd. Start must not
+// block; the input then calls deliver for every message until Close
+// returns.
+type Input interface {
+	Start(deliver func(*Message)) error
+	Close() error
+}
+
+// Transform changes the messages before they are routed. It returns the
+// message to route, m itself changed or another, or nil to drop it.
+// Transform is called concurrently.
+type Transform interface {
+	Transform(m *Message) *Message
+}
+
+type (
+	OutputFactory    func(name string, o Options) (Output, error)
+	InputFactory     func(name string, o Options) (Input, error)
+	TransformFactory func(o Options) (Transform, error)
+)
+
+var (
+	mu         sync.RWMutex
+	outputs    = make(map[string]OutputFactory)
+	inputs     = make(map[string]InputFactory)
+	transforms = make(map[string]TransformFactory)
+)
+
+// RegisterOutput makes the output type typ available. It panics if the
+// type is registered twice.
+func RegisterOutput(typ string, f OutputFactory) {
+	register(outputs, "output", typ, f)
+}
+
+// RegisterInput makes the input type typ available.
+func RegisterInput(typ string, f InputFactory) {
+	register(inputs, "input", typ, f)
+}
+
+// RegisterTransform makes the transform type typ available.
+func RegisterTransform(typ string, f TransformFactory) {
+	register(transforms, "transform", typ, f)
+}
+
+func register[F any](m map[string]F, kind, typ string, f F) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := m[typ]; ok {
+		panic(fmt.Sprintf("plugin: %s type %q registered twice", kind, typ))
+	}
+	m[typ] = f
+}
+
+// LookupOutput returns the factory of the output type typ.
+func LookupOutput(typ string) (OutputFactory, bool) {
+	return lookup(outputs, typ)
+}
+
+// LookupInput returns the factory of the input type typ.
+func LookupInput(typ string) (InputFactory, bool) {
+	return lookup(inputs, typ)
+}
+
+// LookupTransform returns the factory of the transform type typ.
+func LookupTransform(typ string) (TransformFactory, bool) {
+	return lookup(transforms, typ)
+}
+
+func lookup[F any](m map[string]F, typ string) (F, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	f, ok := m[typ]
+	return f, ok
+}
@@ -0,0 +1,374 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/dtls/v3"
+	"github.com/pion/transport/v3/deadline"
+)
+
+// DTLS (RFC 6012) sessions share the UDP socket of their listener: its
+// datagrams are passed to the session of their sender, which pion/dtls
+// runs as over a socket of its own.
+const (
+	dtlsHandshakeTimeout = 30 * time.Second
+	dtlsDefaultSessions  = 10000
+	dtlsDefaultIdle      = time.Hour
+	dtlsMaxRecord        = 16 * 1024 // of the data of a record
+	dtlsQueue            = 64        // datagrams waiting for their session
+
+	recordHandshake = 22
+	hsClientHello   = 1
+)
+
+// dtlsServer passes the datagrams of a UDP socket to the sessions of their
+// senders, starting one for the handshake of a new sender.
+type dtlsServer struct {
+	s      *Server
+	conn   net.PacketConn
+	config *tls.Config
+	ln     *listener
+
+	mu       sync.Mutex
+	sessions map[string]*dtlsSocket
+}
+
+// dtlsSocket is the socket of a session: the datagrams of its client on
+// the socket of the listener.
+type dtlsSocket struct {
+	d           *dtlsServer
+	addr        net.Addr
+	in          chan []byte
+	deadline    *deadline.Deadline
+	closed      chan struct{}
+	once        sync.Once
+	established atomic.Bool
+}
+
+// ListenDTLS receives syslog messages over DTLS (RFC 6012) on the UDP
+// address addr. The certificates, client authentication and verification
+// callbacks of config are used as by a TLS listener.
+func (s *Server) ListenDTLS(addr string, config *tls.Config, opts ...ListenOption) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.ServeDTLS(conn, config, opts...)
+	return nil
+}
+
+// ServeDTLS receives syslog messages over DTLS on conn, a socket opened
+// elsewhere.
+func (s *Server) ServeDTLS(conn net.PacketConn, config *tls.Config, opts ...ListenOption) {
+	d := &dtlsServer{
+		s:        s,
+		conn:     conn,
+		config:   config,
+		ln:       newListener(opts),
+		sessions: make(map[string]*dtlsSocket),
+	}
+	if d.ln.limits.MaxConns <= 0 {
+		d.ln.limits.MaxConns = dtlsDefaultSessions
+	}
+
+	s.mu.Lock()
+	s.packets = append(s.packets, conn)
+	s.bound = append(s.bound, conn.LocalAddr())
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go d.serve()
+}
+
+func (d *dtlsServer) serve() {
+	defer d.s.wg.Done()
+
+	buf := make([]byte, MaxMessageSize)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				d.s.logger.Print(err)
+			}
+			return
+		}
+		if n == 0 || !d.ln.permits(addr) {
+			continue
+		}
+		d.receive(bytes.Clone(buf[:n]), addr)
+	}
+}
+
+// receive passes a datagram to the session of its sender. A ClientHello
+// starts a session, replacing an established one of a client that
+// started over.
+func (d *dtlsServer) receive(data []byte, addr net.Addr) {
+	hello := len(data) > 13 && data[0] == recordHandshake && data[3] == 0 && data[4] == 0 && data[13] == hsClientHello
+
+	d.mu.Lock()
+	sock := d.sessions[addr.String()]
+	if sock != nil && hello && sock.established.Load() {
+		d.mu.Unlock()
+		sock.Close()
+		d.mu.Lock()
+		sock = d.sessions[addr.String()]
+	}
+	start := false
+	if sock == nil {
+		if !hello || !d.ln.acquire() {
+			d.mu.Unlock()
+			return
+		}
+		sock = &dtlsSocket{
+			d:        d,
+			addr:     addr,
+			in:       make(chan []byte, dtlsQueue),
+			deadline: deadline.New(),
+			closed:   make(chan struct{}),
+		}
+		d.sessions[addr.String()] = sock
+		start = true
+	}
+	d.mu.Unlock()
+
+	select {
+	case sock.in <- data:
+	default:
+		// Lost, as by the network.
+	}
+	if start {
+		d.s.wg.Add(1)
+		go d.session(sock)
+	}
+}
+
+// session runs the session of sock until it ends, is idle for too long or
+// the server shuts down.
+func (d *dtlsServer) session(sock *dtlsSocket) {
+	defer d.s.wg.Done()
+
+	var peer *Peer
+	config, err := d.sessionConfig(&peer)
+	var conn *dtls.Conn
+	if err == nil {
+		conn, err = dtls.Server(sock, sock.addr, config)
+	}
+	if err != nil {
+		sock.Close()
+		d.s.logger.Printf("%s: dtls: %v", sock.addr, err)
+		return
+	}
+
+	d.s.mu.Lock()
+	if d.s.shutdown {
+		d.s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	d.s.conns[conn] = struct{}{}
+	d.s.mu.Unlock()
+	defer func() {
+		d.s.mu.Lock()
+		delete(d.s.conns, conn)
+		d.s.mu.Unlock()
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+	err = conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		d.s.logger.Printf("%s: dtls: %v", sock.addr, err)
+		if d.ln.handshakeFailed != nil {
+			d.ln.handshakeFailed(sock.addr, err)
+		}
+		return
+	}
+	sock.established.Store(true)
+
+	idle := d.ln.limits.IdleTimeout
+	if idle <= 0 {
+		idle = dtlsDefaultIdle
+	}
+	var bucket tokenBucket
+	buf := make([]byte, max(dtlsMaxRecord, MaxMessageSize))
+	for {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) && !isTimeout(err) {
+				d.s.logger.Printf("%s: dtls: %v", sock.addr, err)
+			}
+			return
+		}
+		d.applicationData(buf[:n], sock.addr, peer, &bucket)
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// applicationData handles the syslog messages of a record, framed as over
+// TCP.
+func (d *dtlsServer) applicationData(data []byte, addr net.Addr, peer *Peer, bucket *tokenBucket) {
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		frame, size, err := readFrame(r, d.ln.maxSize())
+		if err != nil {
+			return
+		}
+		if size == 0 {
+			continue
+		}
+		if !bucket.allow(d.ln.limits.Rate, time.Now()) || d.ln.full() {
+			d.ln.drop()
+			continue
+		}
+		d.s.handle(frame, size, addr, peer, d.ln)
+	}
+}
+
+// sessionConfig returns the DTLS configuration of a session from the TLS
+// configuration of the listener, setting *peer to the identity of the
+// client once the handshake has verified it.
+func (d *dtlsServer) sessionConfig(peer **Peer) (*dtls.Config, error) {
+	config := d.config
+	if config.GetConfigForClient != nil {
+		c, err := config.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			config = c
+		}
+	}
+
+	var chains [][]*x509.Certificate
+	dc := &dtls.Config{
+		Certificates: config.Certificates,
+		ClientAuth:   dtls.ClientAuthType(config.ClientAuth), // of the same values
+		ClientCAs:    config.ClientCAs,
+		VerifyPeerCertificate: func(raw [][]byte, verified [][]*x509.Certificate) error {
+			chains = verified
+			if config.VerifyPeerCertificate != nil {
+				return config.VerifyPeerCertificate(raw, verified)
+			}
+			return nil
+		},
+		VerifyConnection: func(st *dtls.State) error {
+			cs := tls.ConnectionState{
+				Version:           tls.VersionTLS12,
+				HandshakeComplete: true,
+				CipherSuite:       uint16(st.CipherSuiteID),
+				VerifiedChains:    chains,
+			}
+			for _, der := range st.PeerCertificates {
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return err
+				}
+				cs.PeerCertificates = append(cs.PeerCertificates, cert)
+			}
+			if config.VerifyConnection != nil {
+				if err := config.VerifyConnection(cs); err != nil {
+					return err
+				}
+			}
+			*peer = tlsPeer(cs)
+			return nil
+		},
+	}
+	if config.GetCertificate != nil {
+		dc.GetCertificate = func(hello *dtls.ClientHelloInfo) (*tls.Certificate, error) {
+			return config.GetCertificate(&tls.ClientHelloInfo{ServerName: hello.ServerName})
+		}
+	}
+	return dc, nil
+}
+
+// tokenBucket limits the messages of a session to a rate a second.
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// allow takes a token from the bucket, of rate messages a second.
+func (b *tokenBucket) allow(rate float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	burst := max(rate, 1)
+	if b.at.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.at).Seconds()*rate, burst)
+	}
+	b.at = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (sock *dtlsSocket) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case data := <-sock.in:
+		return copy(p, data), sock.addr, nil
+	case <-sock.deadline.Done():
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-sock.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (sock *dtlsSocket) WriteTo(p []byte, _ net.Addr) (int, error) {
+	select {
+	case <-sock.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return sock.d.conn.WriteTo(p, sock.addr)
+}
+
+// Close ends the session, for the next datagrams of its client to start
+// another.
+func (sock *dtlsSocket) Close() error {
+	sock.once.Do(func() {
+		close(sock.closed)
+		d := sock.d
+		d.mu.Lock()
+		if d.sessions[sock.addr.String()] == sock {
+			delete(d.sessions, sock.addr.String())
+		}
+		d.mu.Unlock()
+		d.ln.release()
+	})
+	return nil
+}
+
+func (sock *dtlsSocket) LocalAddr() net.Addr { return sock.d.conn.LocalAddr() }
+
+func (sock *dtlsSocket) SetDeadline(t time.Time) error {
+	return sock.SetReadDeadline(t)
+}
+
+func (sock *dtlsSocket) SetReadDeadline(t time.Time) error {
+	sock.deadline.Set(t)
+	return nil
+}
+
+func (sock *dtlsSocket) SetWriteDeadline(time.Time) error { return nil }
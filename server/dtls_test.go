@@ -0,0 +1,306 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+// dtlsTestCert returns a certificate of key for name issued by ca, or a
+// self-signed CA certificate without ca.
+func dtlsTestCert(t *testing.T, name string, key crypto.Signer, ca *tls.Certificate) tls.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{name}
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		parent, signer = ca.Leaf, ca.PrivateKey.(crypto.Signer)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func dtlsTestKey(t *testing.T, kind string) crypto.Signer {
+	t.Helper()
+	var key crypto.Signer
+	var err error
+	switch kind {
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// chanHandler passes the messages handled to a channel.
+type chanHandler chan *Message
+
+func (h chanHandler) Handle(m *Message) *Message {
+	h <- m
+	return m
+}
+
+func TestDTLSHandshake(t *testing.T) {
+	caKey := dtlsTestKey(t, "ecdsa")
+	ca := dtlsTestCert(t, "ca", caKey, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	tests := []struct {
+		name       string
+		key        string
+		clientCert bool
+		mtu        int
+	}{
+		{name: "ecdsa", key: "ecdsa"},
+		{name: "rsa", key: "rsa"},
+		{name: "ed25519", key: "ed25519"},
+		// The client sends its certificate in fragments of a small MTU.
+		{name: "client certificate", key: "ecdsa", clientCert: true, mtu: 256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &tls.Config{
+				Certificates: []tls.Certificate{dtlsTestCert(t, "localhost", dtlsTestKey(t, tt.key), &ca)},
+			}
+			if tt.clientCert {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = roots
+			}
+
+			h := make(chanHandler, 1)
+			srv := NewServer()
+			srv.SetLogger(log.New(io.Discard, "", 0))
+			srv.AddHandler(h)
+			if err := srv.ListenDTLS("127.0.0.1:0", config); err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Shutdown()
+
+			client := &dtls.Config{
+				RootCAs:              roots,
+				ServerName:           "localhost",
+				ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+				MTU:                  tt.mtu,
+			}
+			if tt.clientCert {
+				client.Certificates = []tls.Certificate{dtlsTestCert(t, "client", dtlsTestKey(t, "ecdsa"), &ca)}
+			}
+			conn, err := dtls.Dial("udp", srv.Addrs()[0].(*net.UDPAddr), client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := conn.HandshakeContext(ctx); err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+
+			msg := "<13>1 2024-01-02T03:04:05Z host app - - - hello"
+			if _, err := fmt.Fprintf(conn, "%d %s", len(msg), msg); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case m := <-h:
+				if m.Content != "hello" {
+					t.Errorf("content = %q, want hello", m.Content)
+				}
+				if tt.clientCert && (m.Peer == nil || m.Peer.CommonName != "client") {
+					t.Errorf("peer = %+v, want client", m.Peer)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no message received")
+			}
+		})
+	}
+}
+
+// dtlsTestServer returns a server listening for DTLS with a certificate
+// of ca, its messages passed to h.
+func dtlsTestServer(t *testing.T, ca *tls.Certificate, h Handler, opts ...ListenOption) *Server {
+	t.Helper()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{dtlsTestCert(t, "localhost", dtlsTestKey(t, "ecdsa"), ca)},
+	}
+	srv := NewServer()
+	srv.SetLogger(log.New(io.Discard, "", 0))
+	srv.AddHandler(h)
+	if err := srv.ListenDTLS("127.0.0.1:0", config, opts...); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+// silentConn is a client socket that can stop sending, as a client that
+// is gone.
+type silentConn struct {
+	net.PacketConn
+	silent atomic.Bool
+}
+
+func (c *silentConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.silent.Load() {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// dtlsTestClient sends msg over a session with the server from pc.
+func dtlsTestClient(t *testing.T, srv *Server, pc net.PacketConn, roots *x509.CertPool, msg string) *dtls.Conn {
+	t.Helper()
+	conn, err := dtls.Client(pc, srv.Addrs()[0], &dtls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if _, err := fmt.Fprintf(conn, "%d %s", len(msg), msg); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func receive(t *testing.T, h chanHandler) *Message {
+	t.Helper()
+	select {
+	case m := <-h:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestDTLSRestart(t *testing.T) {
+	ca := dtlsTestCert(t, "ca", dtlsTestKey(t, "ecdsa"), nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	h := make(chanHandler, 1)
+	srv := dtlsTestServer(t, &ca, h)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &silentConn{PacketConn: pc}
+	conn := dtlsTestClient(t, srv, sc, roots, "<13>1 - host app - - - first")
+	receive(t, h)
+
+	// The client restarts from the same port without ending its session.
+	sc.silent.Store(true)
+	conn.Close()
+	pc, err = net.ListenPacket("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = dtlsTestClient(t, srv, pc, roots, "<13>1 - host app - - - second")
+	defer conn.Close()
+	if m := receive(t, h); m.Content != "second" {
+		t.Errorf("content = %q, want second", m.Content)
+	}
+}
+
+func TestDTLSLimits(t *testing.T) {
+	ca := dtlsTestCert(t, "ca", dtlsTestKey(t, "ecdsa"), nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	h := make(chanHandler, 1)
+	failed := make(chan error, 1)
+	var st Stats
+	srv := dtlsTestServer(t, &ca, h,
+		WithLimits(Limits{MaxConns: 1}),
+		WithHandshakeError(func(_ net.Addr, err error) { failed <- err }),
+		WithStats(&st))
+
+	// A client that does not trust the server fails its handshake.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dtls.Client(pc, srv.Addrs()[0], &dtls.Config{RootCAs: x509.NewCertPool(), ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err == nil {
+		t.Fatal("handshake with an unknown server succeeded")
+	}
+	conn.Close()
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake error not reported")
+	}
+
+	// Another session than the one allowed is not started.
+	pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = dtlsTestClient(t, srv, pc, roots, "<13>1 - host app - - - hello")
+	defer conn.Close()
+	receive(t, h)
+	pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := dtls.Client(pc, srv.Addrs()[0], &dtls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := other.HandshakeContext(ctx); err == nil {
+		t.Error("handshake beyond the sessions allowed succeeded")
+	}
+	if n := st.Rejected.Load(); n == 0 {
+		t.Error("session not counted as rejected")
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReadFrame reads one message from a stream using octet-counting framing
+// when the frame starts with a digit, and non-transparent framing
+// terminated by LF (RFC 6587) or NUL (as syslog(3) writes to stream
+// sockets) otherwise.
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	frame, _, err := readFrame(r, MaxMessageSize)
+	return frame, err
+}
+
+// readFrame is ReadFrame keeping the first limit bytes of a longer
+// message, and also returns the size of the whole message.
+func readFrame(r *bufio.Reader, limit int) ([]byte, int, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if b[0] >= '1' && b[0] <= '9' {
+		digits, err := r.ReadString(' ')
+		if err != nil {
+			return nil, 0, err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(digits, " "))
+		if err != nil || n > MaxMessageSize {
+			return nil, 0, fmt.Errorf("invalid octet count %q", digits)
+		}
+
+		frame := make([]byte, min(n, limit))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, 0, err
+		}
+		if _, err := r.Discard(n - len(frame)); err != nil {
+			return nil, 0, err
+		}
+		return frame, n, nil
+	}
+
+	var frame []byte
+	size := 0
+	for {
+		n := r.Buffered()
+		if n == 0 {
+			if _, err := r.Peek(1); err != nil {
+				if err == io.EOF && size > 0 {
+					return frame, size, nil
+				}
+				return nil, 0, err
+			}
+			n = r.Buffered()
+		}
+
+		buf, _ := r.Peek(n)
+		i := bytes.IndexAny(buf, "\n\x00")
+		if i >= 0 {
+			buf = buf[:i]
+		}
+		frame = append(frame, buf[:min(len(buf), limit-len(frame))]...)
+		size += len(buf)
+
+		if i >= 0 {
+			r.Discard(i + 1)
+			if size == len(frame) {
+				frame = bytes.TrimSuffix(frame, []byte("\r"))
+				size = len(frame)
+			}
+			return frame, size, nil
+		}
+		r.Discard(n)
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GELFSDID is the SD-ID of the fields of GELF messages besides the host,
+// the short message, the timestamp and the level.
+const GELFSDID = "gelf@32473"
+
+const (
+	gelfChunkMagic   = "\x1e\x0f"
+	gelfChunkHeader  = 12
+	gelfMaxChunks    = 128
+	gelfChunkTimeout = 5 * time.Second
+	gelfMaxPending   = 1024 // messages being reassembled
+)
+
+// WithGELF makes a UDP or TCP listener receive GELF (the Graylog Extended
+// Log Format) messages, as sent by the gelf log driver of Docker, instead
+// of syslog messages. Datagrams may be chunked and compressed with gzip or
+// zlib; over TCP, messages end with a NUL byte.
+//
+// The host, short_message, timestamp and level of a message become its
+// hostname, content, timestamp and severity, _tag or else facility its tag,
+// and the other fields, the additional ones without their leading
+// underscore, params of gelf@32473.
+func WithGELF() ListenOption {
+	return func(l *listener) {
+		l.gelf = &gelfChunks{pending: make(map[gelfKey]*gelfMessage)}
+	}
+}
+
+type gelfKey struct {
+	src string
+	id  [8]byte
+}
+
+type gelfMessage struct {
+	chunks   [][]byte
+	received int
+	size     int
+	first    time.Time
+}
+
+// gelfChunks reassembles chunked datagrams.
+type gelfChunks struct {
+	mu      sync.Mutex
+	pending map[gelfKey]*gelfMessage
+	swept   time.Time
+}
+
+// reassemble returns data if it is not a chunk, the whole message if data
+// is its last missing chunk, or else nil.
+func (g *gelfChunks) reassemble(data []byte, src net.Addr) []byte {
+	if len(data) < 2 || string(data[:2]) != gelfChunkMagic {
+		return data
+	}
+	if len(data) <= gelfChunkHeader {
+		return nil
+	}
+	seq, count := int(data[10]), int(data[11])
+	if count == 0 || count > gelfMaxChunks || seq >= count {
+		return nil
+	}
+	key := gelfKey{}
+	if src != nil {
+		key.src = src.String()
+	}
+	copy(key.id[:], data[2:10])
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if now.Sub(g.swept) >= time.Second || len(g.pending) >= gelfMaxPending {
+		g.sweep(now)
+	}
+	m := g.pending[key]
+	if m == nil {
+		if len(g.pending) >= gelfMaxPending {
+			return nil
+		}
+		m = &gelfMessage{chunks: make([][]byte, count), first: now}
+		g.pending[key] = m
+	}
+	if len(m.chunks) != count || m.chunks[seq] != nil {
+		return nil
+	}
+	// Compressed or not, a message is at most MaxMessageSize bytes.
+	if m.size += len(data) - gelfChunkHeader; m.size > MaxMessageSize {
+		delete(g.pending, key)
+		return nil
+	}
+	m.chunks[seq] = append([]byte(nil), data[gelfChunkHeader:]...)
+	m.received++
+	if m.received < count {
+		return nil
+	}
+	delete(g.pending, key)
+	return bytes.Join(m.chunks, nil)
+}
+
+// sweep drops the messages whose chunks did not all arrive in time.
+func (g *gelfChunks) sweep(now time.Time) {
+	for key, m := range g.pending {
+		if now.Sub(m.first) > gelfChunkTimeout {
+			delete(g.pending, key)
+		}
+	}
+	g.swept = now
+}
+
+// decodeGELF decodes a GELF message, uncompressing it if need be. Like
+// Parse, it returns the data in Content if it is not valid, and reports
+// whether it was.
+func decodeGELF(data []byte, src net.Addr) (*Message, bool) {
+	m := &Message{
+		Time:     time.Now(),
+		Source:   src,
+		Facility: User,
+		Severity: Alert, // the default level of GELF
+	}
+
+	data, err := gelfUncompress(data)
+	data = bytes.TrimRight(data, "\r\n\x00")
+	m.Raw = string(data)
+	var fields map[string]interface{}
+	if err == nil {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		err = d.Decode(&fields)
+	}
+	if err != nil || fields == nil {
+		m.Content = m.Raw
+		m.NormalizeTime()
+		return m, false
+	}
+
+	sd := make(map[string]string)
+	for name, v := range fields {
+		value := gelfString(v)
+		switch name {
+		case "version", "_id":
+		case "host":
+			m.Hostname = value
+		case "short_message":
+			m.Content = value
+		case "timestamp":
+			if f, err := strconv.ParseFloat(value, 64); err == nil && f > 0 {
+				sec, frac := math.Modf(f)
+				m.Timestamp = time.Unix(int64(sec), int64(math.Round(frac*1e6))*1e3)
+			}
+		case "level":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 && n <= int(Debug) {
+				m.Severity = Severity(n)
+			}
+		default:
+			if value != "" {
+				sd[strings.TrimPrefix(name, "_")] = value
+			}
+		}
+	}
+	if m.Content == "" {
+		m.Content = sd["full_message"]
+	}
+	if m.Tag = sd["tag"]; m.Tag == "" {
+		m.Tag = sd["facility"]
+	}
+	if len(sd) > 0 {
+		m.StructuredData = map[string]map[string]string{GELFSDID: sd}
+	}
+	m.NormalizeTime()
+	return m, true
+}
+
+// gelfUncompress uncompresses a message compressed with gzip or zlib, up
+// to MaxMessageSize bytes.
+func gelfUncompress(data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch {
+	case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case len(data) >= 2 && data[0]&0x0f == 8 && (int(data[0])<<8|int(data[1]))%31 == 0:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return data, err
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, MaxMessageSize+1))
+	if err == nil && len(out) > MaxMessageSize {
+		err = errors.New("gelf: message too large")
+	}
+	return out, err
+}
+
+// gelfString returns a field value as a string, numbers as they were sent.
+func gelfString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+// Handler processes messages received by a Server. Handle returns the
+// message to pass it on to the next handler, or nil to consume it. After
+// the server is shut down every handler receives a nil message.
+type Handler interface {
+	Handle(*Message) *Message
+}
+
+// BaseHandler queues the messages accepted by its filter for processing in
+// another goroutine.
+type BaseHandler struct {
+	queue  *Queue[*Message]
+	end    chan struct{}
+	filter func(*Message) bool
+	ft     bool
+}
+
+// NewBaseHandler returns a handler with a queue of length qlen. A nil
+// filter accepts every message. If ft (fall through) is set, accepted
+// messages are also passed on to the next handler.
+func NewBaseHandler(qlen int, filter func(*Message) bool, ft bool) *BaseHandler {
+	return &BaseHandler{
+		queue:  NewQueue(qlen, messageSeverity),
+		end:    make(chan struct{}),
+		filter: filter,
+		ft:     ft,
+	}
+}
+
+func messageSeverity(m *Message) Severity {
+	return m.Severity
+}
+
+// SetPolicy sets the policy of the queue, DropNewest by default. It must
+// not be called after the server started listening.
+func (h *BaseHandler) SetPolicy(p Policy, keep Severity) {
+	h.queue.SetPolicy(p, keep)
+}
+
+// Handle queues m if it matches the filter, applying the policy of the
+// queue if it is full.
+func (h *BaseHandler) Handle(m *Message) *Message {
+	if m == nil {
+		h.queue.Close()
+		<-h.end
+		return nil
+	}
+	if h.filter != nil && !h.filter(m) {
+		return m
+	}
+
+	h.queue.Put(m)
+
+	if h.ft {
+		return m
+	}
+	return nil
+}
+
+// Dropped returns the number of messages with severity sev dropped for a
+// full queue.
+func (h *BaseHandler) Dropped(sev Severity) uint64 {
+	return h.queue.Dropped(sev)
+}
+
+// Len returns the number of queued messages.
+func (h *BaseHandler) Len() int {
+	return h.queue.Len()
+}
+
+// Cap returns the length of the queue.
+func (h *BaseHandler) Cap() int {
+	return h.queue.Cap()
+}
+
+// Get returns the next queued message, or nil after shutdown.
+func (h *BaseHandler) Get() *Message {
+	m, ok := <-h.queue.C()
+	if !ok {
+		return nil
+	}
+	return m
+}
+
+// Queue returns the queue of accepted messages.
+func (h *BaseHandler) Queue() <-chan *Message {
+	return h.queue.C()
+}
+
+// End must be called by the goroutine processing the queue once Get has
+// returned nil, to let the server finish its shutdown.
+func (h *BaseHandler) End() {
+	close(h.end)
+}
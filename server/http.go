@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// MaxHTTPBody is the largest request body of an HTTP listener.
+const MaxHTTPBody = 16 << 20
+
+// HTTPConfig configures a listener accepting messages POSTed over HTTP.
+type HTTPConfig struct {
+	// Authorize checks the credentials of a request. Every request is
+	// accepted when it is nil.
+	Authorize func(*http.Request) bool
+
+	// DecodeJSON decodes a message sent as a JSON object. JSON bodies
+	// are refused when it is nil.
+	DecodeJSON func([]byte) (*Message, error)
+
+	// Ready, if not nil, makes requests be answered with 503 while it
+	// returns false, for the senders to retry once syslogd caught up.
+	Ready func() bool
+}
+
+// WithHTTP makes a TCP listener accept messages POSTed over HTTP instead
+// of syslog frames. A request body is
+//
+//   - a JSON object with the content type application/json,
+//   - JSON objects, one per line, with application/x-ndjson,
+//   - or else syslog messages framed as over TCP, one per line or octet
+//     counted, such as a single RFC 5424 message.
+//
+// The messages of a request are handled once all of them were read, and
+// the request answered with 204, or with 400 and none of them handled if
+// one is malformed, or 413 if a JSON object is longer than the maximum
+// message size of the listener.
+func WithHTTP(c HTTPConfig) ListenOption {
+	return func(l *listener) {
+		l.http = &c
+	}
+}
+
+// permitListener closes the connections the ACLs or MaxConns of a
+// listener refuse.
+type permitListener struct {
+	net.Listener
+	ln *listener
+}
+
+func (l permitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.ln.permits(conn.RemoteAddr()) && l.ln.acquire() {
+			return conn, err
+		}
+		conn.Close()
+	}
+}
+
+func (s *Server) serveHTTP(l net.Listener, ln *listener) {
+	defer s.wg.Done()
+
+	hs := &http.Server{
+		Handler:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { s.handleHTTP(w, r, ln) }),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       ln.limits.ReadTimeout,
+		IdleTimeout:       2 * time.Minute,
+		ErrorLog:          s.logger,
+		// Track the connections for Shutdown to close them.
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			switch state {
+			case http.StateNew:
+				if s.shutdown {
+					conn.Close()
+					return
+				}
+				s.conns[conn] = struct{}{}
+			case http.StateClosed, http.StateHijacked:
+				delete(s.conns, conn)
+				ln.release()
+			}
+		},
+	}
+	if ln.limits.IdleTimeout > 0 {
+		hs.IdleTimeout = ln.limits.IdleTimeout
+	}
+	var hl net.Listener = permitListener{l, ln}
+	if ln.handshakeFailed != nil {
+		hl = s.newHandshakeListener(hl, ln)
+	}
+	if err := hs.Serve(hl); !errors.Is(err, net.ErrClosed) {
+		s.logger.Print(err)
+	}
+}
+
+// handshakeListener hands the TLS connections of an HTTP listener on once
+// their handshake completed, which the http.Server would otherwise do
+// without reporting the failures.
+type handshakeListener struct {
+	net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	err   error
+}
+
+func (s *Server) newHandshakeListener(l net.Listener, ln *listener) *handshakeListener {
+	hl := &handshakeListener{Listener: l, conns: make(chan net.Conn), done: make(chan struct{})}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				hl.err = err
+				close(hl.done)
+				return
+			}
+			go hl.handshake(s, conn, ln)
+		}
+	}()
+	return hl
+}
+
+func (hl *handshakeListener) handshake(s *Server, conn net.Conn, ln *listener) {
+	// Shutdown closes the connections still in their handshake.
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		conn.Close()
+		ln.release()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	_, err := ln.handshake(conn)
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+
+	if err == nil {
+		select {
+		case hl.conns <- conn:
+			return
+		case <-hl.done:
+		}
+	} else {
+		s.logger.Printf("%s: %v", conn.RemoteAddr(), err)
+	}
+	conn.Close()
+	ln.release()
+}
+
+func (hl *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-hl.conns:
+		return conn, nil
+	case <-hl.done:
+		return nil, hl.err
+	}
+}
+
+func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request, ln *listener) {
+	c := ln.http
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.Authorize != nil && !c.Authorize(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if c.Ready != nil && !c.Ready() || ln.full() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+
+	var src net.Addr
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		src = net.TCPAddrFromAddrPort(ap)
+	}
+	var peer *Peer
+	if r.TLS != nil {
+		peer = tlsPeer(*r.TLS)
+	}
+
+	body := http.MaxBytesReader(w, r.Body, MaxHTTPBody)
+	typ, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch typ {
+	case "application/json", "application/x-ndjson":
+		if c.DecodeJSON == nil {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var lines [][]byte
+		var err error
+		if typ == "application/json" {
+			var data []byte
+			if data, err = io.ReadAll(body); err == nil {
+				lines = [][]byte{data}
+			}
+		} else {
+			lines, err = readLines(body)
+		}
+		if err != nil {
+			httpBodyError(w, err)
+			return
+		}
+
+		msgs := make([]*Message, 0, len(lines))
+		for i, line := range lines {
+			if len(line) > ln.maxSize() {
+				if ln.stats != nil {
+					ln.stats.Oversize.Add(1)
+				}
+				http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			m, err := c.DecodeJSON(line)
+			if err != nil {
+				if typ == "application/json" {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				} else {
+					http.Error(w, fmt.Sprintf("line %d: %v", i+1, err), http.StatusBadRequest)
+				}
+				return
+			}
+			m.Source, m.Peer, m.Listener = src, peer, ln.name
+			msgs = append(msgs, m)
+		}
+		for i, m := range msgs {
+			ln.count(len(lines[i]), true)
+			s.dispatch(m)
+		}
+
+	default:
+		var frames [][]byte
+		var sizes []int
+		br := bufio.NewReader(body)
+		for {
+			frame, size, err := readFrame(br, ln.maxSize())
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				httpBodyError(w, err)
+				return
+			}
+			if size > 0 {
+				frames, sizes = append(frames, frame), append(sizes, size)
+			}
+		}
+		for i, frame := range frames {
+			s.handle(frame, sizes[i], src, peer, ln)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readLines returns the lines of r that are not blank.
+func readLines(r io.Reader) ([][]byte, error) {
+	var lines [][]byte
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 4096), MaxMessageSize)
+	for sc.Scan() {
+		if line := bytes.TrimSpace(sc.Bytes()); len(line) > 0 {
+			lines = append(lines, append([]byte(nil), line...))
+		}
+	}
+	return lines, sc.Err()
+}
+
+func httpBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+type Facility byte
+
+const (
+	Kern Facility = iota
+	User
+	Mail
+	Daemon
+	Auth
+	Syslog
+	Lpr
+	News
+	Uucp
+	Cron
+	Authpriv
+	Ftp
+	Ntp
+	Security
+	Console
+	SolarisCron
+	Local0
+	Local1
+	Local2
+	Local3
+	Local4
+	Local5
+	Local6
+	Local7
+)
+
+var facilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+func (f Facility) String() string {
+	if int(f) < len(facilityNames) {
+		return facilityNames[f]
+	}
+	return fmt.Sprintf("facility(%d)", byte(f))
+}
+
+type Severity byte
+
+const (
+	Emerg Severity = iota
+	Alert
+	Crit
+	Err
+	Warning
+	Notice
+	Info
+	Debug
+)
+
+var severityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+func (s Severity) String() string {
+	if int(s) < len(severityNames) {
+		return severityNames[s]
+	}
+	return fmt.Sprintf("severity(%d)", byte(s))
+}
+
+// Message is a received syslog message.
+type Message struct {
+	Time     time.Time // time of reception, in UTC
+	Source   net.Addr  // address of the sender
+	FromHost string    // name of the sender by reverse DNS, if resolved
+	Facility
+	Severity
+	Timestamp time.Time      // optional, as reported by the sender, in UTC
+	Zone      *time.Location // of the Timestamp as reported, nil without one
+	Hostname  string         // optional
+	Tag       string         // message tag as defined in RFC 3164
+	Content   string         // message content as defined in RFC 3164
+	Tag1      string         // alternate message tag (white space as separator)
+	Content1  string         // alternate message content (white space as separator)
+
+	// RFC 5424 fields, left empty for RFC 3164 messages.
+	Version        int
+	AppName        string
+	ProcID         string
+	MsgID          string
+	StructuredData map[string]map[string]string // SD-ID -> PARAM-NAME -> PARAM-VALUE
+
+	// W3C trace context of the message, in lowercase hex, if it carries one.
+	TraceID string // 32 digits
+	SpanID  string // 16 digits
+
+	Raw string // the message as received, without trailing newline
+
+	Peer     *Peer  // the verified client certificate of a TLS sender, if any
+	Listener string // the name of the listener that received it, see WithName
+}
+
+// Peer is the identity of a TLS sender by its client certificate.
+type Peer struct {
+	CommonName string
+	SANs       []string // DNS names, IP addresses, emails and URIs
+}
+
+// NormalizeTime converts the times of m to UTC, recording the zone the
+// sender reported its timestamp in, so that messages from senders in
+// different zones sort by their times.
+func (m *Message) NormalizeTime() {
+	m.Time = m.Time.UTC()
+	if !m.Timestamp.IsZero() && m.Zone == nil {
+		m.Zone = m.Timestamp.Location()
+		m.Timestamp = m.Timestamp.UTC()
+	}
+}
+
+// ReportedTimestamp returns the Timestamp in the zone the sender reported
+// it in.
+func (m *Message) ReportedTimestamp() time.Time {
+	if m.Zone == nil {
+		return m.Timestamp
+	}
+	return m.Timestamp.In(m.Zone)
+}
+
+// NetSrc returns the IP address (or socket path) of the sender.
+func (m *Message) NetSrc() string {
+	switch a := m.Source.(type) {
+	case nil:
+		return ""
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UnixAddr:
+		return a.Name
+	default:
+		return a.String()
+	}
+}
+
+func (m *Message) String() string {
+	const layout = "2006-01-02 15:04:05"
+
+	timestamp := "-"
+	if !m.Timestamp.IsZero() {
+		timestamp = m.Timestamp.Format(layout)
+	}
+
+	return fmt.Sprintf("%s %s <%s,%s> %s %s %s: %s",
+		m.Time.Format(layout), m.NetSrc(),
+		m.Facility, m.Severity,
+		timestamp, m.Hostname,
+		m.Tag, m.Content,
+	)
+}
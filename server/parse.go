@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Format is the format of the messages a Parser expects.
+type Format int
+
+const (
+	// FormatAuto takes a message for RFC 5424 if a VERSION follows its
+	// PRI, and for RFC 3164 otherwise.
+	FormatAuto Format = iota
+	FormatRFC3164
+	// FormatRFC5424 keeps the messages that are not RFC 5424 unparsed in
+	// Content, and reports them malformed.
+	FormatRFC5424
+	// FormatRaw only decodes the PRI of the messages, and keeps the rest
+	// in Content as sent.
+	FormatRaw
+)
+
+// Parser turns raw frames into messages. The zero value is a lenient
+// parser that copes with the RFC 3164 variants seen in the wild, and
+// detects RFC 5424 messages.
+type Parser struct {
+	Format Format
+
+	// Strict accepts only the canonical RFC 3164 header; messages that
+	// deviate from it are kept unparsed in Content.
+	Strict bool
+
+	// Location is the zone of timestamps that carry none. Defaults to the
+	// local zone.
+	Location *time.Location
+}
+
+var defaultParser = &Parser{}
+
+// Parse decodes a single message with the default lenient parser.
+func Parse(data []byte, src net.Addr) *Message {
+	return defaultParser.Parse(data, src)
+}
+
+// Parse decodes a single RFC 5424 or RFC 3164 message. Anything it does
+// not recognize is kept in Content, so parsing never fails.
+func (p *Parser) Parse(data []byte, src net.Addr) *Message {
+	m, _ := p.parse(data, src)
+	return m
+}
+
+// parse also reports whether the message started with a valid PRI, and
+// was of the Format of p.
+func (p *Parser) parse(data []byte, src net.Addr) (*Message, bool) {
+	m := &Message{
+		Time:     time.Now(),
+		Source:   src,
+		Facility: User,
+		Severity: Notice,
+	}
+
+	data = bytes.TrimRight(data, "\r\n\x00")
+	m.Raw = string(data)
+	rest := parsePriority(m, data)
+	ok := len(rest) < len(data)
+
+	switch p.Format {
+	case FormatRFC3164:
+		p.parseRFC3164(m, rest)
+	case FormatRFC5424:
+		if !parseRFC5424(m, rest) {
+			m.Content, m.Content1 = string(rest), string(rest)
+			ok = false
+		}
+	case FormatRaw:
+		m.Content, m.Content1 = string(rest), string(rest)
+	default:
+		if !parseRFC5424(m, rest) {
+			p.parseRFC3164(m, rest)
+		}
+	}
+	m.NormalizeTime()
+	return m, ok
+}
+
+func parsePriority(m *Message, data []byte) []byte {
+	if len(data) < 3 || data[0] != '<' {
+		return data
+	}
+
+	end := bytes.IndexByte(data[:min(len(data), 5)], '>')
+	if end < 2 {
+		return data
+	}
+	pri, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || pri > 191 {
+		return data
+	}
+
+	m.Facility = Facility(pri >> 3)
+	m.Severity = Severity(pri & 0x07)
+	return data[end+1:]
+}
+
+func splitTag(data []byte, sep byte) (string, string) {
+	i := bytes.IndexByte(data, sep)
+	if i <= 0 || i > 48 {
+		return "", string(data)
+	}
+	return string(data[:i]), string(bytes.TrimLeft(data[i+1:], " "))
+}
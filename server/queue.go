@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Policy decides what happens to a message that does not fit in a full
+// Queue.
+type Policy int
+
+const (
+	// DropNewest drops the message that does not fit.
+	DropNewest Policy = iota
+	// DropOldest drops the messages queued the longest to make room.
+	DropOldest
+	// Block waits for room, holding up the stage before the queue.
+	Block
+	// DropBySeverity drops the messages less severe than the kept
+	// severity, and makes room for the others like DropOldest.
+	DropBySeverity
+)
+
+var policyNames = []string{"drop-newest", "drop-oldest", "block", "drop-by-severity"}
+
+func (p Policy) String() string {
+	if int(p) < len(policyNames) {
+		return policyNames[p]
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// ParsePolicy returns the policy named s, drop-newest if s is empty.
+func ParsePolicy(s string) (Policy, error) {
+	if s == "" {
+		return DropNewest, nil
+	}
+	for i, name := range policyNames {
+		if s == name {
+			return Policy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown queue policy %q", s)
+}
+
+// Queue is a bounded queue between two stages, counting the messages its
+// policy drops by severity.
+type Queue[T any] struct {
+	ch       chan T
+	policy   Policy
+	keep     Severity
+	severity func(T) Severity
+	onDrop   func(T)
+	dropped  [Debug + 1]atomic.Uint64
+}
+
+// NewQueue returns a queue of length qlen taking the severity of its
+// messages from severity.
+func NewQueue[T any](qlen int, severity func(T) Severity) *Queue[T] {
+	return &Queue[T]{ch: make(chan T, qlen), severity: severity}
+}
+
+// SetPolicy sets the policy, and the least severe level DropBySeverity
+// keeps. It must not be called while messages are put in the queue.
+func (q *Queue[T]) SetPolicy(p Policy, keep Severity) {
+	q.policy, q.keep = p, keep
+}
+
+// OnDrop makes the queue call f with the messages its policy drops. It
+// must not be called while messages are put in the queue.
+func (q *Queue[T]) OnDrop(f func(T)) {
+	q.onDrop = f
+}
+
+// Put queues v, or applies the policy if the queue is full.
+func (q *Queue[T]) Put(v T) {
+	if q.policy == Block {
+		q.ch <- v
+		return
+	}
+	select {
+	case q.ch <- v:
+		return
+	default:
+	}
+
+	if sev := q.severity(v); q.policy == DropNewest || q.policy == DropBySeverity && sev > q.keep {
+		q.drop(v)
+		return
+	}
+	for {
+		select {
+		case q.ch <- v:
+			return
+		default:
+		}
+		select {
+		case old := <-q.ch:
+			q.drop(old)
+		default:
+		}
+	}
+}
+
+func (q *Queue[T]) drop(v T) {
+	q.dropped[q.severity(v)&7].Add(1)
+	if q.onDrop != nil {
+		q.onDrop(v)
+	}
+}
+
+// C returns the channel the queued messages are taken from.
+func (q *Queue[T]) C() <-chan T {
+	return q.ch
+}
+
+// Close ends the queue once the messages in it are taken.
+func (q *Queue[T]) Close() {
+	close(q.ch)
+}
+
+func (q *Queue[T]) Len() int {
+	return len(q.ch)
+}
+
+func (q *Queue[T]) Cap() int {
+	return cap(q.ch)
+}
+
+// Dropped returns the number of messages dropped with severity sev.
+func (q *Queue[T]) Dropped(sev Severity) uint64 {
+	return q.dropped[sev&7].Load()
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// batchSize is the number of datagrams read per recvmmsg call.
+const batchSize = 32
+
+// mmsghdr is struct mmsghdr, which x/sys does not define.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsgReader reads UDP datagrams with recvmmsg into buffers allocated
+// once per socket.
+type mmsgReader struct {
+	rc    syscall.RawConn
+	bufs  [][]byte
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrAny
+	msgs  []mmsghdr
+}
+
+func newBatchReader(conn net.PacketConn) batchReader {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	r := &mmsgReader{
+		rc:    rc,
+		bufs:  make([][]byte, batchSize),
+		iovs:  make([]unix.Iovec, batchSize),
+		names: make([]unix.RawSockaddrAny, batchSize),
+		msgs:  make([]mmsghdr, batchSize),
+	}
+	slab := make([]byte, batchSize*MaxMessageSize)
+	for i := range r.msgs {
+		r.bufs[i] = slab[i*MaxMessageSize : (i+1)*MaxMessageSize : (i+1)*MaxMessageSize]
+		r.iovs[i].Base = &r.bufs[i][0]
+		r.iovs[i].SetLen(MaxMessageSize)
+		r.msgs[i].hdr.Iov = &r.iovs[i]
+		r.msgs[i].hdr.SetIovlen(1)
+		r.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+	}
+	return r
+}
+
+func (r *mmsgReader) ReadBatch() (int, error) {
+	for i := range r.msgs {
+		r.msgs[i].hdr.Namelen = unix.SizeofSockaddrAny
+		r.msgs[i].hdr.Flags = 0
+	}
+
+	var n int
+	var errno syscall.Errno
+	err := r.rc.Read(func(fd uintptr) bool {
+		r1, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&r.msgs[0])),
+			uintptr(len(r.msgs)), unix.MSG_DONTWAIT, 0, 0)
+		n, errno = int(r1), e
+		// Wait for the socket to become readable again.
+		return errno != unix.EAGAIN && errno != unix.EINTR
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return n, nil
+}
+
+func (r *mmsgReader) Datagram(i int) ([]byte, net.Addr) {
+	return r.bufs[i][:r.msgs[i].len], sockaddrToUDP(&r.names[i])
+}
+
+func sockaddrToUDP(rsa *unix.RawSockaddrAny) net.Addr {
+	switch rsa.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		return &net.UDPAddr{
+			IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+			Port: int(binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])),
+		}
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		addr := &net.UDPAddr{
+			IP:   append(net.IP(nil), sa.Addr[:]...),
+			Port: int(binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])),
+		}
+		if sa.Scope_id != 0 {
+			addr.Zone = zoneName(int(sa.Scope_id))
+		}
+		return addr
+	}
+	return nil
+}
+
+func zoneName(index int) string {
+	if ifi, err := net.InterfaceByIndex(index); err == nil {
+		return ifi.Name
+	}
+	return strconv.Itoa(index)
+}
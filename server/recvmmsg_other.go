@@ -0,0 +1,11 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+// newBatchReader returns nil, leaving datagrams to be read one at a time
+// with ReadFrom.
+func newBatchReader(conn net.PacketConn) batchReader {
+	return nil
+}
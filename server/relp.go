@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// relpOffers are the offers of the server in answer to open.
+const relpOffers = "200 OK\nrelp_version=0\nrelp_software=syslog_tools\ncommands=syslog"
+
+// WithRELP makes a TCP listener speak RELP (the Reliable Event Logging
+// Protocol of rsyslog), acknowledging every message once it is handled.
+// If ready is not nil, the acknowledgements are held back while it returns
+// false, for the senders to keep the messages while syslogd catches up.
+func WithRELP(ready func() bool) ListenOption {
+	return func(l *listener) {
+		l.relp = true
+		l.relpReady = ready
+	}
+}
+
+type relpFrame struct {
+	txnr    int
+	command string
+	data    []byte
+}
+
+func readRELPFrame(r *bufio.Reader) (relpFrame, error) {
+	var f relpFrame
+	txnr, err := readRELPToken(r, 9)
+	if err != nil {
+		return f, err
+	}
+	if f.txnr, err = strconv.Atoi(txnr); err != nil {
+		return f, fmt.Errorf("relp: invalid txnr %q", txnr)
+	}
+	if f.command, err = readRELPToken(r, 32); err != nil {
+		return f, err
+	}
+
+	// DATALEN is followed by SP and the data, or directly by the trailer.
+	var digits []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return f, err
+		}
+		if c == ' ' || c == '\n' {
+			n, err := strconv.Atoi(string(digits))
+			if err != nil || n > MaxMessageSize {
+				return f, fmt.Errorf("relp: invalid datalen %q", digits)
+			}
+			if c == '\n' {
+				if n != 0 {
+					return f, fmt.Errorf("relp: missing data")
+				}
+				return f, nil
+			}
+			f.data = make([]byte, n)
+			if _, err := io.ReadFull(r, f.data); err != nil {
+				return f, err
+			}
+			break
+		}
+		if len(digits) == 9 {
+			return f, fmt.Errorf("relp: invalid datalen")
+		}
+		digits = append(digits, c)
+	}
+	if c, err := r.ReadByte(); err != nil {
+		return f, err
+	} else if c != '\n' {
+		return f, fmt.Errorf("relp: missing trailer")
+	}
+	return f, nil
+}
+
+func readRELPToken(r *bufio.Reader, max int) (string, error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == ' ' {
+			if len(b) == 0 {
+				return "", fmt.Errorf("relp: empty header field")
+			}
+			return string(b), nil
+		}
+		if len(b) == max {
+			return "", fmt.Errorf("relp: header field too long")
+		}
+		b = append(b, c)
+	}
+}
+
+func writeRELPResponse(w io.Writer, txnr int, command, data string) error {
+	var err error
+	if data == "" {
+		_, err = fmt.Fprintf(w, "%d %s 0\n", txnr, command)
+	} else {
+		_, err = fmt.Fprintf(w, "%d %s %d %s\n", txnr, command, len(data), data)
+	}
+	return err
+}
+
+// serveRELP handles a RELP session: the client opens it, sends messages
+// that are acknowledged one by one, and closes it. When the server shuts
+// down, it tells the client with serverclose.
+func (s *Server) serveRELP(conn net.Conn, ln *listener) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		ln.release()
+	}()
+
+	peer, err := ln.handshake(conn)
+	if err != nil {
+		s.logger.Printf("%s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	r := bufio.NewReader(conn)
+	opened := false
+	for {
+		err := ln.awaitFrame(conn, r)
+		var f relpFrame
+		if err == nil {
+			f, err = readRELPFrame(r)
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.logger.Printf("%s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		switch {
+		case f.command == "open":
+			opened = true
+			err = writeRELPResponse(conn, f.txnr, "rsp", relpOffers)
+		case f.command == "close":
+			writeRELPResponse(conn, f.txnr, "rsp", "")
+			writeRELPResponse(conn, 0, "serverclose", "")
+			return
+		case !opened:
+			err = writeRELPResponse(conn, f.txnr, "rsp", "500 session not opened")
+		case f.command == "syslog":
+			data := f.data
+			if n := len(data); n > 0 && data[n-1] == '\n' {
+				data = data[:n-1]
+			}
+			if len(data) > 0 {
+				s.handle(data, len(data), conn.RemoteAddr(), peer, ln)
+			}
+			if !s.relpWait(ln) {
+				writeRELPResponse(conn, 0, "serverclose", "")
+				return
+			}
+			err = writeRELPResponse(conn, f.txnr, "rsp", "200 OK")
+		default:
+			err = writeRELPResponse(conn, f.txnr, "rsp", "500 unknown command "+f.command)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// relpWait holds the acknowledgement back until the listener is ready for
+// more, and returns false if the server shuts down meanwhile.
+func (s *Server) relpWait(ln *listener) bool {
+	return s.await(func() bool {
+		return (ln.relpReady == nil || ln.relpReady()) && !ln.full()
+	})
+}
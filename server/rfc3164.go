@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// yearInferenceWindow is how far in the future a timestamp without a year
+// may be before it is taken to belong to the previous year.
+const yearInferenceWindow = 31 * 24 * time.Hour
+
+var (
+	// Canonical RFC 3164 "Mmm dd hh:mm:ss" and the variations network
+	// devices send: a leading '*' or '.' (Cisco clock not in sync), the year
+	// before or after the date or after the time, fractional seconds, a
+	// zone name or offset and a trailing colon.
+	bsdTimestamp = regexp.MustCompile(`^[*.]?(?:(\d{4}) )?([A-Z][a-z]{2}) +(\d{1,2}) (?:(\d{4}) )?(\d{2}):(\d{2}):(\d{2})(\.\d{1,9})?(?: (\d{4}))?(?: ([A-Z]{3,5}|[+-]\d{2}:?\d{2}))?:?(?: |$)`)
+
+	// ISO 8601 timestamps that some senders put into RFC 3164 messages.
+	isoTimestamp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})[T ](\d{2}:\d{2}:\d{2})(\.\d{1,9})?(Z|[+-]\d{2}:?\d{2})?:?(?: |$)`)
+
+	// Cisco IOS sequence numbers, "000123: ".
+	sequenceNumber = regexp.MustCompile(`^\d{1,10}: `)
+)
+
+var months = map[string]time.Month{
+	"Jan": time.January, "Feb": time.February, "Mar": time.March, "Apr": time.April,
+	"May": time.May, "Jun": time.June, "Jul": time.July, "Aug": time.August,
+	"Sep": time.September, "Oct": time.October, "Nov": time.November, "Dec": time.December,
+}
+
+// parseRFC3164 decodes TIMESTAMP SP HOSTNAME SP TAG CONTENT.
+func (p *Parser) parseRFC3164(m *Message, data []byte) {
+	if p.Strict {
+		p.parseStrictRFC3164(m, data)
+		return
+	}
+
+	data = bytes.TrimLeft(data, " ")
+	if loc := sequenceNumber.FindIndex(data); loc != nil {
+		data = data[loc[1]:]
+	}
+
+	// Without a timestamp the message is taken to carry no header at all,
+	// as a relay would per RFC 3164 section 4.3.3.
+	if t, n, ok := p.timestamp(data, m.Time); ok {
+		m.Timestamp = t
+		data = bytes.TrimLeft(data[n:], " ")
+
+		if host, rest, ok := splitHostname(data); ok {
+			m.Hostname = host
+			data = rest
+		}
+	}
+
+	m.Tag, m.Content = splitTagToken(data)
+	m.Tag1, m.Content1 = splitTag(data, ' ')
+}
+
+// parseStrictRFC3164 accepts only the layout of RFC 3164 section 4.1.2 and
+// leaves anything else unparsed in Content.
+func (p *Parser) parseStrictRFC3164(m *Message, data []byte) {
+	const layout = time.Stamp
+
+	if len(data) > len(layout) && data[len(layout)] == ' ' {
+		if t, err := time.ParseInLocation(layout, string(data[:len(layout)]), p.location()); err == nil {
+			rest := data[len(layout)+1:]
+			if i := bytes.IndexByte(rest, ' '); i > 0 {
+				m.Timestamp = inferYear(t, m.Time)
+				m.Hostname = string(rest[:i])
+				data = rest[i+1:]
+			}
+		}
+	}
+
+	m.Tag, m.Content = splitTag(data, ':')
+	m.Tag1, m.Content1 = splitTag(data, ' ')
+}
+
+func (p *Parser) location() *time.Location {
+	if p.Location != nil {
+		return p.Location
+	}
+	return time.Local
+}
+
+// timestamp recognizes a leading timestamp and returns it along with the
+// number of bytes it occupied.
+func (p *Parser) timestamp(data []byte, received time.Time) (time.Time, int, bool) {
+	if sm := isoTimestamp.FindSubmatch(data); sm != nil {
+		value := string(sm[1]) + "T" + string(sm[2]) + string(sm[3])
+		loc := p.location()
+		if len(sm[4]) > 0 {
+			zone := string(sm[4])
+			if zone != "Z" && !strings.Contains(zone, ":") {
+				zone = zone[:3] + ":" + zone[3:]
+			}
+			value += zone
+			loc = time.UTC
+		}
+
+		layout := "2006-01-02T15:04:05.999999999"
+		if len(sm[4]) > 0 {
+			layout += "Z07:00"
+		}
+		t, err := time.ParseInLocation(layout, value, loc)
+		if err != nil {
+			return time.Time{}, 0, false
+		}
+		return t, len(sm[0]), true
+	}
+
+	sm := bsdTimestamp.FindSubmatch(data)
+	if sm == nil {
+		return time.Time{}, 0, false
+	}
+
+	month, ok := months[string(sm[2])]
+	if !ok {
+		return time.Time{}, 0, false
+	}
+	day, _ := strconv.Atoi(string(sm[3]))
+	hour, _ := strconv.Atoi(string(sm[5]))
+	minute, _ := strconv.Atoi(string(sm[6]))
+	sec, _ := strconv.Atoi(string(sm[7]))
+	if day < 1 || day > 31 || hour > 23 || minute > 59 || sec > 60 {
+		return time.Time{}, 0, false
+	}
+
+	nsec := 0
+	if frac := sm[8]; len(frac) > 1 {
+		digits := string(frac[1:]) + strings.Repeat("0", 10-len(frac))
+		nsec, _ = strconv.Atoi(digits)
+	}
+
+	loc := p.location()
+	if zone := string(sm[10]); zone != "" {
+		loc = zoneLocation(zone, loc)
+	}
+
+	year := 0
+	for _, y := range [][]byte{sm[1], sm[4], sm[9]} {
+		if len(y) > 0 {
+			year, _ = strconv.Atoi(string(y))
+		}
+	}
+
+	if year == 0 {
+		t := time.Date(received.Year(), month, day, hour, minute, sec, nsec, loc)
+		return inferYear(t, received), len(sm[0]), true
+	}
+	return time.Date(year, month, day, hour, minute, sec, nsec, loc), len(sm[0]), true
+}
+
+// inferYear places a timestamp that came without a year in the year that
+// puts it closest to, and not far after, the time it was received.
+func inferYear(t, received time.Time) time.Time {
+	t = time.Date(received.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if t.Sub(received) > yearInferenceWindow {
+		t = t.AddDate(-1, 0, 0)
+	} else if received.Sub(t) > 365*24*time.Hour-yearInferenceWindow {
+		t = t.AddDate(1, 0, 0)
+	}
+	return t
+}
+
+func zoneLocation(zone string, def *time.Location) *time.Location {
+	switch zone {
+	case "UTC", "GMT", "Z":
+		return time.UTC
+	}
+
+	if zone[0] == '+' || zone[0] == '-' {
+		zone = strings.Replace(zone, ":", "", 1)
+		h, _ := strconv.Atoi(zone[1:3])
+		m, _ := strconv.Atoi(zone[3:])
+		offset := h*3600 + m*60
+		if zone[0] == '-' {
+			offset = -offset
+		}
+		return time.FixedZone(zone, offset)
+	}
+
+	// Abbreviations such as "CET" or "IST" are ambiguous, so the
+	// configured zone is used instead.
+	return def
+}
+
+// splitHostname takes the first token as the hostname unless it looks like
+// a tag ("sshd:", "cron[123]:", "%LINK-3-UPDOWN:") or there is nothing after
+// it.
+func splitHostname(data []byte) (string, []byte, bool) {
+	i := bytes.IndexByte(data, ' ')
+	if i <= 0 {
+		return "", data, false
+	}
+
+	token := data[:i]
+	if token[0] == '%' || bytes.ContainsAny(token, "[]") || token[len(token)-1] == ':' {
+		return "", data, false
+	}
+	for _, c := range token {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_' || c == ':') {
+			return "", data, false
+		}
+	}
+
+	return string(token), bytes.TrimLeft(data[i+1:], " "), true
+}
+
+// splitTagToken takes the tag from the first token when it ends in a colon
+// or carries a "[pid]", so a colon later in the content is not mistaken
+// for the end of the tag.
+func splitTagToken(data []byte) (string, string) {
+	i := bytes.IndexByte(data, ' ')
+	if i < 0 {
+		i = len(data)
+	}
+
+	token := data[:i]
+	rest := bytes.TrimLeft(data[i:], " ")
+	switch {
+	case len(token) > 1 && token[len(token)-1] == ':' && len(token) <= 49:
+		return string(token[:len(token)-1]), string(rest)
+	case len(token) > 0 && token[len(token)-1] == ']' && bytes.IndexByte(token, '[') > 0:
+		return string(token), string(rest)
+	}
+	return "", string(data)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRFC3164(t *testing.T) {
+	received := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		in       string
+		received time.Time // default received
+		ts       time.Time
+		host     string
+		tag      string
+		content  string
+	}{
+		{
+			name:    "canonical",
+			in:      "Mar  9 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			ts:      time.Date(2024, time.March, 9, 22, 14, 15, 0, time.UTC),
+			host:    "mymachine",
+			tag:     "su",
+			content: "'su root' failed for lonvick on /dev/pts/8",
+		},
+		{
+			name:    "pid",
+			in:      "Mar 10 11:59:00 host sshd[123]: Accepted publickey",
+			ts:      time.Date(2024, time.March, 10, 11, 59, 0, 0, time.UTC),
+			host:    "host",
+			tag:     "sshd[123]",
+			content: "Accepted publickey",
+		},
+		{
+			name:    "no hostname",
+			in:      "Mar 10 11:59:00 sshd[123]: Accepted publickey",
+			ts:      time.Date(2024, time.March, 10, 11, 59, 0, 0, time.UTC),
+			tag:     "sshd[123]",
+			content: "Accepted publickey",
+		},
+		{
+			name:    "colon in content",
+			in:      "Mar 10 11:59:00 host app said: hello",
+			ts:      time.Date(2024, time.March, 10, 11, 59, 0, 0, time.UTC),
+			host:    "host",
+			content: "app said: hello",
+		},
+		{
+			name:     "previous year",
+			in:       "Dec 31 23:59:59 host app: late",
+			received: time.Date(2024, time.January, 1, 0, 0, 10, 0, time.UTC),
+			ts:       time.Date(2023, time.December, 31, 23, 59, 59, 0, time.UTC),
+			host:     "host",
+			tag:      "app",
+			content:  "late",
+		},
+		{
+			name:     "next year",
+			in:       "Jan  1 00:00:05 host app: early",
+			received: time.Date(2023, time.December, 31, 23, 59, 50, 0, time.UTC),
+			ts:       time.Date(2024, time.January, 1, 0, 0, 5, 0, time.UTC),
+			host:     "host",
+			tag:      "app",
+			content:  "early",
+		},
+		{
+			name:    "year before the date",
+			in:      "2023 Mar 10 11:59:00 host app: x",
+			ts:      time.Date(2023, time.March, 10, 11, 59, 0, 0, time.UTC),
+			host:    "host",
+			tag:     "app",
+			content: "x",
+		},
+		{
+			name:    "year after the time",
+			in:      "Mar 10 11:59:00 2022 host app: x",
+			ts:      time.Date(2022, time.March, 10, 11, 59, 0, 0, time.UTC),
+			host:    "host",
+			tag:     "app",
+			content: "x",
+		},
+		{
+			name:    "zone offset",
+			in:      "Mar 10 11:59:00 +01:00 host app: x",
+			ts:      time.Date(2024, time.March, 10, 10, 59, 0, 0, time.UTC),
+			host:    "host",
+			tag:     "app",
+			content: "x",
+		},
+		{
+			name:    "cisco",
+			in:      "000123: *Mar 10 11:59:00.123 UTC: %LINK-3-UPDOWN: Interface Gi0/1, changed state to up",
+			ts:      time.Date(2024, time.March, 10, 11, 59, 0, 123000000, time.UTC),
+			tag:     "%LINK-3-UPDOWN",
+			content: "Interface Gi0/1, changed state to up",
+		},
+		{
+			name:    "iso",
+			in:      "2024-03-10T11:00:00.5+02:00 host app: x",
+			ts:      time.Date(2024, time.March, 10, 9, 0, 0, 500000000, time.UTC),
+			host:    "host",
+			tag:     "app",
+			content: "x",
+		},
+		{
+			name:    "iso without zone",
+			in:      "2024-03-10 11:00:00 host app: x",
+			ts:      time.Date(2024, time.March, 10, 11, 0, 0, 0, time.UTC),
+			host:    "host",
+			tag:     "app",
+			content: "x",
+		},
+		{
+			name:    "no header",
+			in:      "just some text",
+			content: "just some text",
+		},
+		{
+			name:    "invalid time",
+			in:      "Mar 10 25:00:00 host app: x",
+			content: "Mar 10 25:00:00 host app: x",
+		},
+	}
+	p := &Parser{Location: time.UTC}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Message{Time: received}
+			if !tt.received.IsZero() {
+				m.Time = tt.received
+			}
+			p.parseRFC3164(m, []byte(tt.in))
+			if !m.Timestamp.Equal(tt.ts) {
+				t.Errorf("timestamp = %v, want %v", m.Timestamp, tt.ts)
+			}
+			if m.Hostname != tt.host {
+				t.Errorf("hostname = %q, want %q", m.Hostname, tt.host)
+			}
+			if m.Tag != tt.tag {
+				t.Errorf("tag = %q, want %q", m.Tag, tt.tag)
+			}
+			if m.Content != tt.content {
+				t.Errorf("content = %q, want %q", m.Content, tt.content)
+			}
+		})
+	}
+}
+
+func TestParseStrictRFC3164(t *testing.T) {
+	received := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in      string
+		ts      time.Time
+		host    string
+		tag     string
+		content string
+	}{
+		{
+			in:      "Mar  9 22:14:15 mymachine su: 'su root' failed",
+			ts:      time.Date(2024, time.March, 9, 22, 14, 15, 0, time.UTC),
+			host:    "mymachine",
+			tag:     "su",
+			content: "'su root' failed",
+		},
+		{
+			in:      "Mar 10 11:59:00.123 host app: x",
+			tag:     "Mar 10 11",
+			content: "59:00.123 host app: x",
+		},
+		{
+			in:      "sshd[42]: no header",
+			tag:     "sshd[42]",
+			content: "no header",
+		},
+	}
+	p := &Parser{Strict: true, Location: time.UTC}
+	for _, tt := range tests {
+		m := &Message{Time: received}
+		p.parseRFC3164(m, []byte(tt.in))
+		if !m.Timestamp.Equal(tt.ts) || m.Hostname != tt.host || m.Tag != tt.tag || m.Content != tt.content {
+			t.Errorf("%q: got %v %q %q %q, want %v %q %q %q", tt.in,
+				m.Timestamp, m.Hostname, m.Tag, m.Content, tt.ts, tt.host, tt.tag, tt.content)
+		}
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	tests := []struct {
+		in       string
+		facility Facility
+		severity Severity
+		rest     string
+	}{
+		{"<34>rest", Facility(4), Severity(2), "rest"},
+		{"<0>rest", Facility(0), Severity(0), "rest"},
+		{"<191>rest", Facility(23), Severity(7), "rest"},
+		{"<192>rest", User, Notice, "<192>rest"},
+		{"<x>rest", User, Notice, "<x>rest"},
+		{"<>rest", User, Notice, "<>rest"},
+		{"<1234>rest", User, Notice, "<1234>rest"},
+		{"rest", User, Notice, "rest"},
+	}
+	for _, tt := range tests {
+		m := &Message{Facility: User, Severity: Notice}
+		rest := parsePriority(m, []byte(tt.in))
+		if m.Facility != tt.facility || m.Severity != tt.severity || string(rest) != tt.rest {
+			t.Errorf("%q: got %d %d %q, want %d %d %q", tt.in,
+				m.Facility, m.Severity, rest, tt.facility, tt.severity, tt.rest)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	errNotRFC5424 = errors.New("not an RFC 5424 message")
+	errBadSD      = errors.New("malformed structured data")
+)
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// parseRFC5424 decodes
+//
+//	VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+//
+// and reports false, leaving m untouched, if data does not have that shape.
+func parseRFC5424(m *Message, data []byte) bool {
+	p := &rfc5424Parser{data: data}
+
+	version, err := p.version()
+	if err != nil {
+		return false
+	}
+	header := make([][]byte, 5)
+	for i := range header {
+		if header[i], err = p.field(); err != nil {
+			return false
+		}
+	}
+
+	var timestamp time.Time
+	if ts := nilValue(header[0]); ts != "" {
+		if timestamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return false
+		}
+	}
+
+	sd, err := p.structuredData()
+	if err != nil {
+		// Keep what follows the header rather than dropping the message.
+		sd = nil
+		p.pos = p.sdStart
+	}
+
+	msg := p.rest()
+	msg = bytes.TrimPrefix(msg, utf8BOM)
+
+	m.Version = version
+	m.Timestamp = timestamp
+	m.Hostname = nilValue(header[1])
+	m.AppName = nilValue(header[2])
+	m.ProcID = nilValue(header[3])
+	m.MsgID = nilValue(header[4])
+	m.StructuredData = sd
+	m.Content = string(msg)
+
+	m.Tag = m.AppName
+	if m.ProcID != "" {
+		m.Tag += "[" + m.ProcID + "]"
+	}
+	m.Tag1, m.Content1 = m.Tag, m.Content
+	return true
+}
+
+type rfc5424Parser struct {
+	data    []byte
+	pos     int
+	sdStart int
+}
+
+func (p *rfc5424Parser) version() (int, error) {
+	start := p.pos
+	for p.pos < len(p.data) && p.pos-start < 3 && isDigit(p.data[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start || p.data[start] == '0' || p.pos >= len(p.data) || p.data[p.pos] != ' ' {
+		return 0, errNotRFC5424
+	}
+
+	v, _ := strconv.Atoi(string(p.data[start:p.pos]))
+	p.pos++
+	return v, nil
+}
+
+// field returns the next space-terminated header field.
+func (p *rfc5424Parser) field() ([]byte, error) {
+	i := bytes.IndexByte(p.data[p.pos:], ' ')
+	if i <= 0 {
+		return nil, errNotRFC5424
+	}
+
+	f := p.data[p.pos : p.pos+i]
+	p.pos += i + 1
+	p.sdStart = p.pos
+	return f, nil
+}
+
+func (p *rfc5424Parser) structuredData() (map[string]map[string]string, error) {
+	if p.pos >= len(p.data) {
+		return nil, errBadSD
+	}
+	if p.data[p.pos] == '-' {
+		p.pos++
+		return nil, p.separator()
+	}
+
+	sd := make(map[string]map[string]string)
+	for p.pos < len(p.data) && p.data[p.pos] == '[' {
+		p.pos++
+
+		id, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		params := sd[id]
+		if params == nil {
+			params = make(map[string]string)
+			sd[id] = params
+		}
+
+		for {
+			if p.pos >= len(p.data) {
+				return nil, errBadSD
+			}
+			if p.data[p.pos] == ']' {
+				p.pos++
+				break
+			}
+			if p.data[p.pos] != ' ' {
+				return nil, errBadSD
+			}
+			p.pos++
+
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if p.pos+1 >= len(p.data) || p.data[p.pos] != '=' || p.data[p.pos+1] != '"' {
+				return nil, errBadSD
+			}
+			p.pos += 2
+
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			params[name] = value
+		}
+	}
+	if len(sd) == 0 {
+		return nil, errBadSD
+	}
+
+	return sd, p.separator()
+}
+
+// name reads an SD-NAME: printable US-ASCII except '=', SP, ']' and '"'.
+func (p *rfc5424Parser) name() (string, error) {
+	start := p.pos
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if c <= ' ' || c >= 127 || c == '=' || c == ']' || c == '"' {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start || p.pos-start > 32 {
+		return "", errBadSD
+	}
+	return string(p.data[start:p.pos]), nil
+}
+
+// value reads a PARAM-VALUE up to the closing quote, unescaping \" \\ and \].
+func (p *rfc5424Parser) value() (string, error) {
+	var buf []byte
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return string(buf), nil
+		case c == '\\' && p.pos+1 < len(p.data) && bytes.IndexByte([]byte(`"\]`), p.data[p.pos+1]) >= 0:
+			buf = append(buf, p.data[p.pos+1])
+			p.pos += 2
+		default:
+			buf = append(buf, c)
+			p.pos++
+		}
+	}
+	return "", errBadSD
+}
+
+func (p *rfc5424Parser) separator() error {
+	if p.pos == len(p.data) {
+		return nil
+	}
+	if p.data[p.pos] != ' ' {
+		return errBadSD
+	}
+	p.pos++
+	return nil
+}
+
+func (p *rfc5424Parser) rest() []byte {
+	if p.pos >= len(p.data) {
+		return nil
+	}
+	return p.data[p.pos:]
+}
+
+func nilValue(b []byte) string {
+	if len(b) == 1 && b[0] == '-' {
+		return ""
+	}
+	return string(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRFC5424(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		ts      time.Time
+		host    string
+		app     string
+		procID  string
+		msgID   string
+		sd      map[string]map[string]string
+		tag     string
+		content string
+	}{
+		{
+			name:    "no structured data",
+			in:      "1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \xef\xbb\xbf'su root' failed for lonvick on /dev/pts/8",
+			ts:      time.Date(2003, time.October, 11, 22, 14, 15, 3000000, time.UTC),
+			host:    "mymachine.example.com",
+			app:     "su",
+			msgID:   "ID47",
+			tag:     "su",
+			content: "'su root' failed for lonvick on /dev/pts/8",
+		},
+		{
+			name:    "offset",
+			in:      "1 2003-08-24T05:14:15.000003-07:00 192.0.2.1 myproc 8710 - - %% It's time to make the do-nuts.",
+			ts:      time.Date(2003, time.August, 24, 12, 14, 15, 3000, time.UTC),
+			host:    "192.0.2.1",
+			app:     "myproc",
+			procID:  "8710",
+			tag:     "myproc[8710]",
+			content: "%% It's time to make the do-nuts.",
+		},
+		{
+			name:  "structured data",
+			in:    `1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high"] An application event log entry...`,
+			ts:    time.Date(2003, time.October, 11, 22, 14, 15, 3000000, time.UTC),
+			host:  "mymachine.example.com",
+			app:   "evntslog",
+			msgID: "ID47",
+			sd: map[string]map[string]string{
+				"exampleSDID@32473":     {"iut": "3", "eventSource": "Application", "eventID": "1011"},
+				"examplePriority@32473": {"class": "high"},
+			},
+			tag:     "evntslog",
+			content: "An application event log entry...",
+		},
+		{
+			name: "structured data only",
+			in:   `1 - - - - - [exampleSDID@32473 iut="3"]`,
+			sd:   map[string]map[string]string{"exampleSDID@32473": {"iut": "3"}},
+		},
+		{
+			name: "nil values",
+			in:   "1 - - - - - -",
+		},
+		{
+			name:    "escapes",
+			in:      `1 - host app 12 - [a@1 v="q\"b\\s\]e" w=""] m`,
+			host:    "host",
+			app:     "app",
+			procID:  "12",
+			sd:      map[string]map[string]string{"a@1": {"v": `q"b\s]e`, "w": ""}},
+			tag:     "app[12]",
+			content: "m",
+		},
+		{
+			name:    "malformed structured data",
+			in:      `1 - host app - - [a@1 v="unterminated] m`,
+			host:    "host",
+			app:     "app",
+			tag:     "app",
+			content: `[a@1 v="unterminated] m`,
+		},
+		{
+			name:    "structured data without separator",
+			in:      `1 - host app - - [a@1 v="1"]m`,
+			host:    "host",
+			app:     "app",
+			tag:     "app",
+			content: `[a@1 v="1"]m`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Message{}
+			if !parseRFC5424(m, []byte(tt.in)) {
+				t.Fatalf("not parsed")
+			}
+			if m.Version != 1 {
+				t.Errorf("version = %d, want 1", m.Version)
+			}
+			if !m.Timestamp.Equal(tt.ts) {
+				t.Errorf("timestamp = %v, want %v", m.Timestamp, tt.ts)
+			}
+			if m.Hostname != tt.host || m.AppName != tt.app || m.ProcID != tt.procID || m.MsgID != tt.msgID {
+				t.Errorf("header = %q %q %q %q, want %q %q %q %q", m.Hostname, m.AppName, m.ProcID, m.MsgID,
+					tt.host, tt.app, tt.procID, tt.msgID)
+			}
+			if !reflect.DeepEqual(m.StructuredData, tt.sd) {
+				t.Errorf("structured data = %v, want %v", m.StructuredData, tt.sd)
+			}
+			if m.Tag != tt.tag || m.Tag1 != tt.tag {
+				t.Errorf("tag = %q, tag1 = %q, want %q", m.Tag, m.Tag1, tt.tag)
+			}
+			if m.Content != tt.content || m.Content1 != tt.content {
+				t.Errorf("content = %q, content1 = %q, want %q", m.Content, m.Content1, tt.content)
+			}
+		})
+	}
+}
+
+func TestParseRFC5424Invalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"Mar 10 11:59:00 host app: x",
+		"0 - - - - - -",
+		"01 - - - - - -",
+		"1234 - - - - - -",
+		"1 - host app",
+		"1 - host app - -",
+		"1  host app - - -",
+		"1 2003-13-45T25:00:00Z host app - - -",
+		"1 yesterday host app - - -",
+	} {
+		m := &Message{Content: "untouched"}
+		if parseRFC5424(m, []byte(in)) {
+			t.Errorf("%q parsed", in)
+		}
+		if m.Content != "untouched" || m.Version != 0 {
+			t.Errorf("%q changed the message: %+v", in, m)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	const rfc5424 = "<165>1 2003-10-11T22:14:15.003Z host app - - - hello"
+	const rfc3164 = "<13>Mar 10 11:59:00 host app: hello"
+	tests := []struct {
+		format  Format
+		in      string
+		ok      bool
+		version int
+		content string
+	}{
+		{FormatAuto, rfc5424, true, 1, "hello"},
+		{FormatAuto, rfc3164, true, 0, "hello"},
+		{FormatRFC5424, rfc5424, true, 1, "hello"},
+		{FormatRFC5424, rfc3164, false, 0, "Mar 10 11:59:00 host app: hello"},
+		{FormatRFC3164, rfc3164, true, 0, "hello"},
+		{FormatRaw, rfc3164, true, 0, "Mar 10 11:59:00 host app: hello"},
+		{FormatAuto, "no priority\r\n", false, 0, "no priority"},
+	}
+	for _, tt := range tests {
+		p := &Parser{Format: tt.format, Location: time.UTC}
+		m, ok := p.parse([]byte(tt.in), nil)
+		if ok != tt.ok || m.Version != tt.version || m.Content != tt.content {
+			t.Errorf("format %d, %q: got %v %d %q, want %v %d %q", tt.format, tt.in,
+				ok, m.Version, m.Content, tt.ok, tt.version, tt.content)
+		}
+		if m.Raw != strings.TrimRight(tt.in, "\r\n") {
+			t.Errorf("format %d: raw = %q", tt.format, m.Raw)
+		}
+	}
+}
@@ -0,0 +1,810 @@
+// Package server receives syslog messages over UDP, TCP, TLS, HTTP and unix
+// sockets and passes them to a chain of handlers. A server listens on any
+// number of addresses at once, each with its own parser, ACLs and stats.
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxMessageSize is the largest message accepted on any transport.
+const MaxMessageSize = 64 * 1024
+
+// TruncatedSDID is the SD-ID of the element flagging a message truncated
+// to the maximum size of its listener, with the size of the whole message
+// as its size param.
+const TruncatedSDID = "truncated@32473"
+
+type Server struct {
+	mu        sync.Mutex
+	handlers  []Handler
+	listeners []net.Listener
+	packets   []net.PacketConn
+	bound     []net.Addr
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+	shutdown  bool
+	logger    *log.Logger
+
+	// The parse stage, when there are parse workers.
+	raw     *Queue[rawMessage]
+	parsers sync.WaitGroup
+
+	pacer func(src net.Addr) time.Duration
+}
+
+func NewServer() *Server {
+	return &Server{
+		conns:  make(map[net.Conn]struct{}),
+		logger: log.New(os.Stderr, "", log.LstdFlags),
+	}
+}
+
+// SetLogger sets the logger for errors on established connections.
+func (s *Server) SetLogger(l *log.Logger) {
+	s.logger = l
+}
+
+// AddHandler appends h to the handler chain. It must not be called after
+// the server started listening.
+func (s *Server) AddHandler(h Handler) {
+	s.handlers = append(s.handlers, h)
+}
+
+// SetPacer makes the connections hold back reading their next message
+// for as long as p returns for their remote address, so that a sender can
+// be slowed down on its own connection whichever goroutine handles its
+// messages. It must not be called after the server started listening.
+func (s *Server) SetPacer(p func(src net.Addr) time.Duration) {
+	s.pacer = p
+}
+
+// rawMessage is a message received but not parsed yet.
+type rawMessage struct {
+	data []byte
+	size int // of the whole message, if data was truncated
+	src  net.Addr
+	peer *Peer
+	ln   *listener
+}
+
+// SetParseWorkers makes n goroutines parse the received messages and pass
+// them to the handlers, taking them from a queue of length qlen with the
+// policy p, so that the goroutines reading the sockets only read. The
+// messages of a connection may be handled out of order. It must not be
+// called after the server started listening.
+func (s *Server) SetParseWorkers(n, qlen int, p Policy, keep Severity) {
+	s.raw = NewQueue(qlen, rawSeverity)
+	s.raw.SetPolicy(p, keep)
+	s.raw.OnDrop(func(rm rawMessage) { rm.ln.inflight.Add(-1) })
+	for i := 0; i < n; i++ {
+		s.parsers.Add(1)
+		go func() {
+			defer s.parsers.Done()
+			for rm := range s.raw.C() {
+				s.dispatch(rm.ln.parse(rm.data, rm.size, rm.src, rm.peer))
+				rm.ln.inflight.Add(-1)
+			}
+		}()
+	}
+}
+
+// rawSeverity returns the severity of the PRI of a message not parsed yet.
+func rawSeverity(rm rawMessage) Severity {
+	m := Message{Severity: Notice}
+	parsePriority(&m, rm.data)
+	return m.Severity
+}
+
+// ParseQueueLen returns the number of messages waiting for a parse worker.
+func (s *Server) ParseQueueLen() int {
+	if s.raw == nil {
+		return 0
+	}
+	return s.raw.Len()
+}
+
+// ParseQueueCap returns the length of the parse queue, 0 without parse
+// workers.
+func (s *Server) ParseQueueCap() int {
+	if s.raw == nil {
+		return 0
+	}
+	return s.raw.Cap()
+}
+
+// ParseDropped returns the number of messages with severity sev dropped
+// for a full parse queue.
+func (s *Server) ParseDropped(sev Severity) uint64 {
+	if s.raw == nil {
+		return 0
+	}
+	return s.raw.Dropped(sev)
+}
+
+// handle parses and dispatches data, a message of size bytes possibly
+// truncated already, or queues it for the parse workers.
+func (s *Server) handle(data []byte, size int, src net.Addr, peer *Peer, ln *listener) {
+	if ln.gelf != nil {
+		if data = ln.gelf.reassemble(data, src); data == nil {
+			return
+		}
+		size = len(data)
+	}
+	if limit := ln.maxSize(); len(data) > limit {
+		data = data[:limit]
+	}
+	if size > len(data) {
+		if ln.stats != nil {
+			ln.stats.Oversize.Add(1)
+		}
+		if ln.limits.RejectOversize || ln.gelf != nil {
+			return
+		}
+	}
+
+	ln.inflight.Add(1)
+	if s.raw == nil {
+		s.dispatch(ln.parse(data, size, src, peer))
+		ln.inflight.Add(-1)
+		return
+	}
+	s.raw.Put(rawMessage{append([]byte(nil), data...), size, src, peer, ln})
+}
+
+// listener holds the per-listener settings.
+type listener struct {
+	name    string
+	parser  *Parser
+	stats   *Stats
+	acls    []func(net.Addr) bool
+	sockets int
+
+	relp      bool
+	relpReady func() bool
+
+	http   *HTTPConfig
+	gelf   *gelfChunks
+	limits Limits
+
+	handshakeFailed func(net.Addr, error)
+
+	conns    atomic.Int64 // connections open
+	inflight atomic.Int64 // messages waiting for or being handled
+}
+
+// Stats counts the messages of a listener.
+type Stats struct {
+	Received  atomic.Uint64 // messages
+	Bytes     atomic.Uint64 // size of the messages as received
+	Malformed atomic.Uint64 // messages without a valid PRI, or not RFC 5424 for an RFC 5424 parser
+	Rejected  atomic.Uint64 // datagrams, connections and DTLS sessions refused by an ACL or a limit
+	Dropped   atomic.Uint64 // messages dropped by the limits of the listener
+	Oversize  atomic.Uint64 // messages over the maximum size, truncated or rejected
+}
+
+// parse decodes data, truncated from size bytes if shorter, and counts
+// the message.
+func (l *listener) parse(data []byte, size int, src net.Addr, peer *Peer) *Message {
+	var m *Message
+	var ok bool
+	if l.gelf != nil {
+		m, ok = decodeGELF(data, src)
+	} else {
+		m, ok = l.parser.parse(data, src)
+	}
+	m.Peer = peer
+	m.Listener = l.name
+	if size > len(data) {
+		if m.StructuredData == nil {
+			m.StructuredData = make(map[string]map[string]string)
+		}
+		m.StructuredData[TruncatedSDID] = map[string]string{"size": strconv.Itoa(size)}
+	}
+	l.count(size, ok)
+	return m
+}
+
+// count counts a message of size bytes, well-formed or not.
+func (l *listener) count(size int, ok bool) {
+	if l.stats != nil {
+		l.stats.Received.Add(1)
+		l.stats.Bytes.Add(uint64(size))
+		if !ok {
+			l.stats.Malformed.Add(1)
+		}
+	}
+}
+
+// ListenOption configures a single listener.
+type ListenOption func(*listener)
+
+// WithParser makes the listener decode messages with p instead of the
+// default lenient parser.
+func WithParser(p *Parser) ListenOption {
+	return func(l *listener) {
+		l.parser = p
+	}
+}
+
+// WithACL makes the listener refuse the datagrams and connections from
+// the senders permit returns false for. A listener may have several ACLs,
+// which all have to permit a sender.
+func WithACL(permit func(net.Addr) bool) ListenOption {
+	return func(l *listener) {
+		l.acls = append(l.acls, permit)
+	}
+}
+
+// permits checks addr against the ACLs and counts a refusal.
+func (l *listener) permits(addr net.Addr) bool {
+	for _, permit := range l.acls {
+		if !permit(addr) {
+			if l.stats != nil {
+				l.stats.Rejected.Add(1)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// WithSockets makes a UDP listener open n sockets bound to its address
+// with SO_REUSEPORT, each read by its own goroutine, so that the kernel
+// spreads the datagrams over them. It is only supported on Linux.
+func WithSockets(n int) ListenOption {
+	return func(l *listener) {
+		l.sockets = n
+	}
+}
+
+// Limits are the limits of a listener, for a stuck or malicious sender not
+// to hold its resources indefinitely. Zero means no limit, except for the
+// sessions of a DTLS listener: at most 10000, idle for an hour.
+type Limits struct {
+	// MaxMessageSize is the largest message, MaxMessageSize by default
+	// and at most. Longer messages are truncated to it and flagged with
+	// a truncated@32473 element, or dropped with RejectOversize, and
+	// counted in Stats.Oversize. GELF messages, which cannot be
+	// truncated, are always dropped.
+	MaxMessageSize int
+	RejectOversize bool
+
+	// MaxConns is the number of connections, or DTLS sessions, at once.
+	// Those over it are refused.
+	MaxConns int
+
+	// IdleTimeout is how long a connection may wait before sending a
+	// message, and ReadTimeout how long it may take to send a message it
+	// started, or to complete the TLS handshake, before it is closed.
+	IdleTimeout time.Duration
+	ReadTimeout time.Duration
+
+	// MaxInFlight is the number of messages of the listener waiting for
+	// or being handled. Over it, connections are not read any more until
+	// it has room, HTTP requests are answered with 503, and datagrams are
+	// dropped.
+	MaxInFlight int
+
+	// Rate is the messages a second each DTLS session may send, over
+	// which they are dropped.
+	Rate float64
+}
+
+// acquire counts a new connection, or refuses it over MaxConns.
+func (l *listener) acquire() bool {
+	if n := l.conns.Add(1); l.limits.MaxConns > 0 && n > int64(l.limits.MaxConns) {
+		l.conns.Add(-1)
+		if l.stats != nil {
+			l.stats.Rejected.Add(1)
+		}
+		return false
+	}
+	return true
+}
+
+func (l *listener) release() {
+	l.conns.Add(-1)
+}
+
+// maxSize returns the largest message of the listener.
+func (l *listener) maxSize() int {
+	if n := l.limits.MaxMessageSize; n > 0 && n < MaxMessageSize {
+		return n
+	}
+	return MaxMessageSize
+}
+
+// full reports whether the listener has MaxInFlight messages in flight.
+func (l *listener) full() bool {
+	return l.limits.MaxInFlight > 0 && l.inflight.Load() >= int64(l.limits.MaxInFlight)
+}
+
+// drop counts a message dropped for a limit.
+func (l *listener) drop() {
+	if l.stats != nil {
+		l.stats.Dropped.Add(1)
+	}
+}
+
+// WithLimits sets the limits of the listener.
+func WithLimits(limits Limits) ListenOption {
+	return func(l *listener) {
+		l.limits = limits
+	}
+}
+
+// WithName sets the Listener of the messages the listener receives.
+func WithName(name string) ListenOption {
+	return func(l *listener) {
+		l.name = name
+	}
+}
+
+// WithHandshakeError calls f with the sender and the error of every TLS
+// connection and DTLS session of the listener whose handshake fails, such
+// as for a client certificate that was not verified.
+func WithHandshakeError(f func(src net.Addr, err error)) ListenOption {
+	return func(l *listener) {
+		l.handshakeFailed = f
+	}
+}
+
+// WithStats makes the listener count its messages in st.
+func WithStats(st *Stats) ListenOption {
+	return func(l *listener) {
+		l.stats = st
+	}
+}
+
+func newListener(opts []ListenOption) *listener {
+	l := &listener{parser: defaultParser}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Listen receives datagrams on the UDP address addr.
+func (s *Server) Listen(addr string, opts ...ListenOption) error {
+	ln := newListener(opts)
+	if ln.sockets <= 1 {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		s.servePacket(conn, ln)
+		return nil
+	}
+
+	lc := net.ListenConfig{Control: reusePort}
+	conns := make([]net.PacketConn, 0, ln.sockets)
+	for i := 0; i < ln.sockets; i++ {
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return err
+		}
+		// Bind the other sockets to the port chosen for the first one.
+		addr = conn.LocalAddr().String()
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		s.servePacket(conn, ln)
+	}
+	return nil
+}
+
+// ListenTCP accepts connections on the TCP address addr, using TLS when
+// config is not nil.
+func (s *Server) ListenTCP(addr string, config *tls.Config, opts ...ListenOption) error {
+	var l net.Listener
+	var err error
+	if config != nil {
+		l, err = tls.Listen("tcp", addr, config)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.serveStream(l, newListener(opts))
+	return nil
+}
+
+// Serve accepts connections on l, a listener opened elsewhere such as a
+// socket passed by systemd, using TLS when config is not nil.
+func (s *Server) Serve(l net.Listener, config *tls.Config, opts ...ListenOption) {
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	s.serveStream(l, newListener(opts))
+}
+
+// ServePacket receives datagrams on conn, a socket opened elsewhere.
+func (s *Server) ServePacket(conn net.PacketConn, opts ...ListenOption) {
+	s.servePacket(conn, newListener(opts))
+}
+
+// ListenUnix serves a stream (network "unix") or datagram ("unixgram")
+// socket at path, replacing a stale socket file left behind.
+func (s *Server) ListenUnix(network, path string, mode os.FileMode, opts ...ListenOption) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	if network == "unixgram" {
+		conn, err := net.ListenUnixgram(network, &net.UnixAddr{Name: path, Net: network})
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			conn.Close()
+			return err
+		}
+
+		s.servePacket(conn, newListener(opts))
+		return nil
+	}
+
+	l, err := net.Listen(network, path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return err
+	}
+
+	s.serveStream(l, newListener(opts))
+	return nil
+}
+
+func (s *Server) servePacket(conn net.PacketConn, ln *listener) {
+	s.mu.Lock()
+	s.packets = append(s.packets, conn)
+	s.bound = append(s.bound, conn.LocalAddr())
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.receive(conn, ln)
+}
+
+func (s *Server) serveStream(l net.Listener, ln *listener) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.bound = append(s.bound, l.Addr())
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	if ln.http != nil {
+		go s.serveHTTP(l, ln)
+	} else {
+		go s.accept(l, ln)
+	}
+}
+
+// batchReader reads many datagrams per system call.
+type batchReader interface {
+	ReadBatch() (int, error)
+	Datagram(i int) ([]byte, net.Addr)
+}
+
+func (s *Server) receive(conn net.PacketConn, ln *listener) {
+	defer s.wg.Done()
+
+	if r := newBatchReader(conn); r != nil {
+		s.receiveBatch(r, ln)
+		return
+	}
+
+	buf := make([]byte, MaxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Print(err)
+			}
+			return
+		}
+		if n == 0 || !ln.permits(addr) {
+			continue
+		}
+		if ln.full() {
+			ln.drop()
+			continue
+		}
+		s.handle(buf[:n], n, sourceAddr(addr, conn), nil, ln)
+	}
+}
+
+func (s *Server) receiveBatch(r batchReader, ln *listener) {
+	for {
+		n, err := r.ReadBatch()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Print(err)
+			}
+			return
+		}
+		for i := 0; i < n; i++ {
+			buf, addr := r.Datagram(i)
+			if len(buf) == 0 || addr == nil || !ln.permits(addr) {
+				continue
+			}
+			if ln.full() {
+				ln.drop()
+				continue
+			}
+			s.handle(buf, len(buf), addr, nil, ln)
+		}
+	}
+}
+
+// sourceAddr falls back to the local address for datagrams from unbound
+// unix sockets, which is what syslog(3) clients use.
+func sourceAddr(addr net.Addr, conn net.PacketConn) net.Addr {
+	if ua, ok := addr.(*net.UnixAddr); addr == nil || (ok && ua == nil) {
+		return conn.LocalAddr()
+	}
+	return addr
+}
+
+func (s *Server) accept(l net.Listener, ln *listener) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Print(err)
+			}
+			return
+		}
+		if !ln.permits(conn.RemoteAddr()) || !ln.acquire() {
+			conn.Close()
+			continue
+		}
+
+		s.mu.Lock()
+		if s.shutdown {
+			s.mu.Unlock()
+			ln.release()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		if ln.relp {
+			go s.serveRELP(conn, ln)
+		} else {
+			go s.serve(conn, ln)
+		}
+	}
+}
+
+func (s *Server) serve(conn net.Conn, ln *listener) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		ln.release()
+	}()
+
+	peer, err := ln.handshake(conn)
+	if err != nil {
+		s.logger.Printf("%s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	r := bufio.NewReader(conn)
+	for {
+		if !s.waitInFlight(ln) || !s.pace(conn.RemoteAddr()) {
+			return
+		}
+		err := ln.awaitFrame(conn, r)
+		var frame []byte
+		var size int
+		if err == nil {
+			frame, size, err = readFrame(r, ln.maxSize())
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.logger.Printf("%s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if size == 0 {
+			continue
+		}
+		s.handle(frame, size, conn.RemoteAddr(), peer, ln)
+	}
+}
+
+// errIdle closes the connections idle for longer than IdleTimeout.
+var errIdle = errors.New("idle timeout")
+
+// handshake is connPeer within ReadTimeout, reporting failures to the
+// WithHandshakeError of the listener.
+func (l *listener) handshake(conn net.Conn) (*Peer, error) {
+	if _, ok := conn.(*tls.Conn); !ok {
+		return nil, nil
+	}
+	if l.limits.ReadTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(l.limits.ReadTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	peer, err := connPeer(conn)
+	if err != nil && l.handshakeFailed != nil {
+		l.handshakeFailed(conn.RemoteAddr(), err)
+	}
+	return peer, err
+}
+
+// awaitFrame waits for the next frame of conn for IdleTimeout at most,
+// and then leaves ReadTimeout to read it.
+func (l *listener) awaitFrame(conn net.Conn, r *bufio.Reader) error {
+	idle, read := l.limits.IdleTimeout, l.limits.ReadTimeout
+	if idle <= 0 && read <= 0 {
+		return nil
+	}
+	if r.Buffered() == 0 {
+		var deadline time.Time
+		if idle > 0 {
+			deadline = time.Now().Add(idle)
+		}
+		conn.SetReadDeadline(deadline)
+		if _, err := r.Peek(1); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return errIdle
+			}
+			return err
+		}
+	}
+	var deadline time.Time
+	if read > 0 {
+		deadline = time.Now().Add(read)
+	}
+	return conn.SetReadDeadline(deadline)
+}
+
+// waitInFlight holds the reading of a connection back while the listener
+// is full, and returns false if the server shuts down meanwhile.
+func (s *Server) waitInFlight(ln *listener) bool {
+	return s.await(func() bool { return !ln.full() })
+}
+
+// pace holds the reading of a connection from src back as long as the
+// pacer asks, and returns false if the server shuts down meanwhile.
+func (s *Server) pace(src net.Addr) bool {
+	if s.pacer == nil {
+		return true
+	}
+	d := s.pacer(src)
+	if d <= 0 {
+		return true
+	}
+	until := time.Now().Add(d)
+	return s.await(func() bool { return !time.Now().Before(until) })
+}
+
+// pollInterval is how often a connection held back checks if it may go on.
+const pollInterval = 10 * time.Millisecond
+
+// await polls ready until it returns true, or returns false if the server
+// shuts down meanwhile.
+func (s *Server) await(ready func() bool) bool {
+	for !ready() {
+		s.mu.Lock()
+		shutdown := s.shutdown
+		s.mu.Unlock()
+		if shutdown {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+	return true
+}
+
+// connPeer completes the handshake of a TLS connection, and returns the
+// identity of the client if it presented a certificate that was verified.
+func connPeer(conn net.Conn) (*Peer, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsPeer(tc.ConnectionState()), nil
+}
+
+// tlsPeer returns the identity of the client of a TLS connection, if it
+// presented a certificate that was verified.
+func tlsPeer(st tls.ConnectionState) *Peer {
+	if len(st.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := st.PeerCertificates[0]
+	p := &Peer{CommonName: cert.Subject.CommonName}
+	p.SANs = append(p.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		p.SANs = append(p.SANs, ip.String())
+	}
+	p.SANs = append(p.SANs, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		p.SANs = append(p.SANs, u.String())
+	}
+	return p
+}
+
+// Dispatch passes m through the handler chain, as the listeners do with
+// the messages they receive, once its times are normalized to UTC. It must
+// not be called after Shutdown.
+func (s *Server) Dispatch(m *Message) {
+	m.NormalizeTime()
+	s.dispatch(m)
+}
+
+func (s *Server) dispatch(m *Message) {
+	for _, h := range s.handlers {
+		if m = h.Handle(m); m == nil {
+			return
+		}
+	}
+}
+
+// Addrs returns the addresses the server listens on, in the order they
+// were bound.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]net.Addr(nil), s.bound...)
+}
+
+// Shutdown closes all listeners and connections, waits for the messages
+// in flight and then signals the end of input to every handler.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	s.shutdown = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for _, p := range s.packets {
+		p.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	if s.raw != nil {
+		s.raw.Close()
+		s.parsers.Wait()
+	}
+
+	for _, h := range s.handlers {
+		h.Handle(nil)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const aclLogInterval = 10 * time.Second
+
+// acl permits the senders in one of the allow networks, if there are any,
+// unless they are in one of the deny networks. Senders without an IP
+// address, on unix sockets, are always permitted.
+type acl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newACL(allow, deny []string) (*acl, error) {
+	a := &acl{}
+	var err error
+	if a.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parseCIDRs parses networks in CIDR notation, or single addresses.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range list {
+		for _, s := range strings.Split(item, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q", s)
+			}
+			nets = append(nets, n)
+		}
+	}
+	return nets, nil
+}
+
+func (a *acl) permits(ip net.IP) bool {
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclFilter is the permit function of a listener. The ACL may be replaced
+// on reload.
+type aclFilter struct {
+	acl atomic.Pointer[acl]
+	log bool
+
+	mu       sync.Mutex
+	rejected int
+	last     string
+	logged   time.Time
+}
+
+func newACLFilter(a *acl, logRejected bool) *aclFilter {
+	f := &aclFilter{log: logRejected}
+	f.acl.Store(a)
+	return f
+}
+
+func (f *aclFilter) permit(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		return true
+	}
+	if f.acl.Load().permits(ip) {
+		return true
+	}
+	if f.log {
+		f.logRejected(ip.String())
+	}
+	return false
+}
+
+// logRejected logs the refused senders at most every aclLogInterval.
+func (f *aclFilter) logRejected(src string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rejected++
+	f.last = src
+	if now := time.Now(); now.Sub(f.logged) >= aclLogInterval {
+		log.Printf("acl: rejected %d datagrams or connections, last from %s", f.rejected, f.last)
+		f.rejected, f.logged = 0, now
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeConfig obtains the certificate of the tls listeners from an ACME
+// server such as Let's Encrypt, instead of the cert and key files.
+type acmeConfig struct {
+	Directory string     `yaml:"directory"` // of the ACME server, Let's Encrypt by default
+	Domains   stringList `yaml:"domains"`
+	Email     string     `yaml:"email"`
+	Cache     string     `yaml:"cache"`     // directory of the account key and the certificates
+	Challenge string     `yaml:"challenge"` // http-01 (default), also served, or tls-alpn-01 only, on port 443 of a tls listener
+	HTTPAddr  string     `yaml:"http_addr"` // of the http-01 challenges, :80 by default
+	CA        string     `yaml:"ca"`        // file of the CA of an internal ACME server
+}
+
+// acmeManager obtains a certificate for each of the domains with autocert,
+// which renews them. The cache directory is opened when it starts, so
+// that it stays reachable in a chroot.
+type acmeManager struct {
+	c acmeConfig
+	m *autocert.Manager
+}
+
+func (c acmeConfig) validate() error {
+	if len(c.Domains) == 0 || c.Cache == "" {
+		return errors.New("acme requires domains and a cache directory")
+	}
+	switch c.Challenge {
+	case "", "http-01", "tls-alpn-01":
+	default:
+		return fmt.Errorf("invalid acme challenge %q: want http-01 or tls-alpn-01", c.Challenge)
+	}
+	return nil
+}
+
+func newACMEManager(c acmeConfig) (*acmeManager, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	setDefault(&c.Challenge, "http-01")
+	setDefault(&c.Directory, autocert.DefaultACMEDirectory)
+	setDefault(&c.HTTPAddr, ":80")
+
+	// The roots are loaded now, they may be out of reach in a chroot.
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	if c.CA != "" {
+		data, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		if roots = x509.NewCertPool(); !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CA)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+
+	if err := os.MkdirAll(c.Cache, 0700); err != nil {
+		return nil, err
+	}
+	cache, err := os.OpenRoot(c.Cache)
+	if err != nil {
+		return nil, err
+	}
+	m := &acmeManager{c: c, m: &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      rootCache{cache},
+		HostPolicy: autocert.HostWhitelist(c.Domains...),
+		Email:      c.Email,
+		Client: &acme.Client{
+			DirectoryURL: c.Directory,
+			HTTPClient:   &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		},
+	}}
+
+	// The challenge listener is bound now, it may need privileges.
+	if c.Challenge == "http-01" {
+		ln, err := net.Listen("tcp", c.HTTPAddr)
+		if err != nil {
+			return nil, err
+		}
+		go http.Serve(ln, m.m.HTTPHandler(http.NotFoundHandler()))
+	}
+	return m, nil
+}
+
+// start obtains the certificates, which autocert then renews for as long
+// as syslogd runs.
+func (m *acmeManager) start() {
+	for _, domain := range m.c.Domains {
+		go func() {
+			if _, err := m.m.GetCertificate(&tls.ClientHelloInfo{ServerName: domain}); err != nil {
+				log.Printf("acme: %s: %v", domain, err)
+			}
+		}()
+	}
+}
+
+// getCertificate serves the certificate of the server name, or of the
+// first domain to the clients that name none of them, or the tls-alpn-01
+// certificate of a domain being validated.
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !slices.Contains(hello.SupportedProtos, acme.ALPNProto) && !slices.Contains(m.c.Domains, hello.ServerName) {
+		h := *hello
+		h.ServerName = m.c.Domains[0]
+		hello = &h
+	}
+	return m.m.GetCertificate(hello)
+}
+
+// challengeConfig returns the config of a tls-alpn-01 validation, or nil
+// if hello is not one.
+func (m *acmeManager) challengeConfig(hello *tls.ClientHelloInfo) *tls.Config {
+	if !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return nil
+	}
+	return &tls.Config{GetCertificate: m.getCertificate, NextProtos: []string{acme.ALPNProto}}
+}
+
+// rootCache is the autocert cache of the account key and the certificates
+// in a directory.
+type rootCache struct {
+	root *os.Root
+}
+
+func (c rootCache) Get(_ context.Context, name string) ([]byte, error) {
+	f, err := c.root.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, autocert.ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (c rootCache) Put(_ context.Context, name string, data []byte) error {
+	f, err := c.root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c rootCache) Delete(_ context.Context, name string) error {
+	if err := c.root.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// activated is a socket opened by the service manager.
+type activated struct {
+	name   string
+	scheme string // udp, tcp, unix or unixgram
+	ln     net.Listener
+	conn   net.PacketConn
+	used   bool
+}
+
+func openActivated(name string, f *os.File) (*activated, error) {
+	defer f.Close()
+	a := &activated{name: name}
+	if ln, err := net.FileListener(f); err == nil {
+		a.ln = ln
+		a.scheme = ln.Addr().Network()
+		return a, nil
+	}
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	a.conn = conn
+	a.scheme = conn.LocalAddr().Network()
+	return a, nil
+}
+
+func (a *activated) stream() bool {
+	return a.ln != nil
+}
+
+// systemdAddr returns NAME of a listen address systemd:NAME, which is
+// empty for the address systemd.
+func systemdAddr(addr string) (string, bool) {
+	name, ok := strings.CutPrefix(addr, "systemd")
+	if !ok || name != "" && name[0] != ':' {
+		return "", false
+	}
+	return strings.TrimPrefix(name, ":"), true
+}
+
+// defaultActivatedURLs returns a listen URL for every name and scheme of
+// sockets, for when no listen URL is given.
+func defaultActivatedURLs(sockets []*activated) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, a := range sockets {
+		u := a.scheme + "://systemd:" + a.name
+		if !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// serveActivated serves the sockets named name, or all of them if name is
+// empty, that are of the kind of scheme: datagrams for udp, gelf, dtls and unixgram,
+// streams for the others.
+func serveActivated(srv *server.Server, sockets []*activated, name, scheme string, config *tls.Config, opts []server.ListenOption) error {
+	stream := scheme != "udp" && scheme != "gelf" && scheme != "dtls" && scheme != "unixgram"
+	served := 0
+	for _, a := range sockets {
+		if a.used || name != "" && a.name != name || a.stream() != stream {
+			continue
+		}
+		a.used = true
+		served++
+		if stream {
+			srv.Serve(a.ln, config, opts...)
+		} else if scheme == "dtls" {
+			srv.ServeDTLS(a.conn, config, opts...)
+		} else {
+			srv.ServePacket(a.conn, opts...)
+		}
+	}
+	if served == 0 && name == "" {
+		return fmt.Errorf("no %s socket passed by systemd", scheme)
+	} else if served == 0 {
+		return fmt.Errorf("no %s socket named %s passed by systemd", scheme, name)
+	}
+	return nil
+}
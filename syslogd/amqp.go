@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultAMQPPort       = "5672"
+	defaultAMQPSPort      = "5671"
+	defaultAMQPExchange   = "amq.topic"
+	defaultAMQPRoutingKey = "syslog.%HOSTNAME%.%FACILITY%"
+	amqpTimeout           = 10 * time.Second
+	amqpFrameMax          = 131072
+	amqpFrameEnd          = 0xce
+	amqpChannel           = 1
+)
+
+// AMQP frame types.
+const (
+	amqpFrameMethod = 1
+	amqpFrameHeader = 2
+	amqpFrameBody   = 3
+)
+
+// AMQP classes and methods, as class<<16 | method.
+const (
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpChannelOpen       = 20<<16 | 10
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpChannelClose      = 20<<16 | 40
+	amqpChannelCloseOk    = 20<<16 | 41
+	amqpBasicPublish      = 60<<16 | 40
+	amqpBasicAck          = 60<<16 | 80
+	amqpBasicNack         = 60<<16 | 120
+	amqpConfirmSelect     = 85<<16 | 10
+	amqpConfirmSelectOk   = 85<<16 | 11
+)
+
+// amqpOutput publishes persistent messages to an AMQP 0-9-1 exchange, as
+// of RabbitMQ, the exchange and the routing key expanded from %NAME%
+// properties as file paths are. Every batch waits for the publisher
+// confirms of the broker, and the messages it did not confirm are
+// published again on a new connection if need be: at least once.
+type amqpOutput struct {
+	*batchOutput
+	name        string
+	addr        string
+	tls         *tls.Config
+	vhost       string
+	username    string
+	password    string
+	exchange    string
+	routingKey  string
+	contentType string
+	format      formatter
+
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	frameMax int
+	tag      uint64 // delivery tag of the last message published
+}
+
+// newAMQPOutput publishes to url, amqp://[user:password@]host[:port][/vhost]
+// or amqps://... for TLS, as guest:guest on the / vhost by default.
+func newAMQPOutput(name string, c outputConfig, format formatter) (*amqpOutput, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "amqp" && u.Scheme != "amqps" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid amqp url %q: want amqp://host[:port][/vhost] or amqps://host[:port][/vhost]", c.URL)
+	}
+	o := &amqpOutput{
+		name:        name,
+		addr:        u.Host,
+		vhost:       "/",
+		username:    "guest",
+		password:    "guest",
+		exchange:    defaultAMQPExchange,
+		routingKey:  defaultAMQPRoutingKey,
+		contentType: "text/plain",
+		format:      format,
+	}
+	if u.Port() == "" {
+		port := defaultAMQPPort
+		if u.Scheme == "amqps" {
+			port = defaultAMQPSPort
+		}
+		o.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if len(u.Path) > 1 {
+		o.vhost = u.Path[1:]
+	}
+	if c.Exchange != nil {
+		o.exchange = *c.Exchange
+	}
+	if c.RoutingKey != "" {
+		o.routingKey = c.RoutingKey
+	}
+	if c.Format == "" || c.Format == "json" {
+		o.contentType = "application/json"
+	}
+	for _, t := range []string{o.exchange, o.routingKey} {
+		for _, p := range pathProperty.FindAllString(t, -1) {
+			if _, ok := pathProperties[strings.Trim(p, "%")]; !ok {
+				return nil, fmt.Errorf("unknown property %s in %s", p, t)
+			}
+		}
+	}
+
+	switch {
+	case c.Username != "":
+		o.username, o.password = c.Username, c.Password
+	case u.User != nil:
+		o.username = u.User.Username()
+		o.password, _ = u.User.Password()
+	}
+	if u.Scheme == "amqps" || c.TLS {
+		if o.tls, err = newClientTLSConfig(c); err != nil {
+			return nil, err
+		}
+		o.tls.ServerName = u.Hostname()
+	}
+
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	return o, nil
+}
+
+// expand returns template with the properties of m, turned into single
+// words of a topic exchange.
+func (o *amqpOutput) expand(template string, m *server.Message) string {
+	return pathProperty.ReplaceAllStringFunc(template, func(p string) string {
+		s := strings.ReplaceAll(pathProperties[strings.Trim(p, "%")](m), ".", "_")
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	})
+}
+
+// dial connects to the broker, authenticates with PLAIN and opens a
+// channel in confirm mode. Heartbeats are disabled, the confirms of every
+// batch telling whether the connection is still up.
+func (o *amqpOutput) dial() error {
+	conn, err := net.DialTimeout("tcp", o.addr, amqpTimeout)
+	if err != nil {
+		return err
+	}
+	if o.tls != nil {
+		tc := tls.Client(conn, o.tls)
+		tc.SetDeadline(time.Now().Add(amqpTimeout))
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tc
+	}
+	conn.SetDeadline(time.Now().Add(amqpTimeout))
+	o.conn, o.r, o.w = conn, bufio.NewReader(conn), bufio.NewWriter(conn)
+	o.frameMax, o.tag = amqpFrameMax, 0
+	if err := o.open(); err != nil {
+		o.close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+func (o *amqpOutput) open() error {
+	o.w.WriteString("AMQP\x00\x00\x09\x01")
+	if err := o.w.Flush(); err != nil {
+		return err
+	}
+
+	args, err := o.expect(0, amqpConnectionStart)
+	if err != nil {
+		return err
+	}
+	if len(args) < 6 {
+		return errors.New("invalid Connection.Start")
+	}
+	args = args[2:]
+	size := int(binary.BigEndian.Uint32(args))
+	if len(args) < 4+size+4 {
+		return errors.New("invalid Connection.Start")
+	}
+	mechanisms, _ := amqpReadLongStr(args[4+size:])
+	if !strings.Contains(" "+mechanisms+" ", " PLAIN ") {
+		return fmt.Errorf("broker does not support PLAIN authentication, only %s", mechanisms)
+	}
+
+	var props []byte
+	props = amqpShortStr(props, "product")
+	props = append(props, 'S')
+	props = amqpLongStr(props, "syslogd")
+	props = amqpShortStr(props, "connection_name")
+	props = append(props, 'S')
+	props = amqpLongStr(props, o.name)
+	args = binary.BigEndian.AppendUint32(nil, uint32(len(props)))
+	args = append(args, props...)
+	args = amqpShortStr(args, "PLAIN")
+	args = amqpLongStr(args, "\x00"+o.username+"\x00"+o.password)
+	args = amqpShortStr(args, "en_US")
+	o.writeMethod(0, amqpConnectionStartOk, args)
+	if err := o.w.Flush(); err != nil {
+		return err
+	}
+
+	if args, err = o.expect(0, amqpConnectionTune); err != nil {
+		return err
+	}
+	if len(args) < 8 {
+		return errors.New("invalid Connection.Tune")
+	}
+	if n := int(binary.BigEndian.Uint32(args[2:])); n > 0 && n < o.frameMax {
+		o.frameMax = n
+	}
+	args = binary.BigEndian.AppendUint16(nil, 1)
+	args = binary.BigEndian.AppendUint32(args, uint32(o.frameMax))
+	args = binary.BigEndian.AppendUint16(args, 0)
+	o.writeMethod(0, amqpConnectionTuneOk, args)
+	args = amqpShortStr(nil, o.vhost)
+	args = amqpShortStr(args, "")
+	args = append(args, 0)
+	o.writeMethod(0, amqpConnectionOpen, args)
+	if err := o.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := o.expect(0, amqpConnectionOpenOk); err != nil {
+		return err
+	}
+
+	o.writeMethod(amqpChannel, amqpChannelOpen, amqpShortStr(nil, ""))
+	o.writeMethod(amqpChannel, amqpConfirmSelect, []byte{0})
+	if err := o.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := o.expect(amqpChannel, amqpChannelOpenOk); err != nil {
+		return err
+	}
+	_, err = o.expect(amqpChannel, amqpConfirmSelectOk)
+	return err
+}
+
+func (o *amqpOutput) send(batch []*server.Message) error {
+	if o.conn == nil {
+		if err := o.dial(); err != nil {
+			return err
+		}
+	}
+	o.conn.SetDeadline(time.Now().Add(amqpTimeout))
+
+	// The messages are published first, then their confirms are read.
+	pending := make(map[int]*server.Message)
+	for _, m := range batch {
+		payload, err := o.format(m)
+		if err != nil {
+			log.Printf("output %s: %v", o.name, err)
+			continue
+		}
+		exchange, key := o.expand(o.exchange, m), o.expand(o.routingKey, m)
+		if len(exchange) > 255 || len(key) > 255 {
+			log.Printf("output %s: dropping a message whose exchange or routing key is over 255 bytes", o.name)
+			outputDropped.inc(o.name)
+			continue
+		}
+		o.publish(exchange, key, payload)
+		o.tag++
+		pending[int(o.tag)] = m
+	}
+	if err := o.w.Flush(); err != nil {
+		o.close()
+		return unackedError(pending, nil, err)
+	}
+
+	var failed []*server.Message
+	for len(pending) > 0 {
+		method, args, err := o.readMethod(amqpChannel)
+		if err != nil {
+			o.close()
+			return unackedError(pending, failed, err)
+		}
+		if method != amqpBasicAck && method != amqpBasicNack || len(args) < 9 {
+			continue
+		}
+		tag, multiple := int(binary.BigEndian.Uint64(args)), args[8]&1 != 0
+		for t, m := range pending {
+			if t == tag || multiple && t < tag {
+				delete(pending, t)
+				if method == amqpBasicNack {
+					failed = append(failed, m)
+				}
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return unackedError(nil, failed, errors.New("rejected by the broker"))
+	}
+	return nil
+}
+
+// publish writes the Basic.Publish of payload, its content header and its
+// body frames.
+func (o *amqpOutput) publish(exchange, key, payload string) {
+	args := binary.BigEndian.AppendUint16(nil, 0)
+	args = amqpShortStr(args, exchange)
+	args = amqpShortStr(args, key)
+	args = append(args, 0)
+	o.writeMethod(amqpChannel, amqpBasicPublish, args)
+
+	// content-type and delivery-mode 2, persistent
+	header := binary.BigEndian.AppendUint16(nil, 60)
+	header = binary.BigEndian.AppendUint16(header, 0)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	header = binary.BigEndian.AppendUint16(header, 0x8000|0x1000)
+	header = amqpShortStr(header, o.contentType)
+	header = append(header, 2)
+	amqpWriteFrame(o.w, amqpFrameHeader, amqpChannel, header)
+
+	for len(payload) > 0 {
+		n := min(len(payload), o.frameMax-8)
+		amqpWriteFrame(o.w, amqpFrameBody, amqpChannel, []byte(payload[:n]))
+		payload = payload[n:]
+	}
+}
+
+func (o *amqpOutput) writeMethod(channel uint16, method uint32, args []byte) {
+	payload := binary.BigEndian.AppendUint32(nil, method)
+	amqpWriteFrame(o.w, amqpFrameMethod, channel, append(payload, args...))
+}
+
+// expect reads the next method, which must be method on channel.
+func (o *amqpOutput) expect(channel uint16, method uint32) ([]byte, error) {
+	m, args, err := o.readMethod(channel)
+	if err != nil {
+		return nil, err
+	}
+	if m != method {
+		return nil, fmt.Errorf("unexpected method %d.%d instead of %d.%d", m>>16, m&0xffff, method>>16, method&0xffff)
+	}
+	return args, nil
+}
+
+// readMethod reads the next method on channel, skipping heartbeats, and
+// turns the closing of the connection or the channel by the broker into
+// an error, permanent for access refused.
+func (o *amqpOutput) readMethod(channel uint16) (uint32, []byte, error) {
+	for {
+		typ, ch, payload, err := amqpReadFrame(o.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if typ != amqpFrameMethod || len(payload) < 4 {
+			continue
+		}
+		method, args := binary.BigEndian.Uint32(payload), payload[4:]
+		switch method {
+		case amqpConnectionClose:
+			o.writeMethod(0, amqpConnectionCloseOk, nil)
+			o.w.Flush()
+			return 0, nil, amqpCloseError("connection", args)
+		case amqpChannelClose:
+			o.writeMethod(ch, amqpChannelCloseOk, nil)
+			o.w.Flush()
+			return 0, nil, amqpCloseError("channel", args)
+		}
+		if ch == channel {
+			return method, args, nil
+		}
+	}
+}
+
+// amqpCloseError returns the reason of the Connection.Close or
+// Channel.Close whose arguments are args.
+func amqpCloseError(what string, args []byte) error {
+	if len(args) < 3 {
+		return fmt.Errorf("amqp: %s closed", what)
+	}
+	code := binary.BigEndian.Uint16(args)
+	text, _ := amqpReadShortStr(args[2:])
+	err := fmt.Errorf("amqp: %s closed: %d %s", what, code, text)
+	if code == 403 {
+		return permanentError{err}
+	}
+	return err
+}
+
+func amqpWriteFrame(w *bufio.Writer, typ byte, channel uint16, payload []byte) {
+	var head [7]byte
+	head[0] = typ
+	binary.BigEndian.PutUint16(head[1:], channel)
+	binary.BigEndian.PutUint32(head[3:], uint32(len(payload)))
+	w.Write(head[:])
+	w.Write(payload)
+	w.WriteByte(amqpFrameEnd)
+}
+
+func amqpReadFrame(r *bufio.Reader) (byte, uint16, []byte, error) {
+	var head [7]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(head[3:])
+	if size > amqpFrameMax {
+		return 0, 0, nil, fmt.Errorf("amqp frame of %d bytes over %d", size, amqpFrameMax)
+	}
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	if payload[size] != amqpFrameEnd {
+		return 0, 0, nil, errors.New("invalid amqp frame end")
+	}
+	return head[0], binary.BigEndian.Uint16(head[1:]), payload[:size], nil
+}
+
+func amqpShortStr(b []byte, s string) []byte {
+	return append(append(b, byte(len(s))), s...)
+}
+
+func amqpLongStr(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint32(b, uint32(len(s))), s...)
+}
+
+func amqpReadShortStr(b []byte) (string, []byte) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil
+	}
+	return string(b[1 : 1+b[0]]), b[1+b[0]:]
+}
+
+func amqpReadLongStr(b []byte) (string, []byte) {
+	if len(b) < 4 {
+		return "", nil
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < n {
+		return "", nil
+	}
+	return string(b[4 : 4+n]), b[4+n:]
+}
+
+func (o *amqpOutput) close() {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+}
+
+func (o *amqpOutput) Close() error {
+	err := o.batchOutput.Close()
+	if o.conn != nil {
+		o.conn.SetDeadline(time.Now().Add(amqpTimeout))
+		args := binary.BigEndian.AppendUint16(nil, 200)
+		args = amqpShortStr(args, "")
+		args = binary.BigEndian.AppendUint32(args, 0)
+		o.writeMethod(0, amqpConnectionClose, args)
+		if o.w.Flush() == nil {
+			o.expect(0, amqpConnectionCloseOk)
+		}
+	}
+	o.close()
+	return err
+}
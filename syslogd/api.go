@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const defaultRecentSince = 5 * time.Minute
+
+// recentHandler serves the messages of the ring buffer as a JSON array,
+// oldest first: those received since the since parameter, a time or a
+// duration ago as for syslogd query (5m by default), and at most the limit
+// newest of them.
+func recentHandler(w http.ResponseWriter, r *http.Request) {
+	if recent == nil {
+		http.Error(w, "the ring buffer is disabled", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	since := now.Add(-defaultRecentSince)
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		if since, err = parseQueryTime(s, now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	msgs := recent.since(since)
+	if s := r.FormValue("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit "+s, http.StatusBadRequest)
+			return
+		}
+		if limit > 0 && len(msgs) > limit {
+			msgs = msgs[len(msgs)-limit:]
+		}
+	}
+
+	out := make([]jsonMessage, len(msgs))
+	for i, m := range msgs {
+		out[i] = newJSONMessage(m)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(out)
+}
+
+const (
+	defaultMessagesLimit = 100
+	maxMessagesLimit     = 1000
+)
+
+// messagesPage is a page of /api/v1/messages. Next is the before parameter
+// of the following page, if there may be one.
+type messagesPage struct {
+	Messages []jsonMessage `json:"messages"`
+	Next     string        `json:"next,omitempty"`
+}
+
+// messagesHandler searches the messages of the store if db is set, or else
+// those of the ring buffer, newest first. The parameters host, tag,
+// severity, since, until, q and search filter them as the flags of syslogd
+// query do; limit and before page through the results.
+func messagesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if db == nil && recent == nil {
+			http.Error(w, "neither the store nor the ring buffer is enabled", http.StatusNotFound)
+			return
+		}
+		f, err := newMessageFilter(r.FormValue("since"), r.FormValue("until"), r.FormValue("host"), r.FormValue("tag"), severityParam(r), r.FormValue("q"), r.FormValue("search"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.search != "" && db == nil {
+			http.Error(w, "search requires the store", http.StatusBadRequest)
+			return
+		}
+		limit := defaultMessagesLimit
+		if s := r.FormValue("limit"); s != "" {
+			if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+				http.Error(w, "invalid limit "+s, http.StatusBadRequest)
+				return
+			}
+			limit = min(limit, maxMessagesLimit)
+		}
+		before := uint64(math.MaxUint64)
+		if s := r.FormValue("before"); s != "" {
+			if before, err = strconv.ParseUint(s, 10, 64); err != nil {
+				http.Error(w, "invalid before "+s, http.StatusBadRequest)
+				return
+			}
+		}
+
+		var msgs []*server.Message
+		var last uint64
+		if db != nil {
+			msgs, last, err = storeMessages(db, f, before, limit)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			recent.scan(before, func(seq uint64, m *server.Message) bool {
+				if f.match(m) {
+					msgs, last = append(msgs, m), seq
+				}
+				return len(msgs) < limit
+			})
+		}
+
+		page := messagesPage{Messages: make([]jsonMessage, len(msgs))}
+		for i, m := range msgs {
+			page.Messages[i] = newJSONMessage(m)
+		}
+		if len(msgs) == limit {
+			page.Next = strconv.FormatUint(last, 10)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.Encode(page)
+	}
+}
+
+// storeMessages returns the limit messages of the store that match f with
+// ids below before, newest first, and the id of the last one.
+func storeMessages(db *sql.DB, f messageFilter, before uint64, limit int) ([]*server.Message, uint64, error) {
+	where, params := f.where()
+	if before < math.MaxInt64 {
+		where, params = append(where, "id < ?"), append(params, int64(before))
+	}
+	query := "SELECT id, record FROM messages"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var msgs []*server.Message
+	var last uint64
+	for rows.Next() {
+		var id int64
+		var record []byte
+		if err := rows.Scan(&id, &record); err != nil {
+			return nil, 0, err
+		}
+		m, err := decodeMessage(record)
+		if err != nil {
+			return nil, 0, err
+		}
+		msgs, last = append(msgs, m), uint64(id)
+	}
+	return msgs, last, rows.Err()
+}
+
+// severityParam returns the severity parameter of r, also given as
+// severity<=err which parses as severity< set to err.
+func severityParam(r *http.Request) string {
+	if s := r.FormValue("severity"); s != "" {
+		return s
+	}
+	return r.FormValue("severity<")
+}
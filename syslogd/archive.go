@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const archiveScanInterval = 10 * time.Second
+
+// archiveOutput collects messages into files in a spool directory, one
+// per hour or day, and uploads them compressed to an S3 compatible object
+// store. Files that failed to upload stay in the spool directory until a
+// later attempt succeeds, including after a restart. With encryption, the
+// spool files and the objects are encrypted.
+type archiveOutput struct {
+	mu       sync.Mutex
+	name     string
+	dir      string
+	period   string
+	maxSize  int64
+	compress string
+	format   formatter
+	store    *s3Client
+	prefix   string
+	host     string
+	atRest   *atRest
+
+	f       *os.File
+	w       *bufio.Writer
+	sealed  *sealWriter
+	size    int64
+	started time.Time
+	kick    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newArchiveOutput(name string, c outputConfig, format formatter) (*archiveOutput, error) {
+	o, err := archiveOutputFor(name, c, format)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(o.dir, 0750); err != nil {
+		return nil, err
+	}
+	if o.host, err = os.Hostname(); err != nil {
+		return nil, err
+	}
+
+	go o.run()
+	return o, nil
+}
+
+// archiveOutputFor returns the output of c without creating its spool
+// directory.
+func archiveOutputFor(name string, c outputConfig, format formatter) (*archiveOutput, error) {
+	if c.URL == "" || c.Bucket == "" {
+		return nil, fmt.Errorf("s3 output requires a url and a bucket")
+	}
+	maxSize, err := parseSize(c.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &archiveOutput{
+		name:     name,
+		dir:      c.Path,
+		period:   c.Rotate,
+		maxSize:  maxSize,
+		compress: c.Compress,
+		format:   format,
+		prefix:   c.Prefix,
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	switch o.period {
+	case "":
+		o.period = "hourly"
+	case "hourly", "daily":
+	default:
+		return nil, fmt.Errorf("invalid rotate %q: want hourly or daily", c.Rotate)
+	}
+	switch o.compress {
+	case "":
+		o.compress = "gzip"
+	case "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("invalid compress %q: want gzip or zstd", c.Compress)
+	}
+	if o.dir == "" {
+		o.dir = archiveSpool(name)
+	}
+	if o.store, err = newS3Client(c); err != nil {
+		return nil, err
+	}
+	if o.atRest, err = newAtRest(c); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *archiveOutput) Write(m *server.Message) error {
+	line, err := o.format(m)
+	if err != nil {
+		return err
+	}
+	line += "\n"
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.f != nil && o.due(int64(len(line))) {
+		if err := o.finish(); err != nil {
+			return err
+		}
+	}
+	if o.f == nil {
+		if err := o.open(); err != nil {
+			return err
+		}
+	}
+
+	if o.sealed != nil {
+		_, err = o.sealed.WriteString(line)
+	} else {
+		_, err = o.w.WriteString(line)
+	}
+	o.size += int64(len(line))
+	return err
+}
+
+func (o *archiveOutput) flush() error {
+	if o.sealed != nil {
+		if err := o.sealed.Flush(); err != nil {
+			return err
+		}
+	}
+	return o.w.Flush()
+}
+
+func (o *archiveOutput) due(n int64) bool {
+	if o.maxSize > 0 && o.size+n > o.maxSize {
+		return true
+	}
+	return !periodStart(o.started, o.period).Equal(periodStart(time.Now(), o.period))
+}
+
+func (o *archiveOutput) open() error {
+	o.started = time.Now()
+	name := filepath.Join(o.dir, o.started.UTC().Format(rotatedLayout+".000000000")+".log")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	o.f = f
+	o.w = bufio.NewWriter(f)
+	o.sealed = nil
+	o.size = 0
+	if o.atRest != nil {
+		aead, header, err := o.atRest.newKey()
+		if err != nil {
+			f.Close()
+			os.Remove(name)
+			o.f = nil
+			return err
+		}
+		o.w.Write(header)
+		o.sealed = &sealWriter{w: o.w, aead: aead}
+	}
+	return nil
+}
+
+// finish closes and compresses the current file, leaving it for the
+// uploader.
+func (o *archiveOutput) finish() error {
+	name := o.f.Name()
+	if o.sealed != nil {
+		o.sealed.Close()
+	}
+	o.flush()
+	err := o.f.Close()
+	o.f = nil
+	if err != nil {
+		return err
+	}
+	if err := compressFile(name, o.compress, o.atRest); err != nil {
+		return err
+	}
+
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run flushes the current file and closes it at the end of its period
+// even while no messages arrive, and uploads the finished files.
+func (o *archiveOutput) run() {
+	defer close(o.done)
+
+	t := time.NewTicker(archiveScanInterval)
+	defer t.Stop()
+	retry := time.Duration(0)
+	var next time.Time
+	for {
+		select {
+		case <-t.C:
+			o.mu.Lock()
+			if o.f != nil {
+				if o.due(0) {
+					if err := o.finish(); err != nil {
+						log.Printf("output %s: %v", o.name, err)
+					}
+				} else {
+					o.flush()
+				}
+			}
+			o.mu.Unlock()
+		case <-o.kick:
+		case <-o.stop:
+			o.upload()
+			return
+		}
+
+		if time.Now().Before(next) {
+			continue
+		}
+		if err := o.upload(); err != nil {
+			retry = min(max(2*retry, time.Second), maxRetryInterval)
+			next = time.Now().Add(retry)
+			log.Printf("output %s: %v, retrying in %v", o.name, err, retry)
+			continue
+		}
+		retry = 0
+	}
+}
+
+// upload sends the finished files of the spool directory, oldest first.
+func (o *archiveOutput) upload() error {
+	var names []string
+	for _, pattern := range []string{"*.log.gz", "*.log.zst"} {
+		matches, _ := filepath.Glob(filepath.Join(o.dir, pattern))
+		names = append(names, matches...)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		base := filepath.Base(name)
+		started, err := time.Parse(rotatedLayout, base[:len(rotatedLayout)])
+		if err != nil {
+			continue
+		}
+		prefix := indexLayout.ReplaceAllStringFunc(o.prefix, func(layout string) string {
+			return started.Format(layout[1 : len(layout)-1])
+		})
+		key := prefix + o.host + "-" + base
+
+		if err := o.store.putFile(key, name); err != nil {
+			return fmt.Errorf("upload %s: %v", key, err)
+		}
+		os.Remove(name)
+	}
+	return nil
+}
+
+func (o *archiveOutput) Close() error {
+	o.mu.Lock()
+	var err error
+	if o.f != nil {
+		err = o.finish()
+	}
+	o.mu.Unlock()
+
+	close(o.stop)
+	<-o.done
+	return err
+}
+
+// s3Client uploads objects with path style requests signed with AWS
+// Signature Version 4, which MinIO and the XML API of GCS accept as well.
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	client    *http.Client
+}
+
+func newS3Client(c outputConfig) (*s3Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.URL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	client, err := newHTTPClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &s3Client{
+		endpoint:  u,
+		bucket:    c.Bucket,
+		region:    c.Region,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    client,
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.accessKey == "" {
+		s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("s3 output requires access_key and secret_key")
+	}
+	return s, nil
+}
+
+func (s *s3Client) putFile(key, name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	u := *s.endpoint
+	u.Path += "/" + s.bucket + "/" + key
+	u.RawPath = s3Escape(u.Path)
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte(encMagic)):
+		req.Header.Set("Content-Type", "application/octet-stream")
+	case strings.HasSuffix(name, ".gz"):
+		req.Header.Set("Content-Type", "application/gzip")
+	default:
+		req.Header.Set("Content-Type", "application/zstd")
+	}
+	signV4(req, data, time.Now(), "s3", s.region, s.accessKey, s.secretKey, s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+	return checkResponse(resp)
+}
+
+// signV4 adds the AWS Signature Version 4 headers of service to req.
+func signV4(req *http.Request, payload []byte, now time.Time, service, region, accessKey, secretKey, token string) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	signed := map[string]string{"host": req.URL.Host}
+	var names []string
+	for name := range req.Header {
+		signed[strings.ToLower(name)] = req.Header.Get(name)
+	}
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(signed[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// s3Escape encodes a path as SigV4 expects, everything but the
+// unreserved characters and the slashes.
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// archiveSpool is the spool directory of the output name without a path.
+func archiveSpool(name string) string {
+	return filepath.Join(os.TempDir(), "syslogd-"+name)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// auditSDID holds the details of an audit event.
+const auditSDID = "audit@32473"
+
+// Audit events, the MSGID of their messages.
+const (
+	auditStart         = "start"
+	auditStop          = "stop"
+	auditReload        = "reload"
+	auditReloadFailed  = "reload-failed"
+	auditListenerStart = "listener-start"
+	auditListenerStop  = "listener-stop"
+	auditAuthFailure   = "auth-failure"
+)
+
+// auditLog records the administrative events of syslogd, and the senders
+// failing to authenticate, to the output of the audit section of the
+// config, apart from the routed messages. A nil auditLog records nothing.
+type auditLog struct {
+	stage    *outputStage
+	hostname string
+}
+
+func newAuditLog(c *config) (*auditLog, error) {
+	if c.Audit.Type == "" {
+		return nil, nil
+	}
+	o, err := openOutput("audit", c.Audit)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %v", err)
+	}
+	a := &auditLog{stage: newOutputStage("audit", o, c.Pipeline)}
+	a.hostname, _ = os.Hostname()
+	return a, nil
+}
+
+// record writes an event of the severity, with the parameters given as
+// name, value pairs.
+func (a *auditLog) record(event string, sev server.Severity, msg string, params ...string) {
+	if a == nil {
+		return
+	}
+	sd := map[string]string{"event": event}
+	for i := 0; i+1 < len(params); i += 2 {
+		if params[i+1] != "" {
+			sd[params[i]] = params[i+1]
+		}
+	}
+	now := time.Now()
+	a.stage.write(&server.Message{
+		Time:           now,
+		Facility:       server.Security,
+		Severity:       sev,
+		Timestamp:      now,
+		Hostname:       a.hostname,
+		Tag:            "syslogd",
+		Content:        msg,
+		Tag1:           "syslogd",
+		Content1:       msg,
+		Version:        1,
+		AppName:        "syslogd",
+		ProcID:         strconv.Itoa(os.Getpid()),
+		MsgID:          event,
+		StructuredData: map[string]map[string]string{auditSDID: sd},
+		Raw:            msg,
+	})
+}
+
+func (a *auditLog) start(configFile string) {
+	a.record(auditStart, server.Notice, "syslogd started", "config", configFile, "sha256", fileSum(configFile), "uid", strconv.Itoa(os.Getuid()))
+}
+
+func (a *auditLog) stop() {
+	a.record(auditStop, server.Notice, "syslogd stopped")
+}
+
+// reloaded records a reload, with the parts of the config it changed.
+func (a *auditLog) reloaded(configFile string, prev, next *config) {
+	var changed []string
+	for _, p := range []struct {
+		name       string
+		prev, next interface{}
+	}{
+		{"rules", prev.Rules, next.Rules},
+		{"outputs", prev.Outputs, next.Outputs},
+		{"tenants", prev.Tenants, next.Tenants},
+		{"transforms", prev.Transforms, next.Transforms},
+		{"redact", prev.Redact, next.Redact},
+		{"alerts", prev.Alerts, next.Alerts},
+		{"acl", [2]stringList{prev.Allow, prev.Deny}, [2]stringList{next.Allow, next.Deny}},
+		{"tls", prev.TLS, next.TLS},
+		{"http_tokens", prev.HTTPTokens, next.HTTPTokens},
+	} {
+		if !reflect.DeepEqual(p.prev, p.next) {
+			changed = append(changed, p.name)
+		}
+	}
+	sort.Strings(changed)
+	msg := "configuration reloaded"
+	if len(changed) > 0 {
+		msg += ", changed " + strings.Join(changed, ", ")
+	}
+	a.record(auditReload, server.Notice, msg, "config", configFile, "sha256", fileSum(configFile), "changed", strings.Join(changed, ","))
+}
+
+func (a *auditLog) reloadFailed(configFile string, err error) {
+	a.record(auditReloadFailed, server.Warning, "configuration reload failed: "+err.Error(), "config", configFile, "error", err.Error())
+}
+
+func (a *auditLog) listenerStarted(name string) {
+	a.record(auditListenerStart, server.Notice, "listening on "+name, "listener", name)
+}
+
+func (a *auditLog) listenerStopped(name string) {
+	a.record(auditListenerStop, server.Notice, "stopped listening on "+name, "listener", name)
+}
+
+// authFailed records a sender refused for its credentials: a bearer token
+// or a TLS handshake.
+func (a *auditLog) authFailed(listener, addr, reason string) {
+	a.record(auditAuthFailure, server.Warning, fmt.Sprintf("%s: %s: %s", listener, addr, reason), "listener", listener, "src", addr, "reason", reason)
+}
+
+// close writes the events recorded and closes the output.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.stage.close()
+	if err := a.stage.out.Close(); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// fileSum returns the SHA-256 of the file at path, or "" if unreadable.
+func fileSum(path string) string {
+	data, err := os.ReadFile(path)
+	if path == "" || err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultBatchSize     = 500
+	defaultFlushInterval = time.Second
+	defaultMaxRetries    = 5
+)
+
+// permanentError marks a failure that retrying will not fix.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// partialError reports that only some messages of a batch failed, and
+// only those are to be sent again.
+type partialError struct {
+	err    error
+	failed []*server.Message
+}
+
+func (e partialError) Error() string { return e.err.Error() }
+func (e partialError) Unwrap() error { return e.err }
+
+// unackedError returns err as the partial failure of the messages
+// pending and failed, or err alone if there are none.
+func unackedError(pending map[int]*server.Message, failed []*server.Message, err error) error {
+	for _, m := range pending {
+		failed = append(failed, m)
+	}
+	if len(failed) == 0 {
+		return err
+	}
+	return partialError{err: fmt.Errorf("%d messages not acknowledged: %v", len(failed), err), failed: failed}
+}
+
+// batchOutput collects messages and hands them to send in batches of up
+// to size messages or after interval, retrying failed batches with
+// exponential backoff.
+type batchOutput struct {
+	name     string
+	size     int
+	interval time.Duration
+	retries  int
+	send     func([]*server.Message) error
+
+	mu      sync.Mutex
+	batch   []*server.Message
+	sending int   // messages of the batch being sent
+	err     error // of the last send
+	sendMu  sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newBatchOutput(name string, c outputConfig, send func([]*server.Message) error) *batchOutput {
+	o := &batchOutput{
+		name:     name,
+		size:     c.BatchSize,
+		interval: c.FlushInterval,
+		retries:  c.MaxRetries,
+		send:     send,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if o.size <= 0 {
+		o.size = defaultBatchSize
+	}
+	if o.interval <= 0 {
+		o.interval = defaultFlushInterval
+	}
+	if o.retries <= 0 {
+		o.retries = defaultMaxRetries
+	}
+
+	go o.run()
+	return o
+}
+
+func (o *batchOutput) run() {
+	defer close(o.done)
+
+	t := time.NewTicker(o.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			o.flush()
+		case <-o.stop:
+			o.flush()
+			return
+		}
+	}
+}
+
+// Write adds m to the batch, sending the batch when it is full.
+func (o *batchOutput) Write(m *server.Message) error {
+	o.mu.Lock()
+	o.batch = append(o.batch, m)
+	full := len(o.batch) >= o.size
+	o.mu.Unlock()
+
+	if full {
+		o.flush()
+	}
+	return nil
+}
+
+// pending returns the number of messages waiting for the next batch.
+func (o *batchOutput) pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.batch)
+}
+
+// unsent returns the number of messages not sent yet, those of the batch
+// being sent included.
+func (o *batchOutput) unsent() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.batch) + o.sending
+}
+
+func (o *batchOutput) check() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err
+}
+
+func (o *batchOutput) flush() {
+	o.sendMu.Lock()
+	defer o.sendMu.Unlock()
+
+	o.mu.Lock()
+	batch := o.batch
+	o.batch = nil
+	o.sending = len(batch)
+	o.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	defer func() {
+		o.mu.Lock()
+		o.sending = 0
+		o.mu.Unlock()
+	}()
+
+	retry := time.Second
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := o.send(batch)
+		outputSendSeconds.observe(time.Since(start).Seconds(), o.name)
+		o.mu.Lock()
+		o.err = err
+		o.mu.Unlock()
+		if err == nil {
+			return
+		}
+
+		var perm permanentError
+		if errors.As(err, &perm) || attempt > o.retries {
+			log.Printf("output %s: dropping %d messages: %v", o.name, len(batch), err)
+			outputDropped.add(uint64(len(batch)), o.name)
+			return
+		}
+		var partial partialError
+		if errors.As(err, &partial) {
+			batch = partial.failed
+			o.mu.Lock()
+			o.sending = len(batch)
+			o.mu.Unlock()
+		}
+		log.Printf("output %s: %v, retrying in %v", o.name, err, retry)
+		time.Sleep(retry)
+		retry = min(2*retry, maxRetryInterval)
+	}
+}
+
+func (o *batchOutput) Close() error {
+	close(o.stop)
+	<-o.done
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// cefHeader are the names of the fields of the CEF header after the
+// version, in their order.
+var cefHeader = []string{"deviceVendor", "deviceProduct", "deviceVersion", "signatureID", "name", "severity"}
+
+// parseCEFMessage parses the CEF payload of m, which may follow other text
+// in the message, as with a tag parsed out of "CEF:0|...". It returns the
+// header fields and the extensions, where the header wins over an
+// extension of the same name, or nil if m carries no CEF payload.
+func parseCEFMessage(m *server.Message) map[string]string {
+	s := m.Content
+	i := strings.Index(s, "CEF:")
+	if i < 0 {
+		s = m.Raw
+		if i = strings.Index(s, "CEF:"); i < 0 {
+			return nil
+		}
+	}
+	return parseCEF(s[i+len("CEF:"):])
+}
+
+// parseCEF parses "Version|Device Vendor|...|Severity|Extension", where
+// \| and \\ are escaped in the header, and \=, \\, \n and \r in the values
+// of the extension.
+func parseCEF(s string) map[string]string {
+	var fields []string
+	var b strings.Builder
+	for i := 0; i < len(s) && len(fields) < 7; i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && (s[i+1] == '|' || s[i+1] == '\\'):
+			i++
+			b.WriteByte(s[i])
+		case c == '|':
+			fields = append(fields, b.String())
+			b.Reset()
+			s, i = s[i+1:], -1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if len(fields) < 7 {
+		return nil
+	}
+
+	f := parseCEFExtension(s)
+	f["version"] = fields[0]
+	for i, name := range cefHeader {
+		f[name] = fields[i+1]
+	}
+	return f
+}
+
+// parseCEFExtension parses space separated key=value pairs, where values
+// may contain spaces and the key of the next pair starts after the last
+// space before an unescaped =. An = after anything but a key is kept in
+// the value, as in URLs.
+func parseCEFExtension(s string) map[string]string {
+	f := make(map[string]string)
+	key, start := "", -1
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '=':
+			k := strings.LastIndexByte(s[:i], ' ') + 1
+			if k <= start || !isCEFKey(s[k:i]) {
+				continue
+			}
+			if start >= 0 && k > 0 {
+				f[key] = unescapeCEF(strings.TrimRight(s[start:k-1], " "))
+			}
+			key, start = s[k:i], i+1
+		}
+	}
+	if start >= 0 {
+		f[key] = unescapeCEF(strings.TrimRight(s[start:], " "))
+	}
+	return f
+}
+
+func isCEFKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '[' || c == ']') {
+			return false
+		}
+	}
+	return true
+}
+
+var cefUnescaper = strings.NewReplacer(`\=`, "=", `\\`, `\`, `\n`, "\n", `\r`, "\r", `\|`, "|")
+
+func unescapeCEF(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return cefUnescaper.Replace(s)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// defaultChatTemplate renders an alert fired for Slack and Teams, which
+// both take Markdown.
+const defaultChatTemplate = `*Alert {{.Alert}}*{{if .Group}} for {{.Group}}{{end}}` +
+	`{{if gt .Count 1}}, {{.Count}} messages{{end}}` +
+	`{{if .Suppressed}} ({{.Suppressed}} more held back){{end}}
+{{range .Messages}}
+` + "`{{.Raw}}`" + `{{end}}`
+
+// chatAction posts the alerts fired to a Slack or Microsoft Teams incoming
+// webhook, as the text of its template run on the firing.
+type chatAction struct {
+	kind   string // slack or teams
+	url    string
+	tmpl   *template.Template
+	client *http.Client
+}
+
+func newChatAction(c actionConfig) (*chatAction, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("%s action requires a url", c.Type)
+	}
+	text := c.Template
+	if text == "" {
+		text = defaultChatTemplate
+	}
+	tmpl, err := template.New(c.Type).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newHTTPClient(outputConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return &chatAction{kind: c.Type, url: c.URL, tmpl: tmpl, client: client}, nil
+}
+
+func (a *chatAction) notify(f *firing) error {
+	var b strings.Builder
+	if err := a.tmpl.Execute(&b, f); err != nil {
+		return err
+	}
+
+	var payload interface{}
+	switch a.kind {
+	case "slack":
+		payload = map[string]string{"text": b.String()}
+	case "teams":
+		payload = map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  "Alert " + f.Alert,
+			"text":     b.String(),
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+func (a *chatAction) close() {}
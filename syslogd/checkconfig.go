@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/haccht/syslog_tools/plugin"
+	"gopkg.in/yaml.v3"
+)
+
+// runCheckConfig validates a config file as syslogd would load it at
+// startup, reporting every error found with the line of the file it is
+// about, and exits non-zero if there are any.
+func runCheckConfig(args []string) {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check-config file\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Outputs are not opened: files, spool and queue directories are not created, nothing is connected to and exec commands are not started.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	path := fs.Arg(0)
+	errs := checkConfig(path)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", path)
+}
+
+// checkConfig returns the errors of the config file at path, as
+// path:line: error where the line is known.
+func checkConfig(path string) []error {
+	c, err := decodeConfigFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	var doc yaml.Node
+	yaml.NewDecoder(bytes.NewReader(data)).Decode(&doc)
+
+	var errs []error
+	report := func(err error, keys ...string) {
+		for _, err := range splitErrors(atKeys(err, keys...)) {
+			if n := nodeAt(&doc, configErrorPath(err)...); n != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: %v", path, n.Line, err))
+			} else {
+				errs = append(errs, fmt.Errorf("%s: %v", path, err))
+			}
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		report(err)
+	}
+
+	tls := false
+	check := func(l string, keys ...string) {
+		scheme, _, _, err := parseListenURL(l, false)
+		if err != nil {
+			report(err, keys...)
+			return
+		}
+		if (scheme == "http" || scheme == "https") && len(c.HTTPTokens) == 0 {
+			report(fmt.Errorf("%s: http listeners require http_tokens", l), keys...)
+		}
+		tls = tls || scheme == "tls" || scheme == "dtls" || scheme == "https"
+	}
+	for i, l := range c.Listen {
+		check(l, "listen", strconv.Itoa(i))
+	}
+	for i, t := range c.Tenants {
+		for j, l := range t.Listen {
+			check(l, "tenants", strconv.Itoa(i), "listen", strconv.Itoa(j))
+		}
+	}
+	if _, err := newACL(c.Allow, c.Deny); err != nil {
+		key := "allow"
+		if len(c.Allow) == 0 {
+			key = "deny"
+		}
+		report(err, key)
+	}
+
+	// The certificate is checked when there are TLS listeners, as at
+	// startup, or when the config names one.
+	files := c.TLS
+	switch {
+	case files.Cert == "" && len(files.ACME.Domains) > 0:
+		if err := files.ACME.validate(); err != nil {
+			report(err, "tls", "acme")
+		} else if files.ACME.CA != "" {
+			if _, err := os.ReadFile(files.ACME.CA); err != nil {
+				report(err, "tls", "acme", "ca")
+			}
+		}
+	case tls || files.Cert != "":
+		if _, err := loadServerTLSConfig(files, nil); err != nil {
+			report(err, "tls")
+		}
+	}
+
+	if err := newQuotas().Set(c.Quotas); err != nil {
+		report(err)
+	}
+	if err := newMultiline(nil).Set(c.Multiline); err != nil {
+		report(err)
+	}
+	if err := newGeoIP().Set(c.GeoIP); err != nil {
+		report(err, "geoip")
+	}
+	for i, ic := range c.Inputs {
+		if _, ok := plugin.LookupInput(ic.Type); !ok {
+			report(fmt.Errorf("input%d: unknown input type %q", i+1, ic.Type), "inputs", strconv.Itoa(i))
+		}
+	}
+
+	if c.Audit.Type != "" {
+		if err := checkOutput("audit", c.Audit); err != nil {
+			report(err, "audit")
+		}
+	}
+
+	r, err := newRouterWith(c, func(name string, oc outputConfig) (output, error) {
+		return discardOutput{}, checkOutput(name, oc)
+	})
+	if err != nil {
+		report(err)
+	} else {
+		r.Close()
+	}
+	return errs
+}
+
+// checkOutput validates oc as openOutput does, without opening anything.
+func checkOutput(name string, oc outputConfig) error {
+	if err := checkFields(oc); err != nil {
+		return err
+	}
+	if oc.Queue.Dir != "" {
+		if _, err := parseSize(oc.Queue.MaxSize); err != nil {
+			return err
+		}
+		if _, err := parseSize(oc.Queue.SegmentSize); err != nil {
+			return err
+		}
+	}
+	if _, err := newFormatter(oc.Format); err != nil {
+		return err
+	}
+
+	var err error
+	switch oc.Type {
+	case "file":
+		if strings.Contains(oc.Path, "%") {
+			if _, err := newDynamicFileOutput(oc, nil); err != nil {
+				return err
+			}
+		}
+		_, err = fileOutputFor(oc, nil)
+	case "sqlite":
+		if oc.Path == "" {
+			err = errors.New("sqlite output requires a path")
+		}
+	case "s3":
+		_, err = archiveOutputFor(name, oc, nil)
+	case "journald":
+		_, err = journaldOutputFor(oc, nil)
+	default:
+		if _, ok := plugin.LookupOutput(oc.Type); ok {
+			return nil
+		}
+		var o output
+		if o, err = newOutput(name, oc); err == nil {
+			o.Close()
+		}
+	}
+	return err
+}
+
+func (c *config) tenantIndex(name string) int {
+	for i, t := range c.Tenants {
+		if t.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// nodeAt returns the node of n at keys, mapping keys and sequence indexes,
+// the deepest found if not all are. Mapping entries are found at their key.
+func nodeAt(n *yaml.Node, keys ...string) *yaml.Node {
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	if len(keys) == 0 || n.Kind == 0 {
+		return nil
+	}
+	var found *yaml.Node
+	for _, key := range keys {
+		var next, at *yaml.Node
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == key {
+					at, next = n.Content[i], n.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(n.Content) {
+				at, next = n.Content[i], n.Content[i]
+			}
+		}
+		if next == nil {
+			break
+		}
+		found, n = at, next
+	}
+	return found
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// clickhouseTypes translates the column types of dbFields.
+var clickhouseTypes = map[string]string{
+	"timestamptz": "DateTime64(6, 'UTC')",
+	"smallint":    "UInt8",
+	"text":        "String",
+	"jsonb":       "String",
+}
+
+// clickhouseOutput inserts messages into a ClickHouse MergeTree table
+// through the HTTP interface, one INSERT per batch.
+type clickhouseOutput struct {
+	*batchOutput
+	url     string
+	table   string
+	columns []dbColumn
+	auth    func(*http.Request)
+	client  *http.Client
+	created bool
+}
+
+func newClickHouseOutput(name string, c outputConfig) (*clickhouseOutput, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("clickhouse output requires a url")
+	}
+	columns, err := dbColumnsFor(c)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newHTTPClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &clickhouseOutput{
+		url:     strings.TrimSuffix(c.URL, "/") + "/",
+		table:   c.Table,
+		columns: columns,
+		client:  client,
+	}
+	if o.table == "" {
+		o.table = defaultDBTable
+	}
+	if c.Username != "" {
+		o.auth = func(req *http.Request) {
+			req.Header.Set("X-ClickHouse-User", c.Username)
+			req.Header.Set("X-ClickHouse-Key", c.Password)
+		}
+	}
+
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	return o, nil
+}
+
+func (o *clickhouseOutput) quotedTable() string {
+	parts := strings.Split(o.table, ".")
+	for i, p := range parts {
+		parts[i] = "`" + strings.ReplaceAll(p, "`", "\\`") + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+// create creates the table unless it exists, partitioned by day and
+// ordered by the first time column.
+func (o *clickhouseOutput) create() error {
+	defs := make([]string, len(o.columns))
+	var order []string
+	for i, col := range o.columns {
+		typ := clickhouseTypes[col.field.typ]
+		if col.field.typ == "jsonb" {
+			typ = "Nullable(String)"
+		}
+		defs[i] = fmt.Sprintf("`%s` %s", col.name, typ)
+		if col.field.typ == "timestamptz" && len(order) == 0 {
+			order = append(order, "`"+col.name+"`")
+		}
+	}
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) ENGINE = MergeTree", o.quotedTable(), strings.Join(defs, ", "))
+	if len(order) > 0 {
+		query += fmt.Sprintf(" PARTITION BY toDate(%s) ORDER BY %s", order[0], order[0])
+	} else {
+		query += " ORDER BY tuple()"
+	}
+	return o.post(query, nil)
+}
+
+func (o *clickhouseOutput) send(batch []*server.Message) error {
+	if !o.created {
+		if err := o.create(); err != nil {
+			return err
+		}
+		o.created = true
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetEscapeHTML(false)
+	row := make(map[string]interface{}, len(o.columns))
+	for _, m := range batch {
+		for _, col := range o.columns {
+			v := col.field.get(m)
+			if t, ok := v.(time.Time); ok {
+				v = t.UTC().Format("2006-01-02 15:04:05.000000")
+			}
+			row[col.name] = v
+		}
+		if err := enc.Encode(row); err != nil {
+			return permanentError{err}
+		}
+	}
+	return o.post(fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", o.quotedTable()), &body)
+}
+
+// post runs query, reading the data to insert from body.
+func (o *clickhouseOutput) post(query string, body io.Reader) error {
+	u := o.url + "?query=" + url.QueryEscape(query)
+	if body == nil {
+		u, body = o.url, strings.NewReader(query)
+	}
+	req, err := http.NewRequest("POST", u, body)
+	if err != nil {
+		return permanentError{err}
+	}
+	if o.auth != nil {
+		o.auth(req)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+	return checkResponse(resp)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"runtime"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// serveDebug serves net/http/pprof under /debug/pprof/ and expvar under
+// /debug/vars on addr. Besides the memstats and cmdline of expvar, the
+// variables include the goroutine count and the queue lengths.
+func serveDebug(addr string, srv *server.Server, h *server.BaseHandler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("queues", expvar.Func(func() interface{} {
+		queues := map[string]interface{}{"parse": srv.ParseQueueLen(), "routing": h.Len()}
+		if r := currentRouter.Load(); r != nil {
+			for name, o := range r.outputs {
+				switch o := o.(type) {
+				case interface{ queuedBytes() int64 }:
+					queues[name] = map[string]int64{"bytes": o.queuedBytes()}
+				case interface{ pending() int }:
+					queues[name] = map[string]int{"pending": o.pending()}
+				}
+			}
+		}
+		return queues
+	}))
+
+	// Both packages register on the default mux.
+	go http.Serve(ln, http.DefaultServeMux)
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const defaultMaxOpen = 100
+
+var pathProperty = regexp.MustCompile(`%[A-Z-]+%`)
+
+// pathProperties are the %NAME% placeholders of a file output path.
+var pathProperties = map[string]func(*server.Message) string{
+	"HOSTNAME":    hostname,
+	"PROGRAM":     program,
+	"FROMHOST":    fromHost,
+	"FROMHOST-IP": func(m *server.Message) string { return m.NetSrc() },
+	"TENANT":      tenant,
+	"FACILITY":    func(m *server.Message) string { return m.Facility.String() },
+	"SEVERITY":    func(m *server.Message) string { return m.Severity.String() },
+	"YEAR":        func(m *server.Message) string { return m.Time.Format("2006") },
+	"MONTH":       func(m *server.Message) string { return m.Time.Format("01") },
+	"DAY":         func(m *server.Message) string { return m.Time.Format("02") },
+	"HOUR":        func(m *server.Message) string { return m.Time.Format("15") },
+}
+
+// hostname falls back to the address of the sender when the message has
+// no hostname.
+func hostname(m *server.Message) string {
+	if m.Hostname != "" {
+		return m.Hostname
+	}
+	if src := m.NetSrc(); !strings.Contains(src, "/") {
+		return src
+	}
+	return ""
+}
+
+// fromHost is the resolved name of the sender, or its address.
+func fromHost(m *server.Message) string {
+	if m.FromHost != "" {
+		return m.FromHost
+	}
+	return m.NetSrc()
+}
+
+// program is the tag without a "[pid]" suffix.
+func program(m *server.Message) string {
+	if m.AppName != "" {
+		return m.AppName
+	}
+	if i := strings.IndexByte(m.Tag, '['); i >= 0 {
+		return m.Tag[:i]
+	}
+	return m.Tag
+}
+
+// sanitizePathElement keeps a property value from escaping its directory
+// or creating hidden files.
+func sanitizePathElement(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.TrimLeft(s, ".")
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+type openFile struct {
+	path string
+	out  *fileOutput
+}
+
+// dynamicFileOutput writes to a file per expanded path, keeping at most
+// maxOpen of them open and closing the least recently used.
+type dynamicFileOutput struct {
+	mu      sync.Mutex
+	config  outputConfig
+	format  formatter
+	maxOpen int
+	files   map[string]*list.Element
+	lru     *list.List
+}
+
+func newDynamicFileOutput(c outputConfig, format formatter) (*dynamicFileOutput, error) {
+	for _, p := range pathProperty.FindAllString(c.Path, -1) {
+		if _, ok := pathProperties[strings.Trim(p, "%")]; !ok {
+			return nil, fmt.Errorf("unknown property %s in path %s", p, c.Path)
+		}
+	}
+	if _, err := parseSize(c.MaxSize); err != nil {
+		return nil, err
+	}
+
+	maxOpen := c.MaxOpen
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpen
+	}
+	return &dynamicFileOutput{
+		config:  c,
+		format:  format,
+		maxOpen: maxOpen,
+		files:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+func (o *dynamicFileOutput) expand(m *server.Message) string {
+	return pathProperty.ReplaceAllStringFunc(o.config.Path, func(p string) string {
+		return sanitizePathElement(pathProperties[strings.Trim(p, "%")](m))
+	})
+}
+
+func (o *dynamicFileOutput) Write(m *server.Message) error {
+	path := o.expand(m)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if e, ok := o.files[path]; ok {
+		o.lru.MoveToFront(e)
+		return e.Value.(*openFile).out.Write(m)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	c := o.config
+	c.Path = path
+	out, err := newFileOutput(c, o.format)
+	if err != nil {
+		return err
+	}
+
+	o.files[path] = o.lru.PushFront(&openFile{path: path, out: out})
+	for o.lru.Len() > o.maxOpen {
+		o.evict(o.lru.Back())
+	}
+	return out.Write(m)
+}
+
+func (o *dynamicFileOutput) evict(e *list.Element) {
+	f := o.lru.Remove(e).(*openFile)
+	delete(o.files, f.path)
+	if err := f.out.Close(); err != nil {
+		log.Printf("close %s: %v", f.path, err)
+	}
+}
+
+func (o *dynamicFileOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for o.lru.Len() > 0 {
+		o.evict(o.lru.Back())
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const defaultESIndex = "syslog-{2006.01.02}"
+
+// indexLayout matches the {layout} parts of an index name, which are
+// replaced by the time of the message formatted with the Go layout.
+var indexLayout = regexp.MustCompile(`\{[^}]*\}`)
+
+// esOutput indexes messages into Elasticsearch or OpenSearch with the bulk
+// API.
+type esOutput struct {
+	*batchOutput
+	url    string
+	index  string
+	auth   func(*http.Request)
+	client *http.Client
+}
+
+func newESOutput(name string, c outputConfig) (*esOutput, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("elasticsearch output requires a url")
+	}
+	client, err := newHTTPClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &esOutput{
+		url:    strings.TrimSuffix(c.URL, "/") + "/_bulk",
+		index:  c.Index,
+		client: client,
+	}
+	if o.index == "" {
+		o.index = defaultESIndex
+	}
+	switch {
+	case c.APIKey != "":
+		o.auth = func(req *http.Request) { req.Header.Set("Authorization", "ApiKey "+c.APIKey) }
+	case c.Username != "":
+		o.auth = func(req *http.Request) { req.SetBasicAuth(c.Username, c.Password) }
+	}
+
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	return o, nil
+}
+
+// indexName expands the index for m. Names in Elasticsearch date math
+// syntax, such as "<syslog-{now/d}>", are left for the server to resolve.
+func (o *esOutput) indexName(m *server.Message) string {
+	if strings.HasPrefix(o.index, "<") {
+		return o.index
+	}
+	return indexLayout.ReplaceAllStringFunc(o.index, func(layout string) string {
+		return m.Time.UTC().Format(layout[1 : len(layout)-1])
+	})
+}
+
+type esDocument struct {
+	Timestamp string `json:"@timestamp"`
+	jsonMessage
+}
+
+type esBulkResponse struct {
+	Errors bool                                `json:"errors"`
+	Items  []map[string]esBulkResponseItemInfo `json:"items"`
+}
+
+type esBulkResponseItemInfo struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+func (o *esOutput) send(batch []*server.Message) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, m := range batch {
+		action := map[string]map[string]string{"create": {"_index": o.indexName(m)}}
+		if err := enc.Encode(action); err != nil {
+			return permanentError{err}
+		}
+		doc := esDocument{headerTime(m).Format("2006-01-02T15:04:05.000000Z07:00"), newJSONMessage(m)}
+		if err := enc.Encode(doc); err != nil {
+			return permanentError{err}
+		}
+	}
+
+	req, err := http.NewRequest("POST", o.url, &body)
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if o.auth != nil {
+		o.auth(req)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	var result esBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return permanentError{err}
+	}
+	io.Copy(io.Discard, resp.Body)
+	if !result.Errors {
+		return nil
+	}
+
+	// Documents rejected for overload are sent again, others are dropped.
+	var failed []*server.Message
+	var rejected int
+	var reason string
+	for i, item := range result.Items {
+		for _, info := range item {
+			switch {
+			case info.Status == http.StatusTooManyRequests && i < len(batch):
+				failed = append(failed, batch[i])
+			case info.Status/100 != 2:
+				rejected++
+				reason = string(info.Error)
+			}
+		}
+	}
+	if rejected > 0 {
+		log.Printf("output %s: %d documents rejected: %s", o.name, rejected, reason)
+	}
+	if len(failed) > 0 {
+		return partialError{fmt.Errorf("%d documents rejected for overload", len(failed)), failed}
+	}
+	return nil
+}
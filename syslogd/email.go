@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emailAction mails the alerts fired, gathered in a digest of those fired
+// within the digest window after the first one if set, so that a burst of
+// alerts makes a single mail.
+type emailAction struct {
+	addr     string // host:port
+	implicit bool   // TLS from the start, for smtps
+	auth     smtp.Auth
+	from     string
+	to       []string
+	digest   time.Duration
+
+	mu      sync.Mutex
+	pending []*firing
+	timer   *time.Timer
+}
+
+// newEmailAction sends mail through the server of url, smtp://host:587
+// (with STARTTLS when the server offers it) or smtps://host:465, with the
+// credentials of the URL if any.
+func newEmailAction(c actionConfig) (*emailAction, error) {
+	if c.URL == "" || c.From == "" || len(c.To) == 0 {
+		return nil, fmt.Errorf("email action requires a url, from and to")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	a := &emailAction{addr: u.Host, from: c.From, to: c.To, digest: c.Digest}
+	switch u.Scheme {
+	case "smtp":
+		if u.Port() == "" {
+			a.addr = net.JoinHostPort(u.Hostname(), "25")
+		}
+	case "smtps":
+		a.implicit = true
+		if u.Port() == "" {
+			a.addr = net.JoinHostPort(u.Hostname(), "465")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported email url %q", c.URL)
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		a.auth = smtp.PlainAuth("", u.User.Username(), password, u.Hostname())
+	}
+	return a, nil
+}
+
+func (a *emailAction) notify(f *firing) error {
+	if a.digest <= 0 {
+		return a.send([]*firing{f})
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = append(a.pending, f)
+	if a.timer == nil {
+		a.timer = time.AfterFunc(a.digest, a.flush)
+	}
+	return nil
+}
+
+func (a *emailAction) flush() {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending, a.timer = nil, nil
+	a.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if err := a.send(pending); err != nil {
+		logAlertError(pending, err)
+	}
+}
+
+// close sends the digest pending.
+func (a *emailAction) close() {
+	a.mu.Lock()
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	a.mu.Unlock()
+	a.flush()
+}
+
+func (a *emailAction) send(fs []*firing) error {
+	var subject string
+	if len(fs) == 1 {
+		subject = fmt.Sprintf("[syslogd] alert %s fired", fs[0].Alert)
+		if fs[0].Group != "" {
+			subject += " for " + fs[0].Group
+		}
+	} else {
+		subject = fmt.Sprintf("[syslogd] %d alerts fired", len(fs))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", a.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(a.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, f := range fs {
+		fmt.Fprintf(&b, "%s: alert %s", f.Time.Format(time.RFC3339), f.Alert)
+		if f.Group != "" {
+			fmt.Fprintf(&b, " for %s", f.Group)
+		}
+		if f.Count > 1 {
+			fmt.Fprintf(&b, ", %d messages", f.Count)
+		}
+		b.WriteString("\r\n\r\n")
+		for _, m := range f.Messages {
+			line := m.Raw
+			if line == "" {
+				line = m.Content
+			}
+			fmt.Fprintf(&b, "  %s\r\n", strings.ReplaceAll(line, "\n", " "))
+		}
+		b.WriteString("\r\n")
+	}
+	msg := []byte(b.String())
+
+	if !a.implicit {
+		return smtp.SendMail(a.addr, a.auth, a.from, a.to, msg)
+	}
+	host, _, _ := net.SplitHostPort(a.addr)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", a.addr, &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if a.auth != nil {
+		if err := c.Auth(a.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(a.from); err != nil {
+		return err
+	}
+	for _, to := range a.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encrypted files start with encMagic, the kind of key the data key of the
+// file is wrapped with, k for a local key or m for AWS KMS, and the
+// length and the wrapped data key. Frames of the length of the sealed
+// data, the nonce and the data sealed with AES-256-GCM follow, one for
+// every record written to a live file. As in the STREAM construction of
+// age, the number of every frame and whether it is the last one are sealed
+// with it, so that frames cannot be reordered or dropped unnoticed, and a
+// closed file ends with an empty final frame, without which it was cut
+// short or is still being written.
+const (
+	encMagic    = "syslogd encrypted 1\n"
+	encLocal    = 'k'
+	encKMS      = 'm'
+	encOverhead = 4 + 12 + 16
+	sealChunk   = 256 * 1024
+	maxSealed   = sealChunk + encOverhead - 4
+)
+
+var (
+	errUnencrypted = errors.New("file is not encrypted by syslogd")
+	errNotFinal    = errors.New("file ends before its final frame, cut short or still being written")
+)
+
+// atRest encrypts the files of an output with data keys of their own,
+// wrapped with a local key or by AWS KMS.
+type atRest struct {
+	key   cipher.AEAD // local key
+	kms   *kmsClient
+	keyID string
+}
+
+func newAtRest(c outputConfig) (*atRest, error) {
+	switch {
+	case c.EncryptKey != "" && c.KMSKey != "":
+		return nil, fmt.Errorf("encrypt_key and kms_key are exclusive")
+	case c.EncryptKey != "":
+		key, err := readEncryptKey(c.EncryptKey)
+		if err != nil {
+			return nil, err
+		}
+		return &atRest{key: key}, nil
+	case c.KMSKey != "":
+		kms, err := newKMSClient(c.KMSURL, c.Region, c.AccessKey, c.SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		return &atRest{kms: kms, keyID: c.KMSKey}, nil
+	}
+	return nil, nil
+}
+
+// readEncryptKey reads a 256 bit key from a file, raw, hex or base64.
+func readEncryptKey(path string) (cipher.AEAD, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := data
+	if s := strings.TrimSpace(string(data)); len(data) != 32 {
+		if key, err = hex.DecodeString(s); err != nil {
+			key, err = base64.StdEncoding.DecodeString(s)
+		}
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s: want a key of 32 bytes, raw, hex or base64", path)
+	}
+	return newGCM(key)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, data, aad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, data, aad)
+}
+
+func unseal(aead cipher.AEAD, data, aad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("truncated frame")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+// frameAAD returns the additional data frame n is sealed with.
+func frameAAD(n uint64, final bool) []byte {
+	aad := binary.BigEndian.AppendUint64(make([]byte, 0, 9), n)
+	if final {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// readFrame reads the sealed data of the next frame of r.
+func readFrame(r io.Reader) ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated frame")
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > maxSealed {
+		return nil, fmt.Errorf("frame of %d bytes exceeds %d", n, maxSealed)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, errors.New("truncated frame")
+	}
+	return sealed, nil
+}
+
+// newKey returns a new data key and the header of a file encrypted with it.
+func (a *atRest) newKey() (cipher.AEAD, []byte, error) {
+	var key, wrapped []byte
+	var kind byte
+	if a.kms != nil {
+		var err error
+		if key, wrapped, err = a.kms.generateDataKey(a.keyID); err != nil {
+			return nil, nil, err
+		}
+		kind = encKMS
+	} else {
+		key = make([]byte, 32)
+		rand.Read(key)
+		wrapped, kind = seal(a.key, key, nil), encLocal
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := append([]byte(encMagic), kind, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(wrapped)))
+	return aead, append(header, wrapped...), nil
+}
+
+// readHeader reads the header of an encrypted file and unwraps its key.
+func (a *atRest) readHeader(r io.Reader) (cipher.AEAD, int, error) {
+	header := make([]byte, len(encMagic)+3)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		return nil, 0, errUnencrypted
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint16(header[len(encMagic)+1:]))
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, 0, err
+	}
+
+	var key []byte
+	var err error
+	switch kind := header[len(encMagic)]; {
+	case kind == encLocal && a.key != nil:
+		key, err = unseal(a.key, wrapped, nil)
+		if err != nil {
+			err = errors.New("encrypted with another key")
+		}
+	case kind == encKMS && a.kms != nil:
+		key, err = a.kms.decrypt(wrapped)
+	case kind == encKMS:
+		err = errors.New("encrypted by AWS KMS")
+	default:
+		err = errors.New("encrypted with a local key")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := newGCM(key)
+	return aead, len(header) + len(wrapped), err
+}
+
+// sealWriter encrypts what is written to it into frames, one on every
+// Flush and every sealChunk bytes, numbered from n. Close writes the final
+// frame.
+type sealWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	n    uint64
+	buf  []byte
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for len(s.buf) >= sealChunk {
+		if err := s.frame(s.buf[:sealChunk], false); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[sealChunk:]
+	}
+	return len(p), nil
+}
+
+func (s *sealWriter) WriteString(p string) (int, error) {
+	return s.Write([]byte(p))
+}
+
+func (s *sealWriter) Flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	err := s.frame(s.buf, false)
+	s.buf = s.buf[:0]
+	return err
+}
+
+// Close flushes what is left and writes the final frame, after which
+// nothing can be written.
+func (s *sealWriter) Close() error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	return s.frame(nil, true)
+}
+
+func (s *sealWriter) frame(data []byte, final bool) error {
+	sealed := seal(s.aead, data, frameAAD(s.n, final))
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(sealed)), uint32(len(sealed)))
+	if _, err := s.w.Write(append(frame, sealed...)); err != nil {
+		return err
+	}
+	s.n++
+	return nil
+}
+
+// openReader decrypts the frames of an encrypted file, numbered from n.
+// Unless partial, the frames must end with the final one.
+type openReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	n       uint64
+	partial bool
+	final   bool
+	buf     []byte
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		sealed, err := readFrame(o.r)
+		switch {
+		case err == io.EOF && !o.final && !o.partial:
+			return 0, errNotFinal
+		case err == nil && o.final:
+			return 0, errors.New("frames after the final frame")
+		case err != nil:
+			return 0, err
+		}
+		if o.buf, err = unseal(o.aead, sealed, frameAAD(o.n, false)); err != nil {
+			if o.buf, err = unseal(o.aead, sealed, frameAAD(o.n, true)); err != nil {
+				return 0, fmt.Errorf("frame %d altered or out of place", o.n)
+			}
+			o.final = true
+		}
+		o.n++
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (a *atRest) decrypt(r io.Reader) (io.Reader, error) {
+	aead, _, err := a.readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{r: r, aead: aead}, nil
+}
+
+// resume prepares appending to the encrypted file f of size bytes. It
+// drops a frame cut short by a crash, or the final frame of a file closed
+// before, and returns a sealWriter continuing the frames of the file on w,
+// the decrypted end of the file, at least tail bytes unless it is shorter,
+// and the size of the file.
+func (a *atRest) resume(f *os.File, size int64, tail int, w io.Writer) (*sealWriter, []byte, int64, error) {
+	aead, n, err := a.readHeader(io.NewSectionReader(f, 0, size))
+	if err == errUnencrypted {
+		return nil, nil, 0, err
+	} else if err != nil {
+		return nil, nil, 0, fmt.Errorf("%s: %v", f.Name(), err)
+	}
+	var frames []int64
+	var count uint64
+	off := int64(n)
+	for off < size {
+		var l [4]byte
+		if _, err := f.ReadAt(l[:], off); err != nil {
+			break
+		}
+		sealed := binary.BigEndian.Uint32(l[:])
+		end := off + 4 + int64(sealed)
+		if sealed > maxSealed || end > size {
+			break
+		}
+		if frames = append(frames, off); len(frames) > 16 {
+			frames = frames[1:]
+		}
+		count++
+		off = end
+	}
+
+	if len(frames) > 0 {
+		last := frames[len(frames)-1]
+		sealed, err := readFrame(io.NewSectionReader(f, last, off-last))
+		if err == nil {
+			_, err = unseal(aead, sealed, frameAAD(count-1, true))
+		}
+		if err == nil {
+			frames, count, off = frames[:len(frames)-1], count-1, last
+		}
+	}
+	if off < size {
+		if err := f.Truncate(off); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	var last []byte
+	end := off
+	for i := len(frames) - 1; i >= 0 && len(last) < tail; i-- {
+		r := &openReader{
+			r:       io.NewSectionReader(f, frames[i], end-frames[i]),
+			aead:    aead,
+			n:       count - uint64(len(frames)-i),
+			partial: true,
+		}
+		data, err := io.ReadAll(r)
+		end = frames[i]
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+		last = append(data, last...)
+	}
+	return &sealWriter{w: w, aead: aead, n: count}, last, off, nil
+}
+
+// openLogFile opens a file written by syslogd for reading, decrypting and
+// decompressing it as needed.
+func openLogFile(path string, a *atRest) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(len(encMagic)); string(magic) == encMagic {
+		if a == nil {
+			f.Close()
+			return nil, errors.New("encrypted, requires -encrypt-key or -kms-region")
+		}
+		if r, err = a.decrypt(br); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return readCloser{gz, f.Close}, nil
+	case strings.HasSuffix(path, ".zst"):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return readCloser{zr, func() error { zr.Close(); return f.Close() }}, nil
+	}
+	return readCloser{r, f.Close}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error { return r.close() }
+
+// atRestFlags adds the flags of the keys to read encrypted files with to
+// fs, returning the function to call after fs is parsed, which returns nil
+// without them.
+func atRestFlags(fs *flag.FlagSet) func() (*atRest, error) {
+	key := fs.String("encrypt-key", "", "`file` of the encrypt_key of the output")
+	region := fs.String("kms-region", "", "AWS `region` of the kms_key of the output, with the credentials of the environment")
+	kmsURL := fs.String("kms-url", "", "endpoint of AWS KMS, https://kms.REGION.amazonaws.com by default")
+	return func() (*atRest, error) {
+		if *key == "" && *region == "" && *kmsURL == "" {
+			return nil, nil
+		}
+		a := &atRest{}
+		var err error
+		if *key != "" {
+			if a.key, err = readEncryptKey(*key); err != nil {
+				return nil, err
+			}
+		}
+		if *region != "" || *kmsURL != "" {
+			if a.kms, err = newKMSClient(*kmsURL, *region, "", ""); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+}
+
+// runDecrypt implements "syslogd decrypt", writing the decrypted contents
+// of files, still compressed if they were, to stdout.
+func runDecrypt(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keys := atRestFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s decrypt [options] file...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	a, err := keys()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if a == nil {
+		fmt.Fprintln(os.Stderr, "decrypt requires -encrypt-key or -kms-region")
+		os.Exit(2)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err == nil {
+			var r io.Reader
+			if r, err = a.decrypt(bufio.NewReader(f)); err == nil {
+				_, err = io.Copy(w, r)
+			}
+			f.Close()
+		}
+		if err != nil {
+			w.Flush()
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// kmsClient generates and decrypts data keys with AWS KMS.
+type kmsClient struct {
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	client    *http.Client
+}
+
+func newKMSClient(endpoint, region, accessKey, secretKey string) (*kmsClient, error) {
+	k := &kmsClient{
+		endpoint:  endpoint,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	if k.region == "" {
+		k.region = os.Getenv("AWS_REGION")
+	}
+	if k.region == "" {
+		k.region = "us-east-1"
+	}
+	if k.endpoint == "" {
+		k.endpoint = "https://kms." + k.region + ".amazonaws.com"
+	}
+	if k.accessKey == "" {
+		k.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		k.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if k.accessKey == "" || k.secretKey == "" {
+		return nil, fmt.Errorf("kms requires access_key and secret_key")
+	}
+	if _, err := url.Parse(k.endpoint); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *kmsClient) generateDataKey(keyID string) (key, wrapped []byte, err error) {
+	var resp struct{ Plaintext, CiphertextBlob []byte }
+	err = k.call("GenerateDataKey", map[string]string{"KeyId": keyID, "KeySpec": "AES_256"}, &resp)
+	return resp.Plaintext, resp.CiphertextBlob, err
+}
+
+func (k *kmsClient) decrypt(wrapped []byte) ([]byte, error) {
+	var resp struct{ Plaintext []byte }
+	err := k.call("Decrypt", map[string][]byte{"CiphertextBlob": wrapped}, &resp)
+	return resp.Plaintext, err
+}
+
+// call sends a request of the JSON protocol of KMS, where []byte fields
+// are base64 as encoding/json has them.
+func (k *kmsClient) call(action string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", k.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signV4(req, body, time.Now(), "kms", k.region, k.accessKey, k.secretKey, k.token)
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("kms %s: %v", action, err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return fmt.Errorf("kms %s: %v", action, err)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
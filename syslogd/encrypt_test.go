@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// testEncryptKey writes a key to dir and returns its path.
+func testEncryptKey(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "key")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("k"), 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func openTestFile(t *testing.T, c outputConfig) *fileOutput {
+	t.Helper()
+	o, err := newFileOutput(c, formatRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func writeRecords(t *testing.T, o output, recs ...string) {
+	t.Helper()
+	for _, rec := range recs {
+		if err := o.Write(&server.Message{Raw: rec}); err != nil {
+			t.Fatalf("write %s: %v", rec, err)
+		}
+	}
+}
+
+func decryptFile(t *testing.T, path string, a *atRest) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := a.decrypt(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	return string(data)
+}
+
+func TestEncryptedFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	c := outputConfig{Path: filepath.Join(dir, "app.log"), EncryptKey: testEncryptKey(t, dir)}
+	o := openTestFile(t, c)
+	writeRecords(t, o, "record-0")
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appending after a restart continues the frames of the file.
+	o = openTestFile(t, c)
+	writeRecords(t, o, "record-1")
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newAtRest(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decryptFile(t, c.Path, a), "record-0\nrecord-1\n"; got != want {
+		t.Errorf("decrypted %q, want %q", got, want)
+	}
+}
+
+func TestEncryptedFileReload(t *testing.T) {
+	dir := t.TempDir()
+	c := outputConfig{Path: filepath.Join(dir, "app.log"), EncryptKey: testEncryptKey(t, dir)}
+	old := openTestFile(t, c)
+	writeRecords(t, old, "record-0")
+
+	// The output of the new router opens the file while the old one still
+	// writes the messages it holds.
+	reloaded := openTestFile(t, c)
+	if reloaded != old {
+		t.Fatal("the outputs of a file do not share it across a reload")
+	}
+	writeRecords(t, old, "record-1")
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, reloaded, "record-2")
+	if err := reloaded.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newAtRest(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decryptFile(t, c.Path, a), "record-0\nrecord-1\nrecord-2\n"; got != want {
+		t.Errorf("decrypted %q, want %q", got, want)
+	}
+}
+
+func TestEncryptedFileReloadUnencrypted(t *testing.T) {
+	dir := t.TempDir()
+	c := outputConfig{Path: filepath.Join(dir, "app.log")}
+	old := openTestFile(t, c)
+	writeRecords(t, old, "record-0")
+
+	// Encrypting the file from a reload on starts a new file.
+	c.EncryptKey = testEncryptKey(t, dir)
+	reloaded := openTestFile(t, c)
+	writeRecords(t, old, "record-1")
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := filepath.Glob(c.Path + ".*")
+	if err != nil || len(rotated) != 1 {
+		t.Fatalf("rotated files %v, %v, want 1", rotated, err)
+	}
+	if data, err := os.ReadFile(rotated[0]); err != nil || string(data) != "record-0\n" {
+		t.Errorf("rotated file %q, %v, want record-0 unencrypted", data, err)
+	}
+	a, err := newAtRest(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decryptFile(t, c.Path, a), "record-1\n"; got != want {
+		t.Errorf("decrypted %q, want %q", got, want)
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	dir := t.TempDir()
+	c := outputConfig{Path: filepath.Join(dir, "app.log"), EncryptKey: testEncryptKey(t, dir)}
+	o := openTestFile(t, c)
+	writeRecords(t, o, "record-0", "record-1")
+
+	// Still being written, the file has no final frame yet.
+	a, err := newAtRest(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(c.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := a.decrypt(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != errNotFinal || !strings.HasPrefix(string(data), "record-0\nrecord-1\n") {
+		t.Errorf("decrypted %q, %v, want the records and %v", data, err, errNotFinal)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+	"github.com/klauspost/compress/zstd"
+)
+
+const rotatedLayout = "20060102T150405"
+
+// fileOutput appends messages to a file, rotating it when it grows beyond
+// maxSize or when the hour or day it was started in has passed. Rotated
+// files are renamed to path.TIMESTAMP, compressed in the background and
+// the oldest of them removed beyond keep. With a hash chain, every file
+// starts with a header record chaining it to the one it was rotated from.
+// Encrypted files are sealed a record at a time.
+type fileOutput struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	period   string
+	keep     int
+	compress string
+	format   formatter
+	chain    *hashChain
+	atRest   *atRest
+	sealing  sealing
+	next     *fileOutput // settings to rotate to
+	refs     int
+
+	f       *os.File
+	w       *bufio.Writer
+	sealed  *sealWriter
+	size    int64
+	started time.Time
+	rotated chan rotatedFile
+	done    chan struct{}
+}
+
+// sealing is the settings of an output that chain or encrypt its file.
+type sealing struct {
+	hashChain                bool
+	hashChainKey, encryptKey string
+	kmsKey, kmsURL, region   string
+	accessKey, secretKey     string
+}
+
+// rotatedFile is a file to compress and prune after its rotation, with
+// the settings it was written with.
+type rotatedFile struct {
+	name     string
+	compress string
+	keep     int
+	atRest   *atRest
+}
+
+// files holds the open file outputs by path, so that a file has a single
+// writer: after a reload the new outputs share the files of the old ones,
+// which go on writing the messages they hold until closed.
+var files = struct {
+	sync.Mutex
+	m map[string]*fileOutput
+}{m: make(map[string]*fileOutput)}
+
+// newFileOutput returns the output of the file of c, opening it unless
+// another output has it open, which then takes the settings of c.
+func newFileOutput(c outputConfig, format formatter) (*fileOutput, error) {
+	n, err := fileOutputFor(c, format)
+	if err != nil {
+		return nil, err
+	}
+
+	files.Lock()
+	defer files.Unlock()
+
+	path := filepath.Clean(c.Path)
+	if o, ok := files.m[path]; ok {
+		if err := o.reconfigure(n); err != nil {
+			return nil, err
+		}
+		o.refs++
+		return o, nil
+	}
+	err = n.open()
+	if err == errUnchained || err == errUnencrypted {
+		// Start the chain or the encryption in a new file rather than
+		// after records they cannot cover.
+		err = n.rotate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	go n.cleanup()
+	n.refs = 1
+	files.m[path] = n
+	return n, nil
+}
+
+// reconfigure gives o the settings of n, an output of the same file. If n
+// chains or encrypts the file otherwise, o rotates it, for the records
+// written with either settings to be in files of their own.
+func (o *fileOutput) reconfigure(n *fileOutput) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.maxSize, o.period, o.keep, o.compress, o.format = n.maxSize, n.period, n.keep, n.compress, n.format
+	if n.sealing == o.sealing {
+		return nil
+	}
+	o.next = n
+	err := o.rotate()
+	o.next = nil
+	return err
+}
+
+// fileOutputFor returns the output of c without opening its file.
+func fileOutputFor(c outputConfig, format formatter) (*fileOutput, error) {
+	if c.Path == "" {
+		return nil, fmt.Errorf("file output requires a path")
+	}
+
+	maxSize, err := parseSize(c.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Rotate {
+	case "", "hourly", "daily":
+	default:
+		return nil, fmt.Errorf("invalid rotate %q: want hourly or daily", c.Rotate)
+	}
+	switch c.Compress {
+	case "", "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("invalid compress %q: want gzip or zstd", c.Compress)
+	}
+
+	o := &fileOutput{
+		path:     c.Path,
+		maxSize:  maxSize,
+		period:   c.Rotate,
+		keep:     c.Keep,
+		compress: c.Compress,
+		format:   format,
+		rotated:  make(chan rotatedFile, 16),
+		done:     make(chan struct{}),
+		sealing: sealing{
+			hashChain:    c.HashChain,
+			hashChainKey: c.HashChainKey,
+			encryptKey:   c.EncryptKey,
+			kmsKey:       c.KMSKey,
+			kmsURL:       c.KMSURL,
+			region:       c.Region,
+			accessKey:    c.AccessKey,
+			secretKey:    c.SecretKey,
+		},
+	}
+	if c.HashChain {
+		o.chain = &hashChain{}
+		if c.HashChainKey != "" {
+			o.chain.key = []byte(c.HashChainKey)
+		}
+	}
+	if o.atRest, err = newAtRest(c); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *fileOutput) open() error {
+	flag := os.O_WRONLY
+	if o.chain != nil || o.atRest != nil {
+		// To resume the chain or the encryption.
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(o.path, flag|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	o.f = f
+	o.w = bufio.NewWriter(f)
+	o.sealed = nil
+	o.size = fi.Size()
+	o.started = time.Now()
+	if o.size > 0 {
+		// Appending to a file written before a restart.
+		o.started = fi.ModTime()
+	}
+
+	var tail []byte
+	switch {
+	case o.atRest != nil && o.size > 0:
+		sealed, last, size, err := o.atRest.resume(f, o.size, chainTail, o.w)
+		if err != nil {
+			return err
+		}
+		o.sealed = sealed
+		o.size, tail = size, last
+	case o.atRest != nil:
+		aead, header, err := o.atRest.newKey()
+		if err != nil {
+			return err
+		}
+		o.w.Write(header)
+		o.size += int64(len(header))
+		o.sealed = &sealWriter{w: o.w, aead: aead}
+	case o.chain != nil && o.size > 0:
+		if tail, err = readTail(f, o.size, chainTail); err != nil {
+			return err
+		}
+	}
+
+	if o.chain == nil {
+		return o.w.Flush()
+	}
+	if o.size > 0 && (o.sealed == nil || tail != nil) {
+		return o.chain.resume(tail)
+	}
+	n, err := o.write(o.chain.header() + "\n")
+	o.size += int64(n)
+	return err
+}
+
+// write writes s to the file, in a frame of its own if it is encrypted,
+// and returns the number of bytes written.
+func (o *fileOutput) write(s string) (int, error) {
+	if o.sealed == nil {
+		n, err := o.w.WriteString(s)
+		if err != nil {
+			return n, err
+		}
+		return n, o.w.Flush()
+	}
+	o.sealed.WriteString(s)
+	if err := o.sealed.Flush(); err != nil {
+		return 0, err
+	}
+	return len(s) + encOverhead, o.w.Flush()
+}
+
+func (o *fileOutput) Write(m *server.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	line, err := o.format(m)
+	if err != nil {
+		return err
+	}
+
+	n := int64(len(line)) + 1
+	if o.chain != nil {
+		n += chainSuffixLen
+	}
+	if o.atRest != nil {
+		n += encOverhead
+	}
+	if o.due(n) {
+		if err := o.rotate(); err != nil {
+			return err
+		}
+	}
+	if o.chain != nil {
+		line = o.chain.next(line)
+	}
+	line += "\n"
+
+	written, err := o.write(line)
+	o.size += int64(written)
+	return err
+}
+
+// due reports whether the file must be rotated before n more bytes are
+// written to it.
+func (o *fileOutput) due(n int64) bool {
+	if o.size == 0 {
+		return false
+	}
+	if o.maxSize > 0 && o.size+n > o.maxSize {
+		return true
+	}
+	return o.period != "" && !periodStart(o.started, o.period).Equal(periodStart(time.Now(), o.period))
+}
+
+func periodStart(t time.Time, period string) time.Time {
+	y, m, d := t.Date()
+	if period == "hourly" {
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// rotate closes the file and opens a new one, with the settings of next
+// if it is set.
+func (o *fileOutput) rotate() error {
+	if o.sealed != nil {
+		o.sealed.Close()
+	}
+	o.w.Flush()
+	if err := o.f.Close(); err != nil {
+		return err
+	}
+
+	rotated := o.path + "." + time.Now().Format(rotatedLayout)
+	for i := 1; ; i++ {
+		if !rotatedExists(rotated) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s-%d", o.path, time.Now().Format(rotatedLayout), i)
+	}
+	if err := os.Rename(o.path, rotated); err != nil {
+		// Keep writing to the current file.
+		if err := o.open(); err != nil {
+			return err
+		}
+		return err
+	}
+	closed := rotatedFile{rotated, o.compress, o.keep, o.atRest}
+	if n := o.next; n != nil {
+		if n.chain != nil && o.chain != nil {
+			// Go on with the chain of the file rotated.
+			n.chain.last = o.chain.last
+		}
+		o.chain, o.atRest, o.sealing = n.chain, n.atRest, n.sealing
+	}
+	if err := o.open(); err != nil {
+		return err
+	}
+
+	o.rotated <- closed
+	return nil
+}
+
+// rotatedExists reports whether name was taken by a rotated file, which
+// may have been compressed since.
+func rotatedExists(name string) bool {
+	for _, ext := range []string{"", ".gz", ".zst"} {
+		if _, err := os.Lstat(name + ext); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanup compresses the rotated files one after the other and prunes
+// the old ones.
+func (o *fileOutput) cleanup() {
+	defer close(o.done)
+	for r := range o.rotated {
+		if r.compress != "" {
+			// The file is gone if it was pruned while queued.
+			if err := compressFile(r.name, r.compress, r.atRest); err != nil && !os.IsNotExist(err) {
+				log.Printf("compress %s: %v", r.name, err)
+			}
+		}
+		o.prune(r.keep)
+	}
+}
+
+// prune removes the oldest rotated files beyond keep.
+func (o *fileOutput) prune(keep int) {
+	if keep <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(o.path + ".*")
+	if err != nil {
+		return
+	}
+	var rotated []os.FileInfo
+	prefix := o.path + "."
+	for _, name := range matches {
+		suffix := strings.TrimPrefix(name, prefix)
+		if len(suffix) < len(rotatedLayout) || strings.HasSuffix(suffix, ".tmp") {
+			continue
+		}
+		if _, err := time.Parse(rotatedLayout, suffix[:len(rotatedLayout)]); err != nil {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil {
+			rotated = append(rotated, fi)
+		}
+	}
+	if len(rotated) <= keep {
+		return
+	}
+
+	sort.Slice(rotated, func(i, j int) bool {
+		return rotated[i].ModTime().Before(rotated[j].ModTime())
+	})
+	dir := filepath.Dir(o.path)
+	for _, fi := range rotated[:len(rotated)-keep] {
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// Close closes the file with the last output sharing it, once the files
+// rotated are compressed.
+func (o *fileOutput) Close() error {
+	last, err := o.release()
+	if !last {
+		return nil
+	}
+	close(o.rotated)
+	<-o.done
+	return err
+}
+
+// release drops a reference to o, closing the file with the last one.
+func (o *fileOutput) release() (bool, error) {
+	files.Lock()
+	defer files.Unlock()
+
+	if o.refs--; o.refs > 0 {
+		return false, nil
+	}
+	delete(files.m, filepath.Clean(o.path))
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.sealed != nil {
+		o.sealed.Close()
+	}
+	o.w.Flush()
+	return true, o.f.Close()
+}
+
+// compressFile replaces path with path.gz or path.zst, encrypted with a
+// new key if a is not nil, also if path was not.
+func compressFile(path, method string, a *atRest) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	var r io.Reader = src
+	if a != nil {
+		br := bufio.NewReader(src)
+		r = br
+		if magic, _ := br.Peek(len(encMagic)); string(magic) == encMagic {
+			if r, err = a.decrypt(br); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		}
+	}
+
+	ext := ".gz"
+	if method == "zstd" {
+		ext = ".zst"
+	}
+	tmp := path + ext + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	var out io.Writer = dst
+	var sealed *sealWriter
+	if a != nil {
+		aead, header, err := a.newKey()
+		if err == nil {
+			_, err = dst.Write(header)
+		}
+		if err != nil {
+			dst.Close()
+			return err
+		}
+		sealed = &sealWriter{w: dst, aead: aead}
+		out = sealed
+	}
+
+	var w io.WriteCloser
+	if method == "zstd" {
+		if w, err = zstd.NewWriter(out); err != nil {
+			dst.Close()
+			return err
+		}
+	} else {
+		w = gzip.NewWriter(out)
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		dst.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if sealed != nil {
+		if err := sealed.Close(); err != nil {
+			dst.Close()
+			return err
+		}
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	// Keep the modification time, by which old files are pruned.
+	os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	if err := os.Rename(tmp, path+ext); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// parseSize parses a byte count with an optional K, M or G suffix.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	num, mult := s, int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
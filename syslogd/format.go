@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// formatter renders a message as a single line, without the newline.
+type formatter func(*server.Message) (string, error)
+
+var formats = map[string]formatter{
+	"default": formatDefault,
+	"json":    formatJSON,
+	"logfmt":  formatLogfmt,
+	"raw":     formatRaw,
+	"rfc3164": formatRFC3164,
+	"rfc5424": formatRFC5424,
+}
+
+var templateFuncs = template.FuncMap{
+	"pri": func(m *server.Message) int {
+		return int(m.Facility)<<3 | int(m.Severity)
+	},
+	"rfc3339": func(t time.Time) string {
+		return t.Format(time.RFC3339Nano)
+	},
+	"rfc3339n": func(digits int, t time.Time) string {
+		if digits <= 0 {
+			return t.Format(time.RFC3339)
+		}
+		return t.Format("2006-01-02T15:04:05." + strings.Repeat("0", min(digits, 9)) + "Z07:00")
+	},
+	"timestamp": headerTime,
+	"local":     func(t time.Time) time.Time { return t.Local() },
+	"in": func(zone string, t time.Time) (time.Time, error) {
+		loc, err := loadLocation(zone)
+		return t.In(loc), err
+	},
+}
+
+var locations sync.Map // zone name -> *time.Location
+
+func loadLocation(zone string) (*time.Location, error) {
+	if loc, ok := locations.Load(zone); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(zone, loc)
+	return loc, nil
+}
+
+// newFormatter returns the named format, or a formatter executing format
+// as a text/template on the *server.Message:
+//
+//	{{.Timestamp.Format "Jan _2 15:04:05"}} {{.Hostname}} {{.Tag}}: {{.Content}}
+//
+// Times are in UTC, .ReportedTimestamp is the timestamp in the zone of the
+// sender. Besides the message fields and methods, templates can use pri for
+// the PRI value, timestamp for the timestamp or else the time of
+// reception, in "zone" and local to convert a time, and rfc3339 or
+// rfc3339n digits to format it with all or a fixed number of fractional
+// digits:
+//
+//	{{rfc3339n 3 (in "Asia/Tokyo" (timestamp .))}}
+//
+// An empty format returns nil, for the output to use its own default.
+func newFormatter(format string) (formatter, error) {
+	if format == "" {
+		return nil, nil
+	}
+	if f, ok := formats[format]; ok {
+		return f, nil
+	}
+	if !strings.Contains(format, "{{") {
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	t, err := template.New("format").Funcs(templateFuncs).Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *server.Message) (string, error) {
+		var b strings.Builder
+		if err := t.Execute(&b, m); err != nil {
+			return "", err
+		}
+		return strings.TrimRight(b.String(), "\n"), nil
+	}, nil
+}
+
+func formatDefault(m *server.Message) (string, error) {
+	return m.String(), nil
+}
+
+// formatRaw renders m as it was received.
+func formatRaw(m *server.Message) (string, error) {
+	return m.Raw, nil
+}
+
+// headerHostname is the hostname to put into a message header: the one
+// the message came with, or else the address of the sender.
+func headerHostname(m *server.Message) string {
+	host := m.Hostname
+	if host == "" {
+		host = m.NetSrc()
+	}
+	if host == "" || strings.Contains(host, "/") {
+		// Local clients on a unix socket.
+		host, _ = os.Hostname()
+	}
+	return host
+}
+
+func headerTime(m *server.Message) time.Time {
+	if m.Timestamp.IsZero() {
+		return m.Time
+	}
+	return m.Timestamp
+}
+
+// formatRFC3164 renders m as "<PRI>TIMESTAMP HOSTNAME TAG: CONTENT".
+func formatRFC3164(m *server.Message) (string, error) {
+	s := fmt.Sprintf("<%d>%s %s ", int(m.Facility)<<3|int(m.Severity), headerTime(m).Format(time.Stamp), headerHostname(m))
+	if m.Tag != "" {
+		s += m.Tag + ": "
+	}
+	return s + m.Content, nil
+}
+
+// formatRFC5424 renders m as "<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID
+// MSGID [SD] MSG", taking APP-NAME and PROCID from the tag of RFC 3164
+// messages.
+func formatRFC5424(m *server.Message) (string, error) {
+	appName, procID := m.AppName, m.ProcID
+	if appName == "" {
+		appName = program(m)
+		if i := strings.IndexByte(m.Tag, '['); i >= 0 && strings.HasSuffix(m.Tag, "]") {
+			procID = m.Tag[i+1 : len(m.Tag)-1]
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s ",
+		int(m.Facility)<<3|int(m.Severity),
+		headerTime(m).Format("2006-01-02T15:04:05.000000Z07:00"),
+		headerField(headerHostname(m), 255),
+		headerField(appName, 48),
+		headerField(procID, 128),
+		headerField(m.MsgID, 32),
+	)
+	writeStructuredData(&b, m.StructuredData)
+	if m.Content != "" {
+		b.WriteString(" " + m.Content)
+	}
+	return b.String(), nil
+}
+
+// headerField makes s a valid RFC 5424 header field: printable ASCII
+// without spaces, at most max long, or "-" when empty.
+func headerField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > max {
+		s = s[:max]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+func writeStructuredData(b *strings.Builder, sd map[string]map[string]string) {
+	if len(sd) == 0 {
+		b.WriteString("-")
+		return
+	}
+
+	ids := make([]string, 0, len(sd))
+	for id := range sd {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		b.WriteString("[" + id)
+		names := make([]string, 0, len(sd[id]))
+		for name := range sd[id] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(b, ` %s="%s"`, name, sdEscaper.Replace(sd[id][name]))
+		}
+		b.WriteString("]")
+	}
+}
+
+// jsonMessage is the layout of a message in the json format.
+type jsonMessage struct {
+	Time           time.Time                    `json:"time"`
+	Source         string                       `json:"source,omitempty"`
+	SourceHost     string                       `json:"source_host,omitempty"`
+	Priority       int                          `json:"priority"`
+	Facility       string                       `json:"facility"`
+	Severity       string                       `json:"severity"`
+	Timestamp      *time.Time                   `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	Tag            string                       `json:"tag,omitempty"`
+	Content        string                       `json:"content"`
+	Version        int                          `json:"version,omitempty"`
+	AppName        string                       `json:"app_name,omitempty"`
+	ProcID         string                       `json:"proc_id,omitempty"`
+	MsgID          string                       `json:"msg_id,omitempty"`
+	TraceID        string                       `json:"trace_id,omitempty"`
+	SpanID         string                       `json:"span_id,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Raw            string                       `json:"raw"`
+}
+
+func newJSONMessage(m *server.Message) jsonMessage {
+	j := jsonMessage{
+		Time:           m.Time,
+		Source:         m.NetSrc(),
+		SourceHost:     m.FromHost,
+		Priority:       int(m.Facility)<<3 | int(m.Severity),
+		Facility:       m.Facility.String(),
+		Severity:       m.Severity.String(),
+		Hostname:       m.Hostname,
+		Tag:            m.Tag,
+		Content:        m.Content,
+		Version:        m.Version,
+		AppName:        m.AppName,
+		ProcID:         m.ProcID,
+		MsgID:          m.MsgID,
+		TraceID:        m.TraceID,
+		SpanID:         m.SpanID,
+		StructuredData: m.StructuredData,
+		Raw:            m.Raw,
+	}
+	if !m.Timestamp.IsZero() {
+		j.Timestamp = &m.Timestamp
+	}
+	return j
+}
+
+// formatJSON renders m as a single line JSON object.
+func formatJSON(m *server.Message) (string, error) {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(newJSONMessage(m)); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
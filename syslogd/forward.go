@@ -0,0 +1,481 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	framingLF    = "lf"
+	framingOctet = "octet-counting"
+)
+
+// rewrite replaces header fields of forwarded messages. Empty fields are
+// left as received. Like the header and record_hop options it has no
+// effect on the raw format.
+type rewrite struct {
+	Hostname string `yaml:"hostname"`
+	AppName  string `yaml:"app_name"`
+	Facility string `yaml:"facility"`
+	Severity string `yaml:"severity"`
+}
+
+func (rw *rewrite) compile() (func(*server.Message) *server.Message, error) {
+	if *rw == (rewrite{}) {
+		return nil, nil
+	}
+
+	var fac *server.Facility
+	if rw.Facility != "" {
+		f, err := parseFacility(rw.Facility)
+		if err != nil {
+			return nil, err
+		}
+		fac = &f
+	}
+	var sev *server.Severity
+	if rw.Severity != "" {
+		s, err := parseSeverity(rw.Severity)
+		if err != nil {
+			return nil, err
+		}
+		sev = &s
+	}
+
+	hostname, appName := rw.Hostname, rw.AppName
+	return func(m *server.Message) *server.Message {
+		c := *m
+		if hostname != "" {
+			c.Hostname = hostname
+		}
+		if appName != "" {
+			c.AppName = appName
+			c.Tag = appName
+			if c.ProcID != "" {
+				c.Tag += "[" + c.ProcID + "]"
+			}
+		}
+		if fac != nil {
+			c.Facility = *fac
+		}
+		if sev != nil {
+			c.Severity = *sev
+		}
+		return &c
+	}, nil
+}
+
+const (
+	headerPreserve = "preserve"
+	headerRelay    = "relay"
+)
+
+// relayHeader returns a function to apply the header option of a forward
+// output: preserve the hostname and timestamp the sender reported, or
+// stamp them with the relay's own hostname and time of reception. With a
+// non-empty hopID the relay is also recorded in an SD element such as
+// [relay@32473 host="relay1" from="192.0.2.7" orig-host="web1" received="..."].
+func relayHeader(header, hopID string) (func(*server.Message) *server.Message, error) {
+	switch header {
+	case "", headerPreserve, headerRelay:
+	default:
+		return nil, fmt.Errorf("invalid header %q: want %s or %s", header, headerPreserve, headerRelay)
+	}
+	if header != headerRelay && hopID == "" {
+		return nil, nil
+	}
+
+	self, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return func(m *server.Message) *server.Message {
+		c := *m
+		if header == headerRelay {
+			c.Hostname = self
+			c.Timestamp = m.Time
+		}
+		if hopID != "" {
+			c.StructuredData = make(map[string]map[string]string, len(m.StructuredData)+1)
+			for id, params := range m.StructuredData {
+				c.StructuredData[id] = params
+			}
+			hop := map[string]string{
+				"host":     self,
+				"from":     m.NetSrc(),
+				"received": m.Time.Format(time.RFC3339Nano),
+			}
+			if m.Hostname != "" {
+				hop["orig-host"] = m.Hostname
+			}
+			c.StructuredData[hopID] = hop
+		}
+		return &c
+	}, nil
+}
+
+// forwardOutput relays messages, in RFC 3164 format by default, to another
+// syslog server over udp://, tcp:// or tls://. Stream transports frame
+// messages with a trailing LF or, as RFC 5425 requires for TLS, with octet
+// counting.
+//
+// With failover targets, messages go to the first target that accepts
+// them, in order, or with hash balancing, to the target a message property
+// hashes to on a ring of them all, so that the messages of a host stay in
+// order on one target. A target that fails is probed every health interval
+// and taken back as soon as it accepts a connection again, meanwhile its
+// messages go to the next target. UDP targets are only seen down when the
+// network reports an error.
+type forwardOutput struct {
+	mu      sync.Mutex
+	targets []*forwardTarget
+	active  int // index of the target messages go to, without hash
+	hash    func(*server.Message) string
+	ring    []ringPoint
+	format  formatter
+	framing string
+	relay   func(*server.Message) *server.Message
+	rewrite func(*server.Message) *server.Message
+	err     error // of the last write
+
+	interval  time.Duration
+	recovered chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// forwardTarget is an upstream server of a forward output.
+type forwardTarget struct {
+	url     string
+	network string
+	addr    string
+	config  *tls.Config
+	conn    net.Conn
+	down    bool
+}
+
+// ringPoint places a target on the hash ring.
+type ringPoint struct {
+	hash   uint64
+	target int
+}
+
+// ringPoints is the number of points of each target on the ring, for the
+// keys to spread evenly.
+const ringPoints = 128
+
+func parseForwardTarget(u string) (*forwardTarget, error) {
+	i := strings.Index(u, "://")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid forward url %q: want scheme://address", u)
+	}
+
+	t := &forwardTarget{url: u, network: u[:i], addr: u[i+3:]}
+	switch t.network {
+	case "udp", "tcp":
+	case "tls":
+		host, _, err := net.SplitHostPort(t.addr)
+		if err != nil {
+			return nil, err
+		}
+		t.config = &tls.Config{ServerName: host}
+	default:
+		return nil, fmt.Errorf("invalid forward url %q: unsupported scheme %s", u, t.network)
+	}
+	return t, nil
+}
+
+func newForwardOutput(c outputConfig, format formatter) (*forwardOutput, error) {
+	o := &forwardOutput{format: format, framing: c.Framing, interval: c.HealthInterval}
+	for _, u := range append([]string{c.URL}, c.Failover...) {
+		t, err := parseForwardTarget(u)
+		if err != nil {
+			return nil, err
+		}
+		o.targets = append(o.targets, t)
+	}
+
+	switch o.framing {
+	case "", framingLF, framingOctet:
+	default:
+		return nil, fmt.Errorf("invalid framing %q: want %s or %s", o.framing, framingLF, framingOctet)
+	}
+
+	switch {
+	case c.Balance == "", c.Balance == "failover":
+	case strings.HasPrefix(c.Balance, "hash(") && strings.HasSuffix(c.Balance, ")"):
+		name := c.Balance[5 : len(c.Balance)-1]
+		get, ok := messageFields[name]
+		if strings.HasPrefix(name, "sd.") {
+			get, ok = sdParam(name[3:])
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid balance %q: unknown property %s", c.Balance, name)
+		}
+		o.hash = get
+		for i, t := range o.targets {
+			for j := 0; j < ringPoints; j++ {
+				o.ring = append(o.ring, ringPoint{ringHash(t.url + "#" + strconv.Itoa(j)), i})
+			}
+		}
+		sort.Slice(o.ring, func(i, j int) bool { return o.ring[i].hash < o.ring[j].hash })
+	default:
+		return nil, fmt.Errorf("invalid balance %q: want failover or hash(property)", c.Balance)
+	}
+
+	var err error
+	if o.relay, err = relayHeader(c.Header, c.RecordHop); err != nil {
+		return nil, err
+	}
+	if o.rewrite, err = c.Rewrite.compile(); err != nil {
+		return nil, err
+	}
+
+	if len(o.targets) > 1 {
+		if o.interval <= 0 {
+			o.interval = 10 * time.Second
+		}
+		o.recovered = make(chan struct{}, 1)
+		o.stop = make(chan struct{})
+		o.done = make(chan struct{})
+		go o.probe()
+	}
+	return o, nil
+}
+
+func (t *forwardTarget) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if t.config != nil {
+		return tls.DialWithDialer(d, "tcp", t.addr, t.config)
+	}
+	return d.Dial(t.network, t.addr)
+}
+
+func (o *forwardOutput) frame(m *server.Message, t *forwardTarget) ([]byte, error) {
+	if o.relay != nil {
+		m = o.relay(m)
+	}
+	if o.rewrite != nil {
+		m = o.rewrite(m)
+	}
+	line, err := o.format(m)
+	if err != nil {
+		return nil, err
+	}
+
+	framing := o.framing
+	if framing == "" {
+		framing = framingLF
+		if t.network == "tls" {
+			framing = framingOctet
+		}
+	}
+	switch {
+	case t.network == "udp":
+		return []byte(line), nil
+	case framing == framingOctet:
+		return []byte(strconv.Itoa(len(line)) + " " + line), nil
+	}
+	// A newline would end the frame early.
+	return []byte(strings.ReplaceAll(line, "\n", " ") + "\n"), nil
+}
+
+// ringHash is FNV-1a, mixed by the finalizer of MurmurHash3 for keys that
+// differ only in their last bytes to spread over the ring.
+func ringHash(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// candidates returns the targets to try for m in order: those up from
+// the active one, or from the point of m on the ring, or else the first
+// of them.
+func (o *forwardOutput) candidates(m *server.Message) []int {
+	var order []int
+	if o.hash == nil {
+		for i := o.active; i < len(o.targets); i++ {
+			order = append(order, i)
+		}
+	} else {
+		h := ringHash(o.hash(m))
+		start := sort.Search(len(o.ring), func(i int) bool { return o.ring[i].hash >= h })
+		seen := make([]bool, len(o.targets))
+		for k := 0; k < len(o.ring) && len(order) < len(o.targets); k++ {
+			p := o.ring[(start+k)%len(o.ring)]
+			if !seen[p.target] {
+				seen[p.target] = true
+				order = append(order, p.target)
+			}
+		}
+	}
+
+	up := order[:0:0]
+	for _, i := range order {
+		if !o.targets[i].down {
+			up = append(up, i)
+		}
+	}
+	if len(up) == 0 {
+		return order[:1]
+	}
+	return up
+}
+
+// Write sends m to the first of its candidates that accepts it.
+func (o *forwardOutput) Write(m *server.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var err error
+	for _, i := range o.candidates(m) {
+		t := o.targets[i]
+		var frame []byte
+		if frame, err = o.frame(m, t); err != nil {
+			return err
+		}
+		if err = t.send(frame); err == nil {
+			if o.hash == nil && i != o.active {
+				log.Printf("forward: failing over to %s", t.url)
+				o.targets[o.active].close()
+				o.active = i
+			}
+			o.err = nil
+			return nil
+		}
+		if len(o.targets) > 1 && !t.down {
+			log.Printf("forward: %s: %v", t.url, err)
+		}
+		t.down = true
+	}
+	// Start over from the first target once one is probed up again.
+	o.active = 0
+	o.err = err
+	return err
+}
+
+// send writes frame to t, redialing once if the connection was lost.
+func (t *forwardTarget) send(frame []byte) error {
+	if t.conn != nil && t.network != "udp" && peerClosed(t.conn) {
+		t.close()
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if t.conn == nil {
+			if t.conn, err = t.dial(); err != nil {
+				break
+			}
+		}
+		if _, err = t.conn.Write(frame); err == nil {
+			break
+		}
+		t.close()
+	}
+	return err
+}
+
+func (t *forwardTarget) close() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+// probe checks the targets down, and fails back to those preferred to the
+// active one once they are up.
+func (o *forwardOutput) probe() {
+	defer close(o.done)
+
+	tick := time.NewTicker(o.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-o.stop:
+			return
+		}
+
+		o.mu.Lock()
+		var down []*forwardTarget
+		for _, t := range o.targets {
+			if t.down {
+				down = append(down, t)
+			}
+		}
+		o.mu.Unlock()
+
+		for _, t := range down {
+			conn, err := t.dial()
+			if err != nil {
+				continue
+			}
+			conn.Close()
+
+			o.mu.Lock()
+			t.down = false
+			for i := 0; i < o.active; i++ {
+				if o.targets[i] == t {
+					log.Printf("forward: failing back to %s", t.url)
+					o.targets[o.active].close()
+					o.active = i
+				}
+			}
+			o.mu.Unlock()
+			select {
+			case o.recovered <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// recoveredC is signaled when a target is up again, for a queue to replay
+// its messages without waiting for its next retry. It is nil without
+// failover targets.
+func (o *forwardOutput) recoveredC() <-chan struct{} {
+	return o.recovered
+}
+
+func (o *forwardOutput) check() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err
+}
+
+func (o *forwardOutput) Close() error {
+	if o.stop != nil {
+		close(o.stop)
+		<-o.done
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var err error
+	for _, t := range o.targets {
+		if e := t.close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
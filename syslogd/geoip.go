@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/haccht/syslog_tools/server"
+	"github.com/oschwald/geoip2-golang"
+)
+
+const defaultGeoIPSDID = "geoip@32473"
+
+type geoipConfig struct {
+	CityDB string `yaml:"city_db"` // GeoLite2-City.mmdb or GeoLite2-Country.mmdb
+	ASNDB  string `yaml:"asn_db"`  // GeoLite2-ASN.mmdb
+	SDID   string `yaml:"sd_id"`   // default geoip@32473
+}
+
+// geoip is a server.Handler adding the location and network of public
+// sender addresses to the structured data of messages, as the params
+// country, city, asn and as_org.
+type geoip struct {
+	state atomic.Pointer[geoipState]
+
+	mu     sync.Mutex
+	config geoipConfig
+}
+
+type geoipState struct {
+	sdID string
+	city *geoip2.Reader
+	asn  *geoip2.Reader
+}
+
+func newGeoIP() *geoip {
+	g := &geoip{}
+	g.state.Store(&geoipState{})
+	return g
+}
+
+// Set opens the databases of c. Readers replaced on reload are left open,
+// since messages may still be looked up in them.
+func (g *geoip) Set(c geoipConfig) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c == g.config {
+		return nil
+	}
+
+	st := &geoipState{sdID: c.SDID}
+	if st.sdID == "" {
+		st.sdID = defaultGeoIPSDID
+	}
+	var err error
+	if c.CityDB != "" {
+		if st.city, err = geoip2.Open(c.CityDB); err != nil {
+			return err
+		}
+	}
+	if c.ASNDB != "" {
+		if st.asn, err = geoip2.Open(c.ASNDB); err != nil {
+			if st.city != nil {
+				st.city.Close()
+			}
+			return err
+		}
+	}
+
+	g.state.Store(st)
+	g.config = c
+	return nil
+}
+
+func (g *geoip) Handle(m *server.Message) *server.Message {
+	st := g.state.Load()
+	if m == nil || (st.city == nil && st.asn == nil) {
+		return m
+	}
+	ip := net.ParseIP(m.NetSrc())
+	if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return m
+	}
+
+	params := make(map[string]string)
+	if st.city != nil {
+		if rec, err := st.city.City(ip); err == nil {
+			if rec.Country.IsoCode != "" {
+				params["country"] = rec.Country.IsoCode
+			}
+			if name := rec.City.Names["en"]; name != "" {
+				params["city"] = name
+			}
+		}
+	}
+	if st.asn != nil {
+		if rec, err := st.asn.ASN(ip); err == nil && rec.AutonomousSystemNumber != 0 {
+			params["asn"] = strconv.FormatUint(uint64(rec.AutonomousSystemNumber), 10)
+			params["as_org"] = rec.AutonomousSystemOrganization
+		}
+	}
+	if len(params) == 0 {
+		return m
+	}
+
+	if m.StructuredData == nil {
+		m.StructuredData = make(map[string]map[string]string)
+	}
+	m.StructuredData[st.sdID] = params
+	return m
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// grokPatterns is the library of named patterns grok expressions refer to
+// as %{NAME}, a subset of the Logstash one written for RE2, which has no
+// lookaround or atomic groups. The grok_patterns of the configuration add
+// to it or replace its patterns.
+var grokPatterns = map[string]string{
+	"USERNAME":       `[a-zA-Z0-9._-]+`,
+	"USER":           `%{USERNAME}`,
+	"EMAILLOCALPART": `[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+(?:\.[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+)*`,
+	"EMAILADDRESS":   `%{EMAILLOCALPART}@%{HOSTNAME}`,
+	"INT":            `[+-]?[0-9]+`,
+	"BASE10NUM":      `[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+)`,
+	"NUMBER":         `%{BASE10NUM}`,
+	"BASE16NUM":      `[+-]?(?:0x)?[0-9A-Fa-f]+`,
+	"POSINT":         `\b[1-9][0-9]*\b`,
+	"NONNEGINT":      `\b[0-9]+\b`,
+	"WORD":           `\b\w+\b`,
+	"NOTSPACE":       `\S+`,
+	"SPACE":          `\s*`,
+	"DATA":           `.*?`,
+	"GREEDYDATA":     `.*`,
+	"QUOTEDSTRING":   `"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|` + "`(?:[^`\\\\]|\\\\.)*`",
+	"UUID":           `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+
+	"MAC":      `(?:[A-Fa-f0-9]{2}[:-]){5}[A-Fa-f0-9]{2}|(?:[A-Fa-f0-9]{4}\.){2}[A-Fa-f0-9]{4}`,
+	"IPV4":     `(?:(?:25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])`,
+	"IPV6":     `[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}(?:%[0-9A-Za-z]+)?`,
+	"IP":       `%{IPV6}|%{IPV4}`,
+	"HOSTNAME": `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?`,
+	"IPORHOST": `%{IP}|%{HOSTNAME}`,
+	"HOSTPORT": `%{IPORHOST}:%{POSINT}`,
+
+	"UNIXPATH":     `(?:/[\w_%!$@:.,+~-]*)+`,
+	"WINPATH":      `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"PATH":         `%{UNIXPATH}|%{WINPATH}`,
+	"URIPROTO":     `[A-Za-z][A-Za-z0-9+\-.]*`,
+	"URIHOST":      `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":      `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_\-]*)+`,
+	"URIPARAM":     `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\-\[\]<>]*`,
+	"URIPATHPARAM": `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":          `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?%{URIHOST}?(?:%{URIPATHPARAM})?`,
+
+	"MONTH":             `\b(?:[Jj]an(?:uary|uar)?|[Ff]eb(?:ruary|ruar)?|[Mm](?:a|ä)?r(?:ch|z)?|[Aa]pr(?:il)?|[Mm]a(?:y|i)?|[Jj]un(?:e|i)?|[Jj]ul(?:y|i)?|[Aa]ug(?:ust)?|[Ss]ep(?:tember)?|[Oo](?:c|k)?t(?:ober)?|[Nn]ov(?:ember)?|[Dd]e(?:c|z)(?:ember)?)\b`,
+	"MONTHNUM":          `0?[1-9]|1[0-2]`,
+	"MONTHDAY":          `(?:0[1-9])|(?:[12][0-9])|(?:3[01])|[1-9]`,
+	"DAY":               `\b(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)\b`,
+	"YEAR":              `(?:\d\d){1,2}`,
+	"HOUR":              `2[0123]|[01]?[0-9]`,
+	"MINUTE":            `[0-5][0-9]`,
+	"SECOND":            `(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"DATE_US":           `%{MONTHNUM}[/-]%{MONTHDAY}[/-]%{YEAR}`,
+	"DATE_EU":           `%{MONTHDAY}[./-]%{MONTHNUM}[./-]%{YEAR}`,
+	"DATE":              `%{DATE_US}|%{DATE_EU}`,
+	"DATESTAMP":         `%{DATE}[- ]%{TIME}`,
+	"ISO8601_TIMEZONE":  `Z|[+-]%{HOUR}(?::?%{MINUTE})`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"LOGLEVEL":          `[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo(?:rmation)?|INFO(?:RMATION)?|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|EMERG(?:ENCY)?|[Ee]merg(?:ency)?`,
+
+	"PROG":       `[\x21-\x5a\x5c\x5e-\x7e]+`,
+	"SYSLOGPROG": `%{PROG:program}(?:\[%{POSINT:pid}\])?`,
+	"SYSLOGHOST": `%{IPORHOST}`,
+	"SYSLOGBASE": `%{SYSLOGTIMESTAMP:timestamp} (?:%{SYSLOGHOST:logsource} )?%{SYSLOGPROG}:`,
+
+	"COMMONAPACHELOG":   `%{IPORHOST:clientip} %{USER:ident} %{USER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{NUMBER:response} (?:%{NUMBER:bytes}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+	"NGINXACCESS":       `%{COMBINEDAPACHELOG}`,
+	"QS":                `%{QUOTEDSTRING}`,
+
+	"SSHDAUTH":    `%{WORD:result} %{WORD:method} for (?:invalid user )?%{USERNAME:user} from %{IP:client} port %{INT:port}(?: %{WORD:protocol})?`,
+	"SSHDINVALID": `[Ii]nvalid user %{USERNAME:user} from %{IP:client}(?: port %{INT:port})?`,
+}
+
+// grokRef is %{NAME}, %{NAME:field} or %{NAME:field:type}, where the type
+// of Logstash is accepted but the values stay strings.
+var grokRef = regexp.MustCompile(`%\{(\w+)(?::([\w.\[\]@-]+))?(?::\w+)?\}`)
+
+// grok matches the content of messages against expressions in turn, and
+// returns the fields of the first that matches.
+type grok struct {
+	exprs []*regexp.Regexp
+	names [][]string // the field of each capture group of an expression
+}
+
+func newGrok(exprs []string, custom map[string]string) (*grok, error) {
+	library := make(map[string]string, len(grokPatterns)+len(custom))
+	for name, p := range grokPatterns {
+		library[name] = p
+	}
+	for name, p := range custom {
+		library[name] = p
+	}
+
+	g := &grok{}
+	for _, expr := range exprs {
+		var fields []string
+		s, err := expandGrok(expr, library, &fields, 0)
+		if err != nil {
+			return nil, fmt.Errorf("grok %q: %v", expr, err)
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("grok %q: %v", expr, err)
+		}
+		names := make([]string, re.NumSubexp()+1)
+		for i, name := range re.SubexpNames() {
+			if n, ok := strings.CutPrefix(name, "grok"); ok {
+				k, _ := strconv.Atoi(n)
+				names[i] = fields[k]
+			} else if name != "" {
+				names[i] = name
+			}
+		}
+		g.exprs = append(g.exprs, re)
+		g.names = append(g.names, names)
+	}
+	return g, nil
+}
+
+// expandGrok replaces the references of s by their patterns, the named
+// ones by groups grokN where fields[N] is the field, since Go does not
+// accept dots in group names.
+func expandGrok(s string, library map[string]string, fields *[]string, depth int) (string, error) {
+	if depth > 20 {
+		return "", fmt.Errorf("patterns nested too deep")
+	}
+	var err error
+	s = grokRef.ReplaceAllStringFunc(s, func(ref string) string {
+		sub := grokRef.FindStringSubmatch(ref)
+		p, ok := library[sub[1]]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("unknown pattern %s", sub[1])
+			}
+			return ""
+		}
+		expanded, e := expandGrok(p, library, fields, depth+1)
+		if e != nil && err == nil {
+			err = e
+		}
+		if sub[2] == "" {
+			return "(?:" + expanded + ")"
+		}
+		*fields = append(*fields, sub[2])
+		return fmt.Sprintf("(?P<grok%d>%s)", len(*fields)-1, expanded)
+	})
+	return s, err
+}
+
+func (g *grok) parse(m *server.Message) map[string]string {
+	for i, re := range g.exprs {
+		loc := re.FindStringSubmatchIndex(m.Content)
+		if loc == nil {
+			continue
+		}
+		fields := make(map[string]string)
+		for j, name := range g.names[i] {
+			if name != "" && loc[2*j] >= 0 {
+				fields[name] = m.Content[loc[2*j]:loc[2*j+1]]
+			}
+		}
+		return fields
+	}
+	return nil
+}
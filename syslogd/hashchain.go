@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// A hash chained file ends every record with " #" and the hex SHA-256, or
+// HMAC-SHA256 with a key, of the hash of the previous record followed by
+// the record. The first record of a file is a header holding the last hash
+// of the file it was rotated from, which chains the files together:
+//
+//	# syslogd hash chain, previous 0000...0000 #9f86...
+//	2024-05-01 12:00:00 192.0.2.7 <user,notice> ... #3e23...
+//
+// Records may span lines, which end at the next line with a hash. Altering,
+// inserting or removing records breaks the chain, which syslogd verify
+// detects; removing records at the end of the last file goes unnoticed
+// unless its last hash was kept elsewhere.
+const (
+	chainHeader    = "# syslogd hash chain, previous "
+	chainSuffixLen = 2 + 2*sha256.Size
+	chainTail      = 2*server.MaxMessageSize + chainSuffixLen // read to find the last record
+)
+
+var errUnchained = errors.New("file is not hash chained")
+
+type hashChain struct {
+	key  []byte
+	last [sha256.Size]byte
+}
+
+func (c *hashChain) newHash() hash.Hash {
+	if c.key != nil {
+		return hmac.New(sha256.New, c.key)
+	}
+	return sha256.New()
+}
+
+// next returns record with its hash, the new last one.
+func (c *hashChain) next(record string) string {
+	h := c.newHash()
+	h.Write(c.last[:])
+	io.WriteString(h, record)
+	h.Sum(c.last[:0])
+	return record + " #" + hex.EncodeToString(c.last[:])
+}
+
+// header returns the first record of a file.
+func (c *hashChain) header() string {
+	return c.next(chainHeader + hex.EncodeToString(c.last[:]))
+}
+
+// splitChained splits line into the record and its hash, if it has one.
+func splitChained(line string) (string, []byte, bool) {
+	if len(line) < chainSuffixLen || line[len(line)-chainSuffixLen:len(line)-chainSuffixLen+2] != " #" {
+		return "", nil, false
+	}
+	sum, err := hex.DecodeString(line[len(line)-chainSuffixLen+2:])
+	if err != nil {
+		return "", nil, false
+	}
+	return line[:len(line)-chainSuffixLen], sum, true
+}
+
+// readTail returns the last n bytes of the file f of size bytes.
+func readTail(f *os.File, size int64, n int) ([]byte, error) {
+	if int64(n) > size {
+		n = int(size)
+	}
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, size-int64(n)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// resume sets the last hash to the one of the last record in tail, the
+// end of a file, or returns errUnchained if it has none.
+func (c *hashChain) resume(tail []byte) error {
+	buf := bytes.TrimRight(tail, "\n")
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	_, sum, ok := splitChained(string(buf))
+	if !ok {
+		return errUnchained
+	}
+	copy(c.last[:], sum)
+	return nil
+}
+
+// runVerify implements "syslogd verify", checking the hash chain of files
+// given in the order they were written.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	key := fs.String("key", "", "hash_chain_key of the output, if it has one")
+	keys := atRestFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [options] file...\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Files are given oldest first, such as app.log.20240501T000000.gz app.log; compressed and encrypted files are read as such.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	a, err := keys()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	c := &hashChain{}
+	if *key != "" {
+		c.key = []byte(*key)
+	}
+	failed := false
+	var prev []byte
+	for _, path := range fs.Args() {
+		records, last, err := verifyFile(path, c, a, prev)
+		if err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			failed = true
+			prev = nil
+			continue
+		}
+		fmt.Printf("%s: %d records ok\n", path, records)
+		prev = last
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// verifyFile checks the chain of the file at path, and that it continues
+// the chain ending with prev unless prev is nil. It returns the number of
+// records and the last hash.
+func verifyFile(path string, c *hashChain, a *atRest, prev []byte) (int, []byte, error) {
+	r, err := openLogFile(path, a)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer r.Close()
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 4*server.MaxMessageSize)
+	var record strings.Builder
+	records, lineNo, start := 0, 0, 1
+	for sc.Scan() {
+		lineNo++
+		text, sum, ok := splitChained(sc.Text())
+		if !ok {
+			record.WriteString(sc.Text())
+			record.WriteByte('\n')
+			continue
+		}
+		record.WriteString(text)
+
+		if records == 0 {
+			h, found := strings.CutPrefix(record.String(), chainHeader)
+			last, err := hex.DecodeString(h)
+			if !found || err != nil || len(last) != sha256.Size {
+				return 0, nil, fmt.Errorf("line %d: no hash chain header", start)
+			}
+			if prev != nil && !bytes.Equal(last, prev) {
+				return 0, nil, fmt.Errorf("does not continue the chain of the previous file")
+			}
+			copy(c.last[:], last)
+		}
+		c.next(record.String())
+		if !hmac.Equal(c.last[:], sum) {
+			return 0, nil, fmt.Errorf("line %d: chain broken, records were altered, inserted or removed", start)
+		}
+		records++
+		record.Reset()
+		start = lineNo + 1
+	}
+	if err := sc.Err(); err != nil {
+		return 0, nil, err
+	}
+	if record.Len() > 0 {
+		return 0, nil, fmt.Errorf("line %d: record without hash", start)
+	}
+	if records == 0 {
+		return 0, nil, errors.New("no hash chain header")
+	}
+	return records - 1, append([]byte(nil), c.last[:]...), nil
+}
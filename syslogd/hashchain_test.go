@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func verifyTestFile(t *testing.T, path string, c outputConfig, prev []byte) (int, []byte, error) {
+	t.Helper()
+	a, err := newAtRest(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := &hashChain{}
+	if c.HashChainKey != "" {
+		chain.key = []byte(c.HashChainKey)
+	}
+	return verifyFile(path, chain, a, prev)
+}
+
+func TestHashChainReload(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name string
+		c    outputConfig
+	}{
+		{"plain", outputConfig{HashChain: true}},
+		{"hmac", outputConfig{HashChain: true, HashChainKey: "secret"}},
+		{"encrypted", outputConfig{HashChain: true, EncryptKey: testEncryptKey(t, dir)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.c
+			c.Path = filepath.Join(t.TempDir(), "app.log")
+			old := openTestFile(t, c)
+			writeRecords(t, old, "record-0", "record-1")
+			reloaded := openTestFile(t, c)
+			writeRecords(t, old, "record-2")
+			if err := old.Close(); err != nil {
+				t.Fatal(err)
+			}
+			writeRecords(t, reloaded, "record-3")
+			if err := reloaded.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// And after a restart.
+			o := openTestFile(t, c)
+			writeRecords(t, o, "record-4")
+			if err := o.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if records, _, err := verifyTestFile(t, c.Path, c, nil); err != nil || records != 5 {
+				t.Errorf("verify: %d records, %v, want 5", records, err)
+			}
+		})
+	}
+}
+
+func TestHashChainRotation(t *testing.T) {
+	c := outputConfig{Path: filepath.Join(t.TempDir(), "app.log"), HashChain: true}
+	o := openTestFile(t, c)
+	writeRecords(t, o, "record-0")
+	o.mu.Lock()
+	err := o.rotate()
+	o.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, o, "record-1")
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := filepath.Glob(c.Path + ".*")
+	if err != nil || len(rotated) != 1 {
+		t.Fatalf("rotated files %v, %v, want 1", rotated, err)
+	}
+	_, last, err := verifyTestFile(t, rotated[0], c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := verifyTestFile(t, c.Path, c, last); err != nil {
+		t.Errorf("verify after %s: %v", rotated[0], err)
+	}
+	if _, _, err := verifyTestFile(t, c.Path, c, make([]byte, len(last))); err == nil {
+		t.Error("verify with another previous file passed")
+	}
+}
+
+func TestHashChainAltered(t *testing.T) {
+	c := outputConfig{Path: filepath.Join(t.TempDir(), "app.log"), HashChain: true}
+	o := openTestFile(t, c)
+	writeRecords(t, o, "record-0", "record-1", "record-2")
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+
+	tests := []struct {
+		name  string
+		lines []string
+		err   string
+	}{
+		{"altered", []string{lines[0], lines[1], strings.Replace(lines[2], "record-1", "record-X", 1), lines[3]}, "line 3: chain broken"},
+		{"removed", []string{lines[0], lines[1], lines[3]}, "line 3: chain broken"},
+		{"reordered", []string{lines[0], lines[2], lines[1], lines[3]}, "line 2: chain broken"},
+		{"unhashed", append(lines[:4:4], "record-3\n"), "line 5: record without hash"},
+		{"no header", lines[1:], "line 1: no hash chain header"},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(c.Path, []byte(strings.Join(tt.lines, "")), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := verifyTestFile(t, c.Path, c, nil); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: verify %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
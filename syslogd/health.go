@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const stallTimeout = 30 * time.Second
+
+var (
+	// ready is set once all listeners are bound, and cleared on shutdown.
+	ready atomic.Bool
+
+	// lastRouted is the time the last message was taken from the routing
+	// queue, in Unix nanoseconds.
+	lastRouted atomic.Int64
+)
+
+// routingStalled reports whether the routing queue is full and has not
+// moved for a while, which a restart may fix, and since when it has not.
+func routingStalled(h *server.BaseHandler) (time.Duration, bool) {
+	since := time.Since(time.Unix(0, lastRouted.Load()))
+	return since, h.Len() >= h.Cap() && since > stallTimeout
+}
+
+// healthz fails when routing has stalled.
+func healthz(h *server.BaseHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if since, stalled := routingStalled(h); stalled {
+			http.Error(w, fmt.Sprintf("routing stalled for %v", since.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// readyz fails until the listeners are bound, while the routing queue is
+// nearly full, and while an output fails to deliver.
+func readyz(h *server.BaseHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var problems []string
+		if !ready.Load() {
+			problems = append(problems, "listeners not ready")
+		}
+		if h.Len() > h.Cap()/10*9 {
+			problems = append(problems, "routing queue is almost full")
+		}
+		if rt := currentRouter.Load(); rt != nil {
+			for name, o := range rt.outputs {
+				c, ok := o.(interface{ check() error })
+				if !ok {
+					continue
+				}
+				if err := c.check(); err != nil {
+					problems = append(problems, fmt.Sprintf("output %s: %v", name, err))
+				}
+			}
+		}
+
+		if len(problems) > 0 {
+			sort.Strings(problems)
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// newClientTLSConfig returns the TLS configuration of outputs connecting
+// to servers.
+func newClientTLSConfig(c outputConfig) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: c.TLSSkipVerify}
+	if c.TLSCA != "" {
+		pem, err := os.ReadFile(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLSCA)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// newHTTPClient returns a client for the HTTP based outputs.
+func newHTTPClient(c outputConfig) (*http.Client, error) {
+	config, err := newClientTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// checkResponse turns an unsuccessful response into an error, which is
+// permanent unless the server is overloaded or failing.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return permanentError{err}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	statsToMessage = "message"
+	statsToLog     = "log"
+	statsToBoth    = "both"
+)
+
+// statsConfig reports the counters of the listeners, the queues and the
+// outputs periodically, as rsyslog's impstats does, for where they are not
+// scraped from /metrics. Each is reported in a message of its own from
+// the app syslogd with the MSGID stats, at syslog.info, which rules route
+// like any other:
+//
+//	{"name":"udp://:514","origin":"listener","received":1042,"bytes":95120,"malformed":0,"rejected":0,"dropped":0,"oversize":0}
+//
+// The counters add up since the start.
+type statsConfig struct {
+	Interval time.Duration `yaml:"interval"` // between reports, 0 disables them
+	To       string        `yaml:"to"`       // message (default), log for the log of syslogd, or both
+	Format   string        `yaml:"format"`   // json (default) or kv, name=value pairs
+}
+
+func (c statsConfig) validate() error {
+	var errs []error
+	switch c.To {
+	case "", statsToMessage, statsToLog, statsToBoth:
+	default:
+		errs = append(errs, atKeys(fmt.Errorf("stats: unknown to %q", c.To), "to"))
+	}
+	switch c.Format {
+	case "", "json", "kv":
+	default:
+		errs = append(errs, atKeys(fmt.Errorf("stats: unknown format %q", c.Format), "format"))
+	}
+	return errors.Join(errs...)
+}
+
+// statsReporter sends the reports of the stats config.
+type statsReporter struct {
+	config   atomic.Pointer[statsConfig]
+	srv      *server.Server
+	h        *server.BaseHandler
+	hostname string
+	kick     chan struct{}
+}
+
+func newStatsReporter(srv *server.Server, h *server.BaseHandler) *statsReporter {
+	s := &statsReporter{srv: srv, h: h, kick: make(chan struct{}, 1)}
+	s.hostname, _ = os.Hostname()
+	s.Set(statsConfig{})
+	go s.run()
+	return s
+}
+
+// Set replaces the config, restarting the interval.
+func (s *statsReporter) Set(c statsConfig) {
+	if c.To == "" {
+		c.To = statsToMessage
+	}
+	s.config.Store(&c)
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (s *statsReporter) run() {
+	t := time.NewTimer(0)
+	t.Stop()
+	for {
+		select {
+		case <-s.kick:
+			t.Stop()
+		case <-t.C:
+			s.report()
+		}
+		if interval := s.config.Load().Interval; interval > 0 {
+			t.Reset(interval)
+		}
+	}
+}
+
+func (s *statsReporter) report() {
+	c := s.config.Load()
+	now := time.Now()
+	for _, line := range s.lines(c.Format == "kv") {
+		if c.To != statsToMessage {
+			log.Printf("stats: %s", line)
+		}
+		if c.To == statsToLog || !ready.Load() {
+			continue
+		}
+		s.srv.Dispatch(&server.Message{
+			Time:      now,
+			Facility:  server.Syslog,
+			Severity:  server.Info,
+			Timestamp: now,
+			Hostname:  s.hostname,
+			Tag:       "syslogd",
+			Content:   line,
+			Tag1:      "syslogd",
+			Content1:  line,
+			Version:   1,
+			AppName:   "syslogd",
+			ProcID:    strconv.Itoa(os.Getpid()),
+			MsgID:     "stats",
+			Raw:       line,
+		})
+	}
+}
+
+// statsField is a counter of a report.
+type statsField struct {
+	name  string
+	value uint64
+}
+
+// lines returns the reports of the listeners, the queues and the outputs.
+func (s *statsReporter) lines(kv bool) []string {
+	var lines []string
+	add := func(name, origin string, fields ...statsField) {
+		var b strings.Builder
+		if kv {
+			fmt.Fprintf(&b, "name=%s origin=%s", kvValue(name), origin)
+			for _, f := range fields {
+				fmt.Fprintf(&b, " %s=%d", f.name, f.value)
+			}
+		} else {
+			fmt.Fprintf(&b, `{"name":%s,"origin":%q`, strconv.Quote(name), origin)
+			for _, f := range fields {
+				fmt.Fprintf(&b, `,%q:%d`, f.name, f.value)
+			}
+			b.WriteByte('}')
+		}
+		lines = append(lines, b.String())
+	}
+
+	listenerStats.Lock()
+	for _, name := range listenerStats.names {
+		st := listenerStats.stats[name].st
+		add(name, "listener",
+			statsField{"received", st.Received.Load()},
+			statsField{"bytes", st.Bytes.Load()},
+			statsField{"malformed", st.Malformed.Load()},
+			statsField{"rejected", st.Rejected.Load()},
+			statsField{"dropped", st.Dropped.Load()},
+			statsField{"oversize", st.Oversize.Load()})
+	}
+	listenerStats.Unlock()
+
+	queueNames, queues := []string{"route"}, []stageQueue{s.h}
+	if s.srv.ParseQueueCap() > 0 {
+		queueNames, queues = append([]string{"parse"}, queueNames...), append([]stageQueue{parseQueue{s.srv}}, queues...)
+	}
+	for i, q := range queues {
+		add(queueNames[i], "queue", statsField{"length", uint64(q.Len())}, statsField{"dropped", queueDropped(q)})
+	}
+
+	r := currentRouter.Load()
+	if r == nil {
+		return lines
+	}
+	names := make([]string, 0, len(r.outputs))
+	for name := range r.outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields := []statsField{
+			{"written", outputWrites.value(name, "success")},
+			{"failed", outputWrites.value(name, "failure")},
+			{"dropped", outputDropped.value(name)},
+			{"queued", uint64(r.stages[name].queue.Len())},
+		}
+		if q, ok := r.outputs[name].(interface{ queuedBytes() int64 }); ok {
+			fields = append(fields, statsField{"queue_bytes", uint64(q.queuedBytes())})
+		}
+		if b, ok := r.outputs[name].(interface{ pending() int }); ok {
+			fields = append(fields, statsField{"pending", uint64(b.pending())})
+		}
+		add(name, "output", fields...)
+	}
+	return lines
+}
+
+func queueDropped(q stageQueue) uint64 {
+	var n uint64
+	for sev := server.Emerg; sev <= server.Debug; sev++ {
+		n += q.Dropped(sev)
+	}
+	return n
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// httpTokens authorizes the requests of http and https listeners, which
+// send one of the http_tokens of the config as a bearer token:
+//
+//	curl -H 'Authorization: Bearer TOKEN' -H 'Content-Type: application/x-ndjson' \
+//	    --data-binary '{"hostname":"fn1","app_name":"billing","severity":"err","content":"charge failed"}' \
+//	    https://syslogd:8443/
+//
+// JSON messages have the properties of the json format, of which only the
+// content is required.
+type httpTokens struct {
+	tokens atomic.Pointer[[]string]
+}
+
+func newHTTPTokens(tokens []string) *httpTokens {
+	t := &httpTokens{}
+	t.Set(tokens)
+	return t
+}
+
+func (t *httpTokens) Set(tokens []string) {
+	t.tokens.Store(&tokens)
+}
+
+func (t *httpTokens) authorize(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	authorized := 0
+	for _, want := range *t.tokens.Load() {
+		authorized |= subtle.ConstantTimeCompare([]byte(token), []byte(want))
+	}
+	return authorized == 1
+}
@@ -0,0 +1,187 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const defaultJournalSocket = "/run/systemd/journal/socket"
+
+type journalField struct {
+	name string
+	get  func(*server.Message) string
+}
+
+// journaldOutput writes every message into the local systemd journal with
+// its native protocol, as entries journalctl shows like those of local
+// services, e.g. journalctl SYSLOG_HOSTNAME=web1 -t nginx.
+type journaldOutput struct {
+	mu     sync.Mutex
+	path   string
+	conn   *net.UnixConn
+	format formatter // of MESSAGE, the content by default
+	fields []journalField
+}
+
+func newJournaldOutput(c outputConfig, format formatter) (*journaldOutput, error) {
+	o, err := journaldOutputFor(c, format)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.dial(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// journaldOutputFor returns the output of c without connecting to the
+// journal.
+func journaldOutputFor(c outputConfig, format formatter) (*journaldOutput, error) {
+	o := &journaldOutput{path: c.Path, format: format}
+	if o.path == "" {
+		o.path = defaultJournalSocket
+	}
+	for name, prop := range c.Fields {
+		if !validJournalField(name) {
+			return nil, fmt.Errorf("invalid journal field name %s", name)
+		}
+		get, ok := labelFields[prop]
+		if !ok {
+			get, ok = messageFields[prop]
+		}
+		if strings.HasPrefix(prop, "sd.") {
+			get, ok = sdParam(prop[3:])
+		}
+		if !ok {
+			return nil, fmt.Errorf("field %s: unknown property %s", name, prop)
+		}
+		o.fields = append(o.fields, journalField{name, get})
+	}
+	sort.Slice(o.fields, func(i, j int) bool { return o.fields[i].name < o.fields[j].name })
+	return o, nil
+}
+
+// validJournalField reports whether name may be the name of a field sent
+// to the journal: uppercase letters, digits and underscores, not starting
+// with an underscore, which the journal reserves for trusted fields, or
+// a digit.
+func validJournalField(name string) bool {
+	if name == "" || len(name) > 64 || name[0] == '_' || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (o *journaldOutput) dial() error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: o.path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	o.conn = conn
+	return nil
+}
+
+func (o *journaldOutput) Write(m *server.Message) error {
+	msg := m.Content
+	if o.format != nil {
+		var err error
+		if msg, err = o.format(m); err != nil {
+			return err
+		}
+	}
+
+	var b bytes.Buffer
+	appendJournalField(&b, "MESSAGE", msg)
+	appendJournalField(&b, "PRIORITY", strconv.Itoa(int(m.Severity)))
+	appendJournalField(&b, "SYSLOG_FACILITY", strconv.Itoa(int(m.Facility)))
+	appendJournalField(&b, "SYSLOG_IDENTIFIER", program(m))
+	appendJournalField(&b, "SYSLOG_PID", m.ProcID)
+	appendJournalField(&b, "SYSLOG_HOSTNAME", m.Hostname)
+	appendJournalField(&b, "SYSLOG_TIMESTAMP", headerTime(m).Format("Jan _2 15:04:05"))
+	appendJournalField(&b, "SYSLOG_RAW", m.Raw)
+	appendJournalField(&b, "REMOTE_ADDR", m.NetSrc())
+	for _, f := range o.fields {
+		appendJournalField(&b, f.name, f.get(m))
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err := o.send(b.Bytes())
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ENOTCONN) {
+		// journald restarted.
+		o.conn.Close()
+		if err = o.dial(); err == nil {
+			err = o.send(b.Bytes())
+		}
+	}
+	return err
+}
+
+// send sends an entry in a datagram, or in a sealed memfd when it is too
+// large for one, as sd_journal_send does.
+func (o *journaldOutput) send(entry []byte) error {
+	_, err := o.conn.Write(entry)
+	if !errors.Is(err, syscall.EMSGSIZE) && !errors.Is(err, syscall.ENOBUFS) {
+		return err
+	}
+
+	fd, err := unix.MemfdCreate("journal-entry", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "journal-entry")
+	defer f.Close()
+	if _, err := f.Write(entry); err != nil {
+		return err
+	}
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL); err != nil {
+		return err
+	}
+	_, _, err = o.conn.WriteMsgUnix(nil, unix.UnixRights(int(f.Fd())), nil)
+	return err
+}
+
+// appendJournalField appends a field of an entry, in the binary form when
+// the value has a newline. Empty values are left out.
+func appendJournalField(b *bytes.Buffer, name, value string) {
+	if value == "" {
+		return
+	}
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+func (o *journaldOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.conn.Close()
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+type journaldOutput struct{}
+
+func newJournaldOutput(c outputConfig, format formatter) (*journaldOutput, error) {
+	return journaldOutputFor(c, format)
+}
+
+func journaldOutputFor(c outputConfig, format formatter) (*journaldOutput, error) {
+	return nil, errors.New("the journald output is only supported on Linux")
+}
+
+func (o *journaldOutput) Write(*server.Message) error { return nil }
+func (o *journaldOutput) Close() error                { return nil }
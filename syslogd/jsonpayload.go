@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// parseJSONMessage parses the content of m if it is a JSON object, as
+// containerized applications commonly log. Nested objects are flattened
+// into names joined by dots, such as user.id, arrays are kept as JSON and
+// null values are left out. It returns nil for any other content.
+func parseJSONMessage(m *server.Message) map[string]string {
+	s := strings.TrimSpace(m.Content)
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil || dec.More() {
+		return nil
+	}
+	fields := make(map[string]string)
+	flattenJSON(fields, "", obj)
+	return fields
+}
+
+func flattenJSON(fields map[string]string, prefix string, obj map[string]interface{}) {
+	for k, v := range obj {
+		name := prefix + k
+		switch v := v.(type) {
+		case nil:
+		case map[string]interface{}:
+			flattenJSON(fields, name+".", v)
+		case string:
+			fields[name] = v
+		case json.Number:
+			fields[name] = v.String()
+		case bool:
+			if v {
+				fields[name] = "true"
+			} else {
+				fields[name] = "false"
+			}
+		default:
+			var b bytes.Buffer
+			enc := json.NewEncoder(&b)
+			enc.SetEscapeHTML(false)
+			enc.Encode(v)
+			fields[name] = strings.TrimSuffix(b.String(), "\n")
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+var kafkaCompressions = map[string]kafka.Compression{
+	"gzip":   kafka.Gzip,
+	"snappy": kafka.Snappy,
+	"lz4":    kafka.Lz4,
+	"zstd":   kafka.Zstd,
+}
+
+// kafkaOutput produces messages to a Kafka topic, keyed by a message
+// property so that the messages of a host stay in order on one partition.
+type kafkaOutput struct {
+	*batchOutput
+	writer *kafka.Writer
+	format formatter
+	key    func(*server.Message) string
+}
+
+func newKafkaOutput(name string, c outputConfig, format formatter) (*kafkaOutput, error) {
+	if len(c.Brokers) == 0 || c.Topic == "" {
+		return nil, fmt.Errorf("kafka output requires brokers and a topic")
+	}
+
+	o := &kafkaOutput{format: format}
+	switch c.Key {
+	case "":
+		o.key = messageFields["hostname"]
+	case "none":
+	default:
+		get, ok := messageFields[c.Key]
+		if strings.HasPrefix(c.Key, "sd.") {
+			get, ok = sdParam(c.Key[3:])
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown key property %s", c.Key)
+		}
+		o.key = get
+	}
+
+	transport := &kafka.Transport{}
+	if c.TLS {
+		config, err := newClientTLSConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLS = config
+	}
+	if c.SASL != "" {
+		mechanism, err := newSASLMechanism(c)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+
+	o.writer = &kafka.Writer{
+		Addr:         kafka.TCP(c.Brokers...),
+		Topic:        c.Topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    c.BatchSize,
+		BatchTimeout: 10 * time.Millisecond,
+		RequiredAcks: kafka.RequireAll,
+		Transport:    transport,
+	}
+	if c.Compress != "" {
+		codec, ok := kafkaCompressions[c.Compress]
+		if !ok {
+			return nil, fmt.Errorf("unknown compression %q", c.Compress)
+		}
+		o.writer.Compression = codec
+	}
+
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	return o, nil
+}
+
+func newSASLMechanism(c outputConfig) (sasl.Mechanism, error) {
+	switch strings.ToLower(c.SASL) {
+	case "plain":
+		return plain.Mechanism{Username: c.Username, Password: c.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, c.Username, c.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, c.Username, c.Password)
+	}
+	return nil, fmt.Errorf("unknown SASL mechanism %q", c.SASL)
+}
+
+func (o *kafkaOutput) send(batch []*server.Message) error {
+	msgs := make([]kafka.Message, 0, len(batch))
+	sent := make([]*server.Message, 0, len(batch))
+	for _, m := range batch {
+		value, err := o.format(m)
+		if err != nil {
+			log.Printf("output %s: %v", o.name, err)
+			continue
+		}
+		msg := kafka.Message{Value: []byte(value), Time: m.Time}
+		if o.key != nil {
+			msg.Key = []byte(o.key(m))
+		}
+		msgs = append(msgs, msg)
+		sent = append(sent, m)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := o.writer.WriteMessages(ctx, msgs...)
+
+	// Only the messages the brokers did not take are sent again.
+	var werrs kafka.WriteErrors
+	if errors.As(err, &werrs) {
+		var failed []*server.Message
+		for i, e := range werrs {
+			if e != nil && i < len(sent) {
+				failed = append(failed, sent[i])
+			}
+		}
+		return partialError{err, failed}
+	}
+	var kerr kafka.Error
+	if errors.As(err, &kerr) && !kerr.Temporary() {
+		return permanentError{err}
+	}
+	return err
+}
+
+func (o *kafkaOutput) Close() error {
+	o.batchOutput.Close()
+	return o.writer.Close()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+type listenFlag []string
+
+func (l *listenFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listenFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseListenURL splits scheme://address?options. The options are
+// parser=auto|rfc3164|rfc5424|raw for the format of the messages, auto by
+// default, optionally followed by ,strict or ,lenient for RFC 3164 headers,
+// tz=zone for timestamps that carry none,
+// allow=CIDR,... and deny=CIDR,... to accept only some senders, and for
+// udp and gelf sockets=N|auto to read from N SO_REUSEPORT sockets (Linux
+// only), one per CPU with auto. For connections and DTLS sessions,
+// max_conns=N limits those at once and idle_timeout=duration how long they
+// may wait before sending a message; for connections, read_timeout=duration
+// limits how long they may take to send one or to complete the TLS
+// handshake. max_inflight=N limits the messages of the listener waiting to
+// be handled, and for dtls, rate=N the messages a second of each session.
+// max_message_size=N sets the largest message, at most and by default
+// 65536 bytes, and oversize=truncate|reject whether longer ones are
+// truncated and flagged with truncated@32473, the default, or dropped.
+func parseListenURL(s string, logRejected bool) (string, string, []server.ListenOption, error) {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return "", "", nil, fmt.Errorf("invalid listen address %q: want scheme://address", s)
+	}
+
+	scheme, addr := s[:i], s[i+3:]
+	switch scheme {
+	case "udp", "tcp", "tls", "dtls", "relp", "http", "https", "gelf", "gelf+tcp", "unix", "unixgram":
+	default:
+		return "", "", nil, fmt.Errorf("invalid listen address %q: unsupported scheme %s", s, scheme)
+	}
+
+	var query string
+	if j := strings.IndexByte(addr, '?'); j >= 0 {
+		addr, query = addr[:j], addr[j+1:]
+	}
+	if query == "" {
+		return scheme, addr, nil, nil
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("invalid listen address %q: %v", s, err)
+	}
+
+	parser := &server.Parser{}
+	opts := []server.ListenOption{server.WithParser(parser)}
+	var allow, deny []string
+	var limits server.Limits
+	for key := range values {
+		value := values.Get(key)
+		switch key {
+		case "parser":
+			for _, v := range strings.Split(value, ",") {
+				switch v {
+				case "auto":
+					parser.Format = server.FormatAuto
+				case "rfc3164":
+					parser.Format = server.FormatRFC3164
+				case "rfc5424":
+					parser.Format = server.FormatRFC5424
+				case "raw":
+					parser.Format = server.FormatRaw
+				case "strict":
+					parser.Strict = true
+				case "lenient":
+					parser.Strict = false
+				default:
+					return "", "", nil, fmt.Errorf("invalid listen address %q: unknown parser %s", s, v)
+				}
+			}
+		case "tz":
+			loc, err := time.LoadLocation(value)
+			if err != nil {
+				return "", "", nil, fmt.Errorf("invalid listen address %q: %v", s, err)
+			}
+			parser.Location = loc
+		case "sockets":
+			n := runtime.NumCPU()
+			if value != "auto" {
+				if n, err = strconv.Atoi(value); err != nil || n < 1 {
+					return "", "", nil, fmt.Errorf("invalid listen address %q: invalid sockets %s", s, value)
+				}
+			}
+			if scheme != "udp" && scheme != "gelf" {
+				return "", "", nil, fmt.Errorf("invalid listen address %q: sockets is only supported for udp and gelf", s)
+			}
+			opts = append(opts, server.WithSockets(n))
+		case "max_conns", "idle_timeout", "read_timeout", "max_inflight", "rate":
+			datagram := scheme == "udp" || scheme == "gelf" || scheme == "unixgram"
+			switch {
+			case key == "rate" && scheme != "dtls":
+				return "", "", nil, fmt.Errorf("invalid listen address %q: rate is only supported for dtls", s)
+			case key == "read_timeout" && (datagram || scheme == "dtls"):
+				return "", "", nil, fmt.Errorf("invalid listen address %q: read_timeout is not supported for %s", s, scheme)
+			case (key == "max_conns" || key == "idle_timeout") && datagram:
+				return "", "", nil, fmt.Errorf("invalid listen address %q: %s is not supported for %s", s, key, scheme)
+			}
+			switch key {
+			case "max_conns":
+				limits.MaxConns, err = strconv.Atoi(value)
+			case "idle_timeout":
+				limits.IdleTimeout, err = time.ParseDuration(value)
+			case "read_timeout":
+				limits.ReadTimeout, err = time.ParseDuration(value)
+			case "max_inflight":
+				limits.MaxInFlight, err = strconv.Atoi(value)
+			case "rate":
+				limits.Rate, err = strconv.ParseFloat(value, 64)
+			}
+			if err != nil {
+				return "", "", nil, fmt.Errorf("invalid listen address %q: invalid %s %s", s, key, value)
+			}
+		case "max_message_size":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > server.MaxMessageSize {
+				return "", "", nil, fmt.Errorf("invalid listen address %q: invalid max_message_size %s, want 1 to %d", s, value, server.MaxMessageSize)
+			}
+			limits.MaxMessageSize = n
+		case "oversize":
+			switch value {
+			case "truncate":
+				limits.RejectOversize = false
+			case "reject":
+				limits.RejectOversize = true
+			default:
+				return "", "", nil, fmt.Errorf("invalid listen address %q: unknown oversize policy %s", s, value)
+			}
+		case "allow":
+			allow = values[key]
+		case "deny":
+			deny = values[key]
+		default:
+			return "", "", nil, fmt.Errorf("invalid listen address %q: unknown option %s", s, key)
+		}
+	}
+	if limits != (server.Limits{}) {
+		opts = append(opts, server.WithLimits(limits))
+	}
+	if len(allow) > 0 || len(deny) > 0 {
+		a, err := newACL(allow, deny)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid listen address %q: %v", s, err)
+		}
+		opts = append(opts, server.WithACL(newACLFilter(a, logRejected).permit))
+	}
+	return scheme, addr, opts, nil
+}
+
+// loadServerTLSConfig loads the certificate of the files, or else takes it
+// from acme.
+func loadServerTLSConfig(files tlsFiles, acme *acmeManager) (*tls.Config, error) {
+	var config *tls.Config
+	switch {
+	case files.Cert != "" && files.Key != "":
+		cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case acme != nil:
+		config = &tls.Config{GetCertificate: acme.getCertificate}
+	default:
+		return nil, errors.New("tls listener requires -tls-cert and -tls-key, or tls.acme")
+	}
+
+	var err error
+	if config.ClientAuth, err = parseClientAuth(files.ClientAuth, files.CA != ""); err != nil {
+		return nil, err
+	}
+	if config.ClientAuth == tls.NoClientCert {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(files.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", files.CA)
+	}
+	config.ClientCAs = pool
+
+	rc, err := newRevocationChecker(files, pem)
+	if err != nil {
+		return nil, err
+	}
+	if rc != nil {
+		config.VerifyConnection = rc.verify
+	}
+	return config, nil
+}
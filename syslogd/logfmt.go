@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// parseLogfmtMessage parses the content of m as logfmt, pairs such as
+// at=info method=GET path="/a b" fwd, where a key without a value is true.
+// It returns nil if the content has no key=value pair.
+func parseLogfmtMessage(m *server.Message) map[string]string {
+	return parseLogfmt(m.Content)
+}
+
+func parseLogfmt(s string) map[string]string {
+	fields := make(map[string]string)
+	pairs := 0
+	for i := 0; i < len(s); {
+		if s[i] == ' ' || s[i] == '\t' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(s) && s[j] > ' ' && s[j] != '=' && s[j] != '"' {
+			j++
+		}
+		key := s[i:j]
+		if key == "" {
+			return nil
+		}
+		if j == len(s) || s[j] != '=' {
+			if j < len(s) && s[j] == '"' {
+				return nil
+			}
+			fields[key] = "true"
+			i = j
+			continue
+		}
+
+		j++
+		pairs++
+		if j < len(s) && s[j] == '"' {
+			k := j + 1
+			for k < len(s) && s[k] != '"' {
+				if s[k] == '\\' {
+					k++
+				}
+				k++
+			}
+			if k >= len(s) {
+				return nil
+			}
+			v, err := strconv.Unquote(s[j : k+1])
+			if err != nil {
+				return nil
+			}
+			fields[key] = v
+			i = k + 1
+			continue
+		}
+		k := j
+		for k < len(s) && s[k] != ' ' && s[k] != '\t' {
+			k++
+		}
+		fields[key] = s[j:k]
+		i = k
+	}
+	if pairs == 0 {
+		return nil
+	}
+	return fields
+}
+
+// formatLogfmt renders m as logfmt, with the keys of the json format
+// besides raw, and the structured data as sd.SD-ID.PARAM-NAME keys:
+//
+//	time=2024-05-01T12:00:00.123Z source=192.0.2.7 priority=13 facility=user severity=notice hostname=web1 tag=app content="it works"
+func formatLogfmt(m *server.Message) (string, error) {
+	j := newJSONMessage(m)
+	var b strings.Builder
+	add := func(key, value string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(kvValue(value))
+	}
+	addNonEmpty := func(key, value string) {
+		if value != "" {
+			add(key, value)
+		}
+	}
+
+	add("time", j.Time.Format(time.RFC3339Nano))
+	addNonEmpty("source", j.Source)
+	addNonEmpty("source_host", j.SourceHost)
+	add("priority", strconv.Itoa(j.Priority))
+	add("facility", j.Facility)
+	add("severity", j.Severity)
+	if j.Timestamp != nil {
+		add("timestamp", j.Timestamp.Format(time.RFC3339Nano))
+	}
+	addNonEmpty("hostname", j.Hostname)
+	addNonEmpty("tag", j.Tag)
+	if j.Version != 0 {
+		add("version", strconv.Itoa(j.Version))
+	}
+	addNonEmpty("app_name", j.AppName)
+	addNonEmpty("proc_id", j.ProcID)
+	addNonEmpty("msg_id", j.MsgID)
+	addNonEmpty("trace_id", j.TraceID)
+	addNonEmpty("span_id", j.SpanID)
+	ids := make([]string, 0, len(j.StructuredData))
+	for id := range j.StructuredData {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		params := make([]string, 0, len(j.StructuredData[id]))
+		for name := range j.StructuredData[id] {
+			params = append(params, name)
+		}
+		sort.Strings(params)
+		for _, name := range params {
+			add("sd."+id+"."+name, j.StructuredData[id][name])
+		}
+	}
+	add("content", j.Content)
+	return b.String(), nil
+}
+
+// kvValue quotes s if it is empty or has spaces, quotes, equal signs or
+// other than printable characters.
+func kvValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \"=") || strings.IndexFunc(s, func(r rune) bool { return !strconv.IsPrint(r) }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
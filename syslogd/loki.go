@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultMaxLabelValues = 1000
+	otherLabelValue       = "_other_"
+)
+
+var defaultLokiLabels = []string{"hostname", "program", "severity"}
+
+// lokiLabel is a message property sent as a stream label. Once it has
+// seen max different values, any further values are replaced by _other_,
+// to keep the streams of a typo or a flood of random hostnames from
+// overloading Loki.
+type lokiLabel struct {
+	name string
+	get  func(*server.Message) string
+	max  int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func (l *lokiLabel) value(m *server.Message) string {
+	v := l.get(m)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[v]; ok {
+		return v
+	}
+	if len(l.seen) >= l.max {
+		return otherLabelValue
+	}
+	l.seen[v] = struct{}{}
+	return v
+}
+
+// lokiOutput pushes messages to Grafana Loki, in streams labelled with
+// message properties.
+type lokiOutput struct {
+	*batchOutput
+	url    string
+	tenant string
+	auth   func(*http.Request)
+	client *http.Client
+	format formatter
+	labels []*lokiLabel
+}
+
+func newLokiOutput(name string, c outputConfig, format formatter) (*lokiOutput, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("loki output requires a url")
+	}
+	client, err := newHTTPClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &lokiOutput{
+		url:    strings.TrimSuffix(c.URL, "/") + "/loki/api/v1/push",
+		tenant: c.Tenant,
+		client: client,
+		format: format,
+	}
+	switch {
+	case c.APIKey != "":
+		o.auth = func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+c.APIKey) }
+	case c.Username != "":
+		o.auth = func(req *http.Request) { req.SetBasicAuth(c.Username, c.Password) }
+	}
+
+	maxValues := c.MaxLabelValues
+	if maxValues <= 0 {
+		maxValues = defaultMaxLabelValues
+	}
+	props := []string(c.Labels)
+	if len(props) == 0 {
+		props = defaultLokiLabels
+	}
+	for _, prop := range props {
+		get, ok := labelFields[prop]
+		if !ok {
+			get, ok = messageFields[prop]
+		}
+		if strings.HasPrefix(prop, "sd.") {
+			get, ok = sdParam(prop[3:])
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown label property %s", prop)
+		}
+		name := strings.NewReplacer(".", "_", "-", "_", "@", "_").Replace(prop)
+		o.labels = append(o.labels, &lokiLabel{name: name, get: get, max: maxValues, seen: make(map[string]struct{})})
+	}
+
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	return o, nil
+}
+
+// labelFields are the properties besides those of match conditions that
+// can become labels.
+var labelFields = map[string]func(*server.Message) string{
+	"facility": func(m *server.Message) string { return m.Facility.String() },
+	"severity": func(m *server.Message) string { return m.Severity.String() },
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (o *lokiOutput) send(batch []*server.Message) error {
+	streams := make(map[string]*lokiStream)
+	var keys []string
+	for _, m := range batch {
+		line, err := o.format(m)
+		if err != nil {
+			log.Printf("output %s: %v", o.name, err)
+			continue
+		}
+
+		labels := make(map[string]string, len(o.labels))
+		var key strings.Builder
+		for _, l := range o.labels {
+			v := l.value(m)
+			labels[l.name] = v
+			key.WriteString(v)
+			key.WriteByte(0)
+		}
+		s, ok := streams[key.String()]
+		if !ok {
+			s = &lokiStream{Stream: labels}
+			streams[key.String()] = s
+			keys = append(keys, key.String())
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(m.Time.UnixNano(), 10), line})
+	}
+
+	sort.Strings(keys)
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, key := range keys {
+		push.Streams = append(push.Streams, streams[key])
+	}
+	body, err := json.Marshal(push)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	req, err := http.NewRequest("POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", o.tenant)
+	}
+	if o.auth != nil {
+		o.auth(req)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+	return checkResponse(resp)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// luaTimeout stops a script looping on a message.
+const luaTimeout = 100 * time.Millisecond
+
+// luaFields are the properties of the msg table of a script, which it can
+// change. The structured data is the table sd of SD-IDs to tables of
+// params.
+var luaFields = []string{"facility", "severity", "host", "tag", "app", "procid", "msgid", "trace_id", "span_id", "msg"}
+
+// luaScript runs a Lua chunk on the messages of a transform, for the logic
+// the set and unset of transforms cannot express, for instance
+//
+//	if msg.host:sub(1, 2) == "db" and msg.msg:find("slow query", 1, true) then
+//	  msg.severity = "warning"
+//	  msg.sd["meta"] = {class = "slow_query"}
+//	end
+//
+// The script sees the message as the global table msg, and drops it by
+// returning false. Only the base, string, table and math libraries are
+// open, without files. The states are pooled, so that globals set by a
+// script are not reset between messages.
+type luaScript struct {
+	proto *lua.FunctionProto
+	pool  sync.Pool
+}
+
+func newLuaScript(source string) (*luaScript, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), "lua")
+	if err != nil {
+		return nil, errors.New(strings.TrimSpace(err.Error()))
+	}
+	proto, err := lua.Compile(chunk, "lua")
+	if err != nil {
+		return nil, err
+	}
+	s := &luaScript{proto: proto}
+	s.pool.New = func() any { return newLuaState() }
+	return s, nil
+}
+
+func newLuaState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// run runs the script on m, which it changes, and returns nil if the
+// script drops it.
+func (s *luaScript) run(m *server.Message) (*server.Message, error) {
+	L := s.pool.Get().(*lua.LState)
+
+	ctx, cancel := context.WithTimeout(context.Background(), luaTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	t := L.NewTable()
+	for _, name := range luaFields {
+		t.RawSetString(name, lua.LString(luaGet(m, name)))
+	}
+	sd := L.NewTable()
+	for id, params := range m.StructuredData {
+		p := L.NewTable()
+		for k, v := range params {
+			p.RawSetString(k, lua.LString(v))
+		}
+		sd.RawSetString(id, p)
+	}
+	t.RawSetString("sd", sd)
+	L.SetGlobal("msg", t)
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	err := L.PCall(0, 1, nil)
+	L.RemoveContext()
+	if err != nil {
+		// The state of a script stopped midway is not reused.
+		L.Close()
+		return m, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	s.pool.Put(L)
+	if ret == lua.LFalse {
+		return nil, nil
+	}
+
+	var errs []error
+	for _, name := range luaFields {
+		v := t.RawGetString(name)
+		if v == lua.LNil {
+			v = lua.LString("")
+		}
+		if s := lua.LVAsString(v); s != luaGet(m, name) {
+			if err := transformFields[name](m, s); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	m.StructuredData = nil
+	if sd, ok := t.RawGetString("sd").(*lua.LTable); ok {
+		sd.ForEach(func(id, params lua.LValue) {
+			p, ok := params.(*lua.LTable)
+			if !ok {
+				errs = append(errs, fmt.Errorf("sd.%s is not a table", lua.LVAsString(id)))
+				return
+			}
+			p.ForEach(func(k, v lua.LValue) {
+				setSDParam(lua.LVAsString(id), lua.LVAsString(k))(m, lua.LVAsString(v))
+			})
+		})
+	}
+	return m, errors.Join(errs...)
+}
+
+func luaGet(m *server.Message, name string) string {
+	switch name {
+	case "facility":
+		return m.Facility.String()
+	case "severity":
+		return m.Severity.String()
+	}
+	return messageFields[name](m)
+}
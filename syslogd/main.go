@@ -1,43 +1,583 @@
 package main
 
 import (
+	"crypto/tls"
+	"database/sql"
 	"flag"
-	"fmt"
+	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/ziutek/syslog"
+	"github.com/haccht/syslog_tools/server"
 )
 
-func newHandler() *syslog.BaseHandler {
-	h := syslog.NewBaseHandler(5, nil, false)
-	go func() {
-		defer h.End()
-		for {
-			m := h.Get()
-			if m == nil {
-				break
-			}
-			fmt.Println(m)
-		}
-	}()
+func setDefault(p *string, v string) {
+	if *p == "" && v != "" {
+		*p = v
+	}
+}
 
-	return h
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func main() {
-	address := flag.String("addr", ":514", "address")
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		runQuery(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		runDecrypt(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		runCheckConfig(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "test-route" {
+		runTestRoute(os.Args[2:])
+		return
+	}
 
-	server := syslog.NewServer()
-	server.AddHandler(newHandler())
-	server.Listen(*address)
+	var listens, allow, deny listenFlag
+	var tlsFlags tlsFiles
+	configFile := flag.String("config", "", "routing configuration `file` (YAML)")
+	watchConfig := flag.Bool("watch-config", false, "reload the configuration file when it changes")
+	watchTLS := flag.Bool("watch-tls", true, "reload the certificate, key, CA and CRL of tls listeners when they change, for new connections")
+	address := flag.String("addr", ":514", "address (UDP, used when no -listen is given)")
+	flag.Var(&listens, "listen", "listen on `scheme://address[?parser=auto|rfc3164|rfc5424|raw[,strict]&tz=zone&sockets=N|auto]` where scheme is udp, tcp, tls, dtls, relp, http, https, gelf (UDP), gelf+tcp, unix or unixgram, and address may be systemd[:name] for the sockets passed by systemd (repeatable)")
+	flag.Var(&allow, "allow", "accept messages only from the `CIDR` networks (repeatable)")
+	flag.Var(&deny, "deny", "refuse messages from the `CIDR` networks (repeatable)")
+	logDenied := flag.Bool("log-denied", false, "log refused senders, at most every 10 seconds")
+	flag.StringVar(&tlsFlags.Cert, "tls-cert", "", "certificate `file` for tls listeners")
+	flag.StringVar(&tlsFlags.Key, "tls-key", "", "private key `file` for tls listeners")
+	flag.StringVar(&tlsFlags.CA, "tls-ca", "", "require client certificates signed by this CA `file`")
+	flag.StringVar(&tlsFlags.ClientAuth, "tls-client-auth", "", "client certificates to `mode` none, request (verified if given) or require, require by default with -tls-ca")
+	flag.StringVar(&tlsFlags.CRL, "tls-crl", "", "refuse the client certificates revoked in this CRL `file`")
+	flag.StringVar(&tlsFlags.OCSP, "tls-ocsp", "", "check client certificates with their OCSP responder, `mode` off, soft (refuse revoked ones) or hard (also refuse when the status is unknown)")
+	socketMode := flag.String("socket-mode", "0666", "permission `mode` of unix sockets")
+	esURL := flag.String("es-url", "", "also index every message into Elasticsearch at `url`")
+	esIndex := flag.String("es-index", "", "Elasticsearch index `name`, may contain {layout} of the time")
+	httpAddr := flag.String("http-addr", "", "serve /metrics, /healthz, /readyz the API under /api/ and the web UI under /ui/ on `address`")
+	debugAddr := flag.String("debug-addr", "", "serve pprof and expvar under /debug/ on `address`")
+	runUser := flag.String("user", "", "switch to the `account` once the sockets are bound")
+	runGroup := flag.String("group", "", "switch to the `group` once the sockets are bound, by default the primary group of -user")
+	chrootDir := flag.String("chroot", "", "confine the process to `dir` once the sockets are bound")
+	recentSize := flag.Int("recent", defaultRecent, "keep the last `n` messages in memory for /api/v1/recent and /api/v1/messages, 0 for none")
+	store := flag.String("store", "", "also keep every message in the store at `url` (sqlite:///path) for \"syslogd query\" and /api/v1/messages")
+	storeRetention := flag.Duration("store-retention", 0, "delete the messages of -store older than `duration`, 0 to keep them all")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "on shutdown, wait at most `duration` for the received messages to be delivered, 0 for as long as it takes")
+	stdoutFlag := flag.String("stdout-format", "text", "`format` of the messages printed to stdout by outputs without one: text, json or logfmt, for log pipelines reading it")
+	serviceFlag := flag.String("service", "", "`install`, uninstall or run as a Windows service, install takes the other flags as those of the service")
+	flag.Parse()
+	if f, ok := stdoutFormats[*stdoutFlag]; ok {
+		stdoutFormat = f
+	} else {
+		log.Fatalf("invalid -stdout-format %q", *stdoutFlag)
+	}
 
 	sig := make(chan os.Signal, 2)
-	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
-	<-sig
+	var winSvc *service
+	switch *serviceFlag {
+	case "":
+	case "install":
+		if err := installService(serviceArgs(os.Args[1:])); err != nil {
+			log.Fatal(err)
+		}
+		log.Print("service installed")
+		return
+	case "uninstall":
+		if err := uninstallService(); err != nil {
+			log.Fatal(err)
+		}
+		log.Print("service uninstalled")
+		return
+	case "run":
+		var err error
+		if winSvc, err = runService(sig); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("invalid -service %q", *serviceFlag)
+	}
+
+	// loadConfig adds the outputs given on the command line.
+	loadConfig := func(path string) (*config, error) {
+		c := &config{}
+		if path != "" {
+			var err error
+			if c, err = loadConfigFile(path); err != nil {
+				return nil, err
+			}
+		}
+
+		add := func(name string, oc outputConfig) {
+			if len(c.Rules) == 0 {
+				c.Rules = []ruleConfig{{To: stringList{"stdout"}}}
+			}
+			if c.Outputs == nil {
+				c.Outputs = make(map[string]outputConfig)
+			}
+			c.Outputs[name] = oc
+			c.Rules = append([]ruleConfig{{To: stringList{name}}}, c.Rules...)
+		}
+		if *esURL != "" {
+			add("es-url", outputConfig{Type: "elasticsearch", URL: *esURL, Index: *esIndex})
+		}
+		if *store != "" {
+			path, err := parseStoreURL(*store)
+			if err != nil {
+				return nil, err
+			}
+			add("store", outputConfig{Type: "sqlite", Path: path, Retention: *storeRetention})
+		}
+		return c, nil
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	server.Shutdown()
-	fmt.Println("Server is now down.")
+	// Listen addresses add up, other command line flags take precedence
+	// over the config file.
+	tlsFilesFor := func(c *config) tlsFiles {
+		files := tlsFlags
+		setDefault(&files.Cert, c.TLS.Cert)
+		setDefault(&files.Key, c.TLS.Key)
+		setDefault(&files.CA, c.TLS.CA)
+		setDefault(&files.ClientAuth, c.TLS.ClientAuth)
+		setDefault(&files.CRL, c.TLS.CRL)
+		setDefault(&files.OCSP, c.TLS.OCSP)
+		setDefault(&files.SDID, c.TLS.SDID)
+		files.ACME = c.TLS.ACME
+		return files
+	}
+	listens = append(append(listens, cfg.Listen...), tenantListens(cfg)...)
+	if cfg.SocketMode != "" && !isFlagSet("socket-mode") {
+		*socketMode = cfg.SocketMode
+	}
+
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		log.Fatalf("invalid -socket-mode %q", *socketMode)
+	}
+
+	// Sockets passed by systemd are served instead of the default address.
+	sockets, err := activatedSockets()
+	if err != nil {
+		log.Fatal(err)
+	}
+	notify := newNotifier()
+	if len(listens) == 0 && len(sockets) > 0 {
+		listens = defaultActivatedURLs(sockets)
+	} else if len(listens) == 0 {
+		listens = append(listens, "udp://"+*address)
+	}
+
+	r, err := newRouter(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	audit, err := newAuditLog(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	audit.start(*configFile)
+
+	// A reload leaves its router here for the pipeline to swap in, after
+	// the routing workers and the close of the previous router, without
+	// waiting for it.
+	routers := make(chan *router, 1)
+	srv := server.NewServer()
+	if *recentSize > 0 {
+		recent = newRing(*recentSize)
+	}
+	setParseWorkers(srv, cfg.Pipeline)
+	h := newHandler(r, routers, cfg.Pipeline)
+	registerQueueMetrics(srv, h, cfg.Pipeline)
+	limiter := newRateLimiter()
+	limiter.Set(cfg.RateLimit)
+	quotas := newQuotas()
+	if err := quotas.Set(cfg.Quotas); err != nil {
+		log.Fatal(err)
+	}
+	shed := newShedder(func() float64 { return float64(h.Len()) / float64(h.Cap()) })
+	shed.Set(cfg.Shed)
+	dns := newResolver()
+	dns.Set(cfg.Resolve)
+	geo := newGeoIP()
+	if err := geo.Set(cfg.GeoIP); err != nil {
+		log.Fatal(err)
+	}
+	peers := newPeerSD()
+	peers.Set(tlsFilesFor(cfg).SDID)
+	skew := newSkewDetector()
+	skew.Set(cfg.ClockSkew)
+	traces := newTraceContext()
+	traces.Set(cfg.TraceContext)
+	ml := newMultiline(h)
+	if err := ml.Set(cfg.Multiline); err != nil {
+		log.Fatal(err)
+	}
+	tenants := newTenantTagger()
+	tenants.Set(cfg.Tenants)
+	srv.AddHandler(tenants)
+	srv.AddHandler(limiter)
+	srv.SetPacer(limiter.Pace)
+	srv.AddHandler(quotas)
+	srv.AddHandler(shed)
+	srv.AddHandler(dns)
+	srv.AddHandler(geo)
+	srv.AddHandler(peers)
+	srv.AddHandler(skew)
+	srv.AddHandler(traces)
+	srv.AddHandler(ml)
+	srv.AddHandler(h)
+
+	if *httpAddr != "" {
+		ln, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", metricsHandler)
+		mux.HandleFunc("/healthz", healthz(h))
+		mux.HandleFunc("/readyz", readyz(h))
+		mux.HandleFunc("/api/v1/recent", recentHandler)
+		var db *sql.DB
+		if *store != "" {
+			path, _ := parseStoreURL(*store)
+			if db, err = openStore(path); err != nil {
+				log.Fatal(err)
+			}
+		}
+		mux.HandleFunc("/api/v1/messages", messagesHandler(db))
+		mux.HandleFunc("/api/v1/stream", streamHandler)
+		mux.Handle("/ui/", uiHandler())
+		go http.Serve(ln, mux)
+	}
+	if *debugAddr != "" {
+		if err := serveDebug(*debugAddr, srv, h); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The ACL of the flags and the config file applies to every listener,
+	// besides those of the listen URLs.
+	aclFor := func(c *config) (*acl, error) {
+		return newACL(append(append([]string{}, allow...), c.Allow...), append(append([]string{}, deny...), c.Deny...))
+	}
+	a, err := aclFor(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	acls := newACLFilter(a, *logDenied || cfg.LogDenied)
+
+	var certs *reloadableTLS
+	tokens := newHTTPTokens(cfg.HTTPTokens)
+	for _, l := range listens {
+		scheme, addr, opts, err := parseListenURL(l, *logDenied || cfg.LogDenied)
+		if err != nil {
+			log.Fatal(err)
+		}
+		name, activated := systemdAddr(addr)
+		var port string
+		if !activated {
+			_, port, _ = net.SplitHostPort(addr)
+		}
+		opts = append(opts, server.WithName(l), server.WithStats(countListener(l, scheme, port)), server.WithACL(acls.permit))
+		if scheme == "relp" {
+			opts = append(opts, server.WithRELP(func() bool { return !queuesFull(srv, h) }))
+		}
+		if scheme == "gelf" || scheme == "gelf+tcp" {
+			opts = append(opts, server.WithGELF())
+		}
+		if scheme == "http" || scheme == "https" {
+			if len(cfg.HTTPTokens) == 0 {
+				log.Fatalf("%s: http listeners require http_tokens", l)
+			}
+			opts = append(opts, server.WithHTTP(server.HTTPConfig{
+				Authorize: func(r *http.Request) bool {
+					if tokens.authorize(r) {
+						return true
+					}
+					audit.authFailed(l, r.RemoteAddr, "invalid bearer token")
+					return false
+				},
+				DecodeJSON: parseSidecarMessage,
+				Ready:      func() bool { return !queuesFull(srv, h) },
+			}))
+		}
+
+		var tlsConfig *tls.Config
+		if scheme == "tls" || scheme == "dtls" || scheme == "https" {
+			if certs == nil {
+				certs = &reloadableTLS{}
+				files := tlsFilesFor(cfg)
+				if files.Cert == "" && len(files.ACME.Domains) > 0 {
+					if certs.acme, err = newACMEManager(files.ACME); err != nil {
+						log.Fatal(err)
+					}
+				}
+				if err := certs.Load(files); err != nil {
+					log.Fatal(err)
+				}
+			}
+			tlsConfig = certs.ServerConfig()
+			if audit != nil {
+				opts = append(opts, server.WithHandshakeError(func(src net.Addr, err error) {
+					audit.authFailed(l, src.String(), err.Error())
+				}))
+			}
+		}
+
+		switch {
+		case activated:
+			err = serveActivated(srv, sockets, name, scheme, tlsConfig, opts)
+		case scheme == "udp", scheme == "gelf":
+			err = srv.Listen(addr, opts...)
+		case scheme == "dtls":
+			err = srv.ListenDTLS(addr, tlsConfig, opts...)
+		case scheme == "tcp", scheme == "tls", scheme == "relp", scheme == "http", scheme == "https", scheme == "gelf+tcp":
+			err = srv.ListenTCP(addr, tlsConfig, opts...)
+		case scheme == "unix", scheme == "unixgram":
+			err = srv.ListenUnix(scheme, addr, os.FileMode(mode), opts...)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		audit.listenerStarted(l)
+	}
+	for _, a := range sockets {
+		if !a.used {
+			log.Printf("systemd socket %s (%s) is not used by any listen address", a.name, a.scheme)
+		}
+	}
+
+	for _, a := range srv.Addrs() {
+		log.Printf("listening on %s %s", a.Network(), a)
+	}
+	if certs != nil && certs.acme != nil {
+		certs.acme.start()
+	}
+	inputs, err := startInputs(cfg, srv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The account is looked up before the chroot, and the chroot needs
+	// root, as does landlock without no_new_privs.
+	dropPrivs := *runUser != "" || *runGroup != ""
+	var uid, gid int
+	if dropPrivs {
+		if uid, gid, err = lookupIDs(*runUser, *runGroup); err != nil {
+			log.Fatal(err)
+		}
+	}
+	setDefault(chrootDir, cfg.Sandbox.Chroot)
+	if *chrootDir != "" {
+		if err := chroot(*chrootDir); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("confined to %s", *chrootDir)
+	}
+	if dropPrivs {
+		if err := dropPrivileges(uid, gid); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("running as uid %d gid %d", os.Getuid(), os.Getgid())
+	}
+	if cfg.Sandbox.Landlock {
+		rw, ro := sandboxPaths(cfg, *configFile, tlsFilesFor(cfg))
+		if err := restrictPaths(rw, ro); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("file access restricted to %s, read only %s", strings.Join(rw, " "), strings.Join(ro, " "))
+	}
+	stats := newStatsReporter(srv, h)
+	stats.Set(cfg.Stats)
+	ready.Store(true)
+	notify.ready()
+	if winSvc != nil {
+		winSvc.ready()
+	}
+	notify.watchdog(func() bool {
+		_, stalled := routingStalled(h)
+		return !stalled
+	})
+
+	// reload replaces the routing rules, outputs, TLS certificates and the
+	// settings of the handlers. Listeners are kept, so changes to them need
+	// a restart.
+	reloadConfig := func() error {
+		next, err := loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(next.Listen, cfg.Listen) || next.SocketMode != cfg.SocketMode || !reflect.DeepEqual(tenantListens(next), tenantListens(cfg)) {
+			log.Print("reload: listener changes take effect after a restart")
+		}
+		if !reflect.DeepEqual(next.TLS.ACME, cfg.TLS.ACME) {
+			log.Print("reload: acme changes take effect after a restart")
+		}
+		if !reflect.DeepEqual(next.Audit, cfg.Audit) {
+			log.Print("reload: audit changes take effect after a restart")
+		}
+		if !reflect.DeepEqual(next.Sandbox, cfg.Sandbox) {
+			log.Print("reload: sandbox changes take effect after a restart")
+		}
+		if next.Pipeline.ParseWorkers != cfg.Pipeline.ParseWorkers || next.Pipeline.ParseQueue != cfg.Pipeline.ParseQueue ||
+			next.Pipeline.RouteWorkers != cfg.Pipeline.RouteWorkers || next.Pipeline.RouteQueue != cfg.Pipeline.RouteQueue {
+			log.Print("reload: parse and route stage changes take effect after a restart")
+		}
+		a, err := aclFor(next)
+		if err != nil {
+			return err
+		}
+
+		r, err := newRouter(next)
+		if err != nil {
+			return err
+		}
+		if certs != nil {
+			if err := certs.Load(tlsFilesFor(next)); err != nil {
+				r.Close()
+				return err
+			}
+		}
+		if err := geo.Set(next.GeoIP); err != nil {
+			r.Close()
+			return err
+		}
+		if err := ml.Set(next.Multiline); err != nil {
+			r.Close()
+			return err
+		}
+		if err := quotas.Set(next.Quotas); err != nil {
+			r.Close()
+			return err
+		}
+
+		select {
+		case pending := <-routers:
+			pending.Close()
+		default:
+		}
+		routers <- r
+		limiter.Set(next.RateLimit)
+		shed.Set(next.Shed)
+		dns.Set(next.Resolve)
+		peers.Set(tlsFilesFor(next).SDID)
+		skew.Set(next.ClockSkew)
+		traces.Set(next.TraceContext)
+		tenants.Set(next.Tenants)
+		stats.Set(next.Stats)
+		tokens.Set(next.HTTPTokens)
+		acls.acl.Store(a)
+		audit.reloaded(*configFile, cfg, next)
+		cfg = next
+		log.Print("configuration reloaded")
+		return nil
+	}
+	reload := func() {
+		notify.reloading()
+		defer notify.ready()
+		if err := reloadConfig(); err != nil {
+			log.Printf("reload: %v", err)
+			audit.reloadFailed(*configFile, err)
+		}
+	}
+
+	var changed <-chan struct{}
+	if *watchConfig && *configFile != "" {
+		changed = watchFile(*configFile, 2*time.Second)
+	}
+
+	// Rotated certificates apply to new handshakes, established
+	// connections keep theirs.
+	var tlsChanged <-chan struct{}
+	if *watchTLS && certs != nil {
+		tlsChanged = watchFiles(tlsFilesFor(cfg).paths(), 2*time.Second)
+	}
+
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for running := true; running; {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				reload()
+			} else {
+				running = false
+			}
+		case <-changed:
+			reload()
+		case <-tlsChanged:
+			if err := certs.Load(tlsFilesFor(cfg)); err != nil {
+				log.Printf("tls: %v, keeping the previous certificates", err)
+			} else {
+				log.Print("tls: certificates reloaded")
+			}
+		}
+	}
+
+	ready.Store(false)
+	notify.stopping()
+	select {
+	case pending := <-routers:
+		pending.Close()
+	default:
+	}
+	closeInputs(inputs)
+	log.Printf("shutting down, %d messages to deliver", queuedMessages(srv, h))
+	abandoned, drained := drain(srv, h, *drainTimeout)
+	if !drained {
+		log.Printf("shutdown: not delivered within %v, %d messages abandoned", *drainTimeout, abandoned)
+	}
+	for _, l := range listens {
+		audit.listenerStopped(l)
+	}
+	audit.stop()
+	audit.close()
+	log.Print("Server is now down.")
+	if winSvc != nil {
+		winSvc.stopped()
+	}
+	if !drained {
+		os.Exit(1)
+	}
+}
+
+// serviceArgs returns args for the service to run with, those given
+// to -service install but for -service itself.
+func serviceArgs(args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if strings.HasPrefix(name, "service=") {
+			continue
+		}
+		if name == "service" {
+			i++
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return append(out, "-service", "run")
 }
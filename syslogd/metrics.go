@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// metric is a family of samples in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry []metric
+
+func register(m metric) {
+	registry = append(registry, m)
+}
+
+// metricsHandler serves the registered metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	for _, m := range registry {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, v float64) {
+	w.Write([]byte(name))
+	if len(labels) > 0 {
+		w.Write([]byte("{"))
+		for i, l := range labels {
+			if i > 0 {
+				w.Write([]byte(","))
+			}
+			fmt.Fprintf(w, `%s="%s"`, l, labelEscaper.Replace(values[i]))
+		}
+		w.Write([]byte("}"))
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// counterVec is a counter with labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*atomic.Uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]*atomic.Uint64)}
+	register(c)
+	return c
+}
+
+func (c *counterVec) add(n uint64, values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	v, ok := c.values[key]
+	if !ok {
+		v = new(atomic.Uint64)
+		c.values[key] = v
+	}
+	c.mu.Unlock()
+	v.Add(n)
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+// value returns the count of the label values.
+func (c *counterVec) value(values ...string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.values[strings.Join(values, "\xff")]; ok {
+		return v.Load()
+	}
+	return 0
+}
+
+func (c *counterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		writeSample(w, c.name, c.labels, strings.Split(key, "\xff"), float64(c.values[key].Load()))
+	}
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		hist := h.values[key]
+		values := strings.Split(key, "\xff")
+		for i, le := range h.buckets {
+			writeSample(w, h.name+"_bucket", labels, append(values, strconv.FormatFloat(le, 'g', -1, 64)), float64(hist.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", labels, append(values, "+Inf"), float64(hist.count))
+		writeSample(w, h.name+"_sum", h.labels, values, hist.sum)
+		writeSample(w, h.name+"_count", h.labels, values, float64(hist.count))
+	}
+}
+
+type sample struct {
+	values []string
+	value  float64
+}
+
+// metricFunc collects its samples when scraped.
+type metricFunc struct {
+	name, help, typ string
+	labels          []string
+	collect         func() []sample
+}
+
+func newMetricFunc(name, help, typ string, collect func() []sample, labels ...string) {
+	register(&metricFunc{name: name, help: help, typ: typ, labels: labels, collect: collect})
+}
+
+func (f *metricFunc) write(w io.Writer) {
+	samples := f.collect()
+	if samples == nil {
+		return
+	}
+	writeHeader(w, f.name, f.help, f.typ)
+	for _, s := range samples {
+		writeSample(w, f.name, f.labels, s.values, s.value)
+	}
+}
+
+var (
+	messagesTotal = newCounterVec("syslogd_messages_total",
+		"Messages received by facility and severity.", "facility", "severity")
+	messageSize = newHistogramVec("syslogd_message_size_bytes",
+		"Size of the received messages.", []float64{128, 256, 512, 1024, 2048, 4096, 8192, 16384, 65536}, "network")
+	outputWrites = newCounterVec("syslogd_output_writes_total",
+		"Messages handed to outputs by result.", "output", "result")
+	outputDropped = newCounterVec("syslogd_output_dropped_total",
+		"Messages outputs gave up delivering.", "output")
+	outputSendSeconds = newHistogramVec("syslogd_output_send_duration_seconds",
+		"Time taken to send a batch.", []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}, "output")
+)
+
+// listenerStats are the counters of the listeners by listen URL.
+var listenerStats = struct {
+	sync.Mutex
+	names []string
+	stats map[string]*listenerStat
+}{stats: make(map[string]*listenerStat)}
+
+type listenerStat struct {
+	protocol string
+	port     string
+	st       *server.Stats
+}
+
+// currentRouter is the router in use, for the output gauges.
+var currentRouter atomic.Pointer[router]
+
+func init() {
+	newMetricFunc("syslogd_received_total", "Messages received by listener.", "counter", func() []sample {
+		return collectListeners(func(st *server.Stats) uint64 { return st.Received.Load() })
+	}, "listener", "protocol")
+	newMetricFunc("syslogd_received_bytes_total", "Bytes received by listener.", "counter", func() []sample {
+		return collectListeners(func(st *server.Stats) uint64 { return st.Bytes.Load() })
+	}, "listener", "protocol")
+	newMetricFunc("syslogd_parse_errors_total", "Messages received without a valid PRI.", "counter", func() []sample {
+		return collectListeners(func(st *server.Stats) uint64 { return st.Malformed.Load() })
+	}, "listener", "protocol")
+	newMetricFunc("syslogd_rejected_total", "Datagrams, connections and DTLS sessions refused by an ACL or a limit.", "counter", func() []sample {
+		return collectListeners(func(st *server.Stats) uint64 { return st.Rejected.Load() })
+	}, "listener", "protocol")
+	newMetricFunc("syslogd_listener_dropped_total", "Messages dropped by the limits of a listener.", "counter", func() []sample {
+		return collectListeners(func(st *server.Stats) uint64 { return st.Dropped.Load() })
+	}, "listener", "protocol")
+	newMetricFunc("syslogd_listener_oversize_total", "Messages over the maximum size of a listener, truncated or rejected.", "counter", func() []sample {
+		return collectListeners(func(st *server.Stats) uint64 { return st.Oversize.Load() })
+	}, "listener", "protocol")
+	newMetricFunc("syslogd_udp_drops_total", "Datagrams the kernel dropped on the UDP sockets, from /proc/net/udp.", "counter", collectUDPDrops, "port")
+	newMetricFunc("syslogd_output_queue_bytes", "Bytes waiting in the disk queue of an output.", "gauge", func() []sample {
+		return collectOutputs(func(o output) (float64, bool) {
+			q, ok := o.(interface{ queuedBytes() int64 })
+			if !ok {
+				return 0, false
+			}
+			return float64(q.queuedBytes()), true
+		})
+	}, "output")
+	newMetricFunc("syslogd_output_batch_pending", "Messages waiting for the next batch of an output.", "gauge", func() []sample {
+		return collectOutputs(func(o output) (float64, bool) {
+			b, ok := o.(interface{ pending() int })
+			if !ok {
+				return 0, false
+			}
+			return float64(b.pending()), true
+		})
+	}, "output")
+}
+
+// countMessage counts a message taken from the routing queue.
+func countMessage(m *server.Message) {
+	messagesTotal.inc(m.Facility.String(), m.Severity.String())
+	network := "unknown"
+	if m.Source != nil {
+		network = m.Source.Network()
+	}
+	messageSize.observe(float64(len(m.Raw)), network)
+}
+
+// countListener registers the counters of the listener at the listen URL.
+func countListener(name, protocol, port string) *server.Stats {
+	listenerStats.Lock()
+	defer listenerStats.Unlock()
+	st := &server.Stats{}
+	listenerStats.names = append(listenerStats.names, name)
+	listenerStats.stats[name] = &listenerStat{protocol, port, st}
+	return st
+}
+
+func collectListeners(get func(*server.Stats) uint64) []sample {
+	listenerStats.Lock()
+	defer listenerStats.Unlock()
+	samples := []sample{}
+	for _, name := range listenerStats.names {
+		ls := listenerStats.stats[name]
+		samples = append(samples, sample{[]string{name, ls.protocol}, float64(get(ls.st))})
+	}
+	return samples
+}
+
+func collectOutputs(get func(output) (float64, bool)) []sample {
+	r := currentRouter.Load()
+	if r == nil {
+		return nil
+	}
+	names := make([]string, 0, len(r.outputs))
+	for name := range r.outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	samples := []sample{}
+	for _, name := range names {
+		if v, ok := get(r.outputs[name]); ok {
+			samples = append(samples, sample{[]string{name}, v})
+		}
+	}
+	return samples
+}
+
+// collectUDPDrops sums the drops column of /proc/net/udp and udp6 by the
+// local port of the UDP listeners.
+func collectUDPDrops() []sample {
+	ports := make(map[string]bool)
+	listenerStats.Lock()
+	for _, ls := range listenerStats.stats {
+		if ls.protocol == "udp" && ls.port != "" {
+			ports[ls.port] = true
+		}
+	}
+	listenerStats.Unlock()
+	if len(ports) == 0 {
+		return nil
+	}
+
+	drops := make(map[string]uint64)
+	for _, file := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		s := bufio.NewScanner(f)
+		s.Scan() // header
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) < 13 {
+				continue
+			}
+			local := fields[1]
+			port, err := strconv.ParseUint(local[strings.LastIndexByte(local, ':')+1:], 16, 16)
+			if err != nil || !ports[strconv.FormatUint(port, 10)] {
+				continue
+			}
+			n, _ := strconv.ParseUint(fields[12], 10, 64)
+			drops[strconv.FormatUint(port, 10)] += n
+		}
+		f.Close()
+	}
+
+	var names []string
+	for port := range ports {
+		names = append(names, port)
+	}
+	sort.Strings(names)
+	samples := []sample{}
+	for _, port := range names {
+		samples = append(samples, sample{[]string{port}, float64(drops[port])})
+	}
+	return samples
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultMQTTPort   = "1883"
+	defaultMQTTSPort  = "8883"
+	defaultMQTTTopic  = "syslog/%HOSTNAME%/%FACILITY%"
+	mqttTimeout       = 10 * time.Second
+	mqttKeepAlive     = 60 * time.Second
+	mqttMaxPacketIDs  = 65535
+	mqttMaxRemaining  = 268435455
+	mqttProtocolLevel = 4 // MQTT 3.1.1
+	mqttCleanSession  = 0x02
+	mqttPasswordFlag  = 0x40
+	mqttUsernameFlag  = 0x80
+)
+
+// MQTT packet types, with the flags required of PUBREL.
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttPubrec     = 0x50
+	mqttPubrel     = 0x62
+	mqttPubcomp    = 0x70
+	mqttPingreq    = 0xc0
+	mqttPingresp   = 0xd0
+	mqttDisconnect = 0xe0
+)
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttOutput publishes messages to an MQTT broker, on topics expanded from
+// %NAME% properties as file paths are. With QoS 1 and 2, the messages the
+// broker has not acknowledged are published again, so that they arrive at
+// least once; the session is clean, so QoS 2 does not prevent duplicates
+// across reconnections either.
+type mqttOutput struct {
+	*batchOutput
+	name     string
+	addr     string
+	tls      *tls.Config
+	clientID string
+	username string
+	password string
+	topic    string
+	qos      byte
+	format   formatter
+
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	packetID uint16
+	last     time.Time // of the last packet sent
+}
+
+// newMQTTOutput publishes to url, mqtt://[user:password@]host[:port] or
+// mqtts://... for TLS.
+func newMQTTOutput(name string, c outputConfig, format formatter) (*mqttOutput, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "mqtt" && u.Scheme != "mqtts" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid mqtt url %q: want mqtt://host[:port] or mqtts://host[:port]", c.URL)
+	}
+	if c.QoS < 0 || c.QoS > 2 {
+		return nil, fmt.Errorf("invalid qos %d: want 0, 1 or 2", c.QoS)
+	}
+	if c.QoS > 0 && c.BatchSize > mqttMaxPacketIDs {
+		return nil, fmt.Errorf("batch_size %d over the %d packet identifiers of qos %d", c.BatchSize, mqttMaxPacketIDs, c.QoS)
+	}
+	o := &mqttOutput{
+		name:     name,
+		addr:     u.Host,
+		clientID: c.ClientID,
+		topic:    c.Topic,
+		qos:      byte(c.QoS),
+		format:   format,
+	}
+	if u.Port() == "" {
+		port := defaultMQTTPort
+		if u.Scheme == "mqtts" {
+			port = defaultMQTTSPort
+		}
+		o.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if o.clientID == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		o.clientID = "syslogd-" + hex.EncodeToString(id)
+	}
+	if o.topic == "" {
+		o.topic = defaultMQTTTopic
+	}
+	for _, p := range pathProperty.FindAllString(o.topic, -1) {
+		if _, ok := pathProperties[strings.Trim(p, "%")]; !ok {
+			return nil, fmt.Errorf("unknown property %s in topic %s", p, o.topic)
+		}
+	}
+	if strings.ContainsAny(pathProperty.ReplaceAllString(o.topic, ""), "+#") {
+		return nil, fmt.Errorf("invalid topic %s: wildcards are not allowed", o.topic)
+	}
+
+	o.username, o.password = c.Username, c.Password
+	if o.username == "" && u.User != nil {
+		o.username = u.User.Username()
+		o.password, _ = u.User.Password()
+	}
+	if u.Scheme == "mqtts" || c.TLS {
+		if o.tls, err = newClientTLSConfig(c); err != nil {
+			return nil, err
+		}
+		o.tls.ServerName = u.Hostname()
+	}
+
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	return o, nil
+}
+
+// topicOf returns the topic of m, its properties turned into single topic
+// levels.
+func (o *mqttOutput) topicOf(m *server.Message) string {
+	return pathProperty.ReplaceAllStringFunc(o.topic, func(p string) string {
+		return mqttLevel(pathProperties[strings.Trim(p, "%")](m))
+	})
+}
+
+func mqttLevel(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '+' || r == '#' || r == 0 {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// dial connects and authenticates to the broker, starting a clean session.
+func (o *mqttOutput) dial() error {
+	conn, err := net.DialTimeout("tcp", o.addr, mqttTimeout)
+	if err != nil {
+		return err
+	}
+	if o.tls != nil {
+		tc := tls.Client(conn, o.tls)
+		tc.SetDeadline(time.Now().Add(mqttTimeout))
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tc
+	}
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+
+	flags := byte(mqttCleanSession)
+	body := mqttString(nil, "MQTT")
+	payload := mqttString(nil, o.clientID)
+	if o.username != "" {
+		flags |= mqttUsernameFlag
+		payload = mqttString(payload, o.username)
+		if o.password != "" {
+			flags |= mqttPasswordFlag
+			payload = mqttString(payload, o.password)
+		}
+	}
+	body = append(body, mqttProtocolLevel, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = append(body, payload...)
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	mqttWritePacket(w, mqttConnect, body)
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	typ, body, err := mqttReadPacket(r)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if typ != mqttConnack || len(body) != 2 {
+		conn.Close()
+		return fmt.Errorf("unexpected packet %#x instead of CONNACK", typ)
+	}
+	if code := body[1]; code != 0 {
+		conn.Close()
+		reason, ok := mqttConnackErrors[code]
+		if !ok {
+			reason = fmt.Sprintf("connection refused (%d)", code)
+		}
+		err := fmt.Errorf("mqtt: %s", reason)
+		if code == 4 || code == 5 {
+			return permanentError{err}
+		}
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	o.conn, o.r, o.w = conn, r, w
+	o.last = time.Now()
+	return nil
+}
+
+// ping checks that the broker still has the connection, which it closes
+// after one and a half keep alive periods without a packet.
+func (o *mqttOutput) ping() error {
+	o.conn.SetDeadline(time.Now().Add(mqttTimeout))
+	mqttWritePacket(o.w, mqttPingreq, nil)
+	if err := o.w.Flush(); err != nil {
+		return err
+	}
+	for {
+		typ, _, err := mqttReadPacket(o.r)
+		if err != nil {
+			return err
+		}
+		if typ == mqttPingresp {
+			o.last = time.Now()
+			return nil
+		}
+	}
+}
+
+func (o *mqttOutput) send(batch []*server.Message) error {
+	if o.conn != nil && time.Since(o.last) >= mqttKeepAlive {
+		if err := o.ping(); err != nil {
+			o.close()
+		}
+	}
+	if o.conn == nil {
+		if err := o.dial(); err != nil {
+			return err
+		}
+	}
+	o.conn.SetDeadline(time.Now().Add(mqttTimeout))
+
+	// The messages are published first, then their acknowledgements are
+	// read. QoS 0 has none, a PINGREQ follows the messages instead.
+	pending := make(map[int]*server.Message)
+	for _, m := range batch {
+		payload, err := o.format(m)
+		if err != nil {
+			log.Printf("output %s: %v", o.name, err)
+			continue
+		}
+		topic := o.topicOf(m)
+		if 2+len(topic)+2+len(payload) > mqttMaxRemaining {
+			log.Printf("output %s: dropping a message of %d bytes, over the maximum packet size", o.name, len(payload))
+			outputDropped.inc(o.name)
+			continue
+		}
+		body := mqttString(nil, topic)
+		if o.qos > 0 {
+			o.packetID = o.packetID%mqttMaxPacketIDs + 1
+			body = binary.BigEndian.AppendUint16(body, o.packetID)
+			pending[int(o.packetID)] = m
+		}
+		body = append(body, payload...)
+		mqttWritePacket(o.w, mqttPublish|o.qos<<1, body)
+	}
+	if o.qos == 0 {
+		mqttWritePacket(o.w, mqttPingreq, nil)
+	}
+	if err := o.w.Flush(); err != nil {
+		o.close()
+		return unackedError(pending, nil, err)
+	}
+	o.last = time.Now()
+
+	pong := o.qos > 0
+	for !pong || len(pending) > 0 {
+		typ, body, err := mqttReadPacket(o.r)
+		if err != nil {
+			o.close()
+			return unackedError(pending, nil, err)
+		}
+		switch typ &^ 0x0f {
+		case mqttPingresp:
+			pong = true
+		case mqttPuback, mqttPubcomp:
+			if len(body) == 2 {
+				delete(pending, int(binary.BigEndian.Uint16(body)))
+			}
+		case mqttPubrec:
+			// QoS 2 releases the message, completed by PUBCOMP.
+			if len(body) == 2 {
+				mqttWritePacket(o.w, mqttPubrel, body)
+				if err := o.w.Flush(); err != nil {
+					o.close()
+					return unackedError(pending, nil, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// mqttString appends s to b as an MQTT string, prefixed by its length.
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttWritePacket writes the packet of type and flags typ with body.
+func mqttWritePacket(w *bufio.Writer, typ byte, body []byte) {
+	w.WriteByte(typ)
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		w.WriteByte(b)
+		if n == 0 {
+			break
+		}
+	}
+	w.Write(body)
+}
+
+// mqttReadPacket reads a packet, returning its type and flags and its body.
+func mqttReadPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("invalid MQTT remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+func (o *mqttOutput) close() {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+}
+
+func (o *mqttOutput) Close() error {
+	err := o.batchOutput.Close()
+	if o.conn != nil {
+		o.conn.SetDeadline(time.Now().Add(mqttTimeout))
+		mqttWritePacket(o.w, mqttDisconnect, nil)
+		o.w.Flush()
+	}
+	o.close()
+	return err
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultMultilineTimeout  = time.Second
+	defaultMultilineMaxLines = 500
+)
+
+// multilineConfig joins the consecutive messages a sender logs for one
+// event, such as the lines of a stack trace:
+//
+//	if: program=java
+//	start: '^\d{4}-\d\d-\d\d '
+//
+// A message continues the event of its sender, program and process if it
+// matches Continue, or if it does not match Start when only Start is set.
+type multilineConfig struct {
+	If       string        `yaml:"if"` // match expression, every message by default
+	Start    string        `yaml:"start"`
+	Continue string        `yaml:"continue"`
+	Timeout  time.Duration `yaml:"timeout"`   // since the last line, default 1s
+	MaxLines int           `yaml:"max_lines"` // default 500
+}
+
+type multilineRule struct {
+	match    matcher
+	start    *regexp.Regexp
+	cont     *regexp.Regexp
+	timeout  time.Duration
+	maxLines int
+}
+
+func (r *multilineRule) continues(m *server.Message) bool {
+	if r.cont != nil {
+		return r.cont.MatchString(m.Content)
+	}
+	return !r.start.MatchString(m.Content)
+}
+
+// multiline is a server.Handler joining the lines of events into one
+// message, the first with the contents of the others appended on new
+// lines. It passes the events on to next once a line starts the next
+// event, at the timeout or the maximum number of lines.
+type multiline struct {
+	next server.Handler
+
+	mu      sync.Mutex
+	rules   []*multilineRule
+	pending map[multilineKey]*multilineEvent
+	closed  bool
+}
+
+type multilineKey struct {
+	rule                          *multilineRule
+	source, host, program, procid string
+}
+
+type multilineEvent struct {
+	m     *server.Message
+	lines int
+	timer *time.Timer
+}
+
+func newMultiline(next server.Handler) *multiline {
+	return &multiline{next: next, pending: make(map[multilineKey]*multilineEvent)}
+}
+
+// Set replaces the rules, passing on the events pending with the former
+// ones.
+func (ml *multiline) Set(configs []multilineConfig) error {
+	var rules []*multilineRule
+	for i, c := range configs {
+		r := &multilineRule{timeout: c.Timeout, maxLines: c.MaxLines}
+		at := func(err error, keys ...string) error {
+			return atKeys(err, append([]string{"multiline", strconv.Itoa(i)}, keys...)...)
+		}
+		var err error
+		if r.match, err = parseMatch(c.If); err != nil {
+			return at(fmt.Errorf("multiline %d: %v", i+1, err), "if")
+		}
+		if c.Start == "" && c.Continue == "" {
+			return at(fmt.Errorf("multiline %d: requires start or continue", i+1))
+		}
+		if c.Start != "" {
+			if r.start, err = regexp.Compile(c.Start); err != nil {
+				return at(fmt.Errorf("multiline %d: %v", i+1, err), "start")
+			}
+		}
+		if c.Continue != "" {
+			if r.cont, err = regexp.Compile(c.Continue); err != nil {
+				return at(fmt.Errorf("multiline %d: %v", i+1, err), "continue")
+			}
+		}
+		if r.timeout <= 0 {
+			r.timeout = defaultMultilineTimeout
+		}
+		if r.maxLines <= 0 {
+			r.maxLines = defaultMultilineMaxLines
+		}
+		rules = append(rules, r)
+	}
+
+	ml.mu.Lock()
+	ml.rules = rules
+	flushed := ml.takePending()
+	ml.mu.Unlock()
+	ml.pass(flushed)
+	return nil
+}
+
+func (ml *multiline) Handle(m *server.Message) *server.Message {
+	if m == nil {
+		ml.mu.Lock()
+		ml.closed = true
+		flushed := ml.takePending()
+		ml.mu.Unlock()
+		ml.pass(flushed)
+		return nil
+	}
+
+	ml.mu.Lock()
+	var rule *multilineRule
+	for _, r := range ml.rules {
+		if r.match(m) {
+			rule = r
+			break
+		}
+	}
+	if rule == nil || ml.closed {
+		ml.mu.Unlock()
+		return m
+	}
+
+	key := multilineKey{rule, m.NetSrc(), m.Hostname, program(m), m.ProcID}
+	ev := ml.pending[key]
+	if ev != nil && rule.continues(m) {
+		ev.m.Content += "\n" + m.Content
+		if ev.m.Content1 != "" || m.Content1 != "" {
+			ev.m.Content1 += "\n" + m.Content1
+		}
+		ev.m.Raw += "\n" + m.Raw
+		ev.lines++
+		if ev.lines < rule.maxLines {
+			ev.timer.Reset(rule.timeout)
+			ml.mu.Unlock()
+			return nil
+		}
+		ml.remove(key, ev)
+		ml.mu.Unlock()
+		return ev.m
+	}
+
+	// m starts an event, passing on the one pending.
+	if ev != nil {
+		ml.remove(key, ev)
+	}
+	next := &multilineEvent{m: copyMessage(m), lines: 1}
+	next.timer = time.AfterFunc(rule.timeout, func() { ml.expire(key, next) })
+	ml.pending[key] = next
+	ml.mu.Unlock()
+	if ev != nil {
+		return ev.m
+	}
+	return nil
+}
+
+func (ml *multiline) expire(key multilineKey, ev *multilineEvent) {
+	ml.mu.Lock()
+	if ml.pending[key] != ev {
+		ml.mu.Unlock()
+		return
+	}
+	delete(ml.pending, key)
+	ml.mu.Unlock()
+	ml.pass([]*server.Message{ev.m})
+}
+
+func (ml *multiline) remove(key multilineKey, ev *multilineEvent) {
+	ev.timer.Stop()
+	delete(ml.pending, key)
+}
+
+func (ml *multiline) takePending() []*server.Message {
+	var flushed []*server.Message
+	for key, ev := range ml.pending {
+		ml.remove(key, ev)
+		flushed = append(flushed, ev.m)
+	}
+	return flushed
+}
+
+func (ml *multiline) pass(ms []*server.Message) {
+	for _, m := range ms {
+		ml.next.Handle(m)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultNATSPort    = "4222"
+	defaultNATSSubject = "syslog.%HOSTNAME%.%FACILITY%"
+	natsTimeout        = 10 * time.Second
+)
+
+// natsOutput publishes messages to NATS subjects, expanded from %NAME%
+// properties as file paths are. With jetstream, every message waits for
+// the acknowledgement of the JetStream stream storing it, and those not
+// acknowledged are published again: at least once instead of at most.
+type natsOutput struct {
+	*batchOutput
+	name      string
+	addr      string
+	tls       *tls.Config
+	connect   natsConnect
+	subject   string
+	jetstream bool
+	format    formatter
+
+	conn       net.Conn
+	r          *bufio.Reader
+	w          *bufio.Writer
+	inbox      string
+	maxPayload int
+}
+
+// natsConnect is the CONNECT message of the client.
+type natsConnect struct {
+	Verbose      bool   `json:"verbose"`
+	Pedantic     bool   `json:"pedantic"`
+	TLSRequired  bool   `json:"tls_required"`
+	Name         string `json:"name"`
+	Lang         string `json:"lang"`
+	Version      string `json:"version"`
+	Protocol     int    `json:"protocol"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+	User         string `json:"user,omitempty"`
+	Pass         string `json:"pass,omitempty"`
+	AuthToken    string `json:"auth_token,omitempty"`
+}
+
+// natsInfo is the INFO message of the server.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	MaxPayload  int  `json:"max_payload"`
+	Headers     bool `json:"headers"`
+}
+
+// natsAck is the reply of JetStream to a message it stored, or not.
+type natsAck struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+	Error  *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// newNATSOutput publishes to url, nats://[user:password@|token@]host[:port]
+// or tls://... for TLS, which the server may also require.
+func newNATSOutput(name string, c outputConfig, format formatter) (*natsOutput, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid nats url %q: want nats://host[:port] or tls://host[:port]", c.URL)
+	}
+	o := &natsOutput{
+		name:      name,
+		addr:      u.Host,
+		subject:   c.Subject,
+		jetstream: c.JetStream,
+		format:    format,
+		connect:   natsConnect{Name: "syslogd", Lang: "go", Version: "1.0", Protocol: 1, Headers: true, NoResponders: true},
+	}
+	if u.Port() == "" {
+		o.addr = net.JoinHostPort(u.Hostname(), defaultNATSPort)
+	}
+	if o.subject == "" {
+		o.subject = defaultNATSSubject
+	}
+	for _, p := range pathProperty.FindAllString(o.subject, -1) {
+		if _, ok := pathProperties[strings.Trim(p, "%")]; !ok {
+			return nil, fmt.Errorf("unknown property %s in subject %s", p, o.subject)
+		}
+	}
+
+	switch pass, ok := u.User.Password(); {
+	case c.Username != "":
+		o.connect.User, o.connect.Pass = c.Username, c.Password
+	case ok:
+		o.connect.User, o.connect.Pass = u.User.Username(), pass
+	case u.User != nil:
+		o.connect.AuthToken = u.User.Username()
+	}
+	if u.Scheme == "tls" || c.TLS {
+		if o.tls, err = newClientTLSConfig(c); err != nil {
+			return nil, err
+		}
+		o.tls.ServerName = u.Hostname()
+	}
+
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	return o, nil
+}
+
+// subjectOf returns the subject of m, its properties turned into single
+// subject tokens.
+func (o *natsOutput) subjectOf(m *server.Message) string {
+	return pathProperty.ReplaceAllStringFunc(o.subject, func(p string) string {
+		return natsToken(pathProperties[strings.Trim(p, "%")](m))
+	})
+}
+
+func natsToken(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '.' || r == '*' || r == '>' || r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// dial connects to the server, upgrading to TLS when either side requires
+// it, and subscribes to the inbox of the JetStream acknowledgements.
+func (o *natsOutput) dial() error {
+	conn, err := net.DialTimeout("tcp", o.addr, natsTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	payload, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(payload), &info); err != nil {
+		conn.Close()
+		return fmt.Errorf("invalid INFO: %v", err)
+	}
+
+	connect := o.connect
+	if info.TLSRequired || o.tls != nil {
+		config := o.tls
+		if config == nil {
+			host, _, _ := net.SplitHostPort(o.addr)
+			config = &tls.Config{ServerName: host}
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn, r = tc, bufio.NewReader(tc)
+		connect.TLSRequired = true
+	}
+	connect.Headers = connect.Headers && info.Headers
+	connect.NoResponders = connect.Headers
+
+	data, _ := json.Marshal(connect)
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "CONNECT %s\r\nPING\r\n", data)
+	var inbox string
+	if o.jetstream {
+		id := make([]byte, 11)
+		rand.Read(id)
+		inbox = "_INBOX." + hex.EncodeToString(id)
+		fmt.Fprintf(w, "SUB %s.* 1\r\n", inbox)
+	}
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if msg, ok := strings.CutPrefix(line, "-ERR "); ok {
+			conn.Close()
+			return fmt.Errorf("nats: %s", strings.Trim(msg, "'"))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	o.conn, o.r, o.w, o.inbox = conn, r, w, inbox
+	o.maxPayload = info.MaxPayload
+	return nil
+}
+
+func (o *natsOutput) send(batch []*server.Message) error {
+	if o.conn == nil {
+		if err := o.dial(); err != nil {
+			return err
+		}
+	}
+	o.conn.SetDeadline(time.Now().Add(natsTimeout))
+
+	// The messages are published first, then the acknowledgements and the
+	// PONG that follows them are read.
+	pending := make(map[int]*server.Message)
+	for i, m := range batch {
+		payload, err := o.format(m)
+		if err != nil {
+			log.Printf("output %s: %v", o.name, err)
+			continue
+		}
+		if o.maxPayload > 0 && len(payload) > o.maxPayload {
+			log.Printf("output %s: dropping a message of %d bytes, over the max_payload of the server", o.name, len(payload))
+			outputDropped.inc(o.name)
+			continue
+		}
+		if o.jetstream {
+			fmt.Fprintf(o.w, "PUB %s %s.%d %d\r\n%s\r\n", o.subjectOf(m), o.inbox, i, len(payload), payload)
+			pending[i] = m
+		} else {
+			fmt.Fprintf(o.w, "PUB %s %d\r\n%s\r\n", o.subjectOf(m), len(payload), payload)
+		}
+	}
+	o.w.WriteString("PING\r\n")
+	if err := o.w.Flush(); err != nil {
+		o.close()
+		return err
+	}
+
+	// Core NATS replies with the PONG alone; JetStream acknowledges every
+	// message, possibly after the PONG.
+	var failed []*server.Message
+	var reason string
+	pong := false
+	for !pong || len(pending) > 0 {
+		line, err := o.r.ReadString('\n')
+		if err != nil {
+			o.close()
+			return unackedError(pending, failed, err)
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PONG":
+			pong = true
+		case "PING":
+			o.w.WriteString("PONG\r\n")
+			o.w.Flush()
+		case "-ERR":
+			o.close()
+			return unackedError(pending, failed, fmt.Errorf("nats: %s", strings.Trim(strings.TrimSpace(line[4:]), "'")))
+		case "MSG", "HMSG":
+			i, status, payload, err := o.readReply(fields)
+			if err != nil {
+				o.close()
+				return unackedError(pending, failed, err)
+			}
+			m, ok := pending[i]
+			if !ok {
+				continue
+			}
+			delete(pending, i)
+			var ack natsAck
+			switch {
+			case status != "":
+				reason = status
+			case json.Unmarshal(payload, &ack) != nil:
+				reason = "invalid acknowledgement"
+			case ack.Error != nil:
+				reason = fmt.Sprintf("%d %s", ack.Error.Code, ack.Error.Description)
+			default:
+				continue
+			}
+			failed = append(failed, m)
+		}
+	}
+	if len(failed) > 0 {
+		return unackedError(nil, failed, errors.New(reason))
+	}
+	return nil
+}
+
+// readReply reads the payload of a MSG or HMSG whose fields are given,
+// and returns the index of the message it replies to, and for a HMSG the
+// status of its headers, as NATS/1.0 503 for no stream on the subject.
+func (o *natsOutput) readReply(fields []string) (int, string, []byte, error) {
+	// MSG subject sid [reply] size, HMSG subject sid [reply] hsize size
+	min := 4
+	if fields[0] == "HMSG" {
+		min = 5
+	}
+	if len(fields) < min {
+		return 0, "", nil, fmt.Errorf("invalid %s", fields[0])
+	}
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < 0 {
+		return 0, "", nil, fmt.Errorf("invalid %s size", fields[0])
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(o.r, data); err != nil {
+		return 0, "", nil, err
+	}
+	data = data[:size]
+
+	var status string
+	if fields[0] == "HMSG" {
+		hsize, err := strconv.Atoi(fields[len(fields)-2])
+		if err != nil || hsize > size {
+			return 0, "", nil, errors.New("invalid HMSG header size")
+		}
+		head := string(data[:hsize])
+		if line, _, _ := strings.Cut(head, "\r\n"); len(strings.Fields(line)) > 1 {
+			status = strings.TrimSpace(strings.TrimPrefix(line, "NATS/1.0"))
+		}
+		data = data[hsize:]
+	}
+
+	i := -1
+	if j := strings.LastIndexByte(fields[1], '.'); j >= 0 && fields[1][:j] == o.inbox {
+		i, _ = strconv.Atoi(fields[1][j+1:])
+	}
+	return i, status, data, nil
+}
+
+func (o *natsOutput) close() {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+}
+
+func (o *natsOutput) Close() error {
+	err := o.batchOutput.Close()
+	o.close()
+	return err
+}
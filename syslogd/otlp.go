@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	otlpHTTPPath = "/v1/logs"
+	otlpGRPCPath = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+)
+
+// otlpSeverities are the OpenTelemetry severity numbers of the syslog
+// severities, as the syslog receiver of the collector maps them.
+var otlpSeverities = [8]uint64{
+	22, // emerg: FATAL2
+	21, // alert: FATAL
+	18, // crit: ERROR2
+	17, // err: ERROR
+	13, // warning: WARN
+	10, // notice: INFO2
+	9,  // info: INFO
+	5,  // debug: DEBUG
+}
+
+// otlpRetryable are the gRPC status codes the OTLP specification has
+// clients retry.
+var otlpRetryable = map[int]bool{
+	1:  true, // CANCELLED
+	4:  true, // DEADLINE_EXCEEDED
+	8:  true, // RESOURCE_EXHAUSTED
+	10: true, // ABORTED
+	11: true, // OUT_OF_RANGE
+	14: true, // UNAVAILABLE
+	15: true, // DATA_LOSS
+}
+
+// otlpOutput exports messages as OpenTelemetry log records to an OTLP
+// endpoint such as an OpenTelemetry Collector, over HTTP with protobuf
+// or over gRPC. The records of a batch are grouped by resource, whose
+// host.name and service.name attributes are the hostname and the program
+// of the messages.
+type otlpOutput struct {
+	*batchOutput
+	url     string
+	grpc    bool
+	gzip    bool
+	headers map[string]string
+	auth    func(*http.Request)
+	client  *http.Client
+	format  formatter // of the body, the content by default
+}
+
+// newOTLPOutput exports to url, http[s]://host:port, to which the path of
+// the logs service is added unless the url has one.
+func newOTLPOutput(name string, c outputConfig, format formatter) (*otlpOutput, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid otlp url %q: want http[s]://host:port", c.URL)
+	}
+	o := &otlpOutput{headers: c.Headers, format: format}
+	switch c.Protocol {
+	case "", "http/protobuf":
+		if u.Path == "" || u.Path == "/" {
+			u.Path = otlpHTTPPath
+		}
+	case "grpc":
+		o.grpc = true
+		u.Path = otlpGRPCPath
+	default:
+		return nil, fmt.Errorf("unknown otlp protocol %q: want http/protobuf or grpc", c.Protocol)
+	}
+	switch c.Compress {
+	case "":
+	case "gzip":
+		o.gzip = true
+	default:
+		return nil, fmt.Errorf("unknown otlp compression %q: want gzip", c.Compress)
+	}
+	o.url = u.String()
+
+	if o.client, err = newHTTPClient(c); err != nil {
+		return nil, err
+	}
+	if o.grpc {
+		// gRPC requires HTTP/2, with prior knowledge over cleartext.
+		transport := o.client.Transport.(*http.Transport)
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	switch {
+	case c.APIKey != "":
+		o.auth = func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+c.APIKey) }
+	case c.Username != "":
+		o.auth = func(req *http.Request) { req.SetBasicAuth(c.Username, c.Password) }
+	}
+
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	return o, nil
+}
+
+func (o *otlpOutput) send(batch []*server.Message) error {
+	body := o.encode(batch)
+	if o.gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+	if o.grpc {
+		// the length-prefixed message, flagged as compressed or not
+		frame := []byte{0}
+		if o.gzip {
+			frame[0] = 1
+		}
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+		body = append(frame, body...)
+	}
+
+	req, err := http.NewRequest("POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	if o.grpc {
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		if o.gzip {
+			req.Header.Set("Grpc-Encoding", "gzip")
+		}
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		if o.gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+	}
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+	if o.auth != nil {
+		o.auth(req)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if o.grpc {
+		if err := grpcStatus(resp); err != nil {
+			return err
+		}
+		if len(data) >= 5 && data[0] == 0 {
+			data = data[5:]
+		}
+	}
+	if rejected, msg := otlpPartialSuccess(data); rejected > 0 || msg != "" {
+		log.Printf("output %s: %d log records rejected: %s", o.name, rejected, msg)
+		outputDropped.add(uint64(rejected), o.name)
+	}
+	return nil
+}
+
+// grpcStatus returns the error of the grpc-status of resp, in its
+// trailers once its body is read or in its headers for a response
+// without a message, permanent unless OTLP has clients retry it.
+func grpcStatus(resp *http.Response) error {
+	status, msg := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, msg = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("invalid grpc-status %q", status)
+	}
+	if code == 0 {
+		return nil
+	}
+	if m, err := url.PathUnescape(msg); err == nil {
+		msg = m
+	}
+	err = fmt.Errorf("grpc status %d: %s", code, msg)
+	if otlpRetryable[code] {
+		return err
+	}
+	return permanentError{err}
+}
+
+// encode returns the ExportLogsServiceRequest of batch.
+func (o *otlpOutput) encode(batch []*server.Message) []byte {
+	type resource struct {
+		host, service string
+		records       []byte
+	}
+	resources := make(map[[2]string]*resource)
+	var keys [][2]string
+	for _, m := range batch {
+		body := m.Content
+		if o.format != nil {
+			var err error
+			if body, err = o.format(m); err != nil {
+				log.Printf("output %s: %v", o.name, err)
+				continue
+			}
+		}
+		key := [2]string{hostname(m), program(m)}
+		r, ok := resources[key]
+		if !ok {
+			r = &resource{host: key[0], service: key[1]}
+			resources[key] = r
+			keys = append(keys, key)
+		}
+		r.records = pbBytes(r.records, 2, otlpLogRecord(m, body))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+
+	var req []byte
+	for _, key := range keys {
+		r := resources[key]
+		var res []byte
+		res = pbBytes(res, 1, otlpKeyValue("host.name", r.host))
+		if r.service != "" {
+			res = pbBytes(res, 1, otlpKeyValue("service.name", r.service))
+		}
+		scope := pbBytes(nil, 1, pbString(nil, 1, "syslogd"))
+		scope = append(scope, r.records...)
+
+		var rl []byte
+		rl = pbBytes(rl, 1, res)
+		rl = pbBytes(rl, 2, scope)
+		req = pbBytes(req, 1, rl)
+	}
+	return req
+}
+
+// otlpLogRecord returns the LogRecord of m with body.
+func otlpLogRecord(m *server.Message, body string) []byte {
+	var b []byte
+	if !m.Timestamp.IsZero() {
+		b = pbFixed64(b, 1, uint64(m.Timestamp.UnixNano()))
+	}
+	if int(m.Severity) < len(otlpSeverities) {
+		b = pbVarint(b, 2, otlpSeverities[m.Severity])
+	}
+	b = pbString(b, 3, m.Severity.String())
+	b = pbBytes(b, 5, pbString(nil, 1, body))
+	if traceID, err := hex.DecodeString(m.TraceID); err == nil && len(traceID) == 16 {
+		b = pbBytes(b, 9, traceID)
+	}
+	if spanID, err := hex.DecodeString(m.SpanID); err == nil && len(spanID) == 8 {
+		b = pbBytes(b, 10, spanID)
+	}
+
+	b = pbBytes(b, 6, otlpKeyValue("syslog.facility", m.Facility.String()))
+	for _, a := range [][2]string{
+		{"syslog.procid", m.ProcID},
+		{"syslog.msgid", m.MsgID},
+		{"client.address", m.NetSrc()},
+	} {
+		if a[1] != "" {
+			b = pbBytes(b, 6, otlpKeyValue(a[0], a[1]))
+		}
+	}
+	if len(m.StructuredData) > 0 {
+		b = pbBytes(b, 6, otlpStructuredData(m.StructuredData))
+	}
+	return pbFixed64(b, 11, uint64(m.Time.UnixNano()))
+}
+
+// otlpKeyValue returns the KeyValue of key and the string value.
+func otlpKeyValue(key, value string) []byte {
+	return pbBytes(pbString(nil, 1, key), 2, pbString(nil, 1, value))
+}
+
+// otlpStructuredData returns the syslog.structured_data attribute of sd,
+// a map of its SD-IDs to maps of their parameters.
+func otlpStructuredData(sd map[string]map[string]string) []byte {
+	ids := make([]string, 0, len(sd))
+	for id := range sd {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var list []byte
+	for _, id := range ids {
+		names := make([]string, 0, len(sd[id]))
+		for name := range sd[id] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var params []byte
+		for _, name := range names {
+			params = pbBytes(params, 1, otlpKeyValue(name, sd[id][name]))
+		}
+		kv := pbBytes(pbString(nil, 1, id), 2, pbBytes(nil, 6, params))
+		list = pbBytes(list, 1, kv)
+	}
+	return pbBytes(pbString(nil, 1, "syslog.structured_data"), 2, pbBytes(nil, 6, list))
+}
+
+// otlpPartialSuccess returns the rejected log records and the error
+// message of an ExportLogsServiceResponse, if any.
+func otlpPartialSuccess(resp []byte) (int64, string) {
+	var rejected int64
+	var msg string
+	pbFields(resp, func(field int, v uint64, data []byte) {
+		if field != 1 {
+			return
+		}
+		pbFields(data, func(field int, v uint64, data []byte) {
+			switch field {
+			case 1:
+				rejected = int64(v)
+			case 2:
+				msg = string(data)
+			}
+		})
+	})
+	return rejected, msg
+}
+
+// pbVarint appends the varint field to b.
+func pbVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// pbFixed64 appends the fixed64 field to b.
+func pbFixed64(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|1)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+// pbBytes appends the length-delimited field, bytes or an embedded
+// message, to b.
+func pbBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func pbString(b []byte, field int, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// pbFields calls f with the fields of the message b, with the value of
+// those of integer types and the data of the length-delimited ones,
+// stopping at the first it cannot decode.
+func pbFields(b []byte, f func(field int, v uint64, data []byte)) {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 || tag>>3 > math.MaxInt32 {
+			return
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return
+			}
+			f(field, v, nil)
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return
+			}
+			f(field, binary.LittleEndian.Uint64(b), nil)
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return
+			}
+			f(field, 0, b[n:n+int(size)])
+			b = b[n+int(size):]
+		case 5:
+			if len(b) < 4 {
+				return
+			}
+			f(field, uint64(binary.LittleEndian.Uint32(b)), nil)
+			b = b[4:]
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/haccht/syslog_tools/plugin"
+	"github.com/haccht/syslog_tools/server"
+)
+
+// output is a destination that routing rules send messages to.
+type output interface {
+	Write(*server.Message) error
+	Close() error
+}
+
+// Fields shared by several types of outputs.
+var (
+	batchFields     = []string{"batch_size", "flush_interval", "max_retries"}
+	clientTLSFields = []string{"tls_ca", "tls_skip_verify"}
+	atRestFields    = []string{"encrypt_key", "kms_key", "kms_url", "region", "access_key", "secret_key"}
+)
+
+// outputFields are the fields of outputConfig each type of output takes,
+// besides type and queue, which all of them do.
+var outputFields = map[string][]string{
+	"stdout": {"format"},
+	"file": slices.Concat([]string{"format", "path", "max_open", "max_size", "rotate", "keep", "compress",
+		"hash_chain", "hash_chain_key"}, atRestFields),
+	"forward":       {"format", "url", "framing", "header", "record_hop", "rewrite", "failover", "balance", "health_interval"},
+	"elasticsearch": slices.Concat([]string{"url", "index", "username", "password", "api_key"}, clientTLSFields, batchFields),
+	"kafka": slices.Concat([]string{"format", "brokers", "topic", "key", "sasl", "tls", "username", "password", "compress"},
+		clientTLSFields, batchFields),
+	"nats":  slices.Concat([]string{"format", "url", "subject", "jetstream", "tls", "username", "password"}, clientTLSFields, batchFields),
+	"mqtt":  slices.Concat([]string{"format", "url", "topic", "qos", "client_id", "tls", "username", "password"}, clientTLSFields, batchFields),
+	"amqp":  slices.Concat([]string{"format", "url", "exchange", "routing_key", "tls", "username", "password"}, clientTLSFields, batchFields),
+	"redis": slices.Concat([]string{"format", "url", "stream", "max_len", "fields", "tls", "username", "password"}, clientTLSFields, batchFields),
+	"otlp": slices.Concat([]string{"format", "url", "protocol", "headers", "compress", "username", "password", "api_key"},
+		clientTLSFields, batchFields),
+	"splunk": slices.Concat([]string{"format", "url", "index", "sourcetype", "source", "ack", "fields", "api_key"},
+		clientTLSFields, batchFields),
+	"postgres":   slices.Concat([]string{"url", "table", "columns"}, batchFields),
+	"clickhouse": slices.Concat([]string{"url", "table", "columns", "username", "password"}, clientTLSFields, batchFields),
+	"sqlite":     slices.Concat([]string{"path", "retention"}, batchFields),
+	"s3": slices.Concat([]string{"format", "url", "bucket", "prefix", "path", "max_size", "rotate", "compress"},
+		atRestFields, clientTLSFields),
+	"loki":     slices.Concat([]string{"format", "url", "labels", "max_label_values", "tenant", "username", "password", "api_key"}, clientTLSFields, batchFields),
+	"snmp":     {"url", "trap_oid", "varbinds", "v3"},
+	"journald": {"format", "path", "fields"},
+	"discard":  {},
+}
+
+// checkFields returns an error naming the fields set in c that its type of
+// output does not take, which would be ignored otherwise.
+func checkFields(c outputConfig) error {
+	fields, ok := outputFields[c.Type]
+	if !ok {
+		if _, ok := plugin.LookupOutput(c.Type); !ok {
+			return nil // unknown, reported as such
+		}
+		fields = []string{"options"}
+	}
+
+	var extra []string
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+		if name == "type" || name == "queue" || v.Field(i).IsZero() || slices.Contains(fields, name) {
+			continue
+		}
+		extra = append(extra, name)
+	}
+	if len(extra) > 0 {
+		return fmt.Errorf("%s output does not take %s", c.Type, strings.Join(extra, ", "))
+	}
+	return nil
+}
+
+func newOutput(name string, c outputConfig) (output, error) {
+	if err := checkFields(c); err != nil {
+		return nil, err
+	}
+	format, err := newFormatter(c.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Type {
+	case "stdout":
+		if format == nil {
+			format = stdoutFormat
+		}
+		return &stdoutOutput{format: format}, nil
+	case "file":
+		if format == nil {
+			format = formatDefault
+		}
+		if strings.Contains(c.Path, "%") {
+			return newDynamicFileOutput(c, format)
+		}
+		return newFileOutput(c, format)
+	case "forward":
+		if format == nil {
+			format = formatRFC3164
+		}
+		return newForwardOutput(c, format)
+	case "elasticsearch":
+		return newESOutput(name, c)
+	case "kafka":
+		if format == nil {
+			format = formatJSON
+		}
+		return newKafkaOutput(name, c, format)
+	case "nats":
+		if format == nil {
+			format = formatJSON
+		}
+		return newNATSOutput(name, c, format)
+	case "mqtt":
+		if format == nil {
+			format = formatJSON
+		}
+		return newMQTTOutput(name, c, format)
+	case "amqp":
+		if format == nil {
+			format = formatJSON
+		}
+		return newAMQPOutput(name, c, format)
+	case "redis":
+		if format == nil {
+			format = formatJSON
+		}
+		return newRedisOutput(name, c, format)
+	case "otlp":
+		return newOTLPOutput(name, c, format)
+	case "splunk":
+		return newSplunkOutput(name, c, format)
+	case "postgres":
+		return newPostgresOutput(name, c)
+	case "clickhouse":
+		return newClickHouseOutput(name, c)
+	case "sqlite":
+		return newStoreOutput(name, c)
+	case "s3":
+		if format == nil {
+			format = formatDefault
+		}
+		return newArchiveOutput(name, c, format)
+	case "loki":
+		if format == nil {
+			format = formatDefault
+		}
+		return newLokiOutput(name, c, format)
+	case "snmp":
+		return newSNMPOutput(c)
+	case "journald":
+		return newJournaldOutput(c, format)
+	case "discard":
+		return discardOutput{}, nil
+	}
+	if f, ok := plugin.LookupOutput(c.Type); ok {
+		o, err := f(name, c.Options)
+		if err != nil {
+			return nil, err
+		}
+		return pluginOutput{o}, nil
+	}
+	return nil, fmt.Errorf("unknown output type %q", c.Type)
+}
+
+// stdoutFormat is the format of stdout outputs without one, as set with
+// -stdout-format.
+var stdoutFormat formatter = formatDefault
+
+// stdoutFormats are the values of -stdout-format.
+var stdoutFormats = map[string]formatter{
+	"text":   formatDefault,
+	"json":   formatJSON,
+	"logfmt": formatLogfmt,
+}
+
+type stdoutOutput struct {
+	mu     sync.Mutex
+	format formatter
+}
+
+func (o *stdoutOutput) Write(m *server.Message) error {
+	line, err := o.format(m)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, err = fmt.Println(line)
+	return err
+}
+
+func (o *stdoutOutput) Close() error {
+	return nil
+}
+
+type discardOutput struct{}
+
+func (discardOutput) Write(*server.Message) error { return nil }
+func (discardOutput) Close() error                { return nil }
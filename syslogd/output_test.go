@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOutputFields(t *testing.T) {
+	tags := make(map[string]bool)
+	typ := reflect.TypeOf(outputConfig{})
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("yaml"), ",")
+		tags[name] = true
+	}
+	for typ, fields := range outputFields {
+		for _, name := range fields {
+			if !tags[name] {
+				t.Errorf("%s output takes %s, which is not a field", typ, name)
+			}
+		}
+	}
+}
+
+func TestCheckFields(t *testing.T) {
+	tests := []struct {
+		c   outputConfig
+		err string
+	}{
+		{outputConfig{Type: "file", Path: "app.log", Format: "json", Queue: queueConfig{Dir: "q"}}, ""},
+		{outputConfig{Type: "file", Path: "app.log", Brokers: stringList{"kafka:9092"}, Topic: "syslog"}, "file output does not take brokers, topic"},
+		{outputConfig{Type: "kafka", Brokers: stringList{"kafka:9092"}, TLS: true, TLSCA: "ca.pem", BatchSize: 10}, ""},
+		{outputConfig{Type: "forward", URL: "tcp://relay:514", Index: "syslog"}, "forward output does not take index"},
+		{outputConfig{Type: "discard", Format: "json"}, "discard output does not take format"},
+		{outputConfig{Type: "nope", Path: "app.log"}, ""},
+	}
+	for _, tt := range tests {
+		err := checkFields(tt.c)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s output: %v, want %q", tt.c.Type, err, tt.err)
+		}
+	}
+}
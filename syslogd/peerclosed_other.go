@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// peerClosed cannot tell without peeking at the socket, so a closed
+// connection is only noticed when a write fails.
+func peerClosed(conn net.Conn) bool {
+	return false
+}
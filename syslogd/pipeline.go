@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultParseQueue  = 10000
+	defaultRouteQueue  = 1000
+	defaultOutputQueue = 1000
+)
+
+// pipelineConfig sizes the stages messages go through: the goroutines
+// reading the sockets pass them to the parse workers, which run the
+// handlers and queue them for the route workers, which queue them for the
+// workers of every output they are routed to. The policy of a stage
+// decides what happens to the messages that do not fit in its full queue:
+// block, drop-oldest, drop-newest (the default) or drop-by-severity, which
+// drops the messages less severe than keep and the oldest to make room
+// for the others.
+type pipelineConfig struct {
+	ParseWorkers  int    `yaml:"parse_workers"`  // default none, parsing on the reading goroutines
+	ParseQueue    int    `yaml:"parse_queue"`    // default 10000
+	ParsePolicy   string `yaml:"parse_policy"`   // default drop-newest
+	RouteWorkers  int    `yaml:"route_workers"`  // default 1
+	RouteQueue    int    `yaml:"route_queue"`    // default 1000
+	RoutePolicy   string `yaml:"route_policy"`   // default drop-newest
+	OutputWorkers int    `yaml:"output_workers"` // per output, default 1
+	OutputQueue   int    `yaml:"output_queue"`   // per output, default 1000
+	OutputPolicy  string `yaml:"output_policy"`  // default drop-newest
+	Keep          string `yaml:"keep"`           // least severe level drop-by-severity keeps, default err
+}
+
+func (c pipelineConfig) validate() error {
+	var errs []error
+	if c.ParseWorkers < 0 || c.ParseQueue < 0 || c.RouteWorkers < 0 || c.RouteQueue < 0 ||
+		c.OutputWorkers < 0 || c.OutputQueue < 0 {
+		errs = append(errs, fmt.Errorf("pipeline: negative worker count or queue length"))
+	}
+	for _, p := range []struct{ key, policy string }{
+		{"parse_policy", c.ParsePolicy},
+		{"route_policy", c.RoutePolicy},
+		{"output_policy", c.OutputPolicy},
+	} {
+		if _, err := server.ParsePolicy(p.policy); err != nil {
+			errs = append(errs, atKeys(fmt.Errorf("pipeline: %v", err), p.key))
+		}
+	}
+	if c.Keep != "" {
+		if _, err := parseSeverity(c.Keep); err != nil {
+			errs = append(errs, atKeys(fmt.Errorf("pipeline: %v", err), "keep"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// policy returns the parsed policy p and the severity it keeps.
+func (c pipelineConfig) policy(p string) (server.Policy, server.Severity) {
+	policy, _ := server.ParsePolicy(p)
+	keep := server.Err
+	if c.Keep != "" {
+		keep, _ = parseSeverity(c.Keep)
+	}
+	return policy, keep
+}
+
+func (c pipelineConfig) withDefaults() pipelineConfig {
+	if c.ParseQueue == 0 {
+		c.ParseQueue = defaultParseQueue
+	}
+	if c.RouteWorkers == 0 {
+		c.RouteWorkers = 1
+	}
+	if c.RouteQueue == 0 {
+		c.RouteQueue = defaultRouteQueue
+	}
+	if c.OutputWorkers == 0 {
+		c.OutputWorkers = 1
+	}
+	if c.OutputQueue == 0 {
+		c.OutputQueue = defaultOutputQueue
+	}
+	return c
+}
+
+// newHandler routes the received messages with r, and with the routers
+// sent on reload after that. Messages keep queueing up during a reload.
+func newHandler(r *router, reload <-chan *router, c pipelineConfig) *server.BaseHandler {
+	c = c.withDefaults()
+	h := server.NewBaseHandler(c.RouteQueue, nil, false)
+	h.SetPolicy(c.policy(c.RoutePolicy))
+	currentRouter.Store(r)
+	lastRouted.Store(time.Now().UnixNano())
+
+	// The router is only replaced while no worker is routing with it.
+	var routing sync.RWMutex
+	var workers sync.WaitGroup
+	for i := 0; i < c.RouteWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for m := range h.Queue() {
+				lastRouted.Store(time.Now().UnixNano())
+				countMessage(m)
+				routing.RLock()
+				m = currentRouter.Load().Route(m)
+				routing.RUnlock()
+				if m == nil {
+					continue
+				}
+				if recent != nil {
+					recent.add(m)
+				}
+				streams.publish(m)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	go func() {
+		defer h.End()
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case now := <-tick.C:
+				routing.RLock()
+				currentRouter.Load().Tick(now)
+				routing.RUnlock()
+			case next := <-reload:
+				routing.Lock()
+				prev := currentRouter.Swap(next)
+				routing.Unlock()
+				prev.Close()
+			case <-done:
+				currentRouter.Load().Close()
+				return
+			}
+		}
+	}()
+	return h
+}
+
+// setParseWorkers starts the parse stage of srv, if c has parse workers.
+func setParseWorkers(srv *server.Server, c pipelineConfig) {
+	c = c.withDefaults()
+	if c.ParseWorkers == 0 {
+		return
+	}
+	p, keep := c.policy(c.ParsePolicy)
+	srv.SetParseWorkers(c.ParseWorkers, c.ParseQueue, p, keep)
+}
+
+// stageQueue is a queue between the stages of the pipeline.
+type stageQueue interface {
+	Len() int
+	Dropped(server.Severity) uint64
+}
+
+// registerQueueMetrics exports the lengths of the queues and the messages
+// their policies dropped, for the parse queue of srv if it has one, the
+// routing queue h and the queues of the outputs.
+func registerQueueMetrics(srv *server.Server, h *server.BaseHandler, c pipelineConfig) {
+	queues := func() ([]string, []stageQueue) {
+		var names []string
+		var queues []stageQueue
+		if c.ParseWorkers > 0 {
+			names, queues = append(names, "parse"), append(queues, parseQueue{srv})
+		}
+		names, queues = append(names, "route"), append(queues, h)
+		if r := currentRouter.Load(); r != nil {
+			outputs := make([]string, 0, len(r.stages))
+			for name := range r.stages {
+				outputs = append(outputs, name)
+			}
+			sort.Strings(outputs)
+			for _, name := range outputs {
+				names, queues = append(names, "output:"+name), append(queues, r.stages[name].queue)
+			}
+		}
+		return names, queues
+	}
+
+	newMetricFunc("syslogd_queue_length", "Messages waiting in the queue of a stage.", "gauge", func() []sample {
+		names, queues := queues()
+		samples := []sample{}
+		for i, q := range queues {
+			samples = append(samples, sample{[]string{names[i]}, float64(q.Len())})
+		}
+		return samples
+	}, "queue")
+	newMetricFunc("syslogd_queue_dropped_total", "Messages the policy of a full queue dropped by severity.", "counter", func() []sample {
+		names, queues := queues()
+		samples := []sample{}
+		for i, q := range queues {
+			for sev := server.Emerg; sev <= server.Debug; sev++ {
+				if n := q.Dropped(sev); n > 0 {
+					samples = append(samples, sample{[]string{names[i], sev.String()}, float64(n)})
+				}
+			}
+		}
+		return samples
+	}, "queue", "severity")
+}
+
+type parseQueue struct {
+	srv *server.Server
+}
+
+func (q parseQueue) Len() int                           { return q.srv.ParseQueueLen() }
+func (q parseQueue) Dropped(sev server.Severity) uint64 { return q.srv.ParseDropped(sev) }
+
+// outputStage writes the messages routed to an output from its own
+// workers, so that a slow output holds up neither routing nor the other
+// outputs.
+type outputStage struct {
+	name    string
+	out     output
+	queue   *server.Queue[*server.Message]
+	workers sync.WaitGroup
+}
+
+func newOutputStage(name string, out output, c pipelineConfig) *outputStage {
+	c = c.withDefaults()
+	s := &outputStage{name: name, out: out, queue: server.NewQueue(c.OutputQueue, messageSeverity)}
+	s.queue.SetPolicy(c.policy(c.OutputPolicy))
+	for i := 0; i < c.OutputWorkers; i++ {
+		s.workers.Add(1)
+		go s.run()
+	}
+	return s
+}
+
+// write queues m, applying the policy if the queue is full.
+func (s *outputStage) write(m *server.Message) {
+	s.queue.Put(m)
+}
+
+func messageSeverity(m *server.Message) server.Severity {
+	return m.Severity
+}
+
+func (s *outputStage) run() {
+	defer s.workers.Done()
+	for m := range s.queue.C() {
+		if err := s.out.Write(m); err != nil {
+			log.Printf("output %s: %v", s.name, err)
+			outputWrites.inc(s.name, "failure")
+		} else {
+			outputWrites.inc(s.name, "success")
+		}
+	}
+}
+
+// close writes the queued messages and stops the workers.
+func (s *outputStage) close() {
+	s.queue.Close()
+	s.workers.Wait()
+}
+
+// queuedMessages returns the number of messages the stages and outputs
+// hold in memory, those in the disk queues of outputs aside.
+func queuedMessages(srv *server.Server, h *server.BaseHandler) int {
+	n := srv.ParseQueueLen() + h.Len()
+	if r := currentRouter.Load(); r != nil {
+		for name, s := range r.stages {
+			n += s.queue.Len()
+			if o, ok := r.outputs[name].(interface{ unsent() int }); ok {
+				n += o.unsent()
+			}
+		}
+	}
+	return n
+}
+
+// queueHighWater is the fill of a queue above which RELP listeners hold back
+// their acknowledgements.
+const queueHighWater = 0.9
+
+// queuesFull reports whether the parse queue, the routing queue or the
+// queue of an output is filled above queueHighWater, for the senders that
+// wait for acknowledgements to slow down rather than the policies to drop
+// messages.
+func queuesFull(srv *server.Server, h *server.BaseHandler) bool {
+	full := func(n, c int) bool { return c > 0 && float64(n) >= queueHighWater*float64(c) }
+	if full(srv.ParseQueueLen(), srv.ParseQueueCap()) || full(h.Len(), h.Cap()) {
+		return true
+	}
+	if r := currentRouter.Load(); r != nil {
+		for _, s := range r.stages {
+			if full(s.queue.Len(), s.queue.Cap()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// drain shuts srv down, which stops receiving and then waits for the
+// received messages to be delivered, for at most timeout if it is not
+// zero. It returns the number of messages abandoned when it times out.
+func drain(srv *server.Server, h *server.BaseHandler, timeout time.Duration) (int, bool) {
+	done := make(chan struct{})
+	go func() {
+		srv.Shutdown()
+		close(done)
+	}()
+	if timeout <= 0 {
+		<-done
+		return 0, true
+	}
+	select {
+	case <-done:
+		return 0, true
+	case <-time.After(timeout):
+		return queuedMessages(srv, h), false
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+// Plugins are compiled in by a blank import in this block, such as
+// _ "example.com/siem/syslogd-output", for their init functions to register
+// their types with package plugin.
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/haccht/syslog_tools/plugin"
+	"github.com/haccht/syslog_tools/server"
+)
+
+type inputConfig struct {
+	Type    string         `yaml:"type"` // exec or the type of a plugin
+	Options plugin.Options `yaml:"options"`
+}
+
+// startInputs starts the inputs of c, which deliver their messages to srv.
+func startInputs(c *config, srv *server.Server) ([]plugin.Input, error) {
+	var inputs []plugin.Input
+	for i, ic := range c.Inputs {
+		name := fmt.Sprintf("input%d", i+1)
+		f, ok := plugin.LookupInput(ic.Type)
+		if !ok {
+			closeInputs(inputs)
+			return nil, fmt.Errorf("%s: unknown input type %q", name, ic.Type)
+		}
+		in, err := f(name, ic.Options)
+		if err == nil {
+			err = in.Start(func(p *plugin.Message) {
+				m, err := serverMessage(nil, p)
+				if err != nil {
+					log.Printf("%s: %v", name, err)
+					return
+				}
+				srv.Dispatch(m)
+			})
+		}
+		if err != nil {
+			closeInputs(inputs)
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		inputs = append(inputs, in)
+	}
+	return inputs, nil
+}
+
+func closeInputs(inputs []plugin.Input) {
+	for _, in := range inputs {
+		if err := in.Close(); err != nil {
+			log.Printf("input: %v", err)
+		}
+	}
+}
+
+// pluginOutput is an output of a plugin.
+type pluginOutput struct {
+	plugin.Output
+}
+
+func (o pluginOutput) Write(m *server.Message) error {
+	return o.Output.Write(pluginMessage(m))
+}
+
+// pluginMessage returns m as plugins see it, with structured data of its
+// own.
+func pluginMessage(m *server.Message) *plugin.Message {
+	return &plugin.Message{
+		Time:           m.Time,
+		Source:         m.NetSrc(),
+		SourceHost:     m.FromHost,
+		Facility:       m.Facility.String(),
+		Severity:       m.Severity.String(),
+		Timestamp:      m.Timestamp,
+		Hostname:       m.Hostname,
+		Tag:            m.Tag,
+		Content:        m.Content,
+		Version:        m.Version,
+		AppName:        m.AppName,
+		ProcID:         m.ProcID,
+		MsgID:          m.MsgID,
+		TraceID:        m.TraceID,
+		SpanID:         m.SpanID,
+		StructuredData: copyMessage(&server.Message{StructuredData: m.StructuredData}).StructuredData,
+		Raw:            m.Raw,
+	}
+}
+
+// serverMessage returns a copy of m changed as p, the message m became in
+// a transform, or with m nil the message p of an input, received now. The
+// source of a message cannot be changed.
+func serverMessage(m *server.Message, p *plugin.Message) (*server.Message, error) {
+	if m == nil {
+		m = &server.Message{Time: time.Now(), Facility: server.User, Severity: server.Notice}
+		if p.Raw == "" {
+			p.Raw = p.Content
+		}
+	} else {
+		m = copyMessage(m)
+		m.Time = p.Time
+		if !p.Timestamp.Equal(m.Timestamp) {
+			m.Zone = nil
+		}
+	}
+	var err error
+	if p.Facility != "" {
+		if m.Facility, err = parseFacility(p.Facility); err != nil {
+			return nil, err
+		}
+	}
+	if p.Severity != "" {
+		if m.Severity, err = parseSeverity(p.Severity); err != nil {
+			return nil, err
+		}
+	}
+	m.FromHost = p.SourceHost
+	m.Timestamp = p.Timestamp
+	m.Hostname = p.Hostname
+	m.Tag = p.Tag
+	m.Content = p.Content
+	m.Version = p.Version
+	m.AppName = p.AppName
+	m.ProcID = p.ProcID
+	m.MsgID = p.MsgID
+	m.TraceID = p.TraceID
+	m.SpanID = p.SpanID
+	m.StructuredData = p.StructuredData
+	m.Raw = p.Raw
+	m.NormalizeTime()
+	return m, nil
+}
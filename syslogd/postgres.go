@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/haccht/syslog_tools/server"
+	"github.com/lib/pq"
+)
+
+const defaultDBTable = "syslog"
+
+// dbField is a message property stored in a column of the given type.
+type dbField struct {
+	typ string
+	get func(*server.Message) interface{}
+}
+
+// dbFields are the properties a database column can be filled from, in
+// addition to the string properties of match conditions.
+var dbFields = map[string]dbField{
+	"time":      {"timestamptz", func(m *server.Message) interface{} { return m.Time }},
+	"timestamp": {"timestamptz", func(m *server.Message) interface{} { return headerTime(m) }},
+	"facility":  {"smallint", func(m *server.Message) interface{} { return int(m.Facility) }},
+	"severity":  {"smallint", func(m *server.Message) interface{} { return int(m.Severity) }},
+	"raw":       {"text", func(m *server.Message) interface{} { return m.Raw }},
+	"sd": {"jsonb", func(m *server.Message) interface{} {
+		if len(m.StructuredData) == 0 {
+			return nil
+		}
+		data, _ := json.Marshal(m.StructuredData)
+		return string(data)
+	}},
+}
+
+// defaultDBColumns maps the columns of the table created by default to
+// the properties they hold.
+var defaultDBColumns = map[string]string{
+	"received_at": "time",
+	"reported_at": "timestamp",
+	"hostname":    "hostname",
+	"source":      "source",
+	"facility":    "facility",
+	"severity":    "severity",
+	"app_name":    "program",
+	"procid":      "procid",
+	"msgid":       "msgid",
+	"message":     "msg",
+	"sd":          "sd",
+}
+
+type dbColumn struct {
+	name  string
+	field dbField
+}
+
+// dbColumnsFor resolves the column mapping of c, sorted by column name.
+func dbColumnsFor(c outputConfig) ([]dbColumn, error) {
+	mapping := c.Columns
+	if len(mapping) == 0 {
+		mapping = defaultDBColumns
+	}
+
+	var columns []dbColumn
+	for name, prop := range mapping {
+		f, ok := dbFields[prop]
+		if !ok {
+			get, ok := messageFields[prop]
+			if strings.HasPrefix(prop, "sd.") {
+				get, ok = sdParam(prop[3:])
+			}
+			if !ok {
+				return nil, fmt.Errorf("column %s: unknown property %s", name, prop)
+			}
+			f = dbField{"text", func(m *server.Message) interface{} { return get(m) }}
+		}
+		columns = append(columns, dbColumn{name, f})
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+	return columns, nil
+}
+
+// postgresOutput batch-inserts messages into a PostgreSQL table, which is
+// created when it does not exist yet.
+type postgresOutput struct {
+	*batchOutput
+	db      *sql.DB
+	table   string
+	columns []dbColumn
+	insert  *sql.Stmt
+}
+
+func newPostgresOutput(name string, c outputConfig) (*postgresOutput, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("postgres output requires a url")
+	}
+	columns, err := dbColumnsFor(c)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &postgresOutput{db: db, table: c.Table, columns: columns}
+	if o.table == "" {
+		o.table = defaultDBTable
+	}
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	return o, nil
+}
+
+// quotedTable quotes the parts of a schema qualified table name.
+func (o *postgresOutput) quotedTable() string {
+	parts := strings.Split(o.table, ".")
+	for i, p := range parts {
+		parts[i] = pq.QuoteIdentifier(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// prepare creates the table and the insert statement. It is done on the
+// first batch so that syslogd starts while the database is unavailable.
+func (o *postgresOutput) prepare() error {
+	table := o.quotedTable()
+	defs := make([]string, len(o.columns))
+	names := make([]string, len(o.columns))
+	params := make([]string, len(o.columns))
+	for i, col := range o.columns {
+		names[i] = pq.QuoteIdentifier(col.name)
+		defs[i] = names[i] + " " + col.field.typ
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, strings.Join(defs, ", "))
+	if _, err := o.db.Exec(create); err != nil {
+		return dbError(err)
+	}
+
+	insert, err := o.db.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		table, strings.Join(names, ", "), strings.Join(params, ", ")))
+	if err != nil {
+		return dbError(err)
+	}
+	o.insert = insert
+	return nil
+}
+
+func (o *postgresOutput) send(batch []*server.Message) error {
+	if o.insert == nil {
+		if err := o.prepare(); err != nil {
+			return err
+		}
+	}
+
+	tx, err := o.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt := tx.Stmt(o.insert)
+	args := make([]interface{}, len(o.columns))
+	for _, m := range batch {
+		for i, col := range o.columns {
+			args[i] = col.field.get(m)
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			tx.Rollback()
+			return dbError(err)
+		}
+	}
+	return dbError(tx.Commit())
+}
+
+// dbError makes errors in the data or the schema permanent, as retrying
+// the batch would fail the same way.
+func dbError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "22", "23", "42":
+			return permanentError{err}
+		}
+	}
+	return err
+}
+
+func (o *postgresOutput) Close() error {
+	o.batchOutput.Close()
+	if o.insert != nil {
+		o.insert.Close()
+	}
+	return o.db.Close()
+}
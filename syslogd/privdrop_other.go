@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+var errNoPrivDrop = errors.New("-user and -group are not supported on this platform")
+
+func lookupIDs(name, group string) (uid, gid int, err error) {
+	return 0, 0, errNoPrivDrop
+}
+
+func dropPrivileges(uid, gid int) error {
+	return errNoPrivDrop
+}
@@ -0,0 +1,61 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// lookupIDs returns the uid and gid of the account name and the group, or
+// the primary group of the account if group is empty. It is separate from
+// dropPrivileges as the account database may be out of reach after a
+// chroot.
+func lookupIDs(name, group string) (uid, gid int, err error) {
+	uid, gid = os.Getuid(), os.Getgid()
+	if name != "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("user %s: uid %s", name, u.Uid)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return 0, 0, fmt.Errorf("user %s: gid %s", name, u.Gid)
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("group %s: gid %s", group, g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// dropPrivileges switches to uid and gid. Switching from root clears every
+// capability; none is kept, since the sockets are bound already and never
+// rebound, not even on reload.
+func dropPrivileges(uid, gid int) error {
+	// The group goes first, since changing it needs root.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("setuid: root privileges could be regained")
+	}
+	return nil
+}
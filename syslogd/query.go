@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// parseQueryTime accepts a time as RFC 3339, as a date, or as a duration
+// before now such as 2h.
+func parseQueryTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// messageFilter selects messages as the flags of "syslogd query" and the
+// parameters of /api/v1/messages do.
+type messageFilter struct {
+	since, until time.Time
+	host, tag    string
+	severity     server.Severity
+	bySeverity   bool
+	text         string
+	search       string // full-text query, on the store only
+}
+
+func newMessageFilter(since, until, host, tag, severity, text, search string) (messageFilter, error) {
+	f := messageFilter{host: host, tag: tag, text: text, search: search}
+	now := time.Now()
+	var err error
+	if since != "" {
+		if f.since, err = parseQueryTime(since, now); err != nil {
+			return f, err
+		}
+	}
+	if until != "" {
+		if f.until, err = parseQueryTime(until, now); err != nil {
+			return f, err
+		}
+	}
+	if severity != "" {
+		if f.severity, err = parseSeverity(severity); err != nil {
+			return f, err
+		}
+		f.bySeverity = true
+	}
+	return f, nil
+}
+
+// where returns the conditions of f on the store.
+func (f messageFilter) where() ([]string, []interface{}) {
+	var where []string
+	var params []interface{}
+	if !f.since.IsZero() {
+		where, params = append(where, "time >= ?"), append(params, f.since.UnixNano())
+	}
+	if !f.until.IsZero() {
+		where, params = append(where, "time < ?"), append(params, f.until.UnixNano())
+	}
+	if f.host != "" {
+		where, params = append(where, "hostname = ?"), append(params, f.host)
+	}
+	if f.tag != "" {
+		where, params = append(where, "program = ?"), append(params, f.tag)
+	}
+	if f.bySeverity {
+		where, params = append(where, "severity <= ?"), append(params, int(f.severity))
+	}
+	if f.text != "" {
+		where, params = append(where, "instr(message, ?) > 0"), append(params, f.text)
+	}
+	if f.search != "" {
+		where, params = append(where, "id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)"), append(params, f.search)
+	}
+	return where, params
+}
+
+// match tells whether m passes f, as where does on the store, but for the
+// full-text query.
+func (f messageFilter) match(m *server.Message) bool {
+	return (f.since.IsZero() || !m.Time.Before(f.since)) &&
+		(f.until.IsZero() || m.Time.Before(f.until)) &&
+		(f.host == "" || headerHostname(m) == f.host) &&
+		(f.tag == "" || program(m) == f.tag) &&
+		(!f.bySeverity || m.Severity <= f.severity) &&
+		(f.text == "" || strings.Contains(m.Content, f.text))
+}
+
+// runQuery implements "syslogd query", which prints the messages of the
+// local store that match its flags, oldest first.
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	store := fs.String("store", "sqlite://"+defaultStorePath, "message store `url`")
+	since := fs.String("since", "", "messages received at or after `time` (RFC 3339, date or duration ago)")
+	until := fs.String("until", "", "messages received before `time`")
+	host := fs.String("host", "", "messages of the `hostname`")
+	tag := fs.String("tag", "", "messages of the `program`")
+	severity := fs.String("severity", "", "messages of the `level` or more severe")
+	grep := fs.String("grep", "", "messages containing `text`")
+	search := fs.String("search", "", "messages matching the full-text `query`, words and phrases optionally of a column such as hostname:web1 or program:sshd, combined with AND, OR and NOT")
+	limit := fs.Int("limit", 100, "print the last `n` matching messages, 0 for all")
+	format := fs.String("format", "default", "output `format`: default, json, rfc3164, rfc5424, raw or a template")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s query [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	path, err := parseStoreURL(*store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmtr, err := newFormatter(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := newMessageFilter(*since, *until, *host, *tag, *severity, *grep, *search)
+	if err != nil {
+		log.Fatal(err)
+	}
+	where, params := f.where()
+	query := "SELECT record FROM messages"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY time DESC, id DESC"
+	if *limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", *limit)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		log.Fatal(err)
+	}
+	db, err := openStore(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var records [][]byte
+	for rows.Next() {
+		var record []byte
+		if err := rows.Scan(&record); err != nil {
+			log.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	for i := len(records) - 1; i >= 0; i-- {
+		m, err := decodeMessage(records[i])
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		line, err := fmtr(m)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultSegmentSize = 16 << 20
+	defaultQueueSize   = 1 << 30
+	maxRetryInterval   = 30 * time.Second
+)
+
+var errQueueFull = errors.New("queue full")
+
+type queueConfig struct {
+	Dir         string `yaml:"dir"`
+	MaxSize     string `yaml:"max_size"`     // default 1G
+	SegmentSize string `yaml:"segment_size"` // default 16M
+}
+
+type queueCursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// diskQueue is a FIFO of records kept in a directory of segment files.
+// Records are appended to the newest segment and read from the oldest
+// one, which is removed once it has been read completely. The read
+// position is saved in a cursor file, so records not yet acknowledged are
+// delivered again after a restart.
+type diskQueue struct {
+	mu          sync.Mutex
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	segments []uint64 // oldest first, the last one is written to
+	size     int64
+	w        *os.File
+	wsize    int64
+
+	r       *os.File
+	cursor  queueCursor
+	pending int64
+	saved   time.Time
+	notify  chan struct{}
+	reader  chan struct{}
+	refs    int
+}
+
+// queues holds the open queues by directory. After a reload the new
+// outputs share the queues of the old ones.
+var queues = struct {
+	sync.Mutex
+	m map[string]*diskQueue
+}{m: make(map[string]*diskQueue)}
+
+func acquireQueue(c queueConfig) (*diskQueue, error) {
+	queues.Lock()
+	defer queues.Unlock()
+
+	dir := filepath.Clean(c.Dir)
+	q, ok := queues.m[dir]
+	if !ok {
+		var err error
+		if q, err = openDiskQueue(dir, c); err != nil {
+			return nil, err
+		}
+		queues.m[dir] = q
+	}
+	q.refs++
+	return q, nil
+}
+
+func (q *diskQueue) release() error {
+	queues.Lock()
+	defer queues.Unlock()
+
+	if q.refs--; q.refs > 0 {
+		return nil
+	}
+	delete(queues.m, q.dir)
+	return q.Close()
+}
+
+func openDiskQueue(dir string, c queueConfig) (*diskQueue, error) {
+	maxSize, err := parseSize(c.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize == 0 {
+		maxSize = defaultQueueSize
+	}
+	segmentSize, err := parseSize(c.SegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	if segmentSize == 0 {
+		segmentSize = defaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+		notify:      make(chan struct{}, 1),
+		reader:      make(chan struct{}, 1),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *diskQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.seg", id))
+}
+
+func (q *diskQueue) load() error {
+	names, err := filepath.Glob(filepath.Join(q.dir, "*.seg"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64)
+		if err == nil {
+			q.segments = append(q.segments, id)
+		}
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	if data, err := os.ReadFile(filepath.Join(q.dir, "cursor")); err == nil {
+		json.Unmarshal(data, &q.cursor)
+	}
+
+	// Segments before the cursor have been delivered already.
+	for len(q.segments) > 1 && q.segments[0] < q.cursor.Segment {
+		os.Remove(q.segmentPath(q.segments[0]))
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) == 0 || q.segments[0] != q.cursor.Segment {
+		q.cursor = queueCursor{}
+		if len(q.segments) > 0 {
+			q.cursor.Segment = q.segments[0]
+		}
+	}
+
+	for _, id := range q.segments {
+		if fi, err := os.Stat(q.segmentPath(id)); err == nil {
+			q.size += fi.Size()
+		}
+	}
+
+	if len(q.segments) == 0 {
+		return q.roll()
+	}
+	return q.openTail()
+}
+
+// openTail opens the newest segment for appending, cutting off a record
+// left incomplete by a crash.
+func (q *diskQueue) openTail() error {
+	id := q.segments[len(q.segments)-1]
+	f, err := os.OpenFile(q.segmentPath(id), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	var off int64
+	var hdr [4]byte
+	for {
+		if _, err := f.ReadAt(hdr[:], off); err != nil {
+			break
+		}
+		next := off + 4 + int64(binary.BigEndian.Uint32(hdr[:]))
+		if next > fi.Size() {
+			break
+		}
+		off = next
+	}
+	if off < fi.Size() {
+		log.Printf("queue %s: dropping %d bytes of an incomplete record", q.dir, fi.Size()-off)
+		if err := f.Truncate(off); err != nil {
+			f.Close()
+			return err
+		}
+		q.size -= fi.Size() - off
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	q.w, q.wsize = f, off
+	return nil
+}
+
+// roll starts a new segment.
+func (q *diskQueue) roll() error {
+	var id uint64 = 1
+	if n := len(q.segments); n > 0 {
+		id = q.segments[n-1] + 1
+	}
+
+	f, err := os.OpenFile(q.segmentPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if q.w != nil {
+		q.w.Close()
+	}
+	if len(q.segments) == 0 {
+		q.cursor = queueCursor{Segment: id}
+	}
+	q.segments = append(q.segments, id)
+	q.w, q.wsize = f, 0
+	return nil
+}
+
+// Push appends a record, failing when the queue has reached its maximum
+// size.
+func (q *diskQueue) Push(rec []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Records read from the head segment no longer count.
+	n := int64(4 + len(rec))
+	if q.size-q.cursor.Offset+n > q.maxSize {
+		return errQueueFull
+	}
+	if q.wsize > 0 && q.wsize+n > q.segmentSize {
+		if err := q.roll(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 4, n)
+	binary.BigEndian.PutUint32(buf, uint32(len(rec)))
+	if _, err := q.w.Write(append(buf, rec...)); err != nil {
+		return err
+	}
+	q.wsize += n
+	q.size += n
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// backlog returns the size of the records not yet acknowledged.
+func (q *diskQueue) backlog() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size - q.cursor.Offset
+}
+
+// Peek returns the oldest record without removing it, or nil if the
+// queue is empty.
+func (q *diskQueue) Peek() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.r == nil {
+			f, err := os.Open(q.segmentPath(q.cursor.Segment))
+			if err != nil {
+				return nil, err
+			}
+			q.r = f
+		}
+
+		var hdr [4]byte
+		_, err := q.r.ReadAt(hdr[:], q.cursor.Offset)
+		if err == nil {
+			rec := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+			if _, err := q.r.ReadAt(rec, q.cursor.Offset+4); err == nil {
+				q.pending = int64(4 + len(rec))
+				return rec, nil
+			} else if err != io.EOF {
+				return nil, err
+			}
+		} else if err != io.EOF {
+			return nil, err
+		}
+
+		// End of the segment. Unless it is still written to, move on
+		// to the next one.
+		if q.cursor.Segment == q.segments[len(q.segments)-1] {
+			return nil, nil
+		}
+		q.r.Close()
+		q.r = nil
+		q.dropHead()
+	}
+}
+
+func (q *diskQueue) dropHead() {
+	path := q.segmentPath(q.segments[0])
+	if fi, err := os.Stat(path); err == nil {
+		q.size -= fi.Size()
+	}
+	os.Remove(path)
+	q.segments = q.segments[1:]
+	q.cursor = queueCursor{Segment: q.segments[0]}
+	q.saveCursor()
+}
+
+// Ack removes the record returned by the last Peek.
+func (q *diskQueue) Ack() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.cursor.Offset += q.pending
+	q.pending = 0
+	if time.Since(q.saved) >= time.Second {
+		q.saveCursor()
+	}
+}
+
+func (q *diskQueue) saveCursor() {
+	data, _ := json.Marshal(q.cursor)
+	path := filepath.Join(q.dir, "cursor")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		log.Printf("queue %s: %v", q.dir, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Printf("queue %s: %v", q.dir, err)
+		return
+	}
+	q.saved = time.Now()
+}
+
+func (q *diskQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.saveCursor()
+	if q.r != nil {
+		q.r.Close()
+	}
+	return q.w.Close()
+}
+
+// spooledMessage is the queue record of a message.
+type spooledMessage struct {
+	Time           time.Time                    `json:"time"`
+	Source         string                       `json:"source,omitempty"`
+	FromHost       string                       `json:"from_host,omitempty"`
+	Facility       server.Facility              `json:"facility"`
+	Severity       server.Severity              `json:"severity"`
+	Timestamp      time.Time                    `json:"timestamp"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	Tag            string                       `json:"tag,omitempty"`
+	Content        string                       `json:"content,omitempty"`
+	Tag1           string                       `json:"tag1,omitempty"`
+	Content1       string                       `json:"content1,omitempty"`
+	Version        int                          `json:"version,omitempty"`
+	AppName        string                       `json:"app_name,omitempty"`
+	ProcID         string                       `json:"proc_id,omitempty"`
+	MsgID          string                       `json:"msg_id,omitempty"`
+	TraceID        string                       `json:"trace_id,omitempty"`
+	SpanID         string                       `json:"span_id,omitempty"`
+	StructuredData map[string]map[string]string `json:"sd,omitempty"`
+	Raw            string                       `json:"raw,omitempty"`
+}
+
+// spooledAddr stands in for the address of the sender of a message read
+// back from a queue.
+type spooledAddr string
+
+func (a spooledAddr) Network() string { return "spool" }
+func (a spooledAddr) String() string  { return string(a) }
+
+func encodeMessage(m *server.Message) ([]byte, error) {
+	return json.Marshal(spooledMessage{
+		Time:           m.Time,
+		Source:         m.NetSrc(),
+		FromHost:       m.FromHost,
+		Facility:       m.Facility,
+		Severity:       m.Severity,
+		Timestamp:      m.Timestamp,
+		Hostname:       m.Hostname,
+		Tag:            m.Tag,
+		Content:        m.Content,
+		Tag1:           m.Tag1,
+		Content1:       m.Content1,
+		Version:        m.Version,
+		AppName:        m.AppName,
+		ProcID:         m.ProcID,
+		MsgID:          m.MsgID,
+		TraceID:        m.TraceID,
+		SpanID:         m.SpanID,
+		StructuredData: m.StructuredData,
+		Raw:            m.Raw,
+	})
+}
+
+func decodeMessage(data []byte) (*server.Message, error) {
+	var s spooledMessage
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+
+	m := &server.Message{
+		Time:           s.Time,
+		FromHost:       s.FromHost,
+		Facility:       s.Facility,
+		Severity:       s.Severity,
+		Timestamp:      s.Timestamp,
+		Hostname:       s.Hostname,
+		Tag:            s.Tag,
+		Content:        s.Content,
+		Tag1:           s.Tag1,
+		Content1:       s.Content1,
+		Version:        s.Version,
+		AppName:        s.AppName,
+		ProcID:         s.ProcID,
+		MsgID:          s.MsgID,
+		TraceID:        s.TraceID,
+		SpanID:         s.SpanID,
+		StructuredData: s.StructuredData,
+		Raw:            s.Raw,
+	}
+	if s.Source != "" {
+		m.Source = spooledAddr(s.Source)
+	}
+	return m, nil
+}
+
+// queuedOutput decouples an output from the router with a disk queue,
+// retrying delivery with backoff while the output fails.
+type queuedOutput struct {
+	name string
+	out  output
+	q    *diskQueue
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newQueuedOutput(name string, out output, c queueConfig) (*queuedOutput, error) {
+	q, err := acquireQueue(c)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &queuedOutput{
+		name: name,
+		out:  out,
+		q:    q,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go o.run()
+	return o, nil
+}
+
+func (o *queuedOutput) Write(m *server.Message) error {
+	rec, err := encodeMessage(m)
+	if err != nil {
+		return err
+	}
+	return o.q.Push(rec)
+}
+
+func (o *queuedOutput) queuedBytes() int64 {
+	return o.q.backlog()
+}
+
+// check reports a queue that is almost full, as further messages would
+// soon be refused.
+func (o *queuedOutput) check() error {
+	if o.q.backlog() > o.q.maxSize/10*9 {
+		return fmt.Errorf("queue %s is almost full", o.q.dir)
+	}
+	return nil
+}
+
+func (o *queuedOutput) run() {
+	defer close(o.done)
+
+	// Wait for the output replaced on reload to stop reading.
+	select {
+	case o.q.reader <- struct{}{}:
+		defer func() { <-o.q.reader }()
+	case <-o.stop:
+		return
+	}
+
+	// A forward output signals a target up again to replay at once.
+	var recovered <-chan struct{}
+	if r, ok := o.out.(interface{ recoveredC() <-chan struct{} }); ok {
+		recovered = r.recoveredC()
+	}
+
+	retry := time.Second
+	for {
+		rec, err := o.q.Peek()
+		if err != nil {
+			log.Printf("output %s: queue: %v", o.name, err)
+		} else if rec == nil {
+			select {
+			case <-o.q.notify:
+				continue
+			case <-o.stop:
+				return
+			}
+		} else {
+			m, err := decodeMessage(rec)
+			if err != nil {
+				log.Printf("output %s: dropping queued message: %v", o.name, err)
+				outputDropped.inc(o.name)
+				o.q.Ack()
+				continue
+			}
+			if err = o.out.Write(m); err == nil {
+				o.q.Ack()
+				retry = time.Second
+				continue
+			}
+			log.Printf("output %s: %v, retrying in %v", o.name, err, retry)
+		}
+
+		select {
+		case <-time.After(retry):
+			retry = min(2*retry, maxRetryInterval)
+		case <-recovered:
+			retry = time.Second
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+func (o *queuedOutput) Close() error {
+	close(o.stop)
+	<-o.done
+	if err := o.q.release(); err != nil {
+		log.Printf("output %s: queue: %v", o.name, err)
+	}
+	return o.out.Close()
+}
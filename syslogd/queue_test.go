@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testRecords returns n records of 8 bytes, 12 with their length in a
+// segment.
+func testRecords(n int) []string {
+	var recs []string
+	for i := 0; i < n; i++ {
+		recs = append(recs, fmt.Sprintf("record-%d", i))
+	}
+	return recs
+}
+
+func openTestQueue(t *testing.T, dir string, c queueConfig) *diskQueue {
+	t.Helper()
+	if c.SegmentSize == "" {
+		c.SegmentSize = "32"
+	}
+	q, err := openDiskQueue(dir, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func pushRecords(t *testing.T, q *diskQueue, recs []string) {
+	t.Helper()
+	for _, rec := range recs {
+		if err := q.Push([]byte(rec)); err != nil {
+			t.Fatalf("push %s: %v", rec, err)
+		}
+	}
+}
+
+// readQueue reads and acknowledges the records of q until it is empty.
+func readQueue(t *testing.T, q *diskQueue) []string {
+	t.Helper()
+	var recs []string
+	for {
+		rec, err := q.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec == nil {
+			return recs
+		}
+		recs = append(recs, string(rec))
+		q.Ack()
+	}
+}
+
+// crash closes the files of q without saving its cursor.
+func crash(q *diskQueue) {
+	if q.r != nil {
+		q.r.Close()
+	}
+	q.w.Close()
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	return names
+}
+
+func TestDiskQueueOrder(t *testing.T) {
+	dir := t.TempDir()
+	q := openTestQueue(t, dir, queueConfig{})
+	defer q.Close()
+
+	recs := testRecords(5)
+	pushRecords(t, q, recs)
+	if got := segmentFiles(t, dir); len(got) != 3 {
+		t.Fatalf("segments = %v, want 3 of 2 records", got)
+	}
+	if got := q.backlog(); got != 5*12 {
+		t.Errorf("backlog = %d, want %d", got, 5*12)
+	}
+
+	if got := readQueue(t, q); !reflect.DeepEqual(got, recs) {
+		t.Fatalf("read %q, want %q", got, recs)
+	}
+	if got := q.backlog(); got != 0 {
+		t.Errorf("backlog = %d after reading all, want 0", got)
+	}
+	// The segments read are removed, the last one is still written to.
+	if got, want := segmentFiles(t, dir), []string{fmt.Sprintf("%020d.seg", 3)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("segments = %v, want %v", got, want)
+	}
+
+	more := []string{"record-5", "record-6"}
+	pushRecords(t, q, more)
+	if got := readQueue(t, q); !reflect.DeepEqual(got, more) {
+		t.Errorf("read %q, want %q", got, more)
+	}
+}
+
+func TestDiskQueueReopen(t *testing.T) {
+	dir := t.TempDir()
+	recs := testRecords(5)
+	q := openTestQueue(t, dir, queueConfig{})
+	pushRecords(t, q, recs)
+	for i := 0; i < 3; i++ {
+		if _, err := q.Peek(); err != nil {
+			t.Fatal(err)
+		}
+		q.Ack()
+	}
+	// Read but not acknowledged.
+	if rec, err := q.Peek(); err != nil || string(rec) != recs[3] {
+		t.Fatalf("peek = %q, %v, want %s", rec, err, recs[3])
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openTestQueue(t, dir, queueConfig{})
+	defer q.Close()
+	if got := q.backlog(); got != 2*12 {
+		t.Errorf("backlog = %d after reopening, want %d", got, 2*12)
+	}
+	if got := readQueue(t, q); !reflect.DeepEqual(got, recs[3:]) {
+		t.Errorf("read %q after reopening, want %q", got, recs[3:])
+	}
+}
+
+func TestDiskQueueCrash(t *testing.T) {
+	dir := t.TempDir()
+	recs := testRecords(4)
+	q := openTestQueue(t, dir, queueConfig{})
+	pushRecords(t, q, recs)
+
+	// The first acknowledgement is saved, the second is not yet when
+	// the process dies.
+	q.Peek()
+	q.Ack()
+	q.saved = time.Now()
+	q.Peek()
+	q.Ack()
+	crash(q)
+
+	q = openTestQueue(t, dir, queueConfig{})
+	defer q.Close()
+	if got := readQueue(t, q); !reflect.DeepEqual(got, recs[1:]) {
+		t.Errorf("read %q after a crash, want %q delivered again from the saved cursor", got, recs[1:])
+	}
+}
+
+func TestDiskQueueTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	recs := testRecords(3)
+	q := openTestQueue(t, dir, queueConfig{SegmentSize: "1K"})
+	pushRecords(t, q, recs[:2])
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record of 100 bytes cut off after 2 of them.
+	seg := filepath.Join(dir, fmt.Sprintf("%020d.seg", 1))
+	f, err := os.OpenFile(seg, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 100, 'x', 'y'})
+	f.Close()
+
+	q = openTestQueue(t, dir, queueConfig{SegmentSize: "1K"})
+	defer q.Close()
+	if got := q.backlog(); got != 2*12 {
+		t.Errorf("backlog = %d, want the incomplete record dropped, %d", got, 2*12)
+	}
+	pushRecords(t, q, recs[2:])
+	if got := readQueue(t, q); !reflect.DeepEqual(got, recs) {
+		t.Errorf("read %q, want %q", got, recs)
+	}
+	if fi, err := os.Stat(seg); err != nil {
+		t.Error(err)
+	} else if fi.Size() != 3*12 {
+		t.Errorf("segment of %d bytes, want %d", fi.Size(), 3*12)
+	}
+}
+
+func TestDiskQueueCursor(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+		want   []string
+	}{
+		{"missing", "", testRecords(5)},
+		{"corrupt", "{garbage", testRecords(5)},
+		{"start of a later segment", `{"segment":2,"offset":0}`, testRecords(5)[2:]},
+		{"within a segment", `{"segment":2,"offset":12}`, testRecords(5)[3:]},
+		{"unknown segment", `{"segment":0,"offset":12}`, testRecords(5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			q := openTestQueue(t, dir, queueConfig{})
+			pushRecords(t, q, testRecords(5))
+			crash(q)
+
+			path := filepath.Join(dir, "cursor")
+			if tt.cursor != "" {
+				if err := os.WriteFile(path, []byte(tt.cursor), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			q = openTestQueue(t, dir, queueConfig{})
+			if got := readQueue(t, q); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+			if err := q.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var c queueCursor
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(data, &c); err != nil {
+				t.Fatal(err)
+			}
+			if want := (queueCursor{Segment: 3, Offset: 12}); c != want {
+				t.Errorf("cursor saved = %+v, want %+v", c, want)
+			}
+		})
+	}
+}
+
+func TestDiskQueueFull(t *testing.T) {
+	q := openTestQueue(t, t.TempDir(), queueConfig{MaxSize: "30"})
+	defer q.Close()
+
+	recs := testRecords(4)
+	pushRecords(t, q, recs[:2])
+	if err := q.Push([]byte(recs[2])); err != errQueueFull {
+		t.Fatalf("push beyond max_size: %v, want %v", err, errQueueFull)
+	}
+	// Acknowledged records make room, before their segment is removed.
+	q.Peek()
+	q.Ack()
+	pushRecords(t, q, recs[2:3])
+	if got := readQueue(t, q); !reflect.DeepEqual(got, recs[1:3]) {
+		t.Errorf("read %q, want %q", got, recs[1:3])
+	}
+}
+
+func TestAcquireQueue(t *testing.T) {
+	dir := t.TempDir()
+	c := queueConfig{Dir: dir + "/"}
+	q1, err := acquireQueue(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q2, err := acquireQueue(queueConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q1 != q2 {
+		t.Fatal("the outputs of a directory do not share its queue")
+	}
+	pushRecords(t, q1, testRecords(1))
+
+	if err := q1.release(); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := q2.Peek(); err != nil || string(rec) != "record-0" {
+		t.Fatalf("peek after the first release = %q, %v", rec, err)
+	}
+	if err := q2.release(); err != nil {
+		t.Fatal(err)
+	}
+
+	q3, err := acquireQueue(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q3.release()
+	if q3 == q1 {
+		t.Error("the queue was not closed by its last release")
+	}
+	if got := readQueue(t, q3); !reflect.DeepEqual(got, testRecords(1)) {
+		t.Errorf("read %q after reopening, want %q", got, testRecords(1))
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	quotaDrop   = "drop"
+	quotaSample = "sample"
+	quotaAlert  = "alert"
+
+	quotaSDID          = "quota@32473"
+	defaultQuotaSample = 100
+	maxQuotaKeys       = 10000
+)
+
+// quotaConfig limits the messages and bytes, as received, of every tenant
+// or sending host in an hour or a day:
+//
+//	quotas:
+//	  - by: tenant
+//	    bytes: 50G
+//	  - name: acme-hosts
+//	    by: host
+//	    if: tenant=acme
+//	    messages: 1000000
+//	    period: hourly
+//	    action: sample
+//
+// Over the quota, messages are dropped, sampled, or with alert kept and
+// marked with the params name and key of quota@32473 for alerts to match.
+type quotaConfig struct {
+	Name     string `yaml:"name"`     // default the value of by
+	By       string `yaml:"by"`       // tenant or host
+	If       string `yaml:"if"`       // match expression, every message by default
+	Messages int64  `yaml:"messages"` // per period, 0 for no limit
+	Bytes    string `yaml:"bytes"`    // per period, e.g. 10G
+	Period   string `yaml:"period"`   // hourly or daily (default)
+	Action   string `yaml:"action"`   // drop (default), sample or alert
+	Sample   int    `yaml:"sample"`   // keep 1 in this many messages over the quota with sample, default 100
+}
+
+type quota struct {
+	quotaConfig
+	match matcher
+	bytes int64
+}
+
+// usage is what a tenant or host used of a quota in the current period.
+type usage struct {
+	period   string
+	start    time.Time
+	messages int64
+	bytes    int64
+	over     int64 // messages over the quota
+}
+
+// quotas is a server.Handler enforcing quotas.
+type quotas struct {
+	mu     sync.Mutex
+	quotas []*quota
+	usage  map[[2]string]*usage // by quota name and key
+}
+
+var quotaExceeded = newCounterVec("syslogd_quota_exceeded_total",
+	"Messages over a quota by quota and action.", "quota", "action")
+
+func newQuotas() *quotas {
+	q := &quotas{usage: make(map[[2]string]*usage)}
+	newMetricFunc("syslogd_quota_messages", "Messages counted against a quota in the current period.", "gauge",
+		func() []sample { return q.collect(func(u *usage) int64 { return u.messages }) }, "quota", "key")
+	newMetricFunc("syslogd_quota_bytes", "Bytes counted against a quota in the current period.", "gauge",
+		func() []sample { return q.collect(func(u *usage) int64 { return u.bytes }) }, "quota", "key")
+	return q
+}
+
+// Set replaces the quotas, keeping the usage of those still named alike.
+func (q *quotas) Set(configs []quotaConfig) error {
+	var quotas []*quota
+	names := make(map[string]bool)
+	for i, c := range configs {
+		qt := &quota{quotaConfig: c}
+		at := func(err error, keys ...string) error {
+			return atKeys(err, append([]string{"quotas", strconv.Itoa(i)}, keys...)...)
+		}
+		var err error
+		switch c.By {
+		case "tenant", "host":
+		default:
+			return at(fmt.Errorf("quota %d: by must be tenant or host", i+1), "by")
+		}
+		if qt.Name == "" {
+			qt.Name = c.By
+		}
+		if names[qt.Name] {
+			return at(fmt.Errorf("quota %s: defined twice", qt.Name))
+		}
+		names[qt.Name] = true
+		if qt.match, err = parseMatch(c.If); err != nil {
+			return at(fmt.Errorf("quota %s: %v", qt.Name, err), "if")
+		}
+		if qt.bytes, err = parseSize(c.Bytes); err != nil {
+			return at(fmt.Errorf("quota %s: %v", qt.Name, err), "bytes")
+		}
+		switch qt.Period {
+		case "":
+			qt.Period = "daily"
+		case "hourly", "daily":
+		default:
+			return at(fmt.Errorf("quota %s: invalid period %q: want hourly or daily", qt.Name, c.Period), "period")
+		}
+		switch qt.Action {
+		case "":
+			qt.Action = quotaDrop
+		case quotaDrop, quotaSample, quotaAlert:
+		default:
+			return at(fmt.Errorf("quota %s: unknown action %q", qt.Name, c.Action), "action")
+		}
+		if qt.Sample <= 0 {
+			qt.Sample = defaultQuotaSample
+		}
+		quotas = append(quotas, qt)
+	}
+
+	q.mu.Lock()
+	q.quotas = quotas
+	for key := range q.usage {
+		if !names[key[0]] {
+			delete(q.usage, key)
+		}
+	}
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *quotas) Handle(m *server.Message) *server.Message {
+	if m == nil {
+		return nil
+	}
+	delete(m.StructuredData, quotaSDID)
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, qt := range q.quotas {
+		if !qt.match(m) {
+			continue
+		}
+		key := hostname(m)
+		if qt.By == "tenant" {
+			if key = tenant(m); key == "" {
+				continue
+			}
+		}
+
+		u := q.usage[[2]string{qt.Name, key}]
+		start := periodStart(now, qt.Period)
+		if u == nil && len(q.usage) >= maxQuotaKeys {
+			q.prune(now)
+		}
+		switch {
+		case u == nil && len(q.usage) >= maxQuotaKeys:
+			continue
+		case u == nil:
+			u = &usage{period: qt.Period, start: start}
+			q.usage[[2]string{qt.Name, key}] = u
+		case !u.start.Equal(start):
+			*u = usage{period: qt.Period, start: start}
+		}
+		u.messages++
+		u.bytes += int64(len(m.Raw))
+		if (qt.Messages <= 0 || u.messages <= qt.Messages) && (qt.bytes <= 0 || u.bytes <= qt.bytes) {
+			continue
+		}
+
+		if u.over == 0 {
+			log.Printf("quota %s: %s over its %s quota, %s", qt.Name, key, qt.Period, qt.Action)
+		}
+		u.over++
+		quotaExceeded.inc(qt.Name, qt.Action)
+		switch qt.Action {
+		case quotaDrop:
+			return nil
+		case quotaSample:
+			if u.over%int64(qt.Sample) != 1 && qt.Sample > 1 {
+				return nil
+			}
+		case quotaAlert:
+			if m.StructuredData == nil {
+				m.StructuredData = make(map[string]map[string]string)
+			}
+			m.StructuredData[quotaSDID] = map[string]string{"name": qt.Name, "key": key}
+		}
+	}
+	return m
+}
+
+// prune forgets the usage of past periods.
+func (q *quotas) prune(now time.Time) {
+	for key, u := range q.usage {
+		if !u.start.Equal(periodStart(now, u.period)) {
+			delete(q.usage, key)
+		}
+	}
+}
+
+func (q *quotas) collect(value func(*usage) int64) []sample {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune(time.Now())
+	keys := make([][2]string, 0, len(q.usage))
+	for key := range q.usage {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	samples := make([]sample, len(keys))
+	for i, key := range keys {
+		samples[i] = sample{[]string{key[0], key[1]}, float64(value(q.usage[key]))}
+	}
+	return samples
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	rateDrop   = "drop"
+	rateTarpit = "tarpit"
+
+	maxTarpit       = 10 * time.Second
+	rateLogInterval = time.Minute
+)
+
+type rateLimitConfig struct {
+	Rate   float64 `yaml:"rate"`   // messages per second and source IP
+	Burst  *int    `yaml:"burst"`  // default rate rounded up, at least 1
+	Action string  `yaml:"action"` // drop (default) or tarpit
+
+	burst int
+}
+
+func (c rateLimitConfig) validate() error {
+	var errs []error
+	switch c.Action {
+	case "", rateDrop, rateTarpit:
+	default:
+		errs = append(errs, atKeys(fmt.Errorf("rate_limit: unknown action %q", c.Action), "action"))
+	}
+	if c.Rate < 0 {
+		errs = append(errs, atKeys(fmt.Errorf("rate_limit: negative rate"), "rate"))
+	}
+	if c.Burst != nil && *c.Burst < 1 {
+		errs = append(errs, atKeys(fmt.Errorf("rate_limit: burst %d is below 1", *c.Burst), "burst"))
+	}
+	return errors.Join(errs...)
+}
+
+// rateLimiter is a server.Handler limiting the messages of every source
+// IP with a token bucket. Messages over the limit are dropped, or with the
+// tarpit action passed on while the connection of the sender stops being
+// read from until its bucket has paid back the tokens taken in advance,
+// see Pace. Datagrams cannot be held back without holding back every
+// other sender on the socket, so they are always dropped.
+type rateLimiter struct {
+	config atomic.Pointer[rateLimitConfig]
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	logged  time.Time
+	limited uint64
+}
+
+var rateLimited = newCounterVec("syslogd_rate_limited_total",
+	"Messages over the per source rate limit by action.", "action")
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*bucket)}
+}
+
+// Set replaces the limit, a zero rate disables it.
+func (l *rateLimiter) Set(c rateLimitConfig) {
+	c.burst = max(1, int(math.Ceil(c.Rate)))
+	if c.Burst != nil {
+		c.burst = *c.Burst
+	}
+	if c.Action == "" {
+		c.Action = rateDrop
+	}
+	l.config.Store(&c)
+}
+
+func (l *rateLimiter) Handle(m *server.Message) *server.Message {
+	c := l.config.Load()
+	if m == nil || c == nil || c.Rate <= 0 {
+		return m
+	}
+
+	tarpit := c.Action == rateTarpit && isStream(m.Source)
+	delay := l.take(m.NetSrc(), c, tarpit, time.Now())
+	if delay == 0 {
+		return m
+	}
+	if tarpit && delay <= maxTarpit {
+		rateLimited.inc(rateTarpit)
+		return m
+	}
+	rateLimited.inc(rateDrop)
+	return nil
+}
+
+// Pace returns how long the connection from src is to be held back with
+// the tarpit action, for the tokens its messages took in advance. It is
+// the pacer of the server, so that the delay falls on the reading of that
+// connection rather than on the goroutine handling the message, a parse
+// worker shared by every sender.
+func (l *rateLimiter) Pace(src net.Addr) time.Duration {
+	c := l.config.Load()
+	if c == nil || c.Rate <= 0 || c.Action != rateTarpit || !isStream(src) {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[(&server.Message{Source: src}).NetSrc()]
+	if !ok {
+		return 0
+	}
+	tokens := b.tokens + time.Since(b.last).Seconds()*c.Rate
+	if tokens >= 0 {
+		return 0
+	}
+	return min(time.Duration(-tokens/c.Rate*float64(time.Second)), maxTarpit)
+}
+
+// take takes a token from the bucket of src, and returns how long it
+// takes for the next one to be available if there is none left. A
+// reserved token is taken even if it is not available yet.
+func (l *rateLimiter) take(src string, c *rateLimitConfig, reserve bool, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(c, now)
+	b, ok := l.buckets[src]
+	if !ok {
+		b = &bucket{tokens: float64(c.burst), last: now}
+		l.buckets[src] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*c.Rate, float64(c.burst))
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	delay := time.Duration((1 - b.tokens) / c.Rate * float64(time.Second))
+	if reserve && delay <= maxTarpit {
+		b.tokens--
+	}
+	b.limited++
+	if now.Sub(b.logged) >= rateLogInterval {
+		log.Printf("rate limit: %s exceeds %g messages/s, %d limited", src, c.Rate, b.limited)
+		b.logged = now
+		b.limited = 0
+	}
+	return max(delay, time.Nanosecond)
+}
+
+// prune forgets the sources whose bucket has filled up again.
+func (l *rateLimiter) prune(c *rateLimitConfig, now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for src, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*c.Rate >= float64(c.burst) {
+			delete(l.buckets, src)
+		}
+	}
+}
+
+func isStream(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return true
+	case *net.UnixAddr:
+		return a.Net == "unix"
+	}
+	return false
+}
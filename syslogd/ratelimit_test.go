@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+func TestRateLimiterTarpit(t *testing.T) {
+	burst := 1
+	l := newRateLimiter()
+	l.Set(rateLimitConfig{Rate: 10, Burst: &burst, Action: rateTarpit})
+
+	tcp := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 5000}
+	if d := l.Pace(tcp); d != 0 {
+		t.Fatalf("pace of a new sender = %v, want 0", d)
+	}
+
+	// Over the limit, the messages of a stream pass but its reading is
+	// held back for the tokens taken in advance.
+	for i := 0; i < 3; i++ {
+		if l.Handle(&server.Message{Source: tcp}) == nil {
+			t.Fatalf("message %d of a stream dropped", i)
+		}
+	}
+	if d := l.Pace(tcp); d < 150*time.Millisecond || d > 200*time.Millisecond {
+		t.Errorf("pace = %v, want about 200ms for 2 tokens at 10/s", d)
+	}
+	if d := l.Pace(&net.TCPAddr{IP: net.ParseIP("192.0.2.3")}); d != 0 {
+		t.Errorf("pace of another sender = %v, want 0", d)
+	}
+
+	// Datagrams cannot be held back.
+	if l.Handle(&server.Message{Source: udp}) == nil {
+		t.Fatal("first datagram dropped")
+	}
+	if l.Handle(&server.Message{Source: udp}) != nil {
+		t.Error("datagram over the limit passed")
+	}
+	if d := l.Pace(udp); d != 0 {
+		t.Errorf("pace of a datagram sender = %v, want 0", d)
+	}
+
+	l.Set(rateLimitConfig{Rate: 10, Burst: &burst})
+	if d := l.Pace(tcp); d != 0 {
+		t.Errorf("pace with the drop action = %v, want 0", d)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+type redactConfig struct {
+	Pattern     string `yaml:"pattern"`     // ipv4, ipv6, email, credit_card or a regex
+	Action      string `yaml:"action"`      // mask (default) or hash
+	Replacement string `yaml:"replacement"` // of mask, [PATTERN] by default
+}
+
+// redactPatterns are the patterns known by name.
+var redactPatterns = map[string]string{
+	"ipv4":        `\b(?:(?:25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])\b`,
+	"ipv6":        `\b(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}\b|\b(?:[0-9A-Fa-f]{1,4}:){1,7}:(?:[0-9A-Fa-f]{1,4}(?::[0-9A-Fa-f]{1,4}){0,6})?\b`,
+	"email":       `\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`,
+	"credit_card": `\b[0-9](?:[ -]?[0-9]){12,18}\b`,
+}
+
+type redaction struct {
+	re      *regexp.Regexp
+	replace func(string) string
+}
+
+// redactor masks or hashes the personal data of messages: in the content,
+// the raw message and the structured data parameters. Hashes are keyed, so
+// that the data cannot be found by hashing guesses, but stay the same for
+// the same data so that messages can still be correlated.
+type redactor struct {
+	redactions []redaction
+}
+
+func newRedactor(configs []redactConfig, key string) (*redactor, error) {
+	r := &redactor{}
+	for i, c := range configs {
+		expr, ok := redactPatterns[c.Pattern]
+		if !ok {
+			expr = c.Pattern
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, atKeys(fmt.Errorf("redact %q: %v", c.Pattern, err), strconv.Itoa(i), "pattern")
+		}
+
+		var replace func(string) string
+		switch c.Action {
+		case "", "mask":
+			repl := c.Replacement
+			if repl == "" && ok {
+				repl = "[" + c.Pattern + "]"
+			} else if repl == "" {
+				repl = "[redacted]"
+			}
+			replace = func(string) string { return repl }
+		case "hash":
+			if key == "" {
+				return nil, atKeys(fmt.Errorf("redact %q: hash requires a redact_key", c.Pattern), strconv.Itoa(i), "action")
+			}
+			replace = func(s string) string {
+				mac := hmac.New(sha256.New, []byte(key))
+				mac.Write([]byte(s))
+				return "hash:" + hex.EncodeToString(mac.Sum(nil)[:8])
+			}
+		default:
+			return nil, atKeys(fmt.Errorf("redact %q: unknown action %q", c.Pattern, c.Action), strconv.Itoa(i), "action")
+		}
+		if c.Pattern == "credit_card" {
+			mask := replace
+			replace = func(s string) string {
+				if !luhn(s) {
+					return s
+				}
+				return mask(s)
+			}
+		}
+		r.redactions = append(r.redactions, redaction{re, replace})
+	}
+	return r, nil
+}
+
+func (r *redactor) enabled() bool {
+	return r != nil && len(r.redactions) > 0
+}
+
+func (r *redactor) redact(s string) string {
+	for _, rd := range r.redactions {
+		s = rd.re.ReplaceAllStringFunc(s, rd.replace)
+	}
+	return s
+}
+
+// apply returns a copy of m redacted, in every field that outputs, alerts
+// and the API may show: the header and the sender as well as the content.
+func (r *redactor) apply(m *server.Message) *server.Message {
+	c := *m
+	c.FromHost = r.redact(m.FromHost)
+	c.Hostname = r.redact(m.Hostname)
+	c.Tag = r.redact(m.Tag)
+	c.Tag1 = r.redact(m.Tag1)
+	c.AppName = r.redact(m.AppName)
+	c.ProcID = r.redact(m.ProcID)
+	c.MsgID = r.redact(m.MsgID)
+	c.Content = r.redact(m.Content)
+	c.Content1 = r.redact(m.Content1)
+	c.Raw = r.redact(m.Raw)
+	if src := m.NetSrc(); src != "" {
+		if s := r.redact(src); s != src {
+			c.Source = redactedAddr{m.Source.Network(), s}
+		}
+	}
+	if len(m.StructuredData) > 0 {
+		c.StructuredData = make(map[string]map[string]string, len(m.StructuredData))
+		for id, params := range m.StructuredData {
+			p := make(map[string]string, len(params))
+			for name, v := range params {
+				p[name] = r.redact(v)
+			}
+			c.StructuredData[id] = p
+		}
+	}
+	if m.Peer != nil {
+		p := &server.Peer{CommonName: r.redact(m.Peer.CommonName)}
+		for _, san := range m.Peer.SANs {
+			p.SANs = append(p.SANs, r.redact(san))
+		}
+		c.Peer = p
+	}
+	return &c
+}
+
+// redactedAddr stands for the address of a sender once redacted.
+type redactedAddr struct {
+	network, addr string
+}
+
+func (a redactedAddr) Network() string { return a.network }
+func (a redactedAddr) String() string  { return a.addr }
+
+// luhn tells whether the digits of s pass the check of card numbers.
+func luhn(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		d := int(s[i] - '0')
+		if d < 0 || d > 9 {
+			continue
+		}
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
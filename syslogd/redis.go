@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultRedisPort   = "6379"
+	defaultRedisStream = "syslog"
+	redisTimeout       = 10 * time.Second
+)
+
+type streamField struct {
+	name string
+	get  func(*server.Message) string
+}
+
+// redisOutput appends messages to Redis streams with XADD, pipelined by
+// batch, as entries of a message field with the formatted message and of
+// the fields configured. The stream name is expanded from %NAME%
+// properties as file paths are, and with max_len every XADD trims its
+// stream to about that many entries, Redis keeping whole macro nodes.
+type redisOutput struct {
+	*batchOutput
+	name     string
+	addr     string
+	tls      *tls.Config
+	username string
+	password string
+	db       int
+	stream   string
+	maxLen   int64
+	format   formatter
+	fields   []streamField
+
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// newRedisOutput appends to url, redis://[[user]:password@]host[:port][/db]
+// or rediss://... for TLS.
+func newRedisOutput(name string, c outputConfig, format formatter) (*redisOutput, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid redis url %q: want redis://host[:port][/db] or rediss://host[:port][/db]", c.URL)
+	}
+	if c.MaxLen < 0 {
+		return nil, fmt.Errorf("invalid max_len %d", c.MaxLen)
+	}
+	o := &redisOutput{
+		name:   name,
+		addr:   u.Host,
+		stream: c.Stream,
+		maxLen: c.MaxLen,
+		format: format,
+	}
+	if u.Port() == "" {
+		o.addr = net.JoinHostPort(u.Hostname(), defaultRedisPort)
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if o.db, err = strconv.Atoi(db); err != nil || o.db < 0 {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	if o.stream == "" {
+		o.stream = defaultRedisStream
+	}
+	for _, p := range pathProperty.FindAllString(o.stream, -1) {
+		if _, ok := pathProperties[strings.Trim(p, "%")]; !ok {
+			return nil, fmt.Errorf("unknown property %s in stream %s", p, o.stream)
+		}
+	}
+	for name, prop := range c.Fields {
+		if name == "message" {
+			return nil, errors.New("field message is the formatted message")
+		}
+		get, ok := labelFields[prop]
+		if !ok {
+			get, ok = messageFields[prop]
+		}
+		if strings.HasPrefix(prop, "sd.") {
+			get, ok = sdParam(prop[3:])
+		}
+		if !ok {
+			return nil, fmt.Errorf("field %s: unknown property %s", name, prop)
+		}
+		o.fields = append(o.fields, streamField{name, get})
+	}
+	sort.Slice(o.fields, func(i, j int) bool { return o.fields[i].name < o.fields[j].name })
+
+	o.username, o.password = c.Username, c.Password
+	if o.password == "" && u.User != nil {
+		o.username = u.User.Username()
+		o.password, _ = u.User.Password()
+	}
+	if u.Scheme == "rediss" || c.TLS {
+		if o.tls, err = newClientTLSConfig(c); err != nil {
+			return nil, err
+		}
+		o.tls.ServerName = u.Hostname()
+	}
+
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	return o, nil
+}
+
+// streamOf returns the stream of m.
+func (o *redisOutput) streamOf(m *server.Message) string {
+	return pathProperty.ReplaceAllStringFunc(o.stream, func(p string) string {
+		if s := pathProperties[strings.Trim(p, "%")](m); s != "" {
+			return s
+		}
+		return "unknown"
+	})
+}
+
+// dial connects to the server, authenticating and selecting the database
+// if need be.
+func (o *redisOutput) dial() error {
+	conn, err := net.DialTimeout("tcp", o.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	if o.tls != nil {
+		tc := tls.Client(conn, o.tls)
+		tc.SetDeadline(time.Now().Add(redisTimeout))
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tc
+	}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	o.conn, o.r, o.w = conn, bufio.NewReader(conn), bufio.NewWriter(conn)
+
+	var commands [][]string
+	switch {
+	case o.username != "" && o.password != "":
+		commands = append(commands, []string{"AUTH", o.username, o.password})
+	case o.password != "":
+		commands = append(commands, []string{"AUTH", o.password})
+	}
+	if o.db != 0 {
+		commands = append(commands, []string{"SELECT", strconv.Itoa(o.db)})
+	}
+	for _, args := range commands {
+		redisWriteCommand(o.w, args)
+	}
+	if err := o.w.Flush(); err != nil {
+		o.close()
+		return err
+	}
+	for range commands {
+		if err := redisReadReply(o.r); err != nil {
+			o.close()
+			return err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+func (o *redisOutput) send(batch []*server.Message) error {
+	if o.conn == nil {
+		if err := o.dial(); err != nil {
+			return err
+		}
+	}
+	o.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	// The XADDs are pipelined, then their replies are read in order.
+	var sent []*server.Message
+	args := make([]string, 0, 8+2*len(o.fields))
+	for _, m := range batch {
+		payload, err := o.format(m)
+		if err != nil {
+			log.Printf("output %s: %v", o.name, err)
+			continue
+		}
+		args = append(args[:0], "XADD", o.streamOf(m))
+		if o.maxLen > 0 {
+			args = append(args, "MAXLEN", "~", strconv.FormatInt(o.maxLen, 10))
+		}
+		args = append(args, "*", "message", payload)
+		for _, f := range o.fields {
+			args = append(args, f.name, f.get(m))
+		}
+		redisWriteCommand(o.w, args)
+		sent = append(sent, m)
+	}
+	if err := o.w.Flush(); err != nil {
+		o.close()
+		return err
+	}
+
+	var failed []*server.Message
+	var reason error
+	for i, m := range sent {
+		err := redisReadReply(o.r)
+		var rerr redisError
+		if errors.As(err, &rerr) {
+			failed, reason = append(failed, m), err
+			continue
+		}
+		if err != nil {
+			o.close()
+			return unackedError(nil, append(failed, sent[i:]...), err)
+		}
+	}
+	if len(failed) > 0 {
+		return unackedError(nil, failed, reason)
+	}
+	return nil
+}
+
+func redisWriteCommand(w *bufio.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+// redisReadReply reads a reply, returning a redisError for an error reply.
+func redisReadReply(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return errors.New("empty redis reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return fmt.Errorf("invalid redis bulk string %q", line)
+		}
+		if n < 0 {
+			return nil
+		}
+		_, err = io.CopyN(io.Discard, r, int64(n)+2)
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return fmt.Errorf("invalid redis array %q", line)
+		}
+		for ; n > 0; n-- {
+			if err := redisReadReply(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid redis reply %q", line)
+}
+
+func (o *redisOutput) close() {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+}
+
+func (o *redisOutput) Close() error {
+	err := o.batchOutput.Close()
+	o.close()
+	return err
+}
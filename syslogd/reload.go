@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// reloadableTLS serves the most recently loaded certificates to new TLS
+// connections, so they can be replaced without closing the listeners, or
+// those ACME issued.
+type reloadableTLS struct {
+	config atomic.Pointer[tls.Config]
+	acme   *acmeManager
+}
+
+func (r *reloadableTLS) Load(files tlsFiles) error {
+	config, err := loadServerTLSConfig(files, r.acme)
+	if err != nil {
+		return err
+	}
+	r.config.Store(config)
+	return nil
+}
+
+func (r *reloadableTLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if r.acme != nil {
+				if c := r.acme.challengeConfig(hello); c != nil {
+					return c, nil
+				}
+			}
+			return r.config.Load(), nil
+		},
+	}
+}
+
+// watchFile reports on the returned channel when the modification time or
+// size of path changes.
+func watchFile(path string, interval time.Duration) <-chan struct{} {
+	return watchFiles([]string{path}, interval)
+}
+
+// watchFiles is watchFile for any of paths.
+func watchFiles(paths []string, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	go func() {
+		last := make([]os.FileInfo, len(paths))
+		for i, path := range paths {
+			if fi, err := os.Stat(path); err == nil {
+				last[i] = fi
+			}
+		}
+
+		for range time.Tick(interval) {
+			for i, path := range paths {
+				fi, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+				if last[i] != nil && fi.ModTime().Equal(last[i].ModTime()) && fi.Size() == last[i].Size() {
+					continue
+				}
+				last[i] = fi
+
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed
+}
+
+// paths returns the files of f to watch for changes.
+func (f tlsFiles) paths() []string {
+	var paths []string
+	for _, p := range []string{f.Cert, f.Key, f.CA, f.CRL} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
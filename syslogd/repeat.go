@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// repeatFilter holds back the messages a host and program repeat within
+// window after the first one, to send a single "last message repeated N
+// times" in their place once another message arrives or the window ends.
+type repeatFilter struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	last map[string]*repeated
+}
+
+type repeated struct {
+	m     *server.Message
+	since time.Time
+	count int
+}
+
+func newRepeatFilter(window time.Duration) *repeatFilter {
+	return &repeatFilter{window: window, last: make(map[string]*repeated)}
+}
+
+// filter returns the summary to send before m, if any, and whether m is to
+// be sent.
+func (f *repeatFilter) filter(m *server.Message, now time.Time) (*server.Message, bool) {
+	key := m.Hostname + "\x00" + m.NetSrc() + "\x00" + program(m)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.last[key]
+	if ok && now.Sub(r.since) < f.window && r.m.Content == m.Content &&
+		r.m.Facility == m.Facility && r.m.Severity == m.Severity {
+		r.count++
+		return nil, false
+	}
+
+	var summary *server.Message
+	if ok {
+		summary = r.summary(now)
+	}
+	f.last[key] = &repeated{m: m, since: now}
+	return summary, true
+}
+
+// expire returns the summaries of the windows that ended, or of all of
+// them if all is set.
+func (f *repeatFilter) expire(now time.Time, all bool) []*server.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var summaries []*server.Message
+	for key, r := range f.last {
+		if !all && now.Sub(r.since) < f.window {
+			continue
+		}
+		if s := r.summary(now); s != nil {
+			summaries = append(summaries, s)
+		}
+		delete(f.last, key)
+	}
+	return summaries
+}
+
+func (r *repeated) summary(now time.Time) *server.Message {
+	if r.count == 0 {
+		return nil
+	}
+	s := *r.m
+	s.Time, s.Timestamp = now, now
+	s.Content = fmt.Sprintf("last message repeated %d times", r.count)
+	s.Content1 = s.Content
+	s.Raw = ""
+	return &s
+}
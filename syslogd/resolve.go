@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultResolveTTL         = time.Hour
+	defaultResolveNegativeTTL = 5 * time.Minute
+	defaultResolveTimeout     = 2 * time.Second
+	defaultResolveMaxEntries  = 10000
+	maxPendingLookups         = 16
+)
+
+type resolveConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	TTL         time.Duration `yaml:"ttl"`          // default 1h
+	NegativeTTL time.Duration `yaml:"negative_ttl"` // of failed lookups, default 5m
+	Timeout     time.Duration `yaml:"timeout"`      // default 2s
+	MaxEntries  int           `yaml:"max_entries"`  // default 10000
+}
+
+// resolver is a server.Handler setting the FromHost of messages to the
+// reverse DNS name of their sender. Names come from a cache; an address
+// missing from it is looked up in the background, and its messages go
+// without a name until the lookup completes, so slow DNS never holds up
+// receiving.
+type resolver struct {
+	config atomic.Pointer[resolveConfig]
+
+	mu      sync.Mutex
+	cache   map[string]*resolved
+	pending chan struct{}
+}
+
+type resolved struct {
+	name    string
+	expires time.Time
+	lookup  bool // in progress
+}
+
+func newResolver() *resolver {
+	return &resolver{
+		cache:   make(map[string]*resolved),
+		pending: make(chan struct{}, maxPendingLookups),
+	}
+}
+
+func (r *resolver) Set(c resolveConfig) {
+	if c.TTL <= 0 {
+		c.TTL = defaultResolveTTL
+	}
+	if c.NegativeTTL <= 0 {
+		c.NegativeTTL = defaultResolveNegativeTTL
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultResolveTimeout
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = defaultResolveMaxEntries
+	}
+	r.config.Store(&c)
+}
+
+func (r *resolver) Handle(m *server.Message) *server.Message {
+	c := r.config.Load()
+	if m == nil || c == nil || !c.Enabled {
+		return m
+	}
+	ip := m.NetSrc()
+	if net.ParseIP(ip) == nil {
+		return m
+	}
+	m.FromHost = r.lookup(ip, c, time.Now())
+	return m
+}
+
+// lookup returns the cached name of ip, starting a lookup when it has
+// none or it expired.
+func (r *resolver) lookup(ip string, c *resolveConfig, now time.Time) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.cache[ip]
+	if ok && (e.lookup || now.Before(e.expires)) {
+		return e.name
+	}
+
+	select {
+	case r.pending <- struct{}{}:
+	default:
+		// Too many lookups in progress, try again with the next message.
+		if ok {
+			return e.name
+		}
+		return ""
+	}
+	if !ok {
+		if len(r.cache) >= c.MaxEntries {
+			r.evict(now, c.MaxEntries)
+		}
+		e = &resolved{}
+		r.cache[ip] = e
+	}
+	e.lookup = true
+
+	go func() {
+		defer func() { <-r.pending }()
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		defer cancel()
+
+		var name string
+		ttl := c.NegativeTTL
+		names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+		if err == nil && len(names) > 0 {
+			name, ttl = strings.TrimSuffix(names[0], "."), c.TTL
+		}
+
+		r.mu.Lock()
+		e.name, e.expires, e.lookup = name, time.Now().Add(ttl), false
+		r.mu.Unlock()
+	}()
+	return e.name
+}
+
+// evict removes the expired entries, or all of them if none has expired.
+func (r *resolver) evict(now time.Time, maxEntries int) {
+	for ip, e := range r.cache {
+		if !e.lookup && now.After(e.expires) {
+			delete(r.cache, ip)
+		}
+	}
+	if len(r.cache) >= maxEntries {
+		for ip, e := range r.cache {
+			if !e.lookup {
+				delete(r.cache, ip)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const defaultRecent = 10000
+
+// ring keeps the last messages routed, whatever the outputs, without
+// locks: writers claim a slot by sequence number, and readers skip the
+// slots overwritten while they read.
+type ring struct {
+	slots []atomic.Pointer[ringEntry]
+	next  atomic.Uint64
+}
+
+type ringEntry struct {
+	seq uint64
+	m   *server.Message
+}
+
+// recent holds the last messages for the API, if enabled.
+var recent *ring
+
+func newRing(n int) *ring {
+	return &ring{slots: make([]atomic.Pointer[ringEntry], n)}
+}
+
+func (r *ring) add(m *server.Message) {
+	seq := r.next.Add(1) - 1
+	r.slots[seq%uint64(len(r.slots))].Store(&ringEntry{seq, m})
+}
+
+// scan calls fn with the messages of sequence numbers below before, newest
+// first, until it returns false.
+func (r *ring) scan(before uint64, fn func(seq uint64, m *server.Message) bool) {
+	next := r.next.Load()
+	start := uint64(0)
+	if n := uint64(len(r.slots)); next > n {
+		start = next - n
+	}
+	for seq := min(next, before); seq > start; seq-- {
+		e := r.slots[(seq-1)%uint64(len(r.slots))].Load()
+		if e == nil || e.seq != seq-1 {
+			continue
+		}
+		if !fn(e.seq, e.m) {
+			return
+		}
+	}
+}
+
+// since returns the messages received at or after t, oldest first.
+func (r *ring) since(t time.Time) []*server.Message {
+	var msgs []*server.Message
+	r.scan(math.MaxUint64, func(_ uint64, m *server.Message) bool {
+		if !m.Time.Before(t) {
+			msgs = append(msgs, m)
+		}
+		return true
+	})
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	actionRoute = "route"
+	actionDrop  = "drop"
+	actionKeep  = "keep"
+)
+
+type route struct {
+	match   matcher
+	action  string
+	outputs []string
+	final   bool
+	redact  bool
+	repeats *repeatFilter
+}
+
+// router sends each message, once transformed, to the outputs of the rules
+// that select it, those of its tenant for the messages of a tenant.
+type router struct {
+	transforms []transform
+	routes     []route
+	tenants    map[string][]route
+	outputs    map[string]output
+	stages     map[string]*outputStage
+	alerts     *alerter
+	redact     *redactor
+}
+
+// newRouter opens the outputs of c and sets up its alerts. Without any rule
+// every message is printed to stdout.
+func newRouter(c *config) (*router, error) {
+	return newRouterWith(c, openOutput)
+}
+
+// newRouterWith is newRouter with the outputs made by open.
+func newRouterWith(c *config, open func(string, outputConfig) (output, error)) (*router, error) {
+	rules := c.Rules
+	if len(rules) == 0 {
+		rules = []ruleConfig{{To: stringList{"stdout"}}}
+	}
+
+	transforms, err := newTransforms(c.Transforms, c.GrokPatterns)
+	if err != nil {
+		return nil, atKeys(err, "transforms")
+	}
+	redact, err := newRedactor(c.Redact, c.RedactKey)
+	if err != nil {
+		return nil, atKeys(err, "redact")
+	}
+	alerts, err := newAlerter(c.Alerts)
+	if err != nil {
+		return nil, atKeys(err, "alerts")
+	}
+	r := &router{
+		transforms: transforms,
+		tenants:    make(map[string][]route),
+		outputs:    make(map[string]output),
+		stages:     make(map[string]*outputStage),
+		alerts:     alerts,
+		redact:     redact,
+	}
+	if r.routes, err = r.addRoutes(c, rules, c.Outputs, c.outputFor, open); err != nil {
+		r.Close()
+		return nil, err
+	}
+	for i, t := range c.Tenants {
+		routes, err := r.addRoutes(c, t.Rules, t.Outputs, t.outputFor, open)
+		if err != nil {
+			r.Close()
+			return nil, atKeys(fmt.Errorf("tenant %s: %w", t.Name, err), "tenants", strconv.Itoa(i))
+		}
+		r.tenants[t.Name] = routes
+	}
+	return r, nil
+}
+
+// addRoutes returns the routes of rules, opening with open the outputs outputFor
+// resolves their destinations to, among outputs or inline.
+func (r *router) addRoutes(c *config, rules []ruleConfig, outputs map[string]outputConfig, outputFor func(string) (string, outputConfig, error), open func(string, outputConfig) (output, error)) ([]route, error) {
+	var routes []route
+	for i, rc := range rules {
+		rule := []string{"rules", strconv.Itoa(i)}
+		match, err := parseMatch(rc.Match)
+		if err != nil {
+			return nil, atKeys(fmt.Errorf("rule %d: %v", i+1, err), append(rule, "match")...)
+		}
+		if rc.Selector != "" {
+			sel, err := parseSelector(rc.Selector)
+			if err != nil {
+				return nil, atKeys(fmt.Errorf("rule %d: %v", i+1, err), append(rule, "selector")...)
+			}
+			m := match
+			match = func(msg *server.Message) bool { return sel(msg) && m(msg) }
+		}
+
+		rt := route{match: match, action: rc.Action, final: rc.Final}
+		rt.redact = r.redact.enabled() && (rc.Redact == nil || *rc.Redact)
+		if rc.SuppressRepeats > 0 {
+			rt.repeats = newRepeatFilter(rc.SuppressRepeats)
+		}
+		switch rt.action {
+		case "":
+			rt.action = actionRoute
+			fallthrough
+		case actionRoute:
+			if len(rc.To) == 0 {
+				return nil, atKeys(fmt.Errorf("rule %d: no output", i+1), rule...)
+			}
+		case actionDrop, actionKeep:
+		default:
+			return nil, atKeys(fmt.Errorf("rule %d: unknown action %q", i+1, rt.action), append(rule, "action")...)
+		}
+
+		for j, to := range rc.To {
+			name, oc, err := outputFor(to)
+			if err != nil {
+				return nil, atKeys(fmt.Errorf("rule %d: %v", i+1, err), append(rule, "to", strconv.Itoa(j))...)
+			}
+			if _, ok := r.outputs[name]; !ok {
+				o, err := open(name, oc)
+				if err != nil {
+					keys := append(rule, "to", strconv.Itoa(j))
+					if _, ok := outputs[strings.TrimSpace(to)]; ok {
+						keys = []string{"outputs", strings.TrimSpace(to)}
+					}
+					return nil, atKeys(fmt.Errorf("output %s: %v", name, err), keys...)
+				}
+				r.outputs[name] = o
+				r.stages[name] = newOutputStage(name, o, c.Pipeline)
+			}
+			rt.outputs = append(rt.outputs, name)
+		}
+		routes = append(routes, rt)
+	}
+	return routes, nil
+}
+
+// openOutput opens the output of oc, queued on disk if it has a queue.
+func openOutput(name string, oc outputConfig) (output, error) {
+	o, err := newOutput(name, oc)
+	if err == nil && oc.Queue.Dir != "" {
+		if o, err = newQueuedOutput(name, o, oc.Queue); err != nil {
+			o.Close()
+		}
+	}
+	return o, err
+}
+
+// Route sends m, once transformed and redacted, to the outputs of the
+// rules that select it, those with redact: false getting it unredacted. It
+// returns the message as the alerts saw it, redacted, for the API, or nil
+// if a transform dropped it.
+func (r *router) Route(m *server.Message) *server.Message {
+	if m = applyTransforms(r.transforms, m); m == nil {
+		return nil
+	}
+	redacted := m
+	if r.redact.enabled() {
+		redacted = r.redact.apply(m)
+	}
+	r.alerts.add(redacted)
+	r.walk(m, func(_ int, rt route, matched bool) {
+		if !matched || rt.action == actionDrop {
+			return
+		}
+
+		msg := m
+		if rt.redact {
+			msg = redacted
+		}
+		send := true
+		if rt.repeats != nil {
+			var summary *server.Message
+			if summary, send = rt.repeats.filter(msg, time.Now()); summary != nil {
+				r.send(rt, summary)
+			}
+		}
+		if send {
+			r.send(rt, msg)
+		}
+	})
+	return redacted
+}
+
+// walk calls f with the routes of m in turn, their index and whether they
+// select m, until one drops m, keeps only others or is final and selects
+// it.
+func (r *router) walk(m *server.Message, f func(i int, rt route, matched bool)) {
+	routes := r.routes
+	if t, ok := r.tenants[tenant(m)]; ok {
+		routes = t
+	}
+	for i, rt := range routes {
+		matched := rt.match(m)
+		f(i, rt, matched)
+		if rt.action == actionDrop && matched || rt.action == actionKeep && !matched || rt.final && matched {
+			return
+		}
+	}
+}
+
+func (r *router) send(rt route, m *server.Message) {
+	for _, name := range rt.outputs {
+		r.stages[name].write(m)
+	}
+}
+
+// Tick sends the repeat summaries of the windows that ended by now, and
+// forgets the alert counts of past windows.
+func (r *router) Tick(now time.Time) {
+	r.expire(now, false)
+	r.alerts.tick(now)
+}
+
+func (r *router) expire(now time.Time, all bool) {
+	r.expireRoutes(r.routes, now, all)
+	for _, routes := range r.tenants {
+		r.expireRoutes(routes, now, all)
+	}
+}
+
+func (r *router) expireRoutes(routes []route, now time.Time, all bool) {
+	for _, rt := range routes {
+		if rt.repeats == nil {
+			continue
+		}
+		for _, m := range rt.repeats.expire(now, all) {
+			r.send(rt, m)
+		}
+	}
+}
+
+func (r *router) Close() {
+	r.expire(time.Now(), true)
+	r.alerts.close()
+	for _, s := range r.stages {
+		s.close()
+	}
+	for name, o := range r.outputs {
+		if err := o.Close(); err != nil {
+			log.Printf("output %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// recorder is an output that keeps the messages written to it.
+type recorder struct {
+	mu   sync.Mutex
+	msgs []*server.Message
+}
+
+func (o *recorder) Write(m *server.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.msgs = append(o.msgs, m)
+	return nil
+}
+
+func (o *recorder) Close() error { return nil }
+
+func TestRouteRedacts(t *testing.T) {
+	unredacted := false
+	c := &config{
+		Redact: []redactConfig{{Pattern: "ipv4"}, {Pattern: "email"}},
+		Rules: []ruleConfig{
+			{To: stringList{"redacted"}},
+			{To: stringList{"raw"}, Redact: &unredacted},
+		},
+		Outputs: map[string]outputConfig{"redacted": {Type: "discard"}, "raw": {Type: "discard"}},
+	}
+	outputs := make(map[string]*recorder)
+	r, err := newRouterWith(c, func(name string, _ outputConfig) (output, error) {
+		outputs[name] = &recorder{}
+		return outputs[name], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &server.Message{
+		Source:         &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 514},
+		FromHost:       "192.0.2.1",
+		Hostname:       "192.0.2.2",
+		Tag:            "jane@example.com",
+		Tag1:           "jane@example.com",
+		Content:        "login from 192.0.2.3",
+		Raw:            "192.0.2.2 jane@example.com: login from 192.0.2.3",
+		StructuredData: map[string]map[string]string{"origin": {"ip": "192.0.2.4"}},
+		Peer:           &server.Peer{CommonName: "jane@example.com"},
+	}
+	shown := r.Route(m)
+	r.Close()
+
+	if shown == nil {
+		t.Fatal("message dropped")
+	}
+	want := server.Message{
+		FromHost:       "[ipv4]",
+		Hostname:       "[ipv4]",
+		Tag:            "[email]",
+		Tag1:           "[email]",
+		Content:        "login from [ipv4]",
+		Raw:            "[ipv4] [email]: login from [ipv4]",
+		StructuredData: map[string]map[string]string{"origin": {"ip": "[ipv4]"}},
+	}
+	for _, got := range []*server.Message{shown, outputs["redacted"].msgs[0]} {
+		if got.FromHost != want.FromHost || got.Hostname != want.Hostname || got.Tag != want.Tag ||
+			got.Tag1 != want.Tag1 || got.Content != want.Content || got.Raw != want.Raw {
+			t.Errorf("redacted %+v, want %+v", got, want)
+		}
+		if got.StructuredData["origin"]["ip"] != "[ipv4]" {
+			t.Errorf("structured data %v, want %v", got.StructuredData, want.StructuredData)
+		}
+		if got.NetSrc() != "[ipv4]" || got.Peer.CommonName != "[email]" {
+			t.Errorf("sender %s %q, want it redacted", got.NetSrc(), got.Peer.CommonName)
+		}
+	}
+	if got := outputs["raw"].msgs[0]; got != m {
+		t.Errorf("rule with redact: false got %+v, want the message unredacted", got)
+	}
+	if m.Hostname != "192.0.2.2" || m.StructuredData["origin"]["ip"] != "192.0.2.4" || m.Peer.CommonName != "jane@example.com" {
+		t.Errorf("the message received was changed: %+v", m)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// matcher reports whether a message is selected by a rule.
+type matcher func(*server.Message) bool
+
+// parseMatch compiles a match expression such as
+//
+//	facility=auth & severity<=warning
+//	host~'^fw-' | (tag=sshd & !msg~"Accepted")
+//
+// Conditions compare a message property with =, !=, ^= (prefix), *=
+// (substring), <, <=, >, >=, ~ (regex) or !~. They are combined with &
+// (and), | (or), ! (not) and parentheses. Severities compare by their
+// numeric value, so severity<=warning selects warning and everything more
+// severe. Structured data parameters are named sd.SD-ID.PARAM-NAME.
+func parseMatch(expr string) (matcher, error) {
+	p := &matchParser{tokens: tokenize(expr)}
+	if len(p.tokens) == 0 {
+		return func(*server.Message) bool { return true }, nil
+	}
+
+	m, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("match %q: %v", expr, err)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("match %q: unexpected %q", expr, p.tokens[p.pos])
+	}
+	return m, nil
+}
+
+func tokenize(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '\'' || c == '"':
+			j := strings.IndexByte(s[i+1:], c)
+			if j < 0 {
+				j = len(s) - i - 1
+				tokens = append(tokens, s[i:])
+			} else {
+				tokens = append(tokens, s[i:i+j+2])
+			}
+			i += j + 2
+		case strings.IndexByte("&|()", c) >= 0:
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case (c == '^' || c == '*') && i+1 < len(s) && s[i+1] == '=':
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case c == '!' || c == '<' || c == '>' || c == '=' || c == '~':
+			j := i + 1
+			if j < len(s) && (s[j] == '=' || (c == '!' && s[j] == '~')) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t&|()!<>=~'\"", s[j]) < 0 {
+				if (s[j] == '^' || s[j] == '*') && j+1 < len(s) && s[j+1] == '=' {
+					break
+				}
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+type matchParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *matchParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *matchParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *matchParser) or() (matcher, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "|" {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m *server.Message) bool { return l(m) || right(m) }
+	}
+	return left, nil
+}
+
+func (p *matchParser) and() (matcher, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&" {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m *server.Message) bool { return l(m) && right(m) }
+	}
+	return left, nil
+}
+
+func (p *matchParser) unary() (matcher, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(msg *server.Message) bool { return !m(msg) }, nil
+	case "(":
+		p.next()
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return m, nil
+	}
+	return p.condition()
+}
+
+func (p *matchParser) condition() (matcher, error) {
+	name, op, value := p.next(), p.next(), p.next()
+	if name == "" || op == "" || value == "" {
+		return nil, fmt.Errorf("incomplete condition")
+	}
+	if n := len(value); n >= 2 && (value[0] == '\'' || value[0] == '"') && value[n-1] == value[0] {
+		value = value[1 : n-1]
+	}
+
+	switch name {
+	case "facility":
+		f, err := parseFacility(value)
+		if err != nil {
+			return nil, err
+		}
+		return compareNumber(op, func(m *server.Message) int { return int(m.Facility) }, int(f))
+	case "severity":
+		s, err := parseSeverity(value)
+		if err != nil {
+			return nil, err
+		}
+		return compareNumber(op, func(m *server.Message) int { return int(m.Severity) }, int(s))
+	}
+
+	get, ok := messageFields[name]
+	if strings.HasPrefix(name, "sd.") {
+		get, ok = sdParam(name[3:])
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown property %s", name)
+	}
+	return compareString(op, get, value)
+}
+
+// messageFields are the string properties a condition can test.
+var messageFields = map[string]func(*server.Message) string{
+	"host":     func(m *server.Message) string { return m.Hostname },
+	"hostname": func(m *server.Message) string { return m.Hostname },
+	"tag":      func(m *server.Message) string { return m.Tag },
+	"program":  program,
+	"app":      func(m *server.Message) string { return m.AppName },
+	"procid":   func(m *server.Message) string { return m.ProcID },
+	"msgid":    func(m *server.Message) string { return m.MsgID },
+	"trace_id": func(m *server.Message) string { return m.TraceID },
+	"span_id":  func(m *server.Message) string { return m.SpanID },
+	"msg":      func(m *server.Message) string { return m.Content },
+	"source":   func(m *server.Message) string { return m.NetSrc() },
+	"fromhost": fromHost,
+	"peer":     peerName,
+	"peer_san": peerSANs,
+	"tenant":   tenant,
+}
+
+// peerName returns the common name of the client certificate of a TLS
+// sender, and peerSANs its subject alternative names separated by commas.
+func peerName(m *server.Message) string {
+	if m.Peer == nil {
+		return ""
+	}
+	return m.Peer.CommonName
+}
+
+func peerSANs(m *server.Message) string {
+	if m.Peer == nil {
+		return ""
+	}
+	return strings.Join(m.Peer.SANs, ",")
+}
+
+// sdParam returns the getter of "SD-ID.PARAM-NAME".
+func sdParam(name string) (func(*server.Message) string, bool) {
+	id, param, ok := splitSDName(name)
+	if !ok {
+		return nil, false
+	}
+	return func(m *server.Message) string { return m.StructuredData[id][param] }, true
+}
+
+// splitSDName splits "SD-ID.PARAM-NAME" at the first dot after the @ of
+// the SD-ID, since only the part before the @ may contain dots, and
+// parameter names such as those of parsed JSON payloads may.
+func splitSDName(name string) (id, param string, ok bool) {
+	at := strings.IndexByte(name, '@') + 1
+	i := strings.IndexByte(name[at:], '.')
+	if i < 0 {
+		return "", "", false
+	}
+	i += at
+	if i == 0 || i == len(name)-1 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+func compareNumber(op string, get func(*server.Message) int, v int) (matcher, error) {
+	switch op {
+	case "=":
+		return func(m *server.Message) bool { return get(m) == v }, nil
+	case "!=":
+		return func(m *server.Message) bool { return get(m) != v }, nil
+	case "<":
+		return func(m *server.Message) bool { return get(m) < v }, nil
+	case "<=":
+		return func(m *server.Message) bool { return get(m) <= v }, nil
+	case ">":
+		return func(m *server.Message) bool { return get(m) > v }, nil
+	case ">=":
+		return func(m *server.Message) bool { return get(m) >= v }, nil
+	}
+	return nil, fmt.Errorf("invalid operator %q", op)
+}
+
+func compareString(op string, get func(*server.Message) string, v string) (matcher, error) {
+	switch op {
+	case "=":
+		return func(m *server.Message) bool { return get(m) == v }, nil
+	case "!=":
+		return func(m *server.Message) bool { return get(m) != v }, nil
+	case "^=":
+		return func(m *server.Message) bool { return strings.HasPrefix(get(m), v) }, nil
+	case "*=":
+		return func(m *server.Message) bool { return strings.Contains(get(m), v) }, nil
+	case "~", "!~":
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, err
+		}
+		if op == "!~" {
+			return func(m *server.Message) bool { return !re.MatchString(get(m)) }, nil
+		}
+		return func(m *server.Message) bool { return re.MatchString(get(m)) }, nil
+	}
+	return nil, fmt.Errorf("invalid operator %q", op)
+}
+
+func parseFacility(s string) (server.Facility, error) {
+	for f := server.Kern; f <= server.Local7; f++ {
+		if f.String() == s {
+			return f, nil
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n <= int(server.Local7) {
+		return server.Facility(n), nil
+	}
+	return 0, fmt.Errorf("unknown facility %s", s)
+}
+
+func parseSeverity(s string) (server.Severity, error) {
+	for v := server.Emerg; v <= server.Debug; v++ {
+		if v.String() == s {
+			return v, nil
+		}
+	}
+	switch s {
+	case "panic":
+		return server.Emerg, nil
+	case "error":
+		return server.Err, nil
+	case "warn":
+		return server.Warning, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n <= int(server.Debug) {
+		return server.Severity(n), nil
+	}
+	return 0, fmt.Errorf("unknown severity %s", s)
+}
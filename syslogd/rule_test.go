@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+func TestParseMatch(t *testing.T) {
+	sshd := &server.Message{
+		Facility: server.Auth,
+		Severity: server.Warning,
+		Hostname: "fw-01.example.com",
+		Tag:      "sshd[42]",
+		Content:  "Failed password for root from 192.0.2.1",
+		StructuredData: map[string]map[string]string{
+			"origin@32473": {"ip": "192.0.2.1", "user.name": "root"},
+		},
+	}
+	cron := &server.Message{
+		Facility: server.Cron,
+		Severity: server.Info,
+		Hostname: "db-01",
+		Tag:      "CRON[7]",
+		AppName:  "cron",
+		Content:  "Accepted (root) CMD (run-parts /etc/cron.hourly)",
+	}
+
+	tests := []struct {
+		expr       string
+		sshd, cron bool
+	}{
+		{"", true, true},
+		{"   ", true, true},
+		{"facility=auth", true, false},
+		{"facility=4", true, false},
+		{"facility!=auth", false, true},
+		{"facility>=cron", false, true},
+		{"severity<=warning", true, false},
+		{"severity<warning", false, false},
+		{"severity>warning", false, true},
+		{"severity=warn", true, false},
+		{"severity=6", false, true},
+		{"host=db-01", false, true},
+		{"hostname!=db-01", true, false},
+		{"host^=fw-", true, false},
+		{"msg*=root", true, true},
+		{"host~'^fw-\\d+\\.'", true, false},
+		{`msg!~"Accepted"`, true, false},
+		{"tag=sshd[42]", true, false},
+		{"program=sshd", true, false},
+		{"program=cron", false, true},
+		{"app=cron", false, true},
+		{"sd.origin@32473.ip=192.0.2.1", true, false},
+		{"sd.origin@32473.user.name=root", true, false},
+		{"sd.origin@32473.missing=''", true, true},
+		{"msg='Failed password for root from 192.0.2.1'", true, false},
+		{"facility=auth & severity<=warning", true, false},
+		{"facility=auth&host=db-01", false, false},
+		{"facility=auth | host=db-01", true, true},
+		{"!facility=auth", false, true},
+		{"!!facility=auth", true, false},
+		{"host~'^fw-' | (tag=CRON[7] & !msg~\"Accepted\")", true, false},
+		{"(host~'^fw-' | tag=CRON[7]) & msg*=Accepted", false, true},
+		{"host=db-01 | host=fw-01.example.com & facility=cron", false, true},
+		{"(host=db-01 | host=fw-01.example.com) & facility=cron", false, true},
+		{"(host=db-01 | host=fw-01.example.com) & facility=auth", true, false},
+		{"!(facility=auth | facility=cron)", false, false},
+	}
+	for _, tt := range tests {
+		m, err := parseMatch(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := m(sshd); got != tt.sshd {
+			t.Errorf("%q matches sshd: %v, want %v", tt.expr, got, tt.sshd)
+		}
+		if got := m(cron); got != tt.cron {
+			t.Errorf("%q matches cron: %v, want %v", tt.expr, got, tt.cron)
+		}
+	}
+}
+
+func TestParseMatchErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"host", "incomplete condition"},
+		{"host =", "incomplete condition"},
+		{"host = x &", "incomplete condition"},
+		{"(host = x", "missing )"},
+		{"host = x)", `unexpected ")"`},
+		{"host = x y", `unexpected "y"`},
+		{"nope = x", "unknown property nope"},
+		{"sd.nodot = x", "unknown property sd.nodot"},
+		{"facility = nope", "unknown facility nope"},
+		{"severity = 8", "unknown severity 8"},
+		{"severity ^= err", `invalid operator "^="`},
+		{"host < x", `invalid operator "<"`},
+		{"host ~ '('", "missing closing )"},
+	}
+	for _, tt := range tests {
+		_, err := parseMatch(tt.expr)
+		if err == nil {
+			t.Errorf("%q: no error", tt.expr)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "match ") || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: error %q, want %q", tt.expr, err, tt.err)
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		expr   string
+		tokens []string
+	}{
+		{"facility=auth&severity<=warning", []string{"facility", "=", "auth", "&", "severity", "<=", "warning"}},
+		{"host^=fw- | tag*=ssh", []string{"host", "^=", "fw-", "|", "tag", "*=", "ssh"}},
+		{`!(msg!~"a b" & msg~'c|d')`, []string{"!", "(", "msg", "!~", `"a b"`, "&", "msg", "~", "'c|d'", ")"}},
+		{"msg='unterminated", []string{"msg", "=", "'unterminated"}},
+		{"a>=1\tb!=2", []string{"a", ">=", "1", "b", "!=", "2"}},
+	}
+	for _, tt := range tests {
+		if got := tokenize(tt.expr); !reflect.DeepEqual(got, tt.tokens) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.expr, got, tt.tokens)
+		}
+	}
+}
+
+func TestSplitSDName(t *testing.T) {
+	tests := []struct {
+		name, id, param string
+		ok              bool
+	}{
+		{"origin.ip", "origin", "ip", true},
+		{"origin@32473.ip", "origin@32473", "ip", true},
+		{"json@32473.user.name", "json@32473", "user.name", true},
+		{"a.b@32473.c", "a.b@32473", "c", true},
+		{"origin", "", "", false},
+		{".ip", "", "", false},
+		{"origin.", "", "", false},
+	}
+	for _, tt := range tests {
+		id, param, ok := splitSDName(tt.name)
+		if id != tt.id || param != tt.param || ok != tt.ok {
+			t.Errorf("splitSDName(%q) = %q, %q, %v, want %q, %q, %v", tt.name, id, param, ok, tt.id, tt.param, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sandboxConfig confines the process once the sockets are bound. The
+// paths of the config, of outputs added on reload included, are then
+// resolved inside the chroot directory.
+type sandboxConfig struct {
+	Chroot   string     `yaml:"chroot"`
+	Landlock bool       `yaml:"landlock"`  // restrict file access to the directories in use, Linux only
+	Paths    stringList `yaml:"paths"`     // also writable with landlock
+	ReadOnly stringList `yaml:"read_only"` // also readable with landlock
+}
+
+// systemPaths are the files read by name resolution, TLS and time zones.
+var systemPaths = []string{
+	"/etc/hosts", "/etc/resolv.conf", "/etc/nsswitch.conf", "/etc/localtime",
+	"/etc/ssl", "/etc/pki", "/usr/share/zoneinfo", "/proc",
+}
+
+// sandboxPaths returns the files and directories the process writes and
+// reads with the configuration c: the directories of the file outputs,
+// spools, queues and stores, and the configuration, certificates and
+// databases it rereads.
+func sandboxPaths(c *config, configFile string, tls tlsFiles) (rw, ro []string) {
+	rw = append(rw, c.Sandbox.Paths...)
+	ro = append(append(ro, systemPaths...), c.Sandbox.ReadOnly...)
+	ro = append(ro, configFile, tls.Cert, tls.Key, tls.CA, tls.CRL, c.GeoIP.CityDB, c.GeoIP.ASNDB)
+	if tls.ACME.Cache != "" {
+		rw = append(rw, tls.ACME.Cache)
+	}
+
+	outputs := []func(string) (string, outputConfig, error){c.outputFor}
+	rules := [][]ruleConfig{c.Rules}
+	for _, t := range c.Tenants {
+		outputs = append(outputs, t.outputFor)
+		rules = append(rules, t.Rules)
+	}
+	for i := range rules {
+		rw, ro = outputPaths(rules[i], outputs[i], rw, ro)
+	}
+	if c.Audit.Type != "" {
+		rw, ro = outputConfigPaths("audit", c.Audit, rw, ro)
+	}
+	return compactPaths(rw), compactPaths(ro)
+}
+
+// outputPaths adds the paths of the outputs of rules to rw and ro.
+func outputPaths(rules []ruleConfig, outputFor func(string) (string, outputConfig, error), rw, ro []string) ([]string, []string) {
+	for _, rc := range rules {
+		for _, to := range rc.To {
+			name, oc, err := outputFor(to)
+			if err != nil {
+				continue
+			}
+			rw, ro = outputConfigPaths(name, oc, rw, ro)
+		}
+	}
+	return rw, ro
+}
+
+// outputConfigPaths adds the paths of the output oc to rw and ro.
+func outputConfigPaths(name string, oc outputConfig, rw, ro []string) ([]string, []string) {
+	switch oc.Type {
+	case "file":
+		// The directory of a templated path up to its first property.
+		path := oc.Path
+		if i := strings.IndexByte(path, '%'); i >= 0 {
+			path = path[:i]
+		}
+		rw = append(rw, filepath.Dir(path))
+	case "sqlite":
+		rw = append(rw, filepath.Dir(oc.Path))
+	case "s3":
+		if oc.Path == "" {
+			oc.Path = archiveSpool(name)
+		}
+		rw = append(rw, oc.Path)
+	}
+	rw = append(rw, oc.Queue.Dir)
+	ro = append(ro, oc.TLSCA, oc.EncryptKey)
+	return rw, ro
+}
+
+// compactPaths drops empty and duplicate paths.
+func compactPaths(paths []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, p := range paths {
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// isDir reports whether path is a directory, following symlinks.
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// chroot confines the process to dir.
+func chroot(dir string) error {
+	if err := unix.Chroot(dir); err != nil {
+		return fmt.Errorf("chroot: %v", err)
+	}
+	return os.Chdir("/")
+}
+
+const (
+	landlockRead  = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockWrite = unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR | unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK | unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK | unix.LANDLOCK_ACCESS_FS_MAKE_SYM
+	// The access rights that apply to files rather than directories.
+	landlockFile = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_EXECUTE
+)
+
+// restrictPaths makes the files beneath rw the only ones the process may
+// write and those beneath rw and ro the only ones it may read, with
+// landlock. Paths that do not exist are skipped. Every thread is
+// restricted, and for good, since a landlock domain cannot be left.
+func restrictPaths(rw, ro []string) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("landlock is not available: %v", errno)
+	}
+	handled := uint64(landlockRead | landlockWrite | unix.LANDLOCK_ACCESS_FS_EXECUTE)
+	write := uint64(landlockWrite)
+	if abi >= 2 {
+		// Renaming and linking across directories.
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+		write |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: create ruleset: %v", errno)
+	}
+	defer unix.Close(int(fd))
+
+	add := func(path string, access uint64) error {
+		if !isDir(path) {
+			access &= landlockFile
+		}
+		pfd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("landlock: %v", err)
+		}
+		defer unix.Close(pfd)
+
+		rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(pfd)}
+		_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, fd, unix.LANDLOCK_RULE_PATH_BENEATH,
+			uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("landlock: %s: %v", path, errno)
+		}
+		return nil
+	}
+	for _, path := range rw {
+		if err := add(path, landlockRead|write); err != nil {
+			return err
+		}
+	}
+	for _, path := range ro {
+		if err := add(path, landlockRead); err != nil {
+			return err
+		}
+	}
+
+	// Threads cannot all be reached in binaries built with cgo.
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno == unix.ENOTSUP {
+		return errors.New("landlock: not supported in a build with cgo, build with CGO_ENABLED=0")
+	} else if errno != 0 {
+		return fmt.Errorf("landlock: no_new_privs: %v", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock: restrict self: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func chroot(dir string) error {
+	return errors.New("chroot is only supported on Linux")
+}
+
+func restrictPaths(rw, ro []string) error {
+	return errors.New("landlock is only supported on Linux")
+}
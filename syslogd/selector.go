@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// parseSelector compiles a syslog.conf selector such as
+//
+//	*.info;mail.none;authpriv.none
+//	auth,authpriv.*
+//	kern.=crit;local7.!debug
+//
+// Each facility.priority pair selects the priority and everything more
+// severe, "=" only the priority itself, "!" inverts the selection and
+// "none" deselects the facilities. Later pairs override earlier ones.
+func parseSelector(sel string) (matcher, error) {
+	var table [int(server.Local7) + 1][int(server.Debug) + 1]bool
+
+	for _, part := range strings.Split(sel, ";") {
+		part = strings.TrimSpace(part)
+		i := strings.LastIndexByte(part, '.')
+		if i < 0 {
+			return nil, fmt.Errorf("selector %q: want facility.priority", part)
+		}
+
+		var facilities []server.Facility
+		for _, name := range strings.Split(part[:i], ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				for f := server.Kern; f <= server.Local7; f++ {
+					facilities = append(facilities, f)
+				}
+				continue
+			}
+			f, err := parseFacility(name)
+			if err != nil {
+				return nil, fmt.Errorf("selector %q: %v", part, err)
+			}
+			facilities = append(facilities, f)
+		}
+
+		pri := part[i+1:]
+		negate := strings.HasPrefix(pri, "!")
+		pri = strings.TrimPrefix(pri, "!")
+		exact := strings.HasPrefix(pri, "=")
+		pri = strings.TrimPrefix(pri, "=")
+
+		var severities [int(server.Debug) + 1]bool
+		switch pri {
+		case "*":
+			for s := range severities {
+				severities[s] = true
+			}
+		case "none":
+			negate = !negate
+			for s := range severities {
+				severities[s] = true
+			}
+		default:
+			s, err := parseSeverity(pri)
+			if err != nil {
+				return nil, fmt.Errorf("selector %q: %v", part, err)
+			}
+			if exact {
+				severities[s] = true
+			} else {
+				for v := server.Emerg; v <= s; v++ {
+					severities[v] = true
+				}
+			}
+		}
+
+		for _, f := range facilities {
+			for s, set := range severities {
+				if set {
+					table[f][s] = !negate
+				}
+			}
+		}
+	}
+
+	return func(m *server.Message) bool {
+		if int(m.Facility) >= len(table) || int(m.Severity) >= len(table[0]) {
+			return false
+		}
+		return table[m.Facility][m.Severity]
+	}, nil
+}
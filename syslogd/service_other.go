@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoService = errors.New("-service is only supported on Windows")
+
+func installService(args []string) error { return errNoService }
+func uninstallService() error            { return errNoService }
+
+type service struct{}
+
+func runService(sig chan<- os.Signal) (*service, error) { return nil, errNoService }
+
+func (s *service) ready()   {}
+func (s *service) stopped() {}
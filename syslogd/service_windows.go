@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "syslogd"
+
+// installService registers syslogd as a service started at boot with
+// args, and as a source of the event log.
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s exists already", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "syslogd",
+		Description: "Receives and routes syslog messages.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return err
+	}
+	return nil
+}
+
+// uninstallService removes the service and its event log source.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+// service runs syslogd under the service control manager, which it
+// reports to as main goes along. Stop and shutdown requests are delivered
+// to main as SIGTERM, parameter changes as SIGHUP to reload.
+type service struct {
+	sig     chan<- os.Signal
+	elog    *eventlog.Log
+	running chan struct{}
+	done    chan struct{}
+	exited  chan struct{}
+}
+
+// runService connects to the service control manager and sends the log
+// to the event log.
+func runService(sig chan<- os.Signal) (*service, error) {
+	if ok, err := svc.IsWindowsService(); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("-service run must be started by the service control manager")
+	}
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(eventLogWriter{elog})
+	log.SetFlags(0)
+
+	s := &service{
+		sig:     sig,
+		elog:    elog,
+		running: make(chan struct{}),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	go func() {
+		defer close(s.exited)
+		if err := svc.Run(serviceName, s); err != nil {
+			elog.Error(1, fmt.Sprintf("service failed: %v", err))
+			os.Exit(1)
+		}
+	}()
+	return s, nil
+}
+
+func (s *service) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	<-s.running
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange}
+	s.elog.Info(1, "syslogd started")
+
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				s.sig <- syscall.SIGTERM
+			case svc.ParamChange:
+				s.sig <- syscall.SIGHUP
+			}
+		case <-s.done:
+			s.elog.Info(1, "syslogd stopped")
+			return false, 0
+		}
+	}
+}
+
+// ready reports the service running once the sockets are bound.
+func (s *service) ready() {
+	close(s.running)
+}
+
+// stopped reports the service stopped, and waits for the service control
+// manager to take notice.
+func (s *service) stopped() {
+	close(s.done)
+	<-s.exited
+	s.elog.Close()
+}
+
+// eventLogWriter writes the log to the event log, which is where a
+// service has its output looked for.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	return len(p), w.elog.Info(1, msg)
+}
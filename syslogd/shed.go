@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultShedSample = 0.1
+	shedLogInterval   = time.Minute
+)
+
+type shedConfig struct {
+	MaxRate    float64 `yaml:"max_rate"`    // messages per second
+	QueueLevel float64 `yaml:"queue_level"` // routing queue fill ratio, e.g. 0.8
+	Sample     float64 `yaml:"sample"`      // ratio of the messages kept, default 0.1
+	Keep       string  `yaml:"keep"`        // severity kept in full, default err
+}
+
+func (c shedConfig) validate() error {
+	var errs []error
+	if c.Keep != "" {
+		if _, err := parseSeverity(c.Keep); err != nil {
+			errs = append(errs, atKeys(fmt.Errorf("shed: %v", err), "keep"))
+		}
+	}
+	if c.Sample < 0 || c.Sample > 1 || c.QueueLevel < 0 || c.QueueLevel > 1 {
+		errs = append(errs, fmt.Errorf("shed: sample and queue_level must be between 0 and 1"))
+	}
+	return errors.Join(errs...)
+}
+
+// shedder is a server.Handler that samples the less severe messages while
+// the input exceeds max_rate or the routing queue fills up beyond
+// queue_level, so that an overload sheds debug and info messages before
+// the kernel or the queue start dropping messages at random.
+type shedder struct {
+	config    atomic.Pointer[shedConfig]
+	keep      atomic.Int32
+	queueFill func() float64 // ratio of the routing queue in use
+
+	mu     sync.Mutex
+	second int64
+	count  float64 // in the current second
+	rate   float64 // of the last second
+	shed   uint64  // since the last log
+	logged time.Time
+}
+
+var shedTotal = newCounterVec("syslogd_shed_total",
+	"Messages dropped by overload shedding by severity.", "severity")
+
+func newShedder(queueFill func() float64) *shedder {
+	return &shedder{queueFill: queueFill}
+}
+
+// Set replaces the configuration, which disables shedding when it sets
+// neither max_rate nor queue_level.
+func (s *shedder) Set(c shedConfig) {
+	if c.Sample == 0 {
+		c.Sample = defaultShedSample
+	}
+	keep := server.Err
+	if c.Keep != "" {
+		keep, _ = parseSeverity(c.Keep)
+	}
+	s.keep.Store(int32(keep))
+	s.config.Store(&c)
+}
+
+func (s *shedder) Handle(m *server.Message) *server.Message {
+	c := s.config.Load()
+	if m == nil || c == nil || (c.MaxRate <= 0 && c.QueueLevel <= 0) {
+		return m
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sec := now.Unix(); sec != s.second {
+		s.rate = s.count
+		if sec != s.second+1 {
+			s.rate = 0
+		}
+		s.second, s.count = sec, 0
+	}
+	s.count++
+
+	overloaded := c.MaxRate > 0 && s.rate > c.MaxRate ||
+		c.QueueLevel > 0 && s.queueFill() >= c.QueueLevel
+	if !overloaded || int32(m.Severity) <= s.keep.Load() || rand.Float64() < c.Sample {
+		return m
+	}
+
+	shedTotal.inc(m.Severity.String())
+	s.shed++
+	if now.Sub(s.logged) >= shedLogInterval {
+		log.Printf("overload: shed %d messages", s.shed)
+		s.logged, s.shed = now, 0
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/plugin"
+	"github.com/haccht/syslog_tools/server"
+)
+
+// Sidecar plugins are programs in any language that syslogd runs, and
+// talks to in JSON lines over their standard input and output, the
+// objects of plugin.Message of the version in SYSLOGD_PLUGIN_VERSION of
+// their environment: an exec output gets every message as a line, and
+// answers it with a line "ok" or the error; an exec input writes a line
+// for every message, where only the content is required. What they write
+// to standard error is logged. They are to exit when their standard input
+// closes, or are killed 5 seconds later. Lines of JSON rather than gRPC
+// let plugins be written without generated code or a gRPC library.
+func init() {
+	plugin.RegisterOutput("exec", newExecOutput)
+	plugin.RegisterInput("exec", newExecInput)
+}
+
+const sidecarRestartDelay = time.Second
+
+// sidecar is a running plugin program.
+type sidecar struct {
+	name string
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	out  *bufio.Reader
+}
+
+func startSidecar(name, command string) (*sidecar, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("exec requires a command option")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "SYSLOGD_PLUGIN_VERSION="+strconv.Itoa(plugin.MessageVersion))
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			log.Printf("%s: %s", name, sc.Text())
+		}
+	}()
+	return &sidecar{name: name, cmd: cmd, in: in, out: bufio.NewReader(out)}, nil
+}
+
+func (s *sidecar) stop() error {
+	s.in.Close()
+	done := make(chan error, 1)
+	go func() { done <- s.cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		s.cmd.Process.Kill()
+		return <-done
+	}
+}
+
+// execOutput hands the messages to a sidecar, started again at the next
+// message if it exits.
+type execOutput struct {
+	name    string
+	command string
+	sc      *sidecar
+}
+
+func newExecOutput(name string, o plugin.Options) (plugin.Output, error) {
+	e := &execOutput{name: "output " + name, command: o["command"]}
+	sc, err := startSidecar(e.name, e.command)
+	if err != nil {
+		return nil, err
+	}
+	e.sc = sc
+	return e, nil
+}
+
+func (e *execOutput) Write(m *plugin.Message) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if e.sc == nil {
+		if e.sc, err = startSidecar(e.name, e.command); err != nil {
+			return err
+		}
+	}
+	answer, err := e.exchange(string(line))
+	if err != nil {
+		e.sc.stop()
+		e.sc = nil
+		return err
+	}
+	if answer != "ok" {
+		return fmt.Errorf("%s", answer)
+	}
+	return nil
+}
+
+func (e *execOutput) exchange(line string) (string, error) {
+	if _, err := io.WriteString(e.sc.in, line+"\n"); err != nil {
+		return "", err
+	}
+	answer, err := e.sc.out.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("sidecar exited: %v", err)
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+func (e *execOutput) Close() error {
+	if e.sc == nil {
+		return nil
+	}
+	return e.sc.stop()
+}
+
+// execInput delivers the messages a sidecar writes, and starts it again
+// if it exits.
+type execInput struct {
+	name    string
+	command string
+
+	mu      sync.Mutex
+	sc      *sidecar
+	closing bool
+	done    chan struct{}
+}
+
+func newExecInput(name string, o plugin.Options) (plugin.Input, error) {
+	if o["command"] == "" {
+		return nil, fmt.Errorf("exec requires a command option")
+	}
+	return &execInput{name: "input " + name, command: o["command"], done: make(chan struct{})}, nil
+}
+
+func (e *execInput) Start(deliver func(*plugin.Message)) error {
+	sc, err := startSidecar(e.name, e.command)
+	if err != nil {
+		return err
+	}
+	e.sc = sc
+	go e.run(deliver)
+	return nil
+}
+
+func (e *execInput) run(deliver func(*plugin.Message)) {
+	defer close(e.done)
+	for {
+		e.mu.Lock()
+		sc := e.sc
+		e.mu.Unlock()
+		for {
+			line, err := sc.out.ReadBytes('\n')
+			if len(line) > 1 {
+				var m plugin.Message
+				if perr := json.Unmarshal(line, &m); perr != nil {
+					log.Printf("%s: %v", e.name, perr)
+				} else {
+					deliver(&m)
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+
+		e.mu.Lock()
+		if e.closing {
+			e.mu.Unlock()
+			return
+		}
+		e.mu.Unlock()
+		if err := sc.stop(); err != nil {
+			log.Printf("%s: %v", e.name, err)
+		}
+
+		for started := false; !started; {
+			time.Sleep(sidecarRestartDelay)
+			e.mu.Lock()
+			if e.closing {
+				e.mu.Unlock()
+				return
+			}
+			next, err := startSidecar(e.name, e.command)
+			if err != nil {
+				log.Printf("%s: %v", e.name, err)
+			} else {
+				e.sc, started = next, true
+			}
+			e.mu.Unlock()
+		}
+	}
+}
+
+func (e *execInput) Close() error {
+	e.mu.Lock()
+	e.closing = true
+	sc := e.sc
+	e.mu.Unlock()
+	err := sc.stop()
+	<-e.done
+	return err
+}
+
+// parseSidecarMessage reads a message as exec inputs write it, where only
+// the content is required. The time of reception is now.
+func parseSidecarMessage(line []byte) (*server.Message, error) {
+	var p plugin.Message
+	if err := json.Unmarshal(line, &p); err != nil {
+		return nil, err
+	}
+	return serverMessage(nil, &p)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	defaultSkewSDID   = "skew@32473"
+	maxSkewHosts      = 10000
+	skewActionFlag    = "flag"
+	skewActionCorrect = "correct"
+)
+
+type skewConfig struct {
+	Threshold time.Duration `yaml:"threshold"` // of the difference to the time of reception, 0 disables the check
+	Action    string        `yaml:"action"`    // flag (default) or correct
+	SDID      string        `yaml:"sd_id"`     // default skew@32473
+}
+
+func (c skewConfig) validate() error {
+	switch c.Action {
+	case "", skewActionFlag, skewActionCorrect:
+		return nil
+	}
+	return atKeys(fmt.Errorf("clock_skew: unknown action %q", c.Action), "action")
+}
+
+// skewDetector is a server.Handler comparing the timestamps of messages to
+// their time of reception, to find the senders with broken clocks. It
+// flags the messages that are off by more than the threshold with the
+// param offset, in seconds, of the SD-ID, and with correct also replaces
+// their timestamp by the time of reception, keeping the reported one in
+// the param timestamp. The last offset of every host is exported.
+type skewDetector struct {
+	config atomic.Pointer[skewConfig]
+
+	mu    sync.Mutex
+	hosts map[string]float64 // last offset by host
+}
+
+var clockSkewed = newCounterVec("syslogd_clock_skewed_total",
+	"Messages with a timestamp off by more than the clock_skew threshold by host.", "host")
+
+func newSkewDetector() *skewDetector {
+	d := &skewDetector{hosts: make(map[string]float64)}
+	newMetricFunc("syslogd_clock_skew_seconds", "Offset of the last timestamp of a host to its time of reception.", "gauge", d.collect, "host")
+	return d
+}
+
+func (d *skewDetector) Set(c skewConfig) {
+	if c.Action == "" {
+		c.Action = skewActionFlag
+	}
+	if c.SDID == "" {
+		c.SDID = defaultSkewSDID
+	}
+	d.config.Store(&c)
+}
+
+func (d *skewDetector) Handle(m *server.Message) *server.Message {
+	c := d.config.Load()
+	if m == nil || c == nil || c.Threshold <= 0 || m.Timestamp.IsZero() {
+		return m
+	}
+
+	offset := m.Timestamp.Sub(m.Time)
+	host := m.Hostname
+	if host == "" {
+		host = m.NetSrc()
+	}
+	d.mu.Lock()
+	if _, ok := d.hosts[host]; ok || len(d.hosts) < maxSkewHosts {
+		d.hosts[host] = offset.Seconds()
+	}
+	d.mu.Unlock()
+
+	if offset <= c.Threshold && offset >= -c.Threshold {
+		return m
+	}
+	clockSkewed.inc(host)
+	if m.StructuredData == nil {
+		m.StructuredData = make(map[string]map[string]string)
+	}
+	params := map[string]string{"offset": strconv.FormatFloat(offset.Seconds(), 'f', 3, 64)}
+	if c.Action == skewActionCorrect {
+		params["timestamp"] = m.ReportedTimestamp().Format(time.RFC3339Nano)
+		m.Timestamp = m.Time
+	}
+	m.StructuredData[c.SDID] = params
+	return m
+}
+
+func (d *skewDetector) collect() []sample {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.hosts) == 0 {
+		return nil
+	}
+	hosts := make([]string, 0, len(d.hosts))
+	for host := range d.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	samples := make([]sample, len(hosts))
+	for i, host := range hosts {
+		samples[i] = sample{[]string{host}, d.hosts[host]}
+	}
+	return samples
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+type snmpV3Config struct {
+	User         string `yaml:"user"`
+	Auth         string `yaml:"auth"` // md5 or sha
+	AuthPassword string `yaml:"auth_password"`
+	Priv         string `yaml:"priv"` // aes, when the traps are encrypted
+	PrivPassword string `yaml:"priv_password"`
+	EngineID     string `yaml:"engine_id"` // hex, which the receiver knows the user by
+}
+
+// The objects of the SYSLOG-MSG-MIB (RFC 5676), which the traps are made
+// of by default.
+const (
+	syslogMsgGenerated = "1.3.6.1.2.1.192.0.1"
+	syslogMsgEntry     = "1.3.6.1.2.1.192.1.2.1"
+)
+
+var defaultSNMPVarbinds = map[string]string{
+	syslogMsgEntry + ".2":  "facility",
+	syslogMsgEntry + ".3":  "severity",
+	syslogMsgEntry + ".6":  "hostname",
+	syslogMsgEntry + ".7":  "program",
+	syslogMsgEntry + ".8":  "procid",
+	syslogMsgEntry + ".9":  "msgid",
+	syslogMsgEntry + ".11": "msg",
+}
+
+var (
+	sysUpTimeOID   = mustParseOID("1.3.6.1.2.1.1.3.0")
+	snmpTrapOIDOID = mustParseOID("1.3.6.1.6.3.1.1.4.1.0")
+)
+
+// defaultEngineID is in the text format of RFC 3411, under the enterprise
+// number of net-snmp as snmptrapd expects.
+var defaultEngineID = append([]byte{0x80, 0x00, 0x1f, 0x88, 0x04}, "syslogd"...)
+
+type snmpVarbind struct {
+	oid []uint32
+	get func(*server.Message) interface{} // int or string
+}
+
+// snmpOutput sends every message as an SNMPv2c or SNMPv3 trap, of the
+// trap OID and with the varbinds of the message properties configured.
+type snmpOutput struct {
+	addr      string
+	community string
+	trapOID   []uint32
+	varbinds  []snmpVarbind
+	start     time.Time
+
+	// SNMPv3
+	v3       bool
+	user     string
+	engineID []byte
+	authHash func() hash.Hash
+	authKey  []byte
+	privKey  []byte
+
+	mu    sync.Mutex
+	conn  net.Conn
+	reqID uint32
+}
+
+// newSNMPOutput sends traps to url, snmp://[community@]host[:port], with
+// the community public by default.
+func newSNMPOutput(c outputConfig) (*snmpOutput, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "snmp" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid snmp url %q: want snmp://[community@]host[:port]", c.URL)
+	}
+	o := &snmpOutput{addr: u.Host, community: "public", start: time.Now()}
+	if u.Port() == "" {
+		o.addr = net.JoinHostPort(u.Hostname(), "162")
+	}
+	if u.User != nil {
+		o.community = u.User.Username()
+	}
+
+	trapOID := c.TrapOID
+	if trapOID == "" {
+		trapOID = syslogMsgGenerated
+	}
+	if o.trapOID, err = parseOID(trapOID); err != nil {
+		return nil, err
+	}
+	mapping := c.Varbinds
+	if len(mapping) == 0 {
+		mapping = defaultSNMPVarbinds
+	}
+	for oid, prop := range mapping {
+		vb, err := newSNMPVarbind(oid, prop)
+		if err != nil {
+			return nil, err
+		}
+		o.varbinds = append(o.varbinds, vb)
+	}
+	sort.Slice(o.varbinds, func(i, j int) bool { return compareOIDs(o.varbinds[i].oid, o.varbinds[j].oid) < 0 })
+
+	if c.SNMPv3.User != "" {
+		if err := o.setV3(c.SNMPv3); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func newSNMPVarbind(oid, prop string) (snmpVarbind, error) {
+	vb := snmpVarbind{}
+	var err error
+	if vb.oid, err = parseOID(oid); err != nil {
+		return vb, err
+	}
+	switch prop {
+	case "facility":
+		vb.get = func(m *server.Message) interface{} { return int(m.Facility) }
+	case "severity":
+		vb.get = func(m *server.Message) interface{} { return int(m.Severity) }
+	default:
+		get, ok := messageFields[prop]
+		if strings.HasPrefix(prop, "sd.") {
+			get, ok = sdParam(prop[3:])
+		}
+		if !ok {
+			return vb, fmt.Errorf("varbind %s: unknown property %s", oid, prop)
+		}
+		vb.get = func(m *server.Message) interface{} { return get(m) }
+	}
+	return vb, nil
+}
+
+// setV3 derives the keys of the user, localized to the engine ID of the
+// output (RFC 3414 A.2).
+func (o *snmpOutput) setV3(c snmpV3Config) error {
+	o.v3, o.user, o.engineID = true, c.User, defaultEngineID
+	if c.EngineID != "" {
+		id, err := hex.DecodeString(strings.TrimPrefix(c.EngineID, "0x"))
+		if err != nil || len(id) < 5 || len(id) > 32 {
+			return fmt.Errorf("invalid snmp engine_id %q", c.EngineID)
+		}
+		o.engineID = id
+	}
+
+	switch c.Auth {
+	case "":
+		if c.Priv != "" {
+			return fmt.Errorf("snmp priv requires auth")
+		}
+		return nil
+	case "md5":
+		o.authHash = md5.New
+	case "sha":
+		o.authHash = sha1.New
+	default:
+		return fmt.Errorf("unknown snmp auth %q", c.Auth)
+	}
+	if len(c.AuthPassword) < 8 {
+		return fmt.Errorf("snmp auth_password must have at least 8 characters")
+	}
+	o.authKey = localizeKey(o.authHash, c.AuthPassword, o.engineID)
+
+	switch c.Priv {
+	case "":
+	case "aes":
+		if len(c.PrivPassword) < 8 {
+			return fmt.Errorf("snmp priv_password must have at least 8 characters")
+		}
+		o.privKey = localizeKey(o.authHash, c.PrivPassword, o.engineID)[:16]
+	default:
+		return fmt.Errorf("unknown snmp priv %q", c.Priv)
+	}
+	return nil
+}
+
+func localizeKey(h func() hash.Hash, password string, engineID []byte) []byte {
+	d := h()
+	buf := make([]byte, 64)
+	for i := 0; i < 1048576; i += len(buf) {
+		for j := range buf {
+			buf[j] = password[(i+j)%len(password)]
+		}
+		d.Write(buf)
+	}
+	ku := d.Sum(nil)
+	d.Reset()
+	d.Write(ku)
+	d.Write(engineID)
+	d.Write(ku)
+	return d.Sum(nil)
+}
+
+func (o *snmpOutput) Write(m *server.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.reqID++
+
+	uptime := uint32(time.Since(o.start) / (10 * time.Millisecond))
+	varbinds := berVarbind(sysUpTimeOID, berTLV(0x43, berUint(uptime))) // TimeTicks
+	varbinds = append(varbinds, berVarbind(snmpTrapOIDOID, berOID(o.trapOID))...)
+	for _, vb := range o.varbinds {
+		var value []byte
+		switch v := vb.get(m).(type) {
+		case int:
+			value = berInt(v)
+		case string:
+			value = berTLV(0x04, []byte(v))
+		}
+		varbinds = append(varbinds, berVarbind(vb.oid, value)...)
+	}
+	pdu := berTLV(0xa7, concat(berInt(int(o.reqID&0x7fffffff)), berInt(0), berInt(0), berTLV(0x30, varbinds))) // SNMPv2-Trap-PDU
+
+	var packet []byte
+	if o.v3 {
+		var err error
+		if packet, err = o.v3Message(pdu); err != nil {
+			return err
+		}
+	} else {
+		packet = berTLV(0x30, concat(berInt(1), berTLV(0x04, []byte(o.community)), pdu))
+	}
+
+	if o.conn == nil {
+		conn, err := net.Dial("udp", o.addr)
+		if err != nil {
+			return err
+		}
+		o.conn = conn
+	}
+	_, err := o.conn.Write(packet)
+	return err
+}
+
+// v3Message wraps pdu in a message of the user-based security model,
+// authenticated with HMAC-MD5-96 or HMAC-SHA-96 and encrypted with
+// AES-128-CFB as configured.
+func (o *snmpOutput) v3Message(pdu []byte) ([]byte, error) {
+	boots := 1
+	engineTime := int(time.Since(o.start) / time.Second)
+
+	var flags byte
+	if o.authKey != nil {
+		flags |= 1
+	}
+	scoped := berTLV(0x30, concat(berTLV(0x04, o.engineID), berTLV(0x04, nil), pdu))
+	var privParams []byte
+	if o.privKey != nil {
+		flags |= 2
+		privParams = make([]byte, 8)
+		if _, err := rand.Read(privParams); err != nil {
+			return nil, err
+		}
+		iv := make([]byte, 16)
+		binary.BigEndian.PutUint32(iv, uint32(boots))
+		binary.BigEndian.PutUint32(iv[4:], uint32(engineTime))
+		copy(iv[8:], privParams)
+		block, err := aes.NewCipher(o.privKey)
+		if err != nil {
+			return nil, err
+		}
+		encrypted := make([]byte, len(scoped))
+		cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted, scoped)
+		scoped = berTLV(0x04, encrypted)
+	}
+
+	var authParams []byte
+	if o.authKey != nil {
+		authParams = make([]byte, 12)
+	}
+	global := berTLV(0x30, concat(berInt(int(o.reqID&0x7fffffff)), berInt(65507), berTLV(0x04, []byte{flags}), berInt(3)))
+	secParams := berTLV(0x30, concat(berTLV(0x04, o.engineID), berInt(boots), berInt(engineTime),
+		berTLV(0x04, []byte(o.user)), berTLV(0x04, authParams), berTLV(0x04, privParams)))
+	msg := berTLV(0x30, concat(berInt(3), global, berTLV(0x04, secParams), scoped))
+
+	if o.authKey != nil {
+		// The authentication parameters are the first 12 zero bytes after
+		// the user name, which the digest of the message replaces.
+		i := len(msg) - len(scoped) - len(privParams) - 2 - 12
+		mac := hmac.New(o.authHash, o.authKey)
+		mac.Write(msg)
+		copy(msg[i:i+12], mac.Sum(nil))
+	}
+	return msg, nil
+}
+
+func (o *snmpOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.conn != nil {
+		return o.conn.Close()
+	}
+	return nil
+}
+
+func parseOID(s string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	oid := make([]uint32, len(parts))
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid[i] = uint32(n)
+	}
+	if oid[0] > 2 || oid[0] < 2 && oid[1] >= 40 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return oid, nil
+}
+
+func mustParseOID(s string) []uint32 {
+	oid, err := parseOID(s)
+	if err != nil {
+		panic(err)
+	}
+	return oid
+}
+
+func compareOIDs(a, b []uint32) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// The BER encoding of the SNMP messages.
+
+func berTLV(tag byte, value []byte) []byte {
+	b := []byte{tag}
+	switch n := len(value); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, value...)
+}
+
+func berInt(v int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if (v == 0 && b[0] < 0x80) || (v == -1 && b[0] >= 0x80) {
+			break
+		}
+	}
+	return berTLV(0x02, b)
+}
+
+// berUint is the content of an unsigned application type.
+func berUint(v uint32) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0] >= 0x80 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+func berOID(oid []uint32) []byte {
+	b := berSubID(nil, oid[0]*40+oid[1])
+	for _, n := range oid[2:] {
+		b = berSubID(b, n)
+	}
+	return berTLV(0x06, b)
+}
+
+func berSubID(b []byte, n uint32) []byte {
+	var tmp [5]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(n & 0x7f)
+	for n >>= 7; n > 0; n >>= 7 {
+		i--
+		tmp[i] = byte(n&0x7f) | 0x80
+	}
+	return append(b, tmp[i:]...)
+}
+
+func berVarbind(oid []uint32, value []byte) []byte {
+	return berTLV(0x30, concat(berOID(oid), value))
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
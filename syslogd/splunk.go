@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	splunkEventPath   = "/services/collector/event"
+	splunkAckPath     = "/services/collector/ack"
+	splunkAckInterval = time.Second
+	splunkAckTimeout  = time.Minute
+)
+
+// splunkOutput sends messages to the HTTP Event Collector of Splunk, as
+// events whose index, source type and indexed fields come from message
+// properties. Without a format the event is the JSON object of the
+// message. With ack, every batch waits for indexer acknowledgement, and
+// is sent again if Splunk does not acknowledge it in time.
+type splunkOutput struct {
+	*batchOutput
+	url        string
+	ackURL     string
+	token      string
+	channel    string
+	index      string
+	sourceType string
+	source     string
+	ack        bool
+	client     *http.Client
+	format     formatter
+	fields     []streamField
+}
+
+// splunkEvent is an event of the HEC JSON format.
+type splunkEvent struct {
+	Time       json.Number       `json:"time"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	SourceType string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      interface{}       `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// newSplunkOutput sends to url, https://host:8088, authenticated with the
+// HEC token api_key.
+func newSplunkOutput(name string, c outputConfig, format formatter) (*splunkOutput, error) {
+	if c.URL == "" || c.APIKey == "" {
+		return nil, fmt.Errorf("splunk output requires a url and an api_key")
+	}
+	client, err := newHTTPClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimSuffix(c.URL, "/")
+	o := &splunkOutput{
+		url:        base + splunkEventPath,
+		ackURL:     base + splunkAckPath,
+		token:      c.APIKey,
+		index:      c.Index,
+		sourceType: c.SourceType,
+		source:     c.Source,
+		ack:        c.Ack,
+		client:     client,
+		format:     format,
+	}
+	if o.format == nil && o.sourceType == "" {
+		o.sourceType = "_json"
+	}
+	for _, t := range []string{o.index, o.sourceType, o.source} {
+		for _, p := range pathProperty.FindAllString(t, -1) {
+			if _, ok := pathProperties[strings.Trim(p, "%")]; !ok {
+				return nil, fmt.Errorf("unknown property %s in %s", p, t)
+			}
+		}
+	}
+	for name, prop := range c.Fields {
+		get, ok := labelFields[prop]
+		if !ok {
+			get, ok = messageFields[prop]
+		}
+		if strings.HasPrefix(prop, "sd.") {
+			get, ok = sdParam(prop[3:])
+		}
+		if !ok {
+			return nil, fmt.Errorf("field %s: unknown property %s", name, prop)
+		}
+		o.fields = append(o.fields, streamField{name, get})
+	}
+	sort.Slice(o.fields, func(i, j int) bool { return o.fields[i].name < o.fields[j].name })
+
+	// Acknowledgements are tracked by channel, a GUID of the client.
+	id := make([]byte, 16)
+	rand.Read(id)
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	h := hex.EncodeToString(id)
+	o.channel = h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	return o, nil
+}
+
+// expand returns template with the properties of m.
+func (o *splunkOutput) expand(template string, m *server.Message) string {
+	return pathProperty.ReplaceAllStringFunc(template, func(p string) string {
+		return pathProperties[strings.Trim(p, "%")](m)
+	})
+}
+
+func (o *splunkOutput) send(batch []*server.Message) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetEscapeHTML(false)
+	for _, m := range batch {
+		e := splunkEvent{
+			Time:       json.Number(strconv.FormatFloat(float64(headerTime(m).UnixMilli())/1000, 'f', 3, 64)),
+			Host:       hostname(m),
+			Source:     o.expand(o.source, m),
+			SourceType: o.expand(o.sourceType, m),
+			Index:      strings.ToLower(o.expand(o.index, m)),
+		}
+		if o.format == nil {
+			e.Event = newJSONMessage(m)
+		} else {
+			line, err := o.format(m)
+			if err != nil {
+				log.Printf("output %s: %v", o.name, err)
+				continue
+			}
+			e.Event = line
+		}
+		if len(o.fields) > 0 {
+			e.Fields = make(map[string]string, len(o.fields))
+			for _, f := range o.fields {
+				if v := f.get(m); v != "" {
+					e.Fields[f.name] = v
+				}
+			}
+		}
+		if err := enc.Encode(e); err != nil {
+			log.Printf("output %s: %v", o.name, err)
+		}
+	}
+
+	var resp struct {
+		Text  string `json:"text"`
+		Code  int    `json:"code"`
+		AckID *int64 `json:"ackId"`
+	}
+	if err := o.post(o.url, body.Bytes(), &resp); err != nil {
+		return err
+	}
+	if !o.ack {
+		return nil
+	}
+	if resp.AckID == nil {
+		return permanentError{errors.New("no ackId in the response, is indexer acknowledgement enabled for the token?")}
+	}
+	return o.waitAck(*resp.AckID)
+}
+
+// waitAck polls the acknowledgement of id until Splunk has indexed its
+// events or splunkAckTimeout has passed.
+func (o *splunkOutput) waitAck(id int64) error {
+	req, _ := json.Marshal(map[string][]int64{"acks": {id}})
+	key := strconv.FormatInt(id, 10)
+	for deadline := time.Now().Add(splunkAckTimeout); time.Now().Before(deadline); {
+		time.Sleep(splunkAckInterval)
+		var resp struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		if err := o.post(o.ackURL, req, &resp); err != nil {
+			return fmt.Errorf("acknowledgement %d: %v", id, err)
+		}
+		if resp.Acks[key] {
+			return nil
+		}
+	}
+	return fmt.Errorf("acknowledgement %d not received within %v", id, splunkAckTimeout)
+}
+
+// post sends body to url, decoding the JSON response into v.
+func (o *splunkOutput) post(url string, body []byte, v interface{}) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Splunk "+o.token)
+	req.Header.Set("X-Splunk-Request-Channel", o.channel)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+	_ "modernc.org/sqlite"
+)
+
+const defaultStorePath = "/var/lib/syslogd/logs.db"
+
+// storeSchema keeps the whole message as a queue record, along with the
+// columns queries filter on, and indexes the words of the columns for
+// full-text search.
+const storeSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id       INTEGER PRIMARY KEY,
+	time     INTEGER NOT NULL,
+	hostname TEXT NOT NULL,
+	program  TEXT NOT NULL,
+	severity INTEGER NOT NULL,
+	message  TEXT NOT NULL,
+	record   BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_time ON messages (time);
+CREATE INDEX IF NOT EXISTS messages_hostname ON messages (hostname, time);
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+	message, hostname, program, content='messages', content_rowid='id'
+);
+CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+	INSERT INTO messages_fts (rowid, message, hostname, program)
+	VALUES (new.id, new.message, new.hostname, new.program);
+END;
+CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+	INSERT INTO messages_fts (messages_fts, rowid, message, hostname, program)
+	VALUES ('delete', old.id, old.message, old.hostname, old.program);
+END;
+`
+
+const (
+	storePurgeInterval = 10 * time.Minute
+	storePurgeBatch    = 10000
+)
+
+// parseStoreURL returns the database path of a store such as
+// sqlite:///var/lib/syslogd/logs.db.
+func parseStoreURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "sqlite" {
+		return "", fmt.Errorf("unsupported store %q", s)
+	}
+	path := u.Host + u.Path
+	if path == "" {
+		return "", fmt.Errorf("store %q has no path", s)
+	}
+	return filepath.Clean(path), nil
+}
+
+func openStore(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// Index the messages of a store that predates the index.
+	var indexed int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'messages_fts'").Scan(&indexed); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if _, err := db.Exec(storeSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if indexed == 0 {
+		if _, err := db.Exec("INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')"); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return db, nil
+}
+
+// purgeStore deletes the messages received before t, a batch at a time
+// not to hold up the writers, and returns their number.
+func purgeStore(db *sql.DB, t time.Time) (int64, error) {
+	var total int64
+	for {
+		res, err := db.Exec("DELETE FROM messages WHERE id IN (SELECT id FROM messages WHERE time < ? LIMIT ?)", t.UnixNano(), storePurgeBatch)
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < storePurgeBatch {
+			return total, nil
+		}
+	}
+}
+
+// storeOutput saves messages into the local SQLite store that
+// "syslogd query" searches.
+type storeOutput struct {
+	*batchOutput
+	db        *sql.DB
+	retention time.Duration
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newStoreOutput(name string, c outputConfig) (*storeOutput, error) {
+	if c.Path == "" {
+		return nil, fmt.Errorf("sqlite output requires a path")
+	}
+	db, err := openStore(c.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &storeOutput{db: db, retention: c.Retention, stop: make(chan struct{}), done: make(chan struct{})}
+	o.batchOutput = newBatchOutput(name, c, o.send)
+	go o.purge()
+	return o, nil
+}
+
+// purge deletes the messages older than the retention, if any.
+func (o *storeOutput) purge() {
+	defer close(o.done)
+	if o.retention <= 0 {
+		return
+	}
+	t := time.NewTicker(storePurgeInterval)
+	defer t.Stop()
+	for {
+		n, err := purgeStore(o.db, time.Now().Add(-o.retention))
+		if err != nil {
+			log.Printf("output %s: purge: %v", o.name, err)
+		} else if n > 0 {
+			log.Printf("output %s: purged %d messages older than %s", o.name, n, o.retention)
+		}
+		select {
+		case <-t.C:
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+func (o *storeOutput) send(batch []*server.Message) error {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO messages (time, hostname, program, severity, message, record) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, m := range batch {
+		record, err := encodeMessage(m)
+		if err != nil {
+			log.Printf("output %s: %v", o.name, err)
+			continue
+		}
+		if _, err := stmt.Exec(m.Time.UnixNano(), headerHostname(m), program(m), int(m.Severity), m.Content, record); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (o *storeOutput) Close() error {
+	o.batchOutput.Close()
+	close(o.stop)
+	<-o.done
+	return o.db.Close()
+}
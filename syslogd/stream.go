@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const (
+	streamBuffer    = 1000
+	streamKeepalive = 15 * time.Second
+)
+
+// streams passes the messages routed on to the clients of /api/v1/stream.
+var streams = &broadcast{subs: make(map[*subscriber]bool)}
+
+type broadcast struct {
+	mu   sync.RWMutex
+	subs map[*subscriber]bool
+	n    atomic.Int32
+}
+
+// subscriber gets the messages that match its filter, as long as it keeps
+// up: those that do not fit in its buffer are counted as dropped.
+type subscriber struct {
+	filter  messageFilter
+	c       chan *server.Message
+	dropped atomic.Uint64
+}
+
+func (b *broadcast) subscribe(f messageFilter) *subscriber {
+	s := &subscriber{filter: f, c: make(chan *server.Message, streamBuffer)}
+	b.mu.Lock()
+	b.subs[s] = true
+	b.n.Add(1)
+	b.mu.Unlock()
+	return s
+}
+
+func (b *broadcast) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	delete(b.subs, s)
+	b.n.Add(-1)
+	b.mu.Unlock()
+}
+
+func (b *broadcast) publish(m *server.Message) {
+	if b.n.Load() == 0 {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if !s.filter.match(m) {
+			continue
+		}
+		select {
+		case s.c <- m:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// streamHandler sends the messages routed as server-sent events, each a
+// JSON message, as they come. The parameters host, tag, severity and q
+// filter them as for /api/v1/messages, and since first sends those of the
+// ring buffer received since then. Messages the client is too slow to take
+// are skipped, and reported by a dropped event with their count.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	f, err := newMessageFilter("", "", r.FormValue("host"), r.FormValue("tag"), severityParam(r), r.FormValue("q"), "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var backlog []*server.Message
+	if s := r.FormValue("since"); s != "" {
+		if recent == nil {
+			http.Error(w, "the ring buffer is disabled", http.StatusNotFound)
+			return
+		}
+		since, err := parseQueryTime(s, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, m := range recent.since(since) {
+			if f.match(m) {
+				backlog = append(backlog, m)
+			}
+		}
+	}
+
+	sub := streams.subscribe(f)
+	defer streams.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	send := func(m *server.Message) error {
+		buf.Reset()
+		buf.WriteString("data: ")
+		if enc.Encode(newJSONMessage(m)) != nil {
+			return nil
+		}
+		buf.WriteString("\n")
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	for _, m := range backlog {
+		if send(m) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	var reported uint64
+	for {
+		select {
+		case m := <-sub.c:
+			if dropped := sub.dropped.Load(); dropped != reported {
+				if _, err := fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", dropped-reported); err != nil {
+					return
+				}
+				reported = dropped
+			}
+			if send(m) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,118 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// activatedSockets returns the sockets systemd passed with LISTEN_FDS,
+// named after the FileDescriptorName= of their socket unit. The variables
+// are unset, so that they do not pass on to child processes.
+func activatedSockets() ([]*activated, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var sockets []*activated
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		unix.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		a, err := openActivated(name, os.NewFile(uintptr(fd), name))
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %s (fd %d): %v", name, fd, err)
+		}
+		sockets = append(sockets, a)
+	}
+	return sockets, nil
+}
+
+// notifier reports the state of the service to systemd, when it runs
+// syslogd with Type=notify or notify-reload. The socket is connected at
+// startup, as it may be out of reach once the process is sandboxed.
+type notifier struct {
+	conn *net.UnixConn
+}
+
+func newNotifier() *notifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	os.Unsetenv("NOTIFY_SOCKET")
+	if path == "" {
+		return &notifier{}
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Printf("sd_notify: %v", err)
+		return &notifier{}
+	}
+	return &notifier{conn: conn}
+}
+
+func (n *notifier) notify(state string) {
+	if n.conn == nil {
+		return
+	}
+	// Do not hang if the service manager stops reading.
+	n.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := n.conn.Write([]byte(state)); err != nil {
+		log.Printf("sd_notify: %v", err)
+	}
+}
+
+func (n *notifier) ready()    { n.notify("READY=1") }
+func (n *notifier) stopping() { n.notify("STOPPING=1") }
+
+// reloading must be followed by ready once the reload is done.
+func (n *notifier) reloading() {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	n.notify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", ts.Nano()/1000))
+}
+
+// watchdog sends keepalives at half the WatchdogSec= of the service for as
+// long as healthy reports true, so that systemd restarts a syslogd that
+// has stopped routing.
+func (n *notifier) watchdog(healthy func() bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if n.conn == nil || err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+			if healthy() {
+				n.notify("WATCHDOG=1")
+			}
+		}
+	}()
+}
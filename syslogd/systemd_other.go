@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+func activatedSockets() ([]*activated, error) { return nil, nil }
+
+type notifier struct{}
+
+func newNotifier() *notifier { return &notifier{} }
+
+func (n *notifier) ready()                       {}
+func (n *notifier) stopping()                    {}
+func (n *notifier) reloading()                   {}
+func (n *notifier) watchdog(healthy func() bool) {}
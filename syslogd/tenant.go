@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const tenantSDID = "tenant@32473"
+
+// tenantConfig routes the messages of one tenant of a shared collector,
+// those received on its listeners or from TLS senders with its client
+// certificates, by rules and to outputs of its own:
+//
+//	tenants:
+//	  - name: acme
+//	    listen: [tls://:6515]
+//	    peers: ['*.acme.example']
+//	    dir: /srv/logs/acme
+//	    rules:
+//	      - to: file %HOSTNAME%.log
+//
+// Outputs are named tenant/name, and with dir the paths of file, sqlite
+// and s3 outputs and of queues are relative to it and may not leave it.
+type tenantConfig struct {
+	Name    string                  `yaml:"name"`
+	Listen  stringList              `yaml:"listen"` // also listened on
+	Peers   stringList              `yaml:"peers"`  // patterns of the common name or a SAN of client certificates
+	Dir     string                  `yaml:"dir"`
+	Rules   []ruleConfig            `yaml:"rules"`
+	Outputs map[string]outputConfig `yaml:"outputs"`
+}
+
+func validateTenants(tenants []tenantConfig) error {
+	var errs []error
+	seen := make(map[string]bool)
+	listens := make(map[string]bool)
+	for i, t := range tenants {
+		report := func(err error, keys ...string) {
+			errs = append(errs, atKeys(err, append([]string{"tenants", strconv.Itoa(i)}, keys...)...))
+		}
+		if t.Name == "" || strings.ContainsAny(t.Name, "/ ") {
+			report(fmt.Errorf("tenant %d: invalid name %q", i+1, t.Name), "name")
+			continue
+		}
+		if seen[t.Name] {
+			report(fmt.Errorf("tenant %s: defined twice", t.Name), "name")
+		}
+		seen[t.Name] = true
+		if len(t.Listen) == 0 && len(t.Peers) == 0 {
+			report(fmt.Errorf("tenant %s: requires listen or peers", t.Name))
+		}
+		if len(t.Rules) == 0 {
+			report(fmt.Errorf("tenant %s: no rules", t.Name))
+		}
+		for j, l := range t.Listen {
+			if listens[l] {
+				report(fmt.Errorf("tenant %s: %s is listened on for another tenant", t.Name, l), "listen", strconv.Itoa(j))
+			}
+			listens[l] = true
+		}
+		for j, p := range t.Peers {
+			if _, err := path.Match(p, ""); err != nil {
+				report(fmt.Errorf("tenant %s: invalid peer pattern %q", t.Name, p), "peers", strconv.Itoa(j))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// outputFor resolves a destination of a rule of the tenant like
+// config.outputFor, among the outputs of the tenant only.
+func (t tenantConfig) outputFor(to string) (string, outputConfig, error) {
+	name, oc, err := (&config{Outputs: t.Outputs}).outputFor(to)
+	if err != nil {
+		return "", oc, err
+	}
+	if t.Dir != "" {
+		switch oc.Type {
+		case "file", "sqlite", "s3":
+			if oc.Path != "" || oc.Type != "s3" {
+				if oc.Path, err = t.path(oc.Path); err != nil {
+					return "", oc, err
+				}
+			}
+		}
+		if oc.Queue.Dir != "" {
+			if oc.Queue.Dir, err = t.path(oc.Queue.Dir); err != nil {
+				return "", oc, err
+			}
+		}
+	}
+	return t.Name + "/" + name, oc, nil
+}
+
+// path returns p in the directory of the tenant.
+func (t tenantConfig) path(p string) (string, error) {
+	if filepath.IsAbs(p) || !filepath.IsLocal(strings.ReplaceAll(p, "%", "")) {
+		return "", fmt.Errorf("path %s is not within the directory of tenant %s", p, t.Name)
+	}
+	return filepath.Join(t.Dir, p), nil
+}
+
+// tenantTagger is a server.Handler recording the tenant of messages in the
+// param name of tenant@32473, replacing any the sender set.
+type tenantTagger struct {
+	tenants atomic.Pointer[[]tenantConfig]
+}
+
+func newTenantTagger() *tenantTagger {
+	t := &tenantTagger{}
+	t.Set(nil)
+	return t
+}
+
+func (t *tenantTagger) Set(tenants []tenantConfig) {
+	t.tenants.Store(&tenants)
+}
+
+func (t *tenantTagger) Handle(m *server.Message) *server.Message {
+	if m == nil {
+		return nil
+	}
+	delete(m.StructuredData, tenantSDID)
+	if name := t.tenantOf(m); name != "" {
+		if m.StructuredData == nil {
+			m.StructuredData = make(map[string]map[string]string)
+		}
+		m.StructuredData[tenantSDID] = map[string]string{"name": name}
+	}
+	return m
+}
+
+// tenantOf returns the tenant of the listener of m, or else of its client
+// certificate.
+func (t *tenantTagger) tenantOf(m *server.Message) string {
+	tenants := *t.tenants.Load()
+	for _, tc := range tenants {
+		for _, l := range tc.Listen {
+			if l == m.Listener {
+				return tc.Name
+			}
+		}
+	}
+	if m.Peer == nil {
+		return ""
+	}
+	names := append([]string{m.Peer.CommonName}, m.Peer.SANs...)
+	for _, tc := range tenants {
+		for _, p := range tc.Peers {
+			for _, name := range names {
+				if ok, _ := path.Match(p, name); ok {
+					return tc.Name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// tenantListens returns the listen URLs of the tenants of c.
+func tenantListens(c *config) []string {
+	var listens []string
+	for _, t := range c.Tenants {
+		listens = append(listens, t.Listen...)
+	}
+	return listens
+}
+
+// tenant returns the tenant of m, as recorded by tenantTagger.
+func tenant(m *server.Message) string {
+	return m.StructuredData[tenantSDID]["name"]
+}
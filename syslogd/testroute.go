@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// runTestRoute shows how the rules of a config route sample messages,
+// without opening the outputs or firing the alerts.
+func runTestRoute(args []string) {
+	fs := flag.NewFlagSet("test-route", flag.ExitOnError)
+	configFile := fs.String("config", "", "routing configuration `file` (YAML)")
+	message := fs.String("message", "", "the `message` to route, as received, e.g. '<34>Oct 11 22:14:15 host su: failed'")
+	file := fs.String("file", "", "route the messages of `file`, one per line, - for the standard input")
+	from := fs.String("from", "", "`IP` address of the sender")
+	tenantName := fs.String("tenant", "", "route as the messages of the `tenant`")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s test-route -config file -message message | -file file\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *configFile == "" || (*message == "") == (*file == "") || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := loadConfigFile(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	c.Alerts = nil
+	r, err := newRouterWith(c, func(string, outputConfig) (output, error) { return discardOutput{}, nil })
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer r.Close()
+
+	var src net.Addr
+	if *from != "" {
+		ip := net.ParseIP(*from)
+		if ip == nil {
+			fmt.Fprintf(os.Stderr, "invalid -from %q\n", *from)
+			os.Exit(2)
+		}
+		src = &net.UDPAddr{IP: ip}
+	}
+
+	lines := []string{*message}
+	if *file != "" {
+		var f io.Reader = os.Stdin
+		if *file != "-" {
+			fh, err := os.Open(*file)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer fh.Close()
+			f = fh
+		}
+		lines = nil
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, server.MaxMessageSize)
+		for sc.Scan() {
+			if sc.Text() != "" {
+				lines = append(lines, sc.Text())
+			}
+		}
+		if err := sc.Err(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	for i, line := range lines {
+		if i > 0 {
+			fmt.Println()
+		}
+		m := server.Parse([]byte(line), src)
+		if *tenantName != "" {
+			m.StructuredData = map[string]map[string]string{tenantSDID: {"name": *tenantName}}
+		}
+		testRoute(os.Stdout, c, r, m)
+	}
+}
+
+// testRoute writes how r routes m: whether the rules select it, up to the
+// one that ends the routing, and the outputs it reaches.
+func testRoute(w io.Writer, c *config, r *router, m *server.Message) {
+	fmt.Fprintln(w, m.Raw)
+	fmt.Fprintf(w, "  %s.%s host=%s program=%s\n", m.Facility, m.Severity, m.Hostname, m.Tag)
+	if m = applyTransforms(r.transforms, m); m == nil {
+		fmt.Fprintln(w, "  dropped by a transform")
+		return
+	}
+
+	rules := c.Rules
+	if _, ok := r.tenants[tenant(m)]; ok {
+		fmt.Fprintf(w, "  tenant %s\n", tenant(m))
+		rules = c.Tenants[c.tenantIndex(tenant(m))].Rules
+	}
+	if len(rules) == 0 {
+		rules = []ruleConfig{{To: stringList{"stdout"}}}
+	}
+
+	var outputs []string
+	seen := make(map[string]bool)
+	r.walk(m, func(i int, rt route, matched bool) {
+		var conds []string
+		if rules[i].Selector != "" {
+			conds = append(conds, "selector "+rules[i].Selector)
+		}
+		if rules[i].Match != "" {
+			conds = append(conds, "match "+rules[i].Match)
+		}
+		if len(conds) == 0 {
+			conds = append(conds, "every message")
+		}
+
+		result := "no match"
+		switch {
+		case rt.action == actionDrop && matched:
+			result = "matched, drop"
+		case rt.action == actionKeep && !matched:
+			result = "no match, keep"
+		case matched:
+			result = "matched"
+			if len(rt.outputs) > 0 {
+				result += ", to " + strings.Join(rt.outputs, ", ")
+			}
+			if rt.final {
+				result += ", final"
+			}
+			for _, name := range rt.outputs {
+				if !seen[name] {
+					seen[name] = true
+					outputs = append(outputs, name)
+				}
+			}
+		}
+		fmt.Fprintf(w, "  rule %d (%s): %s\n", i+1, strings.Join(conds, ", "), result)
+	})
+
+	if len(outputs) == 0 {
+		fmt.Fprintln(w, "  reaches no output")
+	} else {
+		fmt.Fprintf(w, "  reaches %s\n", strings.Join(outputs, ", "))
+	}
+}
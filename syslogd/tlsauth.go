@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+const defaultTLSSDID = "tls@32473"
+
+func parseClientAuth(mode string, haveCA bool) (tls.ClientAuthType, error) {
+	switch mode {
+	case "":
+		if haveCA {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.NoClientCert, nil
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		if !haveCA {
+			return 0, errors.New("tls client_auth request requires a ca")
+		}
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		if !haveCA {
+			return 0, errors.New("tls client_auth require requires a ca")
+		}
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return 0, fmt.Errorf("unknown tls client_auth %q", mode)
+}
+
+// revocationChecker refuses the client certificates of verified chains
+// that a CRL lists, or that their OCSP responder reports revoked. The
+// answers of the responders are cached until their next update, and
+// failures for a minute.
+type revocationChecker struct {
+	crls []*x509.RevocationList
+	ocsp string // soft or hard
+
+	mu    sync.Mutex
+	cache map[string]ocspStatus
+}
+
+type ocspStatus struct {
+	err   error // the reason to refuse the certificate, if any
+	until time.Time
+}
+
+// newRevocationChecker returns nil if files ask for no revocation checks.
+// The CRLs must be signed by a certificate of the CA file caPEM.
+func newRevocationChecker(files tlsFiles, caPEM []byte) (*revocationChecker, error) {
+	switch files.OCSP {
+	case "", "off", "soft", "hard":
+	default:
+		return nil, fmt.Errorf("unknown tls ocsp mode %q", files.OCSP)
+	}
+	rc := &revocationChecker{cache: make(map[string]ocspStatus)}
+	if files.OCSP == "soft" || files.OCSP == "hard" {
+		rc.ocsp = files.OCSP
+	}
+	if files.CRL != "" {
+		var err error
+		if rc.crls, err = loadCRLs(files.CRL, caPEM); err != nil {
+			return nil, err
+		}
+	}
+	if rc.ocsp == "" && len(rc.crls) == 0 {
+		return nil, nil
+	}
+	return rc, nil
+}
+
+func loadCRLs(path string, caPEM []byte) ([]*x509.RevocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ders [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+
+	var cas []*x509.Certificate
+	for rest := caPEM; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if c, err := x509.ParseCertificate(block.Bytes); err == nil {
+			cas = append(cas, c)
+		}
+	}
+
+	var crls []*x509.RevocationList
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		signed := false
+		for _, ca := range cas {
+			if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return nil, fmt.Errorf("%s: CRL of %s is not signed by a CA of the tls ca file", path, crl.Issuer)
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// verify checks the certificates of the chain the client was verified
+// with, up to its root, and the OCSP status of the client certificate.
+func (rc *revocationChecker) verify(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	chain := cs.VerifiedChains[0]
+	for i, cert := range chain[:len(chain)-1] {
+		for _, crl := range rc.crls {
+			if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) {
+				continue
+			}
+			for _, e := range crl.RevokedCertificateEntries {
+				if e.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("certificate of %s is revoked", cert.Subject)
+				}
+			}
+		}
+		if i == 0 && rc.ocsp != "" {
+			if err := rc.checkOCSP(cert, chain[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (rc *revocationChecker) checkOCSP(cert, issuer *x509.Certificate) error {
+	key := string(issuer.RawSubject) + cert.SerialNumber.String()
+	rc.mu.Lock()
+	st, ok := rc.cache[key]
+	rc.mu.Unlock()
+	if ok && time.Now().Before(st.until) {
+		return st.err
+	}
+
+	revoked, nextUpdate, err := queryOCSP(cert, issuer)
+	switch {
+	case err != nil:
+		log.Printf("tls: OCSP status of %s: %v", cert.Subject, err)
+		st = ocspStatus{until: time.Now().Add(time.Minute)}
+		if rc.ocsp == "hard" {
+			st.err = fmt.Errorf("OCSP status of %s unknown", cert.Subject)
+		}
+	case revoked:
+		st = ocspStatus{err: fmt.Errorf("certificate of %s is revoked", cert.Subject), until: nextUpdate}
+	default:
+		st = ocspStatus{until: nextUpdate}
+	}
+	rc.mu.Lock()
+	rc.cache[key] = st
+	rc.mu.Unlock()
+	return st.err
+}
+
+// The OCSP messages of RFC 6960, as far as they are used here.
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	KeyHash       []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			Cert ocspCertID
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type basicOCSPResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certs              []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"optional,explicit,default:0,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+	Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked    asn1.RawValue    `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+var (
+	oidSHA1                 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidOCSPBasic            = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+		"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+		"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+		"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+		"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+		"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+		"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+		"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+		"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+		"1.3.101.112":           x509.PureEd25519,
+	}
+)
+
+var ocspClient = &http.Client{Timeout: 5 * time.Second}
+
+// queryOCSP asks the first responder of cert for its status, and returns
+// whether it is revoked and until when the answer holds.
+func queryOCSP(cert, issuer *x509.Certificate) (bool, time.Time, error) {
+	if len(cert.OCSPServer) == 0 {
+		return false, time.Time{}, errors.New("no OCSP responder")
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false, time.Time{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+
+	var req ocspRequest
+	req.TBSRequest.RequestList = make([]struct{ Cert ocspCertID }, 1)
+	req.TBSRequest.RequestList[0].Cert = ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		KeyHash:       keyHash[:],
+		SerialNumber:  cert.SerialNumber,
+	}
+	body, err := asn1.Marshal(req)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	resp, err := ocspClient.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(body))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, time.Time{}, fmt.Errorf("%s: %s", cert.OCSPServer[0], resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	return parseOCSPResponse(data, cert, issuer)
+}
+
+func parseOCSPResponse(data []byte, cert, issuer *x509.Certificate) (bool, time.Time, error) {
+	var r ocspResponse
+	if _, err := asn1.Unmarshal(data, &r); err != nil {
+		return false, time.Time{}, fmt.Errorf("invalid OCSP response: %v", err)
+	}
+	if r.Status != 0 {
+		return false, time.Time{}, fmt.Errorf("OCSP response status %d", r.Status)
+	}
+	if !r.ResponseBytes.ResponseType.Equal(oidOCSPBasic) {
+		return false, time.Time{}, errors.New("OCSP response of unknown type")
+	}
+	var basic basicOCSPResponse
+	if _, err := asn1.Unmarshal(r.ResponseBytes.Response, &basic); err != nil {
+		return false, time.Time{}, fmt.Errorf("invalid OCSP response: %v", err)
+	}
+	var rd ocspResponseData
+	if _, err := asn1.Unmarshal(basic.TBSResponseData.FullBytes, &rd); err != nil {
+		return false, time.Time{}, fmt.Errorf("invalid OCSP response: %v", err)
+	}
+
+	// The response is signed by the issuer, or by a responder the issuer
+	// delegated to.
+	algo, ok := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return false, time.Time{}, fmt.Errorf("OCSP response signed with unsupported %v", basic.SignatureAlgorithm.Algorithm)
+	}
+	signer := issuer
+	if len(basic.Certs) > 0 {
+		c, err := x509.ParseCertificate(basic.Certs[0].FullBytes)
+		if err != nil {
+			return false, time.Time{}, fmt.Errorf("invalid OCSP responder certificate: %v", err)
+		}
+		if !c.Equal(issuer) {
+			if err := c.CheckSignatureFrom(issuer); err != nil {
+				return false, time.Time{}, fmt.Errorf("OCSP responder certificate: %v", err)
+			}
+			if !hasExtKeyUsage(c, x509.ExtKeyUsageOCSPSigning) {
+				return false, time.Time{}, errors.New("OCSP responder certificate is not for OCSP signing")
+			}
+			signer = c
+		}
+	}
+	if err := signer.CheckSignature(algo, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()); err != nil {
+		return false, time.Time{}, fmt.Errorf("OCSP response signature: %v", err)
+	}
+
+	now := time.Now()
+	for _, sr := range rd.Responses {
+		if sr.CertID.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			continue
+		}
+		if sr.ThisUpdate.After(now.Add(5 * time.Minute)) {
+			return false, time.Time{}, errors.New("OCSP response from the future")
+		}
+		until := now.Add(time.Hour)
+		if !sr.NextUpdate.IsZero() {
+			if sr.NextUpdate.Before(now) {
+				return false, time.Time{}, errors.New("OCSP response expired")
+			}
+			until = sr.NextUpdate
+		}
+		switch {
+		case sr.Revoked.FullBytes != nil:
+			return true, until, nil
+		case bool(sr.Unknown):
+			return false, time.Time{}, errors.New("certificate unknown to the OCSP responder")
+		}
+		return false, until, nil
+	}
+	return false, time.Time{}, errors.New("OCSP response without the certificate")
+}
+
+func hasExtKeyUsage(c *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range c.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// peerSD is a server.Handler adding the client certificate of TLS senders
+// to the structured data of messages, as the params cn and san (the
+// subject alternative names separated by commas), for rules and outputs
+// to authorize and audit senders by their identity.
+type peerSD struct {
+	sdID atomic.Value // string
+}
+
+func newPeerSD() *peerSD {
+	p := &peerSD{}
+	p.Set("")
+	return p
+}
+
+func (p *peerSD) Set(sdID string) {
+	if sdID == "" {
+		sdID = defaultTLSSDID
+	}
+	p.sdID.Store(sdID)
+}
+
+func (p *peerSD) Handle(m *server.Message) *server.Message {
+	if m == nil || m.Peer == nil {
+		return m
+	}
+	params := map[string]string{"cn": m.Peer.CommonName}
+	if len(m.Peer.SANs) > 0 {
+		params["san"] = strings.Join(m.Peer.SANs, ",")
+	}
+	if m.StructuredData == nil {
+		m.StructuredData = make(map[string]map[string]string)
+	}
+	m.StructuredData[p.sdID.Load().(string)] = params
+	return m
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/haccht/syslog_tools/server"
+)
+
+// The trace context headers, as written by logging libraries into the
+// messages, e.g. traceparent=00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01,
+// "b3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1" or
+// X-B3-TraceId: 80f198ee56343ba8 X-B3-SpanId: e457b5a2e4d86bd1.
+var (
+	traceparentHeader = regexp.MustCompile(`(?i)\btraceparent["']?\s*[:=]\s*["']?([0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2})\b`)
+	b3Header          = regexp.MustCompile(`(?i)\bb3["']?\s*[:=]\s*["']?([0-9a-f]{16}(?:[0-9a-f]{16})?-[0-9a-f]{16})\b`)
+	b3TraceIDHeader   = regexp.MustCompile(`(?i)\bx-b3-traceid["']?\s*[:=]\s*["']?([0-9a-f]{16}(?:[0-9a-f]{16})?)\b`)
+	b3SpanIDHeader    = regexp.MustCompile(`(?i)\bx-b3-spanid["']?\s*[:=]\s*["']?([0-9a-f]{16})\b`)
+)
+
+// traceContext is a server.Handler setting the trace and span IDs of the
+// messages that carry a W3C traceparent or B3 headers, as parameters of
+// their structured data or in their content, so that outputs can
+// correlate them with the traces. The structured data wins over the
+// content, and traceparent over B3.
+type traceContext struct {
+	enabled atomic.Bool
+}
+
+func newTraceContext() *traceContext {
+	return &traceContext{}
+}
+
+func (t *traceContext) Set(enabled bool) {
+	t.enabled.Store(enabled)
+}
+
+func (t *traceContext) Handle(m *server.Message) *server.Message {
+	if m == nil || !t.enabled.Load() || m.TraceID != "" {
+		return m
+	}
+	if traceID, spanID, ok := traceFromSD(m.StructuredData); ok {
+		m.TraceID, m.SpanID = traceID, spanID
+	} else if traceID, spanID, ok := traceFromText(m.Content); ok {
+		m.TraceID, m.SpanID = traceID, spanID
+	}
+	return m
+}
+
+// traceFromSD returns the trace context of the params of sd, by the names
+// of the headers in any case.
+func traceFromSD(sd map[string]map[string]string) (traceID, spanID string, ok bool) {
+	var b3, b3TraceID, b3SpanID string
+	for _, params := range sd {
+		for name, v := range params {
+			switch strings.ToLower(name) {
+			case "traceparent":
+				if traceID, spanID, ok := parseTraceparent(v); ok {
+					return traceID, spanID, true
+				}
+			case "b3":
+				b3 = v
+			case "x-b3-traceid":
+				b3TraceID = v
+			case "x-b3-spanid":
+				b3SpanID = v
+			}
+		}
+	}
+	if b3 != "" {
+		return parseB3(b3)
+	}
+	return validTrace(padTraceID(strings.ToLower(b3TraceID)), strings.ToLower(b3SpanID))
+}
+
+// traceFromText returns the trace context of the headers in s.
+func traceFromText(s string) (traceID, spanID string, ok bool) {
+	// Most messages carry none, skip them before the expressions.
+	lower := strings.ToLower(s)
+	if !strings.Contains(lower, "traceparent") && !strings.Contains(lower, "b3") {
+		return "", "", false
+	}
+	if sm := traceparentHeader.FindStringSubmatch(s); sm != nil {
+		if traceID, spanID, ok := parseTraceparent(sm[1]); ok {
+			return traceID, spanID, true
+		}
+	}
+	if sm := b3Header.FindStringSubmatch(s); sm != nil {
+		if traceID, spanID, ok := parseB3(sm[1]); ok {
+			return traceID, spanID, true
+		}
+	}
+	tm, sm := b3TraceIDHeader.FindStringSubmatch(s), b3SpanIDHeader.FindStringSubmatch(s)
+	if tm == nil || sm == nil {
+		return "", "", false
+	}
+	return validTrace(padTraceID(strings.ToLower(tm[1])), strings.ToLower(sm[1]))
+}
+
+// parseTraceparent parses version-traceid-spanid-flags, rejecting the
+// invalid version ff.
+func parseTraceparent(v string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(v)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return "", "", false
+	}
+	return validTrace(parts[1], parts[2])
+}
+
+// parseB3 parses traceid-spanid[-sampled[-parentspanid]] of the single
+// b3 header.
+func parseB3(v string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(v)), "-")
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	return validTrace(padTraceID(parts[0]), parts[1])
+}
+
+// padTraceID extends the 64-bit trace IDs of B3 to 128 bits.
+func padTraceID(id string) string {
+	if len(id) == 16 {
+		return strings.Repeat("0", 16) + id
+	}
+	return id
+}
+
+// validTrace returns traceID and spanID if they are lowercase hex of 32
+// and 16 digits, not all zeros.
+func validTrace(traceID, spanID string) (string, string, bool) {
+	if !isTraceHex(traceID, 32) || !isTraceHex(spanID, 16) {
+		return "", "", false
+	}
+	return traceID, spanID, true
+}
+
+func isTraceHex(s string, n int) bool {
+	if len(s) != n || strings.Trim(s, "0") == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
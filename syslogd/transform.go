@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/haccht/syslog_tools/plugin"
+	"github.com/haccht/syslog_tools/server"
+)
+
+// transformConfig changes the messages that match If before they are
+// routed, for instance
+//
+//	if: host^=db & msg*='slow query'
+//	set: {severity: warning, sd.meta.class: slow_query}
+//
+// Values containing {{ are templates on the message, as for formats. A
+// payload is parsed before the changes, into the structured data element
+// SDID, and a transform of a plugin is run after them. The grok parser
+// takes the fields of the first of the Grok expressions that matches,
+// such as
+//
+//	if: program=sshd
+//	parse: grok
+//	grok: ['%{SSHDAUTH}', '%{SSHDINVALID}']
+//
+// A Lua script, see luaScript, runs after the changes and before the
+// plugin.
+type transformConfig struct {
+	If      string            `yaml:"if"`    // match expression, every message by default
+	Parse   string            `yaml:"parse"` // cef, json, logfmt or grok
+	Grok    stringList        `yaml:"grok"`  // expressions of the grok parser
+	SDID    string            `yaml:"sd_id"` // of the parsed fields, default PARSE@32473
+	Set     map[string]string `yaml:"set"`
+	Unset   stringList        `yaml:"unset"`
+	Drop    bool              `yaml:"drop"` // discard the message, before the alerts and rules
+	Stop    bool              `yaml:"stop"` // skip the following transforms
+	Lua     string            `yaml:"lua"`  // script run on the message
+	Plugin  string            `yaml:"plugin"`
+	Options plugin.Options    `yaml:"options"` // of the plugin
+}
+
+type setter func(m *server.Message, v string) error
+
+// payloadParser returns the fields of the payload of a message, or nil if
+// the message carries none.
+type payloadParser struct {
+	sdID  string
+	parse func(*server.Message) map[string]string
+}
+
+var payloadParsers = map[string]payloadParser{
+	"cef":    {"cef@32473", parseCEFMessage},
+	"json":   {"json@32473", parseJSONMessage},
+	"logfmt": {"logfmt@32473", parseLogfmtMessage},
+}
+
+// transformFields are the properties a transform can set. The raw message
+// stays as received.
+var transformFields = map[string]setter{
+	"facility": func(m *server.Message, v string) error {
+		f, err := parseFacility(v)
+		if err == nil {
+			m.Facility = f
+		}
+		return err
+	},
+	"severity": func(m *server.Message, v string) error {
+		s, err := parseSeverity(v)
+		if err == nil {
+			m.Severity = s
+		}
+		return err
+	},
+	"host":     func(m *server.Message, v string) error { m.Hostname = v; return nil },
+	"hostname": func(m *server.Message, v string) error { m.Hostname = v; return nil },
+	"tag":      func(m *server.Message, v string) error { m.Tag = v; return nil },
+	"app":      func(m *server.Message, v string) error { m.AppName = v; return nil },
+	"procid":   func(m *server.Message, v string) error { m.ProcID = v; return nil },
+	"msgid":    func(m *server.Message, v string) error { m.MsgID = v; return nil },
+	"trace_id": func(m *server.Message, v string) error { m.TraceID = v; return nil },
+	"span_id":  func(m *server.Message, v string) error { m.SpanID = v; return nil },
+	"msg":      func(m *server.Message, v string) error { m.Content = v; return nil },
+}
+
+type assignment struct {
+	name  string
+	set   setter
+	value func(*server.Message) (string, error)
+}
+
+type transform struct {
+	match  matcher
+	parse  func(*server.Message) map[string]string
+	sdID   string
+	set    []assignment
+	unset  []string
+	drop   bool
+	stop   bool
+	lua    *luaScript
+	plugin plugin.Transform
+}
+
+func newTransforms(configs []transformConfig, grokPatterns map[string]string) ([]transform, error) {
+	var transforms []transform
+	for i, c := range configs {
+		at := func(err error, keys ...string) error {
+			return atKeys(err, append([]string{strconv.Itoa(i)}, keys...)...)
+		}
+		match, err := parseMatch(c.If)
+		if err != nil {
+			return nil, at(fmt.Errorf("transform %d: %v", i+1, err), "if")
+		}
+		t := transform{match: match, drop: c.Drop, stop: c.Stop}
+		switch {
+		case c.Parse == "grok":
+			if len(c.Grok) == 0 {
+				return nil, at(fmt.Errorf("transform %d: parse grok requires grok expressions", i+1), "parse")
+			}
+			g, err := newGrok(c.Grok, grokPatterns)
+			if err != nil {
+				return nil, at(fmt.Errorf("transform %d: %v", i+1, err), "grok")
+			}
+			t.parse, t.sdID = g.parse, "grok@32473"
+		case len(c.Grok) > 0:
+			return nil, at(fmt.Errorf("transform %d: grok requires parse grok", i+1), "grok")
+		case c.Parse != "":
+			p, ok := payloadParsers[c.Parse]
+			if !ok {
+				return nil, at(fmt.Errorf("transform %d: unknown parse %q", i+1, c.Parse), "parse")
+			}
+			t.parse, t.sdID = p.parse, p.sdID
+		}
+		if c.SDID != "" {
+			t.sdID = c.SDID
+		}
+		for name, v := range c.Set {
+			set, err := setterFor(name)
+			if err != nil {
+				return nil, at(fmt.Errorf("transform %d: %v", i+1, err), "set", name)
+			}
+			value, err := transformValue(v)
+			if err == nil && !strings.Contains(v, "{{") {
+				err = set(&server.Message{}, v)
+			}
+			if err != nil {
+				return nil, at(fmt.Errorf("transform %d: %s: %v", i+1, name, err), "set", name)
+			}
+			t.set = append(t.set, assignment{name, set, value})
+		}
+		for _, name := range c.Unset {
+			if name == "facility" || name == "severity" {
+				return nil, at(fmt.Errorf("transform %d: cannot unset %s", i+1, name), "unset")
+			}
+			if _, err := setterFor(name); err != nil {
+				return nil, at(fmt.Errorf("transform %d: %v", i+1, err), "unset")
+			}
+			t.unset = append(t.unset, name)
+		}
+		if c.Lua != "" {
+			if t.lua, err = newLuaScript(c.Lua); err != nil {
+				return nil, at(fmt.Errorf("transform %d: %v", i+1, err), "lua")
+			}
+		}
+		if c.Plugin != "" {
+			f, ok := plugin.LookupTransform(c.Plugin)
+			if !ok {
+				return nil, at(fmt.Errorf("transform %d: unknown plugin %q", i+1, c.Plugin), "plugin")
+			}
+			if t.plugin, err = f(c.Options); err != nil {
+				return nil, at(fmt.Errorf("transform %d: %v", i+1, err), "options")
+			}
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, nil
+}
+
+func setterFor(name string) (setter, error) {
+	if set, ok := transformFields[name]; ok {
+		return set, nil
+	}
+	if name, ok := strings.CutPrefix(name, "sd."); ok {
+		if id, param, ok := splitSDName(name); ok {
+			return setSDParam(id, param), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown property %s", name)
+}
+
+func setSDParam(id, param string) setter {
+	return func(m *server.Message, v string) error {
+		if m.StructuredData == nil {
+			m.StructuredData = make(map[string]map[string]string)
+		}
+		if m.StructuredData[id] == nil {
+			m.StructuredData[id] = make(map[string]string)
+		}
+		m.StructuredData[id][param] = v
+		return nil
+	}
+}
+
+func transformValue(v string) (func(*server.Message) (string, error), error) {
+	if !strings.Contains(v, "{{") {
+		return func(*server.Message) (string, error) { return v, nil }, nil
+	}
+	t, err := template.New("set").Funcs(templateFuncs).Parse(v)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *server.Message) (string, error) {
+		var b strings.Builder
+		err := t.Execute(&b, m)
+		return b.String(), err
+	}, nil
+}
+
+// applyTransforms returns m changed by the transforms, as a copy as soon as
+// one changes it, or nil if one drops it.
+func applyTransforms(transforms []transform, m *server.Message) *server.Message {
+	copied := false
+	for _, t := range transforms {
+		if !t.match(m) {
+			continue
+		}
+		if t.drop {
+			return nil
+		}
+		if t.parse != nil {
+			if fields := t.parse(m); fields != nil {
+				if !copied {
+					m = copyMessage(m)
+					copied = true
+				}
+				if m.StructuredData == nil {
+					m.StructuredData = make(map[string]map[string]string)
+				}
+				m.StructuredData[t.sdID] = fields
+			}
+		}
+		if !copied && (len(t.set) > 0 || len(t.unset) > 0 || t.lua != nil) {
+			m = copyMessage(m)
+			copied = true
+		}
+		// Values are computed before any is set, for all of them to see
+		// the message as matched.
+		values := make([]string, len(t.set))
+		errs := make([]error, len(t.set))
+		for i, a := range t.set {
+			values[i], errs[i] = a.value(m)
+		}
+		for i, a := range t.set {
+			if errs[i] == nil {
+				errs[i] = a.set(m, values[i])
+			}
+			if errs[i] != nil {
+				transformErrors.add(1, a.name)
+			}
+		}
+		for _, name := range t.unset {
+			unsetProperty(m, name)
+		}
+		if t.lua != nil {
+			var err error
+			if m, err = t.lua.run(m); err != nil {
+				transformErrors.add(1, "lua")
+			}
+			if m == nil {
+				return nil
+			}
+		}
+		if t.plugin != nil {
+			p := t.plugin.Transform(pluginMessage(m))
+			if p == nil {
+				return nil
+			}
+			changed, err := serverMessage(m, p)
+			if err != nil {
+				transformErrors.add(1, "plugin")
+			} else {
+				m, copied = changed, true
+			}
+		}
+		if t.stop {
+			break
+		}
+	}
+	return m
+}
+
+func unsetProperty(m *server.Message, name string) {
+	if name, ok := strings.CutPrefix(name, "sd."); ok {
+		id, param, _ := splitSDName(name)
+		if params := m.StructuredData[id]; params != nil {
+			delete(params, param)
+			if len(params) == 0 {
+				delete(m.StructuredData, id)
+			}
+		}
+		return
+	}
+	transformFields[name](m, "")
+}
+
+// copyMessage returns a copy of m that can be changed, structured data
+// included.
+func copyMessage(m *server.Message) *server.Message {
+	c := *m
+	if m.StructuredData != nil {
+		c.StructuredData = make(map[string]map[string]string, len(m.StructuredData))
+		for id, params := range m.StructuredData {
+			p := make(map[string]string, len(params))
+			for k, v := range params {
+				p[k] = v
+			}
+			c.StructuredData[id] = p
+		}
+	}
+	return &c
+}
+
+var transformErrors = newCounterVec("syslogd_transform_errors_total",
+	"Properties transforms failed to set by property.", "property")
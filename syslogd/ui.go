@@ -0,0 +1,16 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// uiHandler serves the web UI, a single page over the API.
+func uiHandler() http.Handler {
+	sub, _ := fs.Sub(uiFiles, "ui")
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(sub)))
+}
@@ -0,0 +1,120 @@
+"use strict";
+
+const maxRows = 500;
+const rateWindow = 60 * 1000;
+
+const form = document.getElementById("search");
+const tbody = document.querySelector("#messages tbody");
+const status = document.getElementById("status");
+const more = document.getElementById("more");
+
+let live = null;
+let next = "";
+
+function params() {
+  const p = new URLSearchParams();
+  for (const [k, v] of new FormData(form)) {
+    if (v) p.set(k, v);
+  }
+  return p;
+}
+
+function row(m) {
+  const tr = document.createElement("tr");
+  tr.className = m.severity;
+  for (const v of [new Date(m.time).toLocaleString(), m.hostname, m.tag, m.severity, m.content]) {
+    const td = document.createElement("td");
+    td.textContent = v || "";
+    tr.appendChild(td);
+  }
+  return tr;
+}
+
+function stopLive() {
+  if (live) {
+    live.close();
+    live = null;
+  }
+}
+
+// startLive tails the messages that match the form, newest on top.
+function startLive() {
+  stopLive();
+  tbody.replaceChildren();
+  more.hidden = true;
+  const p = params();
+  p.delete("since");
+  live = new EventSource("../api/v1/stream?" + p);
+  live.onopen = () => { status.textContent = "Live"; };
+  live.onerror = () => { status.textContent = "Disconnected, retrying"; };
+  live.onmessage = (e) => {
+    tbody.prepend(row(JSON.parse(e.data)));
+    while (tbody.rows.length > maxRows) tbody.lastChild.remove();
+  };
+  live.addEventListener("dropped", (e) => {
+    status.textContent = "Live, " + e.data + " messages skipped";
+  });
+}
+
+// search lists the messages that match the form, then older ones page by
+// page.
+async function search(before) {
+  stopLive();
+  const p = params();
+  if (before) p.set("before", before);
+  else tbody.replaceChildren();
+  const resp = await fetch("../api/v1/messages?" + p);
+  if (!resp.ok) {
+    status.textContent = await resp.text();
+    return;
+  }
+  const page = await resp.json();
+  for (const m of page.messages) tbody.appendChild(row(m));
+  next = page.next || "";
+  more.hidden = !next;
+  status.textContent = tbody.rows.length + " messages";
+}
+
+form.addEventListener("submit", (e) => {
+  e.preventDefault();
+  search();
+});
+document.getElementById("live").addEventListener("click", startLive);
+more.addEventListener("click", () => search(next));
+
+// The rates count every message over the last minute.
+const seen = [];
+
+function count(list, key) {
+  const counts = new Map();
+  for (const m of list) counts.set(m[key] || "-", (counts.get(m[key] || "-") || 0) + 1);
+  return [...counts].sort((a, b) => b[1] - a[1]);
+}
+
+function showRates() {
+  const since = Date.now() - rateWindow;
+  while (seen.length && seen[0].at < since) seen.shift();
+  for (const [id, key] of [["hosts", "hostname"], ["severities", "severity"]]) {
+    const body = document.getElementById(id);
+    body.replaceChildren();
+    for (const [k, n] of count(seen, key).slice(0, 20)) {
+      const tr = document.createElement("tr");
+      tr.className = key === "severity" ? k : "";
+      for (const v of [k, n]) {
+        const td = document.createElement("td");
+        td.textContent = v;
+        tr.appendChild(td);
+      }
+      body.appendChild(tr);
+    }
+  }
+}
+
+const all = new EventSource("../api/v1/stream");
+all.onmessage = (e) => {
+  const m = JSON.parse(e.data);
+  seen.push({ at: Date.now(), hostname: m.hostname, severity: m.severity });
+};
+setInterval(showRates, 1000);
+
+startLive();